@@ -5,8 +5,10 @@ import (
 	"encoding/hex"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -17,6 +19,8 @@ import (
 	"github.com/tags-drive/core/cmd/common"
 	auth "github.com/tags-drive/core/internal/storage/auth_tokens"
 	"github.com/tags-drive/core/internal/storage/files"
+	"github.com/tags-drive/core/internal/storage/files/extensions"
+	"github.com/tags-drive/core/internal/storage/searches"
 	share "github.com/tags-drive/core/internal/storage/share_tokens"
 	"github.com/tags-drive/core/internal/storage/tags"
 	"github.com/tags-drive/core/internal/web"
@@ -39,15 +43,38 @@ type config struct {
 	}
 
 	Storage struct {
+		// Encrypt isn't supported with the sqlite metadata storage: the database is kept in plaintext
 		Encrypt          bool   `envconfig:"STORAGE_ENCRYPT" default:"false"`
 		PassPhraseString string `envconfig:"STORAGE_PASS_PHRASE"`
 		// PassPhrase is a sha256 of PassPhraseString
 		PassPhrase [32]byte `ignored:"true"`
 
 		TimeBeforeDeleting time.Duration `envconfig:"STORAGE_TIME_BEFORE_DELETING" default:"168h"` // default is 168h = 7 days
-
-		// Valid options: json. Ignore now. Can be used in future
-		MetadataStorageType string `envconfig:"IGNORE_STORAGE_METADATA_TYPE" default:"json"`
+		// ScrubInterval is an interval between integrity checks of stored files. 0 disables checks
+		ScrubInterval time.Duration `envconfig:"STORAGE_SCRUB_INTERVAL" default:"720h"` // default is 720h = 30 days
+		// ThumbnailSizes are sizes of thumbnails served by /data/thumb/{size}/{id}
+		ThumbnailSizes []int `envconfig:"STORAGE_THUMBNAIL_SIZES" default:"256,512,1024,2048"`
+		// ProcessingWorkers is a number of images processed in background at the same time
+		ProcessingWorkers int `envconfig:"STORAGE_PROCESSING_WORKERS" default:"2"`
+		// ImportMaxSizeMB is a max size of a file imported from a url (in megabytes)
+		ImportMaxSizeMB int64 `envconfig:"STORAGE_IMPORT_MAX_SIZE_MB" default:"1024"`
+		// ImportTimeout is a max time of downloading of an imported file
+		ImportTimeout time.Duration `envconfig:"STORAGE_IMPORT_TIMEOUT" default:"10m"`
+		// ImportContentTypes are allowed media types of imported files. All types are allowed if it is empty
+		ImportContentTypes []string `envconfig:"STORAGE_IMPORT_CONTENT_TYPES"`
+		// ImportAllowedHosts are internal hosts (names, ips or networks) which files can be imported from
+		ImportAllowedHosts []string `envconfig:"STORAGE_IMPORT_ALLOWED_HOSTS"`
+		// QuotaMB is a max size of all stored files (in megabytes). 0 disables the quota
+		QuotaMB int64 `envconfig:"STORAGE_QUOTA_MB" default:"0"`
+		// TypeQuotasMB are max sizes of files of every type (in megabytes): "image:10240,video:51200"
+		TypeQuotasMB map[string]int64 `envconfig:"STORAGE_TYPE_QUOTAS_MB"`
+		// DuplicatePolicy defines what is done with uploaded duplicates. Valid options: keep, reject, merge, replace
+		DuplicatePolicy string `envconfig:"STORAGE_DUPLICATE_POLICY" default:"keep"`
+		// DuplicatesByFilename enables detection of duplicates by filename
+		DuplicatesByFilename bool `envconfig:"STORAGE_DUPLICATES_BY_FILENAME" default:"false"`
+
+		// Valid options: json, sqlite. sqlite can't be used with Encrypt
+		MetadataStorageType string `envconfig:"STORAGE_METADATA_TYPE" default:"json"`
 
 		// Valid options: disk, s3
 		FileStorageType string `envconfig:"STORAGE_FILES_TYPE" default:"disk"`
@@ -73,11 +100,12 @@ const (
 type app struct {
 	config config
 
-	fileStorage  *files.FileStorage
-	tagStorage   *tags.TagStorage
-	authService  *auth.AuthService
-	shareService *share.ShareService
-	server       *web.Server
+	fileStorage   *files.FileStorage
+	tagStorage    *tags.TagStorage
+	searchStorage *searches.SearchStorage
+	authService   *auth.AuthService
+	shareService  *share.ShareService
+	server        *web.Server
 
 	logger *clog.Logger
 }
@@ -106,6 +134,57 @@ func prepareNewApp(version string) (*app, error) {
 		return nil, errors.New("wrong env config: PASS_PHRASE can't be empty with ENCRYPT=true")
 	}
 
+	if cnf.Storage.Encrypt && cnf.Storage.MetadataStorageType == "sqlite" {
+		// The database isn't encrypted, metadata and tokens would be kept in plaintext
+		return nil, errors.New("wrong env config: ENCRYPT=true isn't supported with METADATA_TYPE=sqlite")
+	}
+
+	for _, size := range cnf.Storage.ThumbnailSizes {
+		if size <= 0 {
+			return nil, errors.New("wrong env config: THUMBNAIL_SIZES must contain only positive numbers")
+		}
+	}
+
+	if cnf.Storage.ProcessingWorkers <= 0 {
+		return nil, errors.New("wrong env config: PROCESSING_WORKERS must be greater than 0")
+	}
+
+	if cnf.Storage.ImportMaxSizeMB <= 0 {
+		return nil, errors.New("wrong env config: IMPORT_MAX_SIZE_MB must be greater than 0")
+	}
+
+	if cnf.Storage.ImportTimeout <= 0 {
+		return nil, errors.New("wrong env config: IMPORT_TIMEOUT must be greater than 0")
+	}
+
+	for _, host := range cnf.Storage.ImportAllowedHosts {
+		if strings.Contains(host, "/") {
+			if _, _, err := net.ParseCIDR(host); err != nil {
+				return nil, errors.Errorf("wrong env config: invalid network in IMPORT_ALLOWED_HOSTS: %q", host)
+			}
+		}
+	}
+
+	if cnf.Storage.QuotaMB < 0 {
+		return nil, errors.New("wrong env config: QUOTA_MB can't be negative")
+	}
+
+	for fileType, quota := range cnf.Storage.TypeQuotasMB {
+		switch extensions.FileType(fileType) {
+		case extensions.FileTypeUnsupported, extensions.FileTypeArchive, extensions.FileTypeAudio,
+			extensions.FileTypeImage, extensions.FileTypeLanguage, extensions.FileTypeText, extensions.FileTypeVideo:
+		default:
+			return nil, errors.Errorf("wrong env config: TYPE_QUOTAS_MB contains unknown file type '%s'", fileType)
+		}
+		if quota <= 0 {
+			return nil, errors.New("wrong env config: TYPE_QUOTAS_MB must contain only positive numbers")
+		}
+	}
+
+	if !files.DuplicatePolicy(cnf.Storage.DuplicatePolicy).IsValid() {
+		return nil, errors.New("wrong env config: DUPLICATE_POLICY must be one of keep, reject, merge, replace")
+	}
+
 	if cnf.Web.SkipLogin && !cnf.Debug {
 		return nil, errors.New("wrong env config: SkipLogin can't be true in Production mode")
 	}
@@ -144,54 +223,40 @@ func (app *app) ConfigureServices() error {
 	var err error
 
 	// File storage
-	fileStorageConfig := files.Config{
-		Debug:              app.config.Debug,
-		VarFolder:          common.VarFolder,
-		Encrypt:            app.config.Storage.Encrypt,
-		PassPhrase:         app.config.Storage.PassPhrase,
-		TimeBeforeDeleting: app.config.Storage.TimeBeforeDeleting,
-		// Binary Storage
-		FileStorageType: app.config.Storage.FileStorageType,
-		DiskStorage: files.Config_DiskStorage{
-			DataFolder:          common.DataFolder,
-			ResizedImagesFolder: common.ResizedImagesFolder,
-		},
-		S3Storage: files.Config_S3Storage{
-			Endpoint:            app.config.Storage.S3.Endpoint,
-			AccessKeyID:         app.config.Storage.S3.AccessKeyID,
-			SecretAccessKey:     app.config.Storage.S3.SecretAccessKey,
-			DataBucket:          common.DataBucket,
-			ResizedImagesBucket: common.ResizedImagesBucket,
-		},
-		// Metadata Storage
-		MetadataStorageType: app.config.Storage.MetadataStorageType,
-		FilesJSONFile:       common.FilesJSONFile,
-	}
-	app.fileStorage, err = files.NewFileStorage(fileStorageConfig, app.logger)
+	app.fileStorage, err = files.NewFileStorage(app.fileStorageConfig(), app.logger)
 	if err != nil {
 		return errors.Wrap(err, "can't create a new FileStorage")
 	}
 
 	// Tag storage
-	tagStorageConfig := tags.Config{
+	app.tagStorage, err = tags.NewTagStorage(app.tagStorageConfig(), app.logger)
+	if err != nil {
+		return errors.Wrap(err, "can't create a new TagStorage")
+	}
+
+	// Search storage
+	searchStorageConfig := searches.Config{
 		Debug:               app.config.Debug,
 		MetadataStorageType: app.config.Storage.MetadataStorageType,
-		TagsJSONFile:        common.TagsJSONFile,
+		SearchesJSONFile:    common.SearchesJSONFile,
+		SQLiteFile:          common.SQLiteFile,
 		Encrypt:             app.config.Storage.Encrypt,
 		PassPhrase:          app.config.Storage.PassPhrase,
 	}
-	app.tagStorage, err = tags.NewTagStorage(tagStorageConfig, app.logger)
+	app.searchStorage, err = searches.NewSearchStorage(searchStorageConfig, app.fileStorage, app.tagStorage, app.logger)
 	if err != nil {
-		return errors.Wrap(err, "can't create a new TagStorage")
+		return errors.Wrap(err, "can't create a new SearchStorage")
 	}
 
 	// Auth service
 	authConfig := auth.Config{
-		Debug:          app.config.Debug,
-		TokensJSONFile: common.AuthTokensJSONFile,
-		Encrypt:        app.config.Storage.Encrypt,
-		PassPhrase:     app.config.Storage.PassPhrase,
-		MaxTokenLife:   app.config.Web.MaxTokenLife,
+		Debug:               app.config.Debug,
+		MetadataStorageType: app.config.Storage.MetadataStorageType,
+		TokensJSONFile:      common.AuthTokensJSONFile,
+		SQLiteFile:          common.SQLiteFile,
+		Encrypt:             app.config.Storage.Encrypt,
+		PassPhrase:          app.config.Storage.PassPhrase,
+		MaxTokenLife:        app.config.Web.MaxTokenLife,
 	}
 	app.authService, err = auth.NewAuthService(authConfig, app.logger)
 	if err != nil {
@@ -200,11 +265,14 @@ func (app *app) ConfigureServices() error {
 
 	// Share service
 	shareConfig := share.Config{
-		ShareTokenJSONFile: common.ShareTokensJSONFile,
-		Encrypt:            app.config.Storage.Encrypt,
-		PassPhrase:         app.config.Storage.PassPhrase,
+		MetadataStorageType:  app.config.Storage.MetadataStorageType,
+		ShareTokenJSONFile:   common.ShareTokensJSONFile,
+		SearchTokensJSONFile: common.SearchTokensJSONFile,
+		SQLiteFile:           common.SQLiteFile,
+		Encrypt:              app.config.Storage.Encrypt,
+		PassPhrase:           app.config.Storage.PassPhrase,
 	}
-	app.shareService, err = share.NewShareStorage(shareConfig, app.fileStorage, app.logger)
+	app.shareService, err = share.NewShareStorage(shareConfig, app.fileStorage, app.searchStorage, app.logger)
 	if err != nil {
 		return errors.Wrap(err, "can't create a new Share Service")
 	}
@@ -225,6 +293,7 @@ func (app *app) ConfigureServices() error {
 	app.server, err = web.NewWebServer(serverConfig,
 		app.fileStorage,
 		app.tagStorage,
+		app.searchStorage,
 		app.authService,
 		app.shareService,
 		app.logger)
@@ -235,6 +304,65 @@ func (app *app) ConfigureServices() error {
 	return nil
 }
 
+// typeQuotas converts quotas from megabytes into bytes
+func (app *app) typeQuotas() map[extensions.FileType]int64 {
+	quotas := make(map[extensions.FileType]int64, len(app.config.Storage.TypeQuotasMB))
+	for fileType, quota := range app.config.Storage.TypeQuotasMB {
+		quotas[extensions.FileType(fileType)] = quota << 20
+	}
+	return quotas
+}
+
+func (app *app) fileStorageConfig() files.Config {
+	return files.Config{
+		Debug:              app.config.Debug,
+		VarFolder:          common.VarFolder,
+		Encrypt:            app.config.Storage.Encrypt,
+		PassPhrase:         app.config.Storage.PassPhrase,
+		TimeBeforeDeleting: app.config.Storage.TimeBeforeDeleting,
+		ScrubInterval:      app.config.Storage.ScrubInterval,
+		ThumbnailSizes:     app.config.Storage.ThumbnailSizes,
+		ProcessingWorkers:  app.config.Storage.ProcessingWorkers,
+		ImportMaxSize:      app.config.Storage.ImportMaxSizeMB << 20,
+		ImportTimeout:      app.config.Storage.ImportTimeout,
+		ImportContentTypes: app.config.Storage.ImportContentTypes,
+		ImportAllowedHosts: app.config.Storage.ImportAllowedHosts,
+		Quota:              app.config.Storage.QuotaMB << 20,
+		TypeQuotas:         app.typeQuotas(),
+		// Duplicates
+		DuplicatePolicy:      files.DuplicatePolicy(app.config.Storage.DuplicatePolicy),
+		DuplicatesByFilename: app.config.Storage.DuplicatesByFilename,
+		// Binary Storage
+		FileStorageType: app.config.Storage.FileStorageType,
+		DiskStorage: files.Config_DiskStorage{
+			DataFolder:          common.DataFolder,
+			ResizedImagesFolder: common.ResizedImagesFolder,
+		},
+		S3Storage: files.Config_S3Storage{
+			Endpoint:            app.config.Storage.S3.Endpoint,
+			AccessKeyID:         app.config.Storage.S3.AccessKeyID,
+			SecretAccessKey:     app.config.Storage.S3.SecretAccessKey,
+			DataBucket:          common.DataBucket,
+			ResizedImagesBucket: common.ResizedImagesBucket,
+		},
+		// Metadata Storage
+		MetadataStorageType: app.config.Storage.MetadataStorageType,
+		FilesJSONFile:       common.FilesJSONFile,
+		SQLiteFile:          common.SQLiteFile,
+	}
+}
+
+func (app *app) tagStorageConfig() tags.Config {
+	return tags.Config{
+		Debug:               app.config.Debug,
+		MetadataStorageType: app.config.Storage.MetadataStorageType,
+		TagsJSONFile:        common.TagsJSONFile,
+		SQLiteFile:          common.SQLiteFile,
+		Encrypt:             app.config.Storage.Encrypt,
+		PassPhrase:          app.config.Storage.PassPhrase,
+	}
+}
+
 // Start starts the web server and the background jobs. It block the process (like http.ListenAndServe())
 func (app *app) Start() error {
 	app.logger.Infoln("start Tags Drive")
@@ -273,6 +401,12 @@ func (app *app) Shutdown() {
 		app.logger.Warnf("can't shutdown File Storage gracefully: %s\n", err)
 	}
 
+	app.logger.Debugln("shutdown Search Storage")
+	err = app.searchStorage.Shutdown()
+	if err != nil {
+		app.logger.Warnf("can't shutdown Search Storage gracefully: %s\n", err)
+	}
+
 	app.logger.Debugln("shutdown Tag Storage")
 	err = app.tagStorage.Shutdown()
 	if err != nil {
@@ -296,6 +430,17 @@ func (app *app) PrintConfig() {
 		{"Storage.Encrypt", app.config.Storage.Encrypt},
 		{"Storage.MetadataStorageType", app.config.Storage.MetadataStorageType},
 		{"Storage.FileStorageType", app.config.Storage.FileStorageType},
+		{"Storage.ScrubInterval", app.config.Storage.ScrubInterval},
+		{"Storage.ThumbnailSizes", app.config.Storage.ThumbnailSizes},
+		{"Storage.ProcessingWorkers", app.config.Storage.ProcessingWorkers},
+		{"Storage.ImportMaxSizeMB", app.config.Storage.ImportMaxSizeMB},
+		{"Storage.ImportTimeout", app.config.Storage.ImportTimeout},
+		{"Storage.ImportContentTypes", app.config.Storage.ImportContentTypes},
+		{"Storage.ImportAllowedHosts", app.config.Storage.ImportAllowedHosts},
+		{"Storage.QuotaMB", app.config.Storage.QuotaMB},
+		{"Storage.TypeQuotasMB", app.config.Storage.TypeQuotasMB},
+		{"Storage.DuplicatePolicy", app.config.Storage.DuplicatePolicy},
+		{"Storage.DuplicatesByFilename", app.config.Storage.DuplicatesByFilename},
 	}
 
 	for _, v := range vars {
@@ -314,6 +459,12 @@ func StartApp(version string) <-chan struct{} {
 		log.Fatalf("[FAT] can't prepare a new App instance: %s\n", err)
 	}
 
+	// The lock is held until the process exits
+	lock, err := lockVarFolder()
+	if err != nil {
+		log.Fatalf("[FAT] can't lock the var folder: %s\n", err)
+	}
+
 	err = app.ConfigureServices()
 	if err != nil {
 		log.Fatalf("[FAT] can't configure services: %s\n", err)
@@ -337,6 +488,7 @@ func StartApp(version string) <-chan struct{} {
 		// Shutdown also
 		app.Shutdown()
 
+		lock.unlock()
 		app.logger.Infoln("Tags Drive is stopped")
 
 		close(shutdowned)
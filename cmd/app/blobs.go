@@ -0,0 +1,48 @@
+package app
+
+import (
+	"log"
+
+	clog "github.com/ShoshinNikita/log/v2"
+
+	"github.com/tags-drive/core/internal/storage/files"
+)
+
+// StartBlobs moves content of files uploaded before the introduction of hashes into blobs. Tags Drive must be stopped,
+// the command refuses to run while the var folder is locked
+func StartBlobs(version string) <-chan struct{} {
+	log.SetFlags(0)
+	log.Printf("Tags Drive %s - https://github.com/tags-drive\n\n", version)
+
+	app, err := prepareNewApp(version)
+	if err != nil {
+		log.Fatalf("[FAT] can't prepare a new App instance: %s\n", err)
+	}
+
+	app.logger = clog.NewProdConfig().PrintTime(false).Build()
+
+	lock, err := lockVarFolder()
+	if err != nil {
+		app.logger.Fatalf("can't move content into blobs: %s\n", err)
+	}
+	defer lock.unlock()
+
+	fileStorage, err := files.NewFileStorage(app.fileStorageConfig(), app.logger)
+	if err != nil {
+		app.logger.Fatalf("can't create a new FileStorage: %s\n", err)
+	}
+	defer fileStorage.Shutdown()
+
+	app.logger.Infoln("start moving content of files without a hash into blobs")
+
+	migrated, failed := fileStorage.MigrateToBlobs()
+	if failed > 0 {
+		app.logger.Errorf("%d revision(s) were moved into blobs, %d revision(s) can't be moved\n", migrated, failed)
+	} else {
+		app.logger.Infof("%d revision(s) were moved into blobs\n", migrated)
+	}
+
+	done := make(chan struct{})
+	close(done)
+	return done
+}
@@ -0,0 +1,48 @@
+package app
+
+import (
+	"log"
+
+	clog "github.com/ShoshinNikita/log/v2"
+
+	"github.com/tags-drive/core/internal/storage/files"
+)
+
+// StartExif extracts metadata of all stored images. Tags Drive must be stopped, the command refuses
+// to run while the var folder is locked
+func StartExif(version string) <-chan struct{} {
+	log.SetFlags(0)
+	log.Printf("Tags Drive %s - https://github.com/tags-drive\n\n", version)
+
+	app, err := prepareNewApp(version)
+	if err != nil {
+		log.Fatalf("[FAT] can't prepare a new App instance: %s\n", err)
+	}
+
+	app.logger = clog.NewProdConfig().PrintTime(false).Build()
+
+	lock, err := lockVarFolder()
+	if err != nil {
+		app.logger.Fatalf("can't extract metadata of images: %s\n", err)
+	}
+	defer lock.unlock()
+
+	fileStorage, err := files.NewFileStorage(app.fileStorageConfig(), app.logger)
+	if err != nil {
+		app.logger.Fatalf("can't create a new FileStorage: %s\n", err)
+	}
+	defer fileStorage.Shutdown()
+
+	app.logger.Infoln("start extracting metadata of images")
+
+	n, err := fileStorage.ExtractImageMetadata()
+	if err != nil {
+		app.logger.Fatalf("can't extract metadata of images: %s\n", err)
+	}
+
+	app.logger.Infof("metadata of %d image(s) was extracted\n", n)
+
+	done := make(chan struct{})
+	close(done)
+	return done
+}
@@ -0,0 +1,109 @@
+package app
+
+import (
+	"log"
+	"os"
+
+	clog "github.com/ShoshinNikita/log/v2"
+	"github.com/jessevdk/go-flags"
+
+	"github.com/tags-drive/core/internal/storage/files"
+)
+
+type fsckConfig struct {
+	Repair bool `long:"repair"`
+}
+
+// StartFsck reconciles Metadata Storage with Binary Storage and prints found problems.
+// Problems are repaired if the flag "--repair" is passed. Tags Drive must be stopped: repair
+// refuses to run while the var folder is locked
+func StartFsck(version string) <-chan struct{} {
+	log.SetFlags(0)
+	log.Printf("Tags Drive %s - https://github.com/tags-drive\n\n", version)
+
+	var cnf fsckConfig
+	parser := flags.NewParser(&cnf, flags.HelpFlag|flags.PassDoubleDash|flags.IgnoreUnknown)
+	if _, err := parser.ParseArgs(os.Args[1:]); err != nil {
+		log.Fatalf("[FAT] can't parse flags: %s\n", err)
+	}
+
+	app, err := prepareNewApp(version)
+	if err != nil {
+		log.Fatalf("[FAT] can't prepare a new App instance: %s\n", err)
+	}
+
+	app.logger = clog.NewProdConfig().PrintTime(false).Build()
+
+	if cnf.Repair {
+		// Chunks of uploads in progress and temporary files of a running instance would be deleted
+		lock, err := lockVarFolder()
+		if err != nil {
+			app.logger.Fatalf("can't repair: %s\n", err)
+		}
+		defer lock.unlock()
+	}
+
+	fileStorage, err := files.NewFileStorage(app.fileStorageConfig(), app.logger)
+	if err != nil {
+		app.logger.Fatalf("can't create a new FileStorage: %s\n", err)
+	}
+	defer fileStorage.Shutdown()
+
+	app.logger.Infoln("start fsck")
+
+	report, err := fileStorage.Fsck(cnf.Repair)
+	if err != nil {
+		app.logger.Fatalf("can't check files: %s\n", err)
+	}
+
+	for _, hash := range report.OrphanBlobs {
+		app.logger.Warnf("orphan blob: %s\n", hash)
+	}
+	for _, id := range report.OrphanFiles {
+		app.logger.Warnf("orphan file: %d\n", id)
+	}
+	for _, rev := range report.OrphanRevisions {
+		app.logger.Warnf("orphan revision: %d of file %d\n", rev.Revision, rev.FileID)
+	}
+	for _, id := range report.OrphanResizedImages {
+		app.logger.Warnf("orphan resized image: %d\n", id)
+	}
+	for _, id := range report.OrphanThumbnails {
+		app.logger.Warnf("orphan thumbnails of file: %d\n", id)
+	}
+	for _, id := range report.OrphanUploads {
+		app.logger.Warnf("orphan upload: %s\n", id)
+	}
+	for _, name := range report.TemporaryFiles {
+		app.logger.Warnf("temporary file: %s\n", name)
+	}
+	for _, name := range report.UnknownFiles {
+		app.logger.Infof("unknown file (it is never deleted): %s\n", name)
+	}
+	for _, p := range report.MissingContent {
+		msg := ""
+		if p.Current {
+			msg = " (the current revision)"
+		}
+		app.logger.Errorf("missing content: file \"%s\" (id: %d, revision: %d)%s\n", p.Filename, p.FileID, p.Revision, msg)
+	}
+	for _, p := range report.MissingResizedImages {
+		app.logger.Warnf("missing resized image: file \"%s\" (id: %d)\n", p.Filename, p.FileID)
+	}
+
+	switch {
+	case report.OK():
+		app.logger.Infoln("no problems were found")
+	case !report.Repaired:
+		app.logger.Infoln("run with \"--repair\" flag to delete orphans, regenerate resized images and move files without content into Trash")
+	default:
+		for _, e := range report.RepairErrors {
+			app.logger.Errorf("repair: %s\n", e)
+		}
+		app.logger.Infof("problems were repaired, %d error(s) occurred\n", len(report.RepairErrors))
+	}
+
+	done := make(chan struct{})
+	close(done)
+	return done
+}
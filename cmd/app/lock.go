@@ -0,0 +1,36 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+
+	"github.com/tags-drive/core/cmd/common"
+)
+
+// ErrVarFolderLocked is returned when the var folder is used by another process
+var ErrVarFolderLocked = errors.New("the var folder is used by another process (is Tags Drive running?)")
+
+// varFolderLock is an exclusive lock of common.LockFile. It is released by the OS if the process exits
+type varFolderLock struct {
+	file *os.File
+}
+
+// lockVarFolder locks the var folder. It returns ErrVarFolderLocked if the folder is locked by another process
+func lockVarFolder() (*varFolderLock, error) {
+	if err := os.MkdirAll(filepath.Dir(common.LockFile), 0700); err != nil {
+		return nil, errors.Wrap(err, "can't create the var folder")
+	}
+
+	f, err := openLockFile(common.LockFile)
+	if err != nil {
+		return nil, err
+	}
+	return &varFolderLock{file: f}, nil
+}
+
+// unlock releases the lock. The file isn't deleted, because another process can already wait for it
+func (l *varFolderLock) unlock() {
+	l.file.Close()
+}
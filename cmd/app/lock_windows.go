@@ -0,0 +1,29 @@
+package app
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// errorSharingViolation is ERROR_SHARING_VIOLATION
+const errorSharingViolation syscall.Errno = 32
+
+func openLockFile(path string) (*os.File, error) {
+	pathp, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't open the lock file")
+	}
+
+	// The file is opened without sharing, so it can't be opened by another process until it is closed
+	h, err := syscall.CreateFile(pathp, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil,
+		syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err != nil {
+		if err == errorSharingViolation {
+			return nil, ErrVarFolderLocked
+		}
+		return nil, errors.Wrap(err, "can't open the lock file")
+	}
+	return os.NewFile(uintptr(h), path), nil
+}
@@ -0,0 +1,48 @@
+package app
+
+import (
+	"log"
+
+	clog "github.com/ShoshinNikita/log/v2"
+
+	"github.com/tags-drive/core/internal/storage/files"
+)
+
+// StartReindex rebuilds the index of content of text files. Tags Drive must be stopped, the command
+// refuses to run while the var folder is locked
+func StartReindex(version string) <-chan struct{} {
+	log.SetFlags(0)
+	log.Printf("Tags Drive %s - https://github.com/tags-drive\n\n", version)
+
+	app, err := prepareNewApp(version)
+	if err != nil {
+		log.Fatalf("[FAT] can't prepare a new App instance: %s\n", err)
+	}
+
+	app.logger = clog.NewProdConfig().PrintTime(false).Build()
+
+	lock, err := lockVarFolder()
+	if err != nil {
+		app.logger.Fatalf("can't rebuild the content index: %s\n", err)
+	}
+	defer lock.unlock()
+
+	fileStorage, err := files.NewFileStorage(app.fileStorageConfig(), app.logger)
+	if err != nil {
+		app.logger.Fatalf("can't create a new FileStorage: %s\n", err)
+	}
+	defer fileStorage.Shutdown()
+
+	app.logger.Infoln("start reindexing")
+
+	n, err := fileStorage.RebuildContentIndex()
+	if err != nil {
+		app.logger.Fatalf("can't rebuild the content index: %s\n", err)
+	}
+
+	app.logger.Infof("%d file(s) were indexed\n", n)
+
+	done := make(chan struct{})
+	close(done)
+	return done
+}
@@ -0,0 +1,64 @@
+package app
+
+import (
+	"log"
+
+	clog "github.com/ShoshinNikita/log/v2"
+
+	"github.com/tags-drive/core/internal/storage/files"
+)
+
+// StartScrub checks the integrity of all stored files and prints the report. Tags Drive must be stopped
+func StartScrub(version string) <-chan struct{} {
+	log.SetFlags(0)
+	log.Printf("Tags Drive %s - https://github.com/tags-drive\n\n", version)
+
+	app, err := prepareNewApp(version)
+	if err != nil {
+		log.Fatalf("[FAT] can't prepare a new App instance: %s\n", err)
+	}
+
+	app.logger = clog.NewProdConfig().PrintTime(false).Build()
+
+	fileStorage, err := files.NewFileStorage(app.fileStorageConfig(), app.logger)
+	if err != nil {
+		app.logger.Fatalf("can't create a new FileStorage: %s\n", err)
+	}
+	defer fileStorage.Shutdown()
+
+	app.logger.Infoln("start scrub")
+
+	report, err := fileStorage.Scrub()
+	if err != nil {
+		app.logger.Fatalf("can't scrub files: %s\n", err)
+	}
+
+	app.logger.Infof("scrub is finished: %d revision(s) were checked, %d revision(s) without a hash were skipped\n",
+		report.Checked, report.Skipped)
+
+	for _, group := range []struct {
+		name     string
+		problems []files.ScrubProblem
+	}{
+		{"corrupted", report.Corrupted},
+		{"missing", report.Missing},
+		{"unreadable", report.Unreadable},
+	} {
+		for _, p := range group.problems {
+			msg := ""
+			if p.Error != "" {
+				msg = ": " + p.Error
+			}
+			app.logger.Errorf("%s: file \"%s\" (id: %d, revision: %d, hash: %s)%s\n",
+				group.name, p.Filename, p.FileID, p.Revision, p.Hash, msg)
+		}
+	}
+
+	if report.OK() {
+		app.logger.Infoln("no damaged files were found")
+	}
+
+	done := make(chan struct{})
+	close(done)
+	return done
+}
@@ -0,0 +1,86 @@
+package app
+
+import (
+	"log"
+	"os"
+	"runtime"
+
+	clog "github.com/ShoshinNikita/log/v2"
+	"github.com/jessevdk/go-flags"
+
+	"github.com/tags-drive/core/internal/storage/files"
+	"github.com/tags-drive/core/internal/storage/tags"
+)
+
+type thumbnailsConfig struct {
+	// Expr is a logical expression of tags. All images are processed if it is empty
+	Expr string `long:"expr"`
+	// Workers is a number of images processed at the same time
+	Workers int `long:"workers"`
+}
+
+// StartThumbnails manages resized images and thumbnails. The only subcommand is "regenerate": it recreates
+// resized images of images found by the flag "--expr" and deletes their cached thumbnails.
+// Tags Drive must be stopped, the command refuses to run while the var folder is locked
+func StartThumbnails(version string) <-chan struct{} {
+	log.SetFlags(0)
+	log.Printf("Tags Drive %s - https://github.com/tags-drive\n\n", version)
+
+	cnf := thumbnailsConfig{
+		Workers: runtime.NumCPU(),
+	}
+	parser := flags.NewParser(&cnf, flags.HelpFlag|flags.PassDoubleDash|flags.IgnoreUnknown)
+	args, err := parser.ParseArgs(os.Args[1:])
+	if err != nil {
+		log.Fatalf("[FAT] can't parse flags: %s\n", err)
+	}
+	// The first arg is the command itself
+	if len(args) != 2 || args[1] != "regenerate" {
+		log.Fatalln("[FAT] usage: thumbnails regenerate [--expr=<expression>] [--workers=<number>]")
+	}
+	if cnf.Workers < 1 {
+		log.Fatalln("[FAT] number of workers must be greater than 0")
+	}
+
+	app, err := prepareNewApp(version)
+	if err != nil {
+		log.Fatalf("[FAT] can't prepare a new App instance: %s\n", err)
+	}
+
+	app.logger = clog.NewProdConfig().PrintTime(false).Build()
+
+	lock, err := lockVarFolder()
+	if err != nil {
+		app.logger.Fatalf("can't regenerate resized images: %s\n", err)
+	}
+	defer lock.unlock()
+
+	fileStorage, err := files.NewFileStorage(app.fileStorageConfig(), app.logger)
+	if err != nil {
+		app.logger.Fatalf("can't create a new FileStorage: %s\n", err)
+	}
+	defer fileStorage.Shutdown()
+
+	// Tags are needed to resolve tags referred by name in the expression
+	tagStorage, err := tags.NewTagStorage(app.tagStorageConfig(), app.logger)
+	if err != nil {
+		app.logger.Fatalf("can't create a new TagStorage: %s\n", err)
+	}
+	defer tagStorage.Shutdown()
+
+	app.logger.Infof("start regenerating resized images with %d worker(s)\n", cnf.Workers)
+
+	n, err := fileStorage.RegenerateResizedImages(files.GetFilesConfig{
+		Expr: cnf.Expr,
+		Tags: tagStorage.GetAll(),
+	}, cnf.Workers)
+	if err != nil {
+		app.logger.Fatalf("can't regenerate resized images: %s\n", err)
+	}
+
+	app.logger.Infof("%d resized image(s) were regenerated\n", n)
+
+	done := make(chan struct{})
+	close(done)
+	return done
+}
@@ -12,8 +12,16 @@ const (
 	DataBucket          = "var-data"
 	ResizedImagesBucket = "var-data-resized"
 
-	FilesJSONFile       = "./var/files.json"        // for files
-	TagsJSONFile        = "./var/tags.json"         // for tags
-	AuthTokensJSONFile  = "./var/auth_tokens.json"  // for auth tokens
-	ShareTokensJSONFile = "./var/share_tokens.json" // for share tokens
+	FilesJSONFile        = "./var/files.json"         // for files
+	TagsJSONFile         = "./var/tags.json"          // for tags
+	SearchesJSONFile     = "./var/searches.json"      // for saved searches
+	AuthTokensJSONFile   = "./var/auth_tokens.json"   // for auth tokens
+	ShareTokensJSONFile  = "./var/share_tokens.json"  // for share tokens
+	SearchTokensJSONFile = "./var/search_tokens.json" // for share tokens of saved searches
+
+	SQLiteFile = "./var/tags-drive.db" // for all metadata when STORAGE_METADATA_TYPE is "sqlite"
+
+	// LockFile is locked by a running instance. Commands which change stored files refuse to run
+	// while it is locked
+	LockFile = "./var/tags-drive.lock"
 )
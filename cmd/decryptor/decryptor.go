@@ -95,6 +95,10 @@ func (a *app) Decrypt() error {
 			var input, output string
 			for file := range filesChan {
 				input = a.config.DataFolder + "/" + strconv.Itoa(file.ID)
+				if len(file.Hash) > 2 {
+					// Content is stored by hash
+					input = a.config.DataFolder + "/blobs/" + file.Hash[:2] + "/" + file.Hash
+				}
 				output = a.config.OutputFolder + "/" + file.Filename
 				err = a.decryptAndSaveFile(input, output)
 				if err != nil {
@@ -174,8 +174,8 @@ func (app *app) fromDisk() <-chan file {
 		walkFunction := func(root string, resized bool) filepath.WalkFunc {
 			return func(path string, info os.FileInfo, err error) error {
 				if info.IsDir() {
-					// Skip folders
-					if path != root {
+					// Skip folders. Blobs are stored in subfolders of the "blobs" folder
+					if path != root && !(!resized && isBlobsFolder(root, path)) {
 						return filepath.SkipDir
 					}
 					return nil
@@ -212,8 +212,11 @@ func (app *app) fromDisk() <-chan file {
 					f.Close()
 				}
 
+				// Use a relative path as a name to keep blobs in their folders
+				name, _ := filepath.Rel(root, path)
+
 				file := file{
-					name:    info.Name(),
+					name:    filepath.ToSlash(name),
 					size:    fileSize,
 					resized: resized,
 					r:       src,
@@ -260,7 +263,8 @@ func (app *app) fromS3() <-chan file {
 		getFunction := func(bucket string, resized bool) {
 			done := make(chan struct{})
 
-			objects := app.s3.ListObjects(bucket, "", false, done)
+			// Blobs are stored with "blobs/" prefix
+			objects := app.s3.ListObjects(bucket, "", true, done)
 			for object := range objects {
 				obj, err := app.s3.GetObject(bucket, object.Key, minio.GetObjectOptions{})
 				if err != nil {
@@ -329,6 +333,11 @@ func (app *app) toDisk(files <-chan file) {
 				}
 				path += "/" + file.name
 
+				if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+					app.logger.Errorf("can't create a folder: %s\n", err)
+					continue
+				}
+
 				f, err := os.Create(path)
 				if err != nil {
 					app.logger.Errorf("can't create a file: %s\n", err)
@@ -2,6 +2,8 @@ package migrator
 
 import (
 	"io"
+	"path/filepath"
+	"strings"
 )
 
 type readCloserWrapper struct {
@@ -15,3 +17,14 @@ func (rc readCloserWrapper) Read(p []byte) (n int, err error) {
 func (rc readCloserWrapper) Close() error {
 	return nil
 }
+
+// isBlobsFolder checks if path is the "blobs" folder or its subfolder
+func isBlobsFolder(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+
+	return rel == "blobs" || strings.HasPrefix(rel, "blobs/")
+}
@@ -0,0 +1,225 @@
+package auth
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	clog "github.com/ShoshinNikita/log/v2"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+
+	"github.com/tags-drive/core/internal/utils"
+)
+
+var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+// maxJournalRecords is a number of journal records after which the journal is compacted
+const maxJournalRecords = 100
+
+// journalRecord describes a change of jsonAuthStorage.tokens. Records can be applied several times
+type journalRecord struct {
+	Put    []tokenStruct `json:"put,omitempty"`
+	Delete []string      `json:"delete,omitempty"`
+}
+
+// jsonAuthStorage implements auth.internalStorage interface.
+//
+// Every change is written into the journal before it is applied. The journal is replayed
+// on start and compacted into config.TokensJSONFile
+type jsonAuthStorage struct {
+	config Config
+
+	tokens []tokenStruct // we can use array instead of map because number of tokens is small and O(n) is enough
+	mutex  *sync.RWMutex
+
+	journal *utils.Journal
+
+	logger *clog.Logger
+}
+
+func newJsonAuthStorage(cnf Config, lg *clog.Logger) *jsonAuthStorage {
+	return &jsonAuthStorage{
+		config: cnf,
+		mutex:  new(sync.RWMutex),
+		logger: lg,
+	}
+}
+
+func (jas *jsonAuthStorage) init() error {
+	f, err := os.Open(jas.config.TokensJSONFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return errors.Wrapf(err, "can't open file %s", jas.config.TokensJSONFile)
+		}
+
+		// Have to create a new file
+		jas.logger.Debugf("file %s doesn't exist. Need to create a new file\n", jas.config.TokensJSONFile)
+
+		err := utils.WriteFileAtomic(jas.config.TokensJSONFile, jas.tokens, jas.config.Encrypt, jas.config.PassPhrase)
+		if err != nil {
+			return errors.Wrap(err, "can't create a new file")
+		}
+	} else {
+		err = utils.Decode(f, &jas.tokens, jas.config.Encrypt, jas.config.PassPhrase)
+		f.Close()
+		if err != nil {
+			return errors.Wrap(err, "can't decode allToken.tokens")
+		}
+	}
+
+	// Apply changes made after the last snapshot
+	jas.journal, err = utils.OpenJournal(jas.config.TokensJSONFile+".journal", jas.config.Encrypt, jas.config.PassPhrase)
+	if err != nil {
+		return err
+	}
+
+	err = jas.journal.Replay(func(data []byte) error {
+		var rec journalRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return err
+		}
+		jas.apply(rec)
+
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "can't replay journal")
+	}
+
+	return nil
+}
+
+// compact writes jas.tokens into jas.config.TokensJSONFile and clears the journal. jas.mutex must be locked
+func (jas *jsonAuthStorage) compact() {
+	err := utils.WriteFileAtomic(jas.config.TokensJSONFile, jas.tokens, jas.config.Encrypt, jas.config.PassPhrase)
+	if err != nil {
+		jas.logger.Warnf("can't write '%s': %s\n", jas.config.TokensJSONFile, err)
+		return
+	}
+
+	if err := jas.journal.Reset(); err != nil {
+		jas.logger.Errorf("can't reset journal: %s\n", err)
+	}
+}
+
+// commit writes a record into the journal and applies it. jas.mutex must be locked
+func (jas *jsonAuthStorage) commit(rec journalRecord) error {
+	if err := jas.journal.Append(rec); err != nil {
+		return errors.Wrap(err, "can't write a change into the journal")
+	}
+
+	jas.apply(rec)
+
+	if jas.journal.Len() >= maxJournalRecords {
+		jas.compact()
+	}
+
+	return nil
+}
+
+// apply applies a record to jas.tokens
+func (jas *jsonAuthStorage) apply(rec journalRecord) {
+	for _, tok := range rec.Put {
+		jas.removeToken(tok.Token)
+		jas.tokens = append(jas.tokens, tok)
+	}
+	for _, token := range rec.Delete {
+		jas.removeToken(token)
+	}
+}
+
+// removeToken removes a token from jas.tokens. It does nothing if a token doesn't exist
+func (jas *jsonAuthStorage) removeToken(token string) {
+	tokenIndex := -1
+	for i, tok := range jas.tokens {
+		if tok.Token == token {
+			tokenIndex = i
+			break
+		}
+	}
+	if tokenIndex == -1 {
+		return
+	}
+
+	jas.tokens = append(jas.tokens[:tokenIndex], jas.tokens[tokenIndex+1:]...)
+}
+
+func (jas jsonAuthStorage) getAll() []tokenStruct {
+	jas.mutex.RLock()
+	defer jas.mutex.RUnlock()
+
+	return append(jas.tokens[:0:0], jas.tokens...)
+}
+
+func (jas *jsonAuthStorage) addToken(tok tokenStruct) {
+	jas.mutex.Lock()
+	defer jas.mutex.Unlock()
+
+	if err := jas.commit(journalRecord{Put: []tokenStruct{tok}}); err != nil {
+		jas.logger.Errorf("can't add an auth token: %s\n", err)
+	}
+}
+
+func (jas *jsonAuthStorage) deleteToken(token string) {
+	jas.mutex.Lock()
+	defer jas.mutex.Unlock()
+
+	if !jas.hasToken(token) {
+		return
+	}
+
+	if err := jas.commit(journalRecord{Delete: []string{token}}); err != nil {
+		jas.logger.Errorf("can't delete an auth token: %s\n", err)
+	}
+}
+
+func (jas jsonAuthStorage) checkToken(token string) bool {
+	jas.mutex.RLock()
+	defer jas.mutex.RUnlock()
+
+	return jas.hasToken(token)
+}
+
+// hasToken checks if a token exists. jas.mutex must be locked
+func (jas jsonAuthStorage) hasToken(token string) bool {
+	for _, tok := range jas.tokens {
+		if tok.Token == token {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (jas *jsonAuthStorage) deleteExpiredTokens(now time.Time) {
+	jas.mutex.Lock()
+	defer jas.mutex.Unlock()
+
+	var rec journalRecord
+	for _, tok := range jas.tokens {
+		if !now.Before(tok.Expires) {
+			jas.logger.Debugf("token \"%s\" expired\n", tok.Token)
+			rec.Delete = append(rec.Delete, tok.Token)
+		}
+	}
+
+	if len(rec.Delete) == 0 {
+		return
+	}
+
+	if err := jas.commit(rec); err != nil {
+		jas.logger.Errorf("can't delete expired auth tokens: %s\n", err)
+	}
+}
+
+func (jas *jsonAuthStorage) shutdown() error {
+	// Wait for all locks
+	jas.mutex.Lock()
+	defer jas.mutex.Unlock()
+
+	// Write changes
+	jas.compact()
+
+	return jas.journal.Close()
+}
@@ -0,0 +1,170 @@
+package auth
+
+import (
+	"database/sql"
+	"os"
+	"time"
+
+	clog "github.com/ShoshinNikita/log/v2"
+	"github.com/pkg/errors"
+
+	"github.com/tags-drive/core/internal/utils"
+)
+
+const sqliteAuthSchema = `
+	CREATE TABLE IF NOT EXISTS auth_tokens (
+		token    TEXT PRIMARY KEY,
+		expires  INTEGER NOT NULL
+	);`
+
+// sqliteAuthStorage implements auth.internalStorage interface
+type sqliteAuthStorage struct {
+	config Config
+
+	db *sql.DB
+
+	logger *clog.Logger
+}
+
+func newSqliteAuthStorage(cnf Config, lg *clog.Logger) *sqliteAuthStorage {
+	return &sqliteAuthStorage{
+		config: cnf,
+		logger: lg,
+	}
+}
+
+func (sas *sqliteAuthStorage) init() (err error) {
+	sas.db, err = utils.OpenSQLite(sas.config.SQLiteFile)
+	if err != nil {
+		return err
+	}
+
+	// The table is created in the same transaction in which tokens are imported. So, if the import fails,
+	// nothing is committed and the import is repeated on the next start
+	tx, err := sas.db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "can't begin a transaction")
+	}
+	defer tx.Rollback()
+
+	var tableExists bool
+	err = tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'auth_tokens')`).Scan(&tableExists)
+	if err != nil {
+		return errors.Wrap(err, "can't check the table 'auth_tokens'")
+	}
+
+	if _, err := tx.Exec(sqliteAuthSchema); err != nil {
+		return errors.Wrap(err, "can't create the table 'auth_tokens'")
+	}
+
+	imported := 0
+	if !tableExists {
+		// The table was just created. Import tokens from the json storage to not log out users
+		// after switching from "json" to "sqlite"
+		if imported, err = sas.importFromJSON(tx); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "can't commit the schema")
+	}
+
+	if imported > 0 {
+		sas.logger.Infof("%d auth token(s) were imported from %s\n", imported, sas.config.TokensJSONFile)
+	}
+
+	return nil
+}
+
+// importFromJSON copies tokens from config.TokensJSONFile into the database. It returns a number of imported tokens
+func (sas *sqliteAuthStorage) importFromJSON(tx *sql.Tx) (int, error) {
+	if _, err := os.Stat(sas.config.TokensJSONFile); os.IsNotExist(err) {
+		return 0, nil
+	}
+
+	// Load tokens with jsonAuthStorage to apply changes from its journal
+	jsonStorage := newJsonAuthStorage(sas.config, sas.logger)
+	if err := jsonStorage.init(); err != nil {
+		return 0, errors.Wrapf(err, "can't load tokens from %s", sas.config.TokensJSONFile)
+	}
+	defer jsonStorage.shutdown()
+
+	tokens := jsonStorage.getAll()
+	for _, tok := range tokens {
+		_, err := tx.Exec(`INSERT OR REPLACE INTO auth_tokens (token, expires) VALUES (?, ?)`, tok.Token, tok.Expires.UnixNano())
+		if err != nil {
+			return 0, errors.Wrap(err, "can't insert a token")
+		}
+	}
+
+	return len(tokens), nil
+}
+
+func (sas *sqliteAuthStorage) getAll() []tokenStruct {
+	tokens := []tokenStruct{}
+
+	rows, err := sas.db.Query(`SELECT token, expires FROM auth_tokens`)
+	if err != nil {
+		sas.logger.Errorf("can't select auth tokens: %s\n", err)
+		return tokens
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			tok     tokenStruct
+			expires int64
+		)
+		if err := rows.Scan(&tok.Token, &expires); err != nil {
+			sas.logger.Errorf("can't scan an auth token: %s\n", err)
+			return tokens
+		}
+		tok.Expires = time.Unix(0, expires)
+
+		tokens = append(tokens, tok)
+	}
+
+	return tokens
+}
+
+func (sas *sqliteAuthStorage) addToken(tok tokenStruct) {
+	_, err := sas.db.Exec(`INSERT OR REPLACE INTO auth_tokens (token, expires) VALUES (?, ?)`, tok.Token, tok.Expires.UnixNano())
+	if err != nil {
+		sas.logger.Errorf("can't add an auth token: %s\n", err)
+	}
+}
+
+func (sas *sqliteAuthStorage) deleteToken(token string) {
+	_, err := sas.db.Exec(`DELETE FROM auth_tokens WHERE token = ?`, token)
+	if err != nil {
+		sas.logger.Errorf("can't delete an auth token: %s\n", err)
+	}
+}
+
+func (sas *sqliteAuthStorage) checkToken(token string) bool {
+	var exists bool
+	err := sas.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM auth_tokens WHERE token = ?)`, token).Scan(&exists)
+	if err != nil {
+		sas.logger.Errorf("can't check an auth token: %s\n", err)
+		return false
+	}
+
+	return exists
+}
+
+func (sas *sqliteAuthStorage) deleteExpiredTokens(now time.Time) {
+	res, err := sas.db.Exec(`DELETE FROM auth_tokens WHERE expires <= ?`, now.UnixNano())
+	if err != nil {
+		sas.logger.Errorf("can't delete expired auth tokens: %s\n", err)
+		return
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		sas.logger.Debugf("%d token(s) expired\n", n)
+	}
+}
+
+func (sas *sqliteAuthStorage) shutdown() error {
+	return sas.db.Close()
+}
@@ -3,7 +3,6 @@ package auth
 import (
 	"os"
 	"sort"
-	"sync"
 	"testing"
 	"time"
 
@@ -42,24 +41,51 @@ func toStringSlice(t []tokenStruct) (s []string) {
 	return
 }
 
-func newAuth() *AuthService {
-	cnf := Config{
-		Debug:          false,
-		TokensJSONFile: "tokens.json",
-		Encrypt:        false,
-		MaxTokenLife:   time.Hour,
-	}
+const (
+	testJSONFile   = "tokens.json"
+	testSQLiteFile = "tokens.db"
+)
 
-	auth := &AuthService{
-		config:     cnf,
-		mutex:      new(sync.RWMutex),
-		tokens:     originalTokens(),
-		logger:     clog.NewProdLogger(),
-		shutdowned: make(chan struct{}),
+// runForAllStorages creates AuthService with every internal storage and original tokens, and runs f.
+// Storages are removed after the test
+func runForAllStorages(t *testing.T, f func(t *testing.T, a *AuthService)) {
+	for _, storageType := range []string{"json", "sqlite"} {
+		t.Run(storageType, func(t *testing.T) {
+			cnf := Config{
+				Debug:               false,
+				MetadataStorageType: storageType,
+				TokensJSONFile:      testJSONFile,
+				SQLiteFile:          testSQLiteFile,
+				Encrypt:             false,
+				MaxTokenLife:        time.Hour,
+			}
+
+			auth, err := NewAuthService(cnf, clog.NewProdLogger())
+			if err != nil {
+				t.Fatalf("can't create AuthService: %s", err)
+			}
+			defer func() {
+				auth.Shutdown()
+				for _, path := range []string{testJSONFile, testJSONFile + ".journal", testSQLiteFile, testSQLiteFile + "-wal", testSQLiteFile + "-shm"} {
+					removeConfigFile(path)
+				}
+			}()
+
+			setTokens(auth, originalTokens())
+
+			f(t, auth)
+		})
 	}
-	auth.createNewFile()
+}
 
-	return auth
+// setTokens replaces all tokens in a storage with passed ones
+func setTokens(a *AuthService, tokens []tokenStruct) {
+	for _, tok := range a.storage.getAll() {
+		a.storage.deleteToken(tok.Token)
+	}
+	for _, tok := range tokens {
+		a.storage.addToken(tok)
+	}
 }
 
 // originalTokens returns []tokenStruct. The function creates new slice every time.
@@ -74,118 +100,108 @@ func originalTokens() []tokenStruct {
 }
 
 func TestAdd(t *testing.T) {
-	tt := newAuth()
-
-	tt.AddToken("999")
-	answerSlice := []tokenStruct{
-		{Token: "123"},
-		{Token: "465"},
-		{Token: "789"},
-		{Token: "101"},
-		{Token: "999"},
-	}
-	want := toStringSlice(answerSlice)
-	got := toStringSlice(tt.tokens)
-	if !isEqual(want, got) {
-		t.Errorf("Wrong add result Want: %v Got: %v", want, got)
-	}
-
-	tt.AddToken("15")
-	answerSlice = []tokenStruct{
-		{Token: "123"},
-		{Token: "465"},
-		{Token: "789"},
-		{Token: "101"},
-		{Token: "999"},
-		{Token: "15"},
-	}
-	want = toStringSlice(answerSlice)
-	got = toStringSlice(tt.tokens)
-	if !isEqual(want, got) {
-		t.Errorf("Wrong add result Want: %v Got: %v", want, got)
-	}
+	runForAllStorages(t, func(t *testing.T, tt *AuthService) {
+		tt.AddToken("999")
+		answerSlice := []tokenStruct{
+			{Token: "123"},
+			{Token: "465"},
+			{Token: "789"},
+			{Token: "101"},
+			{Token: "999"},
+		}
+		want := toStringSlice(answerSlice)
+		got := toStringSlice(tt.storage.getAll())
+		if !isEqual(want, got) {
+			t.Errorf("Wrong add result Want: %v Got: %v", want, got)
+		}
 
-	tt.Shutdown()
-	removeConfigFile(tt.config.TokensJSONFile)
+		tt.AddToken("15")
+		answerSlice = []tokenStruct{
+			{Token: "123"},
+			{Token: "465"},
+			{Token: "789"},
+			{Token: "101"},
+			{Token: "999"},
+			{Token: "15"},
+		}
+		want = toStringSlice(answerSlice)
+		got = toStringSlice(tt.storage.getAll())
+		if !isEqual(want, got) {
+			t.Errorf("Wrong add result Want: %v Got: %v", want, got)
+		}
+	})
 }
 
 func TestDelete(t *testing.T) {
-	tt := newAuth()
-
-	tt.DeleteToken("465")
-	answerSlice := []tokenStruct{
-		{Token: "123"},
-		{Token: "789"},
-		{Token: "101"},
-	}
-	want := toStringSlice(answerSlice)
-	got := toStringSlice(tt.tokens)
-	if !isEqual(want, got) {
-		t.Errorf("Wrong delete result Want: %v Got: %v", want, got)
-	}
-
-	tt.DeleteToken("123")
-	answerSlice = []tokenStruct{
-		{Token: "789"},
-		{Token: "101"},
-	}
-	want = toStringSlice(answerSlice)
-	got = toStringSlice(tt.tokens)
-	if !isEqual(want, got) {
-		t.Errorf("Wrong delete result Want: %v Got: %v", want, got)
-	}
+	runForAllStorages(t, func(t *testing.T, tt *AuthService) {
+		tt.DeleteToken("465")
+		answerSlice := []tokenStruct{
+			{Token: "123"},
+			{Token: "789"},
+			{Token: "101"},
+		}
+		want := toStringSlice(answerSlice)
+		got := toStringSlice(tt.storage.getAll())
+		if !isEqual(want, got) {
+			t.Errorf("Wrong delete result Want: %v Got: %v", want, got)
+		}
 
-	tt.DeleteToken("789")
-	answerSlice = []tokenStruct{
-		{Token: "101"},
-	}
-	want = toStringSlice(answerSlice)
-	got = toStringSlice(tt.tokens)
-	if !isEqual(want, got) {
-		t.Errorf("Wrong delete result Want: %v Got: %v", want, got)
-	}
+		tt.DeleteToken("123")
+		answerSlice = []tokenStruct{
+			{Token: "789"},
+			{Token: "101"},
+		}
+		want = toStringSlice(answerSlice)
+		got = toStringSlice(tt.storage.getAll())
+		if !isEqual(want, got) {
+			t.Errorf("Wrong delete result Want: %v Got: %v", want, got)
+		}
 
-	tt.DeleteToken("101")
-	answerSlice = []tokenStruct{}
-	want = toStringSlice(answerSlice)
-	got = toStringSlice(tt.tokens)
-	if !isEqual(want, got) {
-		t.Errorf("Wrong delete result Want: %v Got: %v", want, got)
-	}
+		tt.DeleteToken("789")
+		answerSlice = []tokenStruct{
+			{Token: "101"},
+		}
+		want = toStringSlice(answerSlice)
+		got = toStringSlice(tt.storage.getAll())
+		if !isEqual(want, got) {
+			t.Errorf("Wrong delete result Want: %v Got: %v", want, got)
+		}
 
-	tt.DeleteToken("999")
-	answerSlice = []tokenStruct{}
-	want = toStringSlice(answerSlice)
-	got = toStringSlice(tt.tokens)
-	if !isEqual(want, got) {
-		t.Errorf("Wrong delete result Want: %v Got: %v", want, got)
-	}
+		tt.DeleteToken("101")
+		answerSlice = []tokenStruct{}
+		want = toStringSlice(answerSlice)
+		got = toStringSlice(tt.storage.getAll())
+		if !isEqual(want, got) {
+			t.Errorf("Wrong delete result Want: %v Got: %v", want, got)
+		}
 
-	tt.Shutdown()
-	removeConfigFile(tt.config.TokensJSONFile)
+		tt.DeleteToken("999")
+		answerSlice = []tokenStruct{}
+		want = toStringSlice(answerSlice)
+		got = toStringSlice(tt.storage.getAll())
+		if !isEqual(want, got) {
+			t.Errorf("Wrong delete result Want: %v Got: %v", want, got)
+		}
+	})
 }
 
 func TestCheck(t *testing.T) {
-	tt := newAuth()
-
-	res := tt.CheckToken("15")
-	answerBool := false
-	if res != answerBool {
-		t.Errorf("Wrong check result Want: %v Got: %v", answerBool, res)
-	}
-
-	res = tt.CheckToken("123")
-	answerBool = true
-	if res != answerBool {
-		t.Errorf("Wrong check result Want: %v Got: %v", answerBool, res)
-	}
+	runForAllStorages(t, func(t *testing.T, tt *AuthService) {
+		res := tt.CheckToken("15")
+		answerBool := false
+		if res != answerBool {
+			t.Errorf("Wrong check result Want: %v Got: %v", answerBool, res)
+		}
 
-	tt.Shutdown()
-	removeConfigFile(tt.config.TokensJSONFile)
+		res = tt.CheckToken("123")
+		answerBool = true
+		if res != answerBool {
+			t.Errorf("Wrong check result Want: %v Got: %v", answerBool, res)
+		}
+	})
 }
 
 func TestExpire(t *testing.T) {
-	testTokens := newAuth()
 	tests := []struct {
 		before []tokenStruct
 		after  []tokenStruct
@@ -212,19 +228,17 @@ func TestExpire(t *testing.T) {
 		},
 	}
 
-	for i, tt := range tests {
-		testTokens.tokens = make([]tokenStruct, len(tt.before))
-		copy(testTokens.tokens, tt.before)
-		testTokens.expire()
+	runForAllStorages(t, func(t *testing.T, testTokens *AuthService) {
+		for i, tt := range tests {
+			setTokens(testTokens, tt.before)
+			testTokens.expire()
 
-		want := toStringSlice(tt.after)
-		got := toStringSlice(testTokens.tokens)
+			want := toStringSlice(tt.after)
+			got := toStringSlice(testTokens.storage.getAll())
 
-		if !isEqual(want, got) {
-			t.Errorf("Test #%d Want: %v Got: %v\n", i, want, got)
+			if !isEqual(want, got) {
+				t.Errorf("Test #%d Want: %v Got: %v\n", i, want, got)
+			}
 		}
-	}
-
-	testTokens.Shutdown()
-	removeConfigFile(testTokens.config.TokensJSONFile)
+	})
 }
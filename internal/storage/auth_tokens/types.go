@@ -5,9 +5,39 @@ import "time"
 type Config struct {
 	Debug bool
 
-	TokensJSONFile string
-	Encrypt        bool
-	PassPhrase     [32]byte
+	MetadataStorageType string
+	TokensJSONFile      string
+	// SQLiteFile is a path to the database used when MetadataStorageType is "sqlite"
+	SQLiteFile string
+
+	Encrypt    bool
+	PassPhrase [32]byte
 
 	MaxTokenLife time.Duration
 }
+
+type tokenStruct struct {
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expire"`
+}
+
+type internalStorage interface {
+	init() error
+
+	// getAll returns all tokens
+	getAll() []tokenStruct
+
+	// addToken adds a token
+	addToken(tok tokenStruct)
+
+	// deleteToken deletes a token. It does nothing if a token doesn't exist
+	deleteToken(token string)
+
+	// checkToken checks if a token exists
+	checkToken(token string) bool
+
+	// deleteExpiredTokens deletes tokens expired before now
+	deleteExpiredTokens(now time.Time)
+
+	shutdown() error
+}
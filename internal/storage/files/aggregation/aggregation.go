@@ -1,65 +1,53 @@
 package aggregation
 
-import (
-	"bytes"
-	"fmt"
-	"io"
-	"strconv"
-)
-
 // IsGoodFile runs an expression for file tags
 //
 // expr is a logical expression in reverse Polish notation received from ParseLogicalExpr()
 //
-func IsGoodFile(expr LogicalExpr, fileTags []int) (res bool) {
-	// Just in case
-	defer func() {
-		if r := recover(); r != nil {
-			res = false
-		}
-	}()
+func IsGoodFile(expr LogicalExpr, fileTags []int) bool {
+	return Match(expr, Fields{Tags: fileTags})
+}
 
-	if expr == "" {
-		return true
+// Match runs an expression for fields of a file
+//
+// expr is a logical expression in reverse Polish notation received from ParseExpr(). Use Compile()
+// to check many files
+//
+func Match(expr LogicalExpr, file Fields) bool {
+	p, err := Compile(expr)
+	if err != nil {
+		return false
 	}
 
+	return p.Match(file)
+}
+
+// splitExpr splits an expression by spaces. Spaces inside quoted values are ignored
+func splitExpr(expr string) []string {
 	var (
-		steps processingStack
-		s     string
-		err   error
+		res    []string
+		start  = 0
+		quoted = false
 	)
-
-	buf := bytes.NewBuffer([]byte(expr))
-	for {
-		_, err = fmt.Fscan(buf, &s)
-		if err == io.EOF {
-			break
-		}
-
-		switch s {
-		case "!":
-			b := steps.pop()
-			steps.push(!b)
-		case "&":
-			a := steps.pop()
-			b := steps.pop()
-			steps.push(a && b)
-		case "|":
-			a := steps.pop()
-			b := steps.pop()
-			steps.push(a || b)
-		default:
-			// We can skip error because expr must be correct
-			id, _ := strconv.Atoi(s)
-			steps.push(has(fileTags, id))
+	for i := 0; i < len(expr); i++ {
+		switch {
+		case quoted && expr[i] == '\\':
+			// Skip an escaped symbol
+			i++
+		case expr[i] == '"':
+			quoted = !quoted
+		case !quoted && expr[i] == ' ':
+			if start < i {
+				res = append(res, expr[start:i])
+			}
+			start = i + 1
 		}
 	}
-
-	if steps.len != 1 {
-		return false
+	if start < len(expr) {
+		res = append(res, expr[start:])
 	}
 
-	return steps.pop()
+	return res
 }
 
 func has(tags []int, tag int) bool {
@@ -2,6 +2,7 @@ package aggregation_test
 
 import (
 	"testing"
+	"time"
 
 	"github.com/tags-drive/core/internal/storage/files/aggregation"
 )
@@ -39,3 +40,89 @@ func TestIsGoodFile(t *testing.T) {
 		}
 	}
 }
+
+func TestMatch(t *testing.T) {
+	file := aggregation.Fields{
+		Tags:        []int{1, 2},
+		Filename:    "Report 2024.pdf",
+		Type:        "unsupported",
+		Ext:         ".pdf",
+		Size:        3 << 20,
+		AddTime:     time.Date(2024, time.March, 10, 0, 0, 0, 0, time.Local),
+		Description: "Annual report",
+		Deleted:     false,
+	}
+	photo := aggregation.Fields{
+		Filename: "IMG_0001.JPG",
+		Type:     "image",
+		Ext:      ".JPG",
+		AddTime:  time.Date(2024, time.March, 10, 0, 0, 0, 0, time.Local),
+		TakenAt:  time.Date(2023, time.August, 5, 12, 0, 0, 0, time.Local),
+		Camera:   "Canon EOS 5D",
+		Lens:     "EF50mm f/1.8",
+		Width:    4000,
+		Height:   3000,
+		ISO:      400,
+		HasGPS:   true,
+	}
+
+	tests := []struct {
+		expr   string
+		answer bool
+	}{
+		{"1 & 2", true},
+		{"ext:pdf", true},
+		{"ext:doc", false},
+		{"size>=3MB & size<4MB", true},
+		{"size:3MB", true},
+		{"size>3MB", false},
+		{"added:2024", true},
+		{"added:2024-03-10", true},
+		{"added:2024-03-11..", false},
+		{"added:..2024-02", false},
+		{"added<2024-04", true},
+		{"added>2024-03", false},
+		{`name:"report 2024"`, true},
+		{`name:~"^report"`, false},
+		{`name:~"(?i)^report"`, true},
+		{"desc:annual & !deleted:true", true},
+		{"deleted:true | 3", false},
+		// Files without metadata don't match predicates on it
+		{"taken<2030", false},
+		{"width<100", false},
+		{"gps:false", true},
+	}
+
+	photoTests := []struct {
+		expr   string
+		answer bool
+	}{
+		{"taken:2023-08", true},
+		{"taken>2023-08-05", false},
+		{"taken:2023..2024 & added:2024", true},
+		{"camera:canon & lens:ef50", true},
+		{`camera:~"^Nikon"`, false},
+		{"width>=4000 & height<4000", true},
+		{"iso>400", false},
+		{"iso:400 & gps:true", true},
+	}
+
+	check := func(file aggregation.Fields, expr string, answer bool) {
+		parsed, err := aggregation.ParseExpr(expr, nil)
+		if err != nil {
+			t.Errorf("%s: can't parse: %s", expr, err)
+			return
+		}
+
+		if res := aggregation.Match(parsed, file); res != answer {
+			t.Errorf("%s: Want: %t Got: %t", expr, answer, res)
+		}
+	}
+
+	for _, tt := range tests {
+		check(file, tt.expr, tt.answer)
+	}
+	for _, tt := range photoTests {
+		check(photo, tt.expr, tt.answer)
+	}
+}
@@ -0,0 +1,117 @@
+package aggregation
+
+import (
+	"strconv"
+	"strings"
+)
+
+type nodeKind int
+
+// Kinds of nodes. Operators are sorted by precedence
+const (
+	nodeOr nodeKind = iota
+	nodeAnd
+	nodeNot
+	nodeTag
+	nodePredicate
+)
+
+// node is a node of a parsed expression
+type node struct {
+	kind nodeKind
+
+	// left is the only operand of '!'
+	left, right *node
+
+	// tags are ids of a tag. A tag referred by name can have several ids
+	tags []int
+	pred predicate
+
+	// display is a term in the normalized form
+	display string
+}
+
+// rpn appends the node in reverse Polish notation to dst
+func (n *node) rpn(dst []string) []string {
+	switch n.kind {
+	case nodeOr, nodeAnd:
+		dst = n.left.rpn(dst)
+		dst = n.right.rpn(dst)
+		if n.kind == nodeOr {
+			return append(dst, "|")
+		}
+		return append(dst, "&")
+	case nodeNot:
+		return append(n.left.rpn(dst), "!")
+	case nodeTag:
+		dst = append(dst, strconv.Itoa(n.tags[0]))
+		for _, id := range n.tags[1:] {
+			dst = append(dst, strconv.Itoa(id), "|")
+		}
+		return dst
+	default:
+		return append(dst, n.pred.String())
+	}
+}
+
+// String returns the node in the normalized form: operators are separated by spaces,
+// redundant parentheses are removed, predicates have normalized fields and values
+func (n *node) String() string {
+	switch n.kind {
+	case nodeOr, nodeAnd:
+		op := " | "
+		if n.kind == nodeAnd {
+			op = " & "
+		}
+		return n.operand(n.left) + op + n.operand(n.right)
+	case nodeNot:
+		return "!" + n.operand(n.left)
+	default:
+		return n.display
+	}
+}
+
+// operand returns an operand of the node. Operators with lower precedence are put into parentheses
+func (n *node) operand(child *node) string {
+	if child.kind < n.kind {
+		return "(" + child.String() + ")"
+	}
+	return child.String()
+}
+
+// displayPredicate returns a predicate in the normalized form
+func displayPredicate(pred predicate, tok token) string {
+	value := tok.value
+	switch pred.field {
+	case fieldType, fieldExt, fieldDeleted:
+		value = pred.value
+	case fieldSize:
+		value = strings.ToUpper(value)
+	case fieldName, fieldDesc:
+		if tok.op == opEqual {
+			value = pred.value
+		}
+	}
+
+	// Original operator is used because comparisons of dates are converted into ranges
+	return tok.field + tok.op + quoteIfNeeded(value)
+}
+
+// quoteIfNeeded quotes a value if it is empty or contains spaces or special symbols
+func quoteIfNeeded(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\n()&|!:<>=~\"\\") {
+		return s
+	}
+
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		if r == '"' || r == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	b.WriteByte('"')
+
+	return b.String()
+}
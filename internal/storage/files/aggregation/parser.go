@@ -1,189 +1,500 @@
 package aggregation
 
 import (
-	"bytes"
-	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"unicode"
 
 	"github.com/pkg/errors"
 )
 
-var ErrBadSyntax = errors.New("syntax of a logical expression is incorrect")
+// Errors
+var (
+	ErrBadSyntax  = errors.New("syntax of a logical expression is incorrect")
+	ErrUnknownTag = errors.New("logical expression contains an unknown tag")
+)
 
-// LogicalExpr is a parsed logical expression
+// LogicalExpr is a parsed logical expression in reverse Polish notation.
+//
+// Tags are kept as ids. Field predicates are kept as "field" + "operator" + "quoted value"
+// with normalized values, for example: `type:"image"`, `size>"10485760"`, `name:~"^a.*"`
 type LogicalExpr string
 
-// ParseLogicalExpr returns expression in reverse Polish notation
+// Tags is used to resolve tags referred by name and to check ids of tags
+type Tags interface {
+	// Resolve returns ids of tags with passed name. It returns nil if there's no such tag
+	Resolve(name string) []int
+	// Exists checks if a tag with passed id exists
+	Exists(id int) bool
+}
+
+// ErrorKind is a kind of a syntax error
+type ErrorKind string
+
+// Kinds of syntax errors
+const (
+	ErrorUnbalancedParen  ErrorKind = "unbalanced-paren"
+	ErrorEmptyParens      ErrorKind = "empty-parens"
+	ErrorDanglingOperator ErrorKind = "dangling-operator"
+	ErrorMissingOperator  ErrorKind = "missing-operator"
+	ErrorDoubleNegation   ErrorKind = "double-negation"
+	ErrorUnclosedQuote    ErrorKind = "unclosed-quote"
+	ErrorEmptyValue       ErrorKind = "empty-value"
+	ErrorUnknownField     ErrorKind = "unknown-field"
+	ErrorInvalidOperator  ErrorKind = "invalid-operator"
+	ErrorInvalidValue     ErrorKind = "invalid-value"
+	ErrorUnknownTag       ErrorKind = "unknown-tag"
+)
+
+// SyntaxError describes an error in a logical expression. Pos and End are offsets in runes (End is exclusive)
+type SyntaxError struct {
+	Pos     int       `json:"pos"`
+	End     int       `json:"end"`
+	Kind    ErrorKind `json:"kind"`
+	Message string    `json:"message"`
+}
+
+func (e *SyntaxError) Error() string {
+	return "position " + strconv.Itoa(e.Pos+1) + ": " + e.Message
+}
+
+// Cause returns ErrUnknownTag for unknown tags and ErrBadSyntax for other errors. It allows
+// to use errors.Cause()
+func (e *SyntaxError) Cause() error {
+	if e.Kind == ErrorUnknownTag {
+		return ErrUnknownTag
+	}
+	return ErrBadSyntax
+}
+
+// ParseResult is a result of ParseExprWithDiagnostics
+type ParseResult struct {
+	Expr LogicalExpr
+	// Normalized is an expression in the canonical form. It is empty if there are errors
+	Normalized string
+	// Errors are sorted by position
+	Errors []SyntaxError
+}
+
+// ParseLogicalExpr returns expression in reverse Polish notation. Tags can be referred only by id
 //
-// Valid symbols: digits, !, &, |, (, )
 // Examples:
 //   - input: "66&!8|7" output: "66 8 ! & 7 |"
 //   - input: "(!7|6)&(6|9)" output: "7 ! 6 | 6 9 | &"
 //
-func ParseLogicalExpr(expr string) (result LogicalExpr, err error) {
-	// Just in case
-	defer func() {
-		if r := recover(); r != nil {
-			result = LogicalExpr("")
-			err = ErrBadSyntax
-		}
-	}()
+func ParseLogicalExpr(expr string) (LogicalExpr, error) {
+	return ParseExpr(expr, nil)
+}
 
-	expr = removeAllSpaces(expr)
-	if expr == "" {
-		return "", nil
+// ParseExpr returns expression in reverse Polish notation. Tags referred by name are resolved
+// with passed Tags. If tags are nil, tags can be referred only by id and ids aren't checked.
+// The first found error is returned as *SyntaxError
+//
+// Grammar:
+//
+//   expr      = and { "|" and }
+//   and       = unary { "&" unary }
+//   unary     = [ "!" ] primary
+//   primary   = "(" expr ")" | tag | predicate
+//   tag       = id | name | quoted name
+//   predicate = field operator value
+//
+// Fields:
+//   - tag:{id or name}
+//   - type:{file type} - archive, audio, image, lang, text, video, unsupported
+//   - ext:{extension} - with or without a dot
+//   - size{:,>,>=,<,<=}{size} - size can have a unit: B, KB, MB, GB, TB (1KB = 1024B)
+//   - added{:,>,>=,<,<=}{date} - date is YYYY, YYYY-MM or YYYY-MM-DD in the server time zone.
+//     Ranges are supported with ':' operator: 2024-01..2024-06, 2024-01.., ..2024-06
+//   - name:{text}, name:~{regexp}
+//   - desc:{text}, desc:~{regexp}
+//   - deleted:{true or false}
+//
+// Values with spaces or special symbols must be quoted: name:"my file", name:~"^(a|b)"
+//
+func ParseExpr(expr string, tags Tags) (LogicalExpr, error) {
+	res := ParseExprWithDiagnostics(expr, tags)
+	if len(res.Errors) > 0 {
+		return "", &res.Errors[0]
 	}
 
-	if !isCorrectExpression([]rune(expr)) {
-		return "", ErrBadSyntax
-	}
+	return res.Expr, nil
+}
 
-	var (
-		builder   strings.Builder
-		operators logicalStack
-		lastDigit = false
-	)
+// ParseExprWithDiagnostics parses an expression (see ParseExpr) and returns all found errors
+func ParseExprWithDiagnostics(expr string, tags Tags) ParseResult {
+	p := &parser{tags: tags}
 
-	for _, c := range expr {
-		switch {
-		case isDigit(c):
-			if !lastDigit {
-				builder.WriteByte(' ')
-			}
-			builder.WriteRune(c)
-			lastDigit = true
-		case c == '&' || c == '|':
-			lastDigit = false
-			for operators.len > 0 &&
-				(operators.top() == '!' || isGreaterPriority(c, operators.top())) {
-				builder.WriteByte(' ')
-				builder.WriteRune(operators.pop())
-			}
-			operators.push(c)
-		case c == '!':
-			lastDigit = false
-			operators.push(c)
-		case c == '(':
-			lastDigit = false
-			operators.push(c)
-		case c == ')':
-			lastDigit = false
-			for {
-				if operators.len == 0 {
-					return "", ErrBadSyntax
-				}
-				if operators.top() == '(' {
-					// Remove '('
-					operators.pop()
-					break
-				}
-				builder.WriteByte(' ')
-				builder.WriteRune(operators.pop())
-			}
-		default:
-			return "", ErrBadSyntax
-		}
+	p.lex([]rune(expr))
+	p.checkTerms()
+	p.checkStructure()
+
+	if len(p.errors) > 0 {
+		sort.SliceStable(p.errors, func(i, j int) bool { return p.errors[i].Pos < p.errors[j].Pos })
+		return ParseResult{Errors: p.errors}
 	}
 
-	for operators.len > 0 {
-		builder.WriteByte(' ')
-		builder.WriteRune(operators.pop())
+	if len(p.tokens) == 0 {
+		return ParseResult{Errors: []SyntaxError{}}
 	}
 
-	res := builder.String()
+	root := p.parseOr()
 
-	// Trim first and last spaces
-	if res[0] == ' ' {
-		res = res[1:]
-	}
-	if res[len(res)-1] == ' ' {
-		res = res[:len(res)-1]
+	return ParseResult{
+		Expr:       LogicalExpr(strings.Join(root.rpn(nil), " ")),
+		Normalized: root.String(),
+		Errors:     []SyntaxError{},
 	}
+}
+
+type tokenKind int
+
+const (
+	tokenAnd tokenKind = iota
+	tokenOr
+	tokenNot
+	tokenLeftParen
+	tokenRightParen
+	// tokenTerm is a tag or a field predicate
+	tokenTerm
+)
+
+type token struct {
+	kind tokenKind
+	// pos and end are offsets in runes (end is exclusive)
+	pos, end int
+
+	// Fields of terms. field and op are empty for tags
+
+	field string
+	op    string
+	value string
+	// quoted is true if value was quoted
+	quoted bool
+	// invalid is true if a lexical error was found
+	invalid bool
+
+	// node is a checked term
+	node *node
+}
+
+// isTermEnd checks if a rune can't be a part of an unquoted term
+func isTermEnd(r rune) bool {
+	return unicode.IsSpace(r) || strings.ContainsRune("()&|", r)
+}
+
+type parser struct {
+	tokens []token
+	pos    int
 
-	return LogicalExpr(res), nil
+	tags Tags
+
+	errors []SyntaxError
+}
+
+func (p *parser) addError(pos, end int, kind ErrorKind, msg string) {
+	p.errors = append(p.errors, SyntaxError{Pos: pos, End: end, Kind: kind, Message: msg})
 }
 
-func removeAllSpaces(s string) string {
-	var b bytes.Buffer
-	b.Grow(len(s))
+// lex splits an expression into tokens
+func (p *parser) lex(s []rune) {
+	operators := map[rune]tokenKind{
+		'&': tokenAnd,
+		'|': tokenOr,
+		'!': tokenNot,
+		'(': tokenLeftParen,
+		')': tokenRightParen,
+	}
+
+	for i := 0; i < len(s); {
+		r := s[i]
+
+		if unicode.IsSpace(r) {
+			i++
+			continue
+		}
+		if kind, ok := operators[r]; ok {
+			p.tokens = append(p.tokens, token{kind: kind, pos: i, end: i + 1})
+			i++
+			continue
+		}
+
+		// Term
+		tok := token{kind: tokenTerm, pos: i}
+
+		if r == '"' {
+			// Quoted tag name
+			value, n, ok := readQuoted(s[i:])
+			if !ok {
+				p.addError(i, len(s), ErrorUnclosedQuote, "quote isn't closed")
+				// Add the term to check the structure of the expression
+				tok.end, tok.invalid = len(s), true
+				p.tokens = append(p.tokens, tok)
+				return
+			}
+			tok.value, tok.quoted = value, true
+			i += n
+			tok.end = i
+			p.tokens = append(p.tokens, tok)
+			continue
+		}
+
+		// Read a tag or a field name
+		for i < len(s) && !isTermEnd(s[i]) && !strings.ContainsRune(`!:<>="`, s[i]) {
+			i++
+		}
+		name := string(s[tok.pos:i])
+
+		// Read an operator
+		opStart := i
+		for i < len(s) && strings.ContainsRune(":~<>=", s[i]) {
+			i++
+		}
+		if opStart == i {
+			tok.value = name
+			tok.end = i
+			p.tokens = append(p.tokens, tok)
+			continue
+		}
+		tok.field = strings.ToLower(name)
+		tok.op = string(s[opStart:i])
 
-	for _, r := range s {
-		if r != ' ' {
-			b.WriteRune(r)
+		// Read a value
+		if i < len(s) && s[i] == '"' {
+			value, n, ok := readQuoted(s[i:])
+			if !ok {
+				p.addError(i, len(s), ErrorUnclosedQuote, "quote isn't closed")
+				// Add the term to check the structure of the expression
+				tok.end, tok.invalid = len(s), true
+				p.tokens = append(p.tokens, tok)
+				return
+			}
+			tok.value, tok.quoted = value, true
+			i += n
+		} else {
+			valueStart := i
+			for i < len(s) && !isTermEnd(s[i]) {
+				i++
+			}
+			tok.value = string(s[valueStart:i])
+		}
+		tok.end = i
+
+		p.tokens = append(p.tokens, tok)
+	}
+}
+
+// readQuoted reads a quoted string. s[0] must be '"'. '\' escapes the next rune.
+// It returns the unquoted string and a number of read runes
+func readQuoted(s []rune) (string, int, bool) {
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+			if i == len(s) {
+				return "", 0, false
+			}
+			b.WriteRune(s[i])
+		case '"':
+			return b.String(), i + 1, true
+		default:
+			b.WriteRune(s[i])
 		}
 	}
 
-	return b.String()
+	// No closing quote
+	return "", 0, false
 }
 
-func isGreaterPriority(a, b rune) bool {
-	switch a {
-	case '&':
-		return b == '&' || b == '|'
-	case '|':
-		return b == '&'
-	default:
-		return false
+// checkTerms checks tags and predicates and creates nodes for them
+func (p *parser) checkTerms() {
+	for i := range p.tokens {
+		tok := &p.tokens[i]
+		if tok.kind != tokenTerm || tok.invalid {
+			continue
+		}
+
+		switch {
+		case tok.field == "" && tok.op != "":
+			p.addError(tok.pos, tok.end, ErrorUnknownField, "field name is missing")
+		case tok.value == "" && !tok.quoted:
+			p.addError(tok.pos, tok.end, ErrorEmptyValue, "value of field \""+tok.field+"\" is missing")
+		case tok.field == "" || tok.field == fieldTag:
+			if tok.op != "" && tok.op != opEqual {
+				p.addError(tok.pos, tok.end, ErrorInvalidOperator, "operator \""+tok.op+"\" can't be used with tags")
+				continue
+			}
+			tok.node = p.newTagNode(*tok)
+		default:
+			pred, kind := newPredicate(tok.field, tok.op, tok.value)
+			if kind != "" {
+				p.addError(tok.pos, tok.end, kind, predicateErrorMessage(kind, *tok))
+				continue
+			}
+			tok.node = &node{kind: nodePredicate, pred: pred, display: displayPredicate(pred, *tok)}
+		}
 	}
 }
 
-func isCorrectExpression(expr []rune) bool {
-	if len(expr) == 0 || !isValidSymbol(expr[0]) {
-		return false
+// newTagNode returns a node for a tag referred by id or by name. It returns nil if a tag doesn't exist
+func (p *parser) newTagNode(tok token) *node {
+	if !tok.quoted {
+		if id, err := strconv.Atoi(tok.value); err == nil && id >= 0 {
+			if p.tags != nil && !p.tags.Exists(id) {
+				p.addError(tok.pos, tok.end, ErrorUnknownTag, "tag with id "+strconv.Itoa(id)+" doesn't exist")
+				return nil
+			}
+			return &node{kind: nodeTag, tags: []int{id}, display: strconv.Itoa(id)}
+		}
 	}
 
-	if expr[0] == '&' || expr[len(expr)-1] == '&' ||
-		expr[0] == '|' || expr[len(expr)-1] == '|' {
-		return false
+	var ids []int
+	if p.tags != nil {
+		ids = p.tags.Resolve(tok.value)
+	}
+	if len(ids) == 0 {
+		p.addError(tok.pos, tok.end, ErrorUnknownTag, "tag \""+tok.value+"\" doesn't exist")
+		return nil
 	}
 
-	invalidPares := []struct {
-		f rune
-		s rune
-	}{
-		{'(', ')'},
-		{'(', '&'},
-		{'(', '|'},
-		{')', '('},
-		{'&', '&'},
-		{'&', '|'},
-		{'|', '&'},
-		{'|', '|'},
-		{'!', '&'},
-		{'!', '|'},
-		{'!', '!'},
+	return &node{kind: nodeTag, tags: ids, display: quoteIfNeeded(tok.value)}
+}
+
+func predicateErrorMessage(kind ErrorKind, tok token) string {
+	switch kind {
+	case ErrorUnknownField:
+		return "unknown field \"" + tok.field + "\""
+	case ErrorInvalidOperator:
+		return "operator \"" + tok.op + "\" can't be used with field \"" + tok.field + "\""
+	default:
+		return "invalid value \"" + tok.value + "\" of field \"" + tok.field + "\""
 	}
+}
 
-	for i := 1; i < len(expr); i++ {
-		if !isValidSymbol(expr[i]) {
-			return false
-		}
+// checkStructure checks the order of operators, operands and parentheses
+func (p *parser) checkStructure() {
+	var (
+		expectOperand = true
+		openParens    []token
+		prev          *token
+	)
+
+	for i := range p.tokens {
+		tok := p.tokens[i]
 
-		for _, pare := range invalidPares {
-			if expr[i-1] == pare.f && expr[i] == pare.s {
-				return false
+		switch tok.kind {
+		case tokenTerm, tokenLeftParen:
+			if !expectOperand {
+				p.addError(tok.pos, tok.end, ErrorMissingOperator, "operator is missing before this operand")
+			}
+			if tok.kind == tokenLeftParen {
+				openParens = append(openParens, tok)
+				expectOperand = true
+			} else {
+				expectOperand = false
+			}
+		case tokenNot:
+			switch {
+			case prev != nil && prev.kind == tokenNot:
+				p.addError(tok.pos, tok.end, ErrorDoubleNegation, "double negation isn't allowed")
+			case !expectOperand:
+				p.addError(tok.pos, tok.end, ErrorMissingOperator, "operator is missing before '!'")
+			}
+			expectOperand = true
+		case tokenAnd, tokenOr:
+			if expectOperand {
+				p.addError(tok.pos, tok.end, ErrorDanglingOperator, "operator '"+opName(tok.kind)+"' has no left operand")
+			}
+			expectOperand = true
+		case tokenRightParen:
+			if len(openParens) == 0 {
+				p.addError(tok.pos, tok.end, ErrorUnbalancedParen, "parenthesis isn't opened")
+				continue
 			}
+			openParens = openParens[:len(openParens)-1]
+
+			if expectOperand && prev != nil {
+				if prev.kind == tokenLeftParen {
+					p.addError(prev.pos, tok.end, ErrorEmptyParens, "parentheses are empty")
+				} else {
+					p.addError(prev.pos, prev.end, ErrorDanglingOperator, "operator '"+opName(prev.kind)+"' has no right operand")
+				}
+			}
+			expectOperand = false
 		}
+
+		prev = &p.tokens[i]
 	}
 
-	invalidRegexpes := []string{
-		`\d!\d`,
-		`\d\(`,
+	if expectOperand && prev != nil && prev.kind != tokenLeftParen && prev.kind != tokenRightParen {
+		p.addError(prev.pos, prev.end, ErrorDanglingOperator, "operator '"+opName(prev.kind)+"' has no right operand")
 	}
-	for _, r := range invalidRegexpes {
-		reg := regexp.MustCompile(r)
-		if reg.MatchString(string(expr)) {
-			return false
-		}
+	for _, tok := range openParens {
+		p.addError(tok.pos, tok.end, ErrorUnbalancedParen, "parenthesis isn't closed")
+	}
+}
+
+func opName(kind tokenKind) string {
+	switch kind {
+	case tokenAnd:
+		return "&"
+	case tokenOr:
+		return "|"
+	case tokenNot:
+		return "!"
+	default:
+		return ""
 	}
+}
+
+// Methods below build a tree of a checked expression
 
-	return true
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	p.pos++
+	return tok
 }
 
-func isValidSymbol(c rune) bool {
-	return ('0' <= c && c <= '9') || c == '!' || c == '&' || c == '|' || c == '(' || c == ')'
+func (p *parser) peekKind(kind tokenKind) bool {
+	return p.pos < len(p.tokens) && p.tokens[p.pos].kind == kind
 }
 
-func isDigit(c rune) bool {
-	return '0' <= c && c <= '9'
+func (p *parser) parseOr() *node {
+	left := p.parseAnd()
+	for p.peekKind(tokenOr) {
+		p.pos++
+		left = &node{kind: nodeOr, left: left, right: p.parseAnd()}
+	}
+	return left
+}
+
+func (p *parser) parseAnd() *node {
+	left := p.parseUnary()
+	for p.peekKind(tokenAnd) {
+		p.pos++
+		left = &node{kind: nodeAnd, left: left, right: p.parseUnary()}
+	}
+	return left
+}
+
+func (p *parser) parseUnary() *node {
+	if p.peekKind(tokenNot) {
+		p.pos++
+		return &node{kind: nodeNot, left: p.parsePrimary()}
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() *node {
+	tok := p.next()
+	if tok.kind == tokenLeftParen {
+		n := p.parseOr()
+		// Skip ')'
+		p.pos++
+		return n
+	}
+
+	return tok.node
 }
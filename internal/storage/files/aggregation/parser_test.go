@@ -1,8 +1,11 @@
 package aggregation_test
 
 import (
+	"reflect"
 	"testing"
 
+	"github.com/pkg/errors"
+
 	"github.com/tags-drive/core/internal/storage/files/aggregation"
 )
 
@@ -57,3 +60,188 @@ func TestParse(t *testing.T) {
 		}
 	}
 }
+
+// testTags implements aggregation.Tags
+type testTags map[string][]int
+
+func (tags testTags) Resolve(name string) []int {
+	return tags[name]
+}
+
+func (tags testTags) Exists(id int) bool {
+	for _, ids := range tags {
+		for _, tagID := range ids {
+			if tagID == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var tags = testTags{
+	"work":      {5},
+	"my photos": {7, 8},
+	"1":         {1},
+	"12":        {12},
+}
+
+func TestParseExpr(t *testing.T) {
+	tests := []struct {
+		expr   string
+		answer aggregation.LogicalExpr
+		err    error
+	}{
+		// tags
+		{"work & !12", "5 12 ! &", nil},
+		{`tag:work | "my photos"`, "5 7 8 | |", nil},
+		{"tag:12", "12", nil},
+		{"home", "", aggregation.ErrUnknownTag},
+		{"5 & 100", "", aggregation.ErrUnknownTag},
+		// fields
+		{"type:IMAGE", `type:"image"`, nil},
+		{"ext:PDF", `ext:".pdf"`, nil},
+		{"size>10MB", `size>"10485760"`, nil},
+		{"size<=1.5kb", `size<="1536"`, nil},
+		{"deleted:true & 1", `deleted:"true" 1 &`, nil},
+		{`name:"My File"`, `name:"my file"`, nil},
+		{`name:~"^(a|b)\\.txt$"`, `name:~"^(a|b)\\.txt$"`, nil},
+		{`desc:"say \"hi\""`, `desc:"say \"hi\""`, nil},
+		{"(type:video | type:audio) & !deleted:true", `type:"video" type:"audio" | deleted:"true" ! &`, nil},
+		{`camera:"Canon EOS" & iso>=800`, `camera:"canon eos" iso>="800" &`, nil},
+		{"width>1920 | gps:TRUE", `width>"1920" gps:"true" |`, nil},
+		// incorrect
+		{"color:red", "", aggregation.ErrBadSyntax},
+		{"size>big", "", aggregation.ErrBadSyntax},
+		{"size:~1", "", aggregation.ErrBadSyntax},
+		{"type>image", "", aggregation.ErrBadSyntax},
+		{"added:2024-13", "", aggregation.ErrBadSyntax},
+		{"added:..", "", aggregation.ErrBadSyntax},
+		{"deleted:maybe", "", aggregation.ErrBadSyntax},
+		{"height>-1", "", aggregation.ErrBadSyntax},
+		{"iso:~100", "", aggregation.ErrBadSyntax},
+		{"gps>true", "", aggregation.ErrBadSyntax},
+		{"taken:yesterday", "", aggregation.ErrBadSyntax},
+		{`name:~"("`, "", aggregation.ErrBadSyntax},
+		{`name:"unclosed`, "", aggregation.ErrBadSyntax},
+		{"name:", "", aggregation.ErrBadSyntax},
+		{"1 12", "", aggregation.ErrBadSyntax},
+	}
+
+	for _, tt := range tests {
+		res, err := aggregation.ParseExpr(tt.expr, tags)
+		if errors.Cause(err) != tt.err {
+			t.Errorf("%s: Want error: %v Got: %v", tt.expr, tt.err, err)
+			continue
+		}
+
+		if tt.answer != res {
+			t.Errorf("%s: Want: %s Got: %s", tt.expr, tt.answer, res)
+		}
+	}
+}
+
+func TestParseExprWithDiagnostics(t *testing.T) {
+	tests := []struct {
+		expr       string
+		normalized string
+		errors     []aggregation.SyntaxError
+	}{
+		{"", "", nil},
+		{"work&!12", "work & !12", nil},
+		{"(work | 12)&(1)", "(work | 12) & 1", nil},
+		{"((work & 12)) | !(1 | 5)", "work & 12 | !(1 | 5)", nil},
+		{`TYPE:Image & name:"My File" & size>=10mb`, `type:image & name:"my file" & size>=10MB`, nil},
+		{`ext:PDF | "my photos" | added<2024-06`, `ext:.pdf | "my photos" | added<2024-06`, nil},
+		{`name:~"^a\\.txt$"`, `name:~"^a\\.txt$"`, nil},
+		//
+		{
+			"(5 & 12", "",
+			[]aggregation.SyntaxError{{Pos: 0, End: 1, Kind: aggregation.ErrorUnbalancedParen}},
+		},
+		{
+			"5) & 12", "",
+			[]aggregation.SyntaxError{{Pos: 1, End: 2, Kind: aggregation.ErrorUnbalancedParen}},
+		},
+		{
+			"5 & 12 |", "",
+			[]aggregation.SyntaxError{{Pos: 7, End: 8, Kind: aggregation.ErrorDanglingOperator}},
+		},
+		{
+			"(5 &) | 12", "",
+			[]aggregation.SyntaxError{{Pos: 3, End: 4, Kind: aggregation.ErrorDanglingOperator}},
+		},
+		{
+			"& 5", "",
+			[]aggregation.SyntaxError{{Pos: 0, End: 1, Kind: aggregation.ErrorDanglingOperator}},
+		},
+		{
+			"5 () 12", "",
+			[]aggregation.SyntaxError{
+				{Pos: 2, End: 3, Kind: aggregation.ErrorMissingOperator},
+				{Pos: 2, End: 4, Kind: aggregation.ErrorEmptyParens},
+				{Pos: 5, End: 7, Kind: aggregation.ErrorMissingOperator},
+			},
+		},
+		{
+			"!!5", "",
+			[]aggregation.SyntaxError{{Pos: 1, End: 2, Kind: aggregation.ErrorDoubleNegation}},
+		},
+		{
+			"5 & 100 | home", "",
+			[]aggregation.SyntaxError{
+				{Pos: 4, End: 7, Kind: aggregation.ErrorUnknownTag},
+				{Pos: 10, End: 14, Kind: aggregation.ErrorUnknownTag},
+			},
+		},
+		{
+			"color:red & size:~1 & size>big & (12", "",
+			[]aggregation.SyntaxError{
+				{Pos: 0, End: 9, Kind: aggregation.ErrorUnknownField},
+				{Pos: 12, End: 19, Kind: aggregation.ErrorInvalidOperator},
+				{Pos: 22, End: 30, Kind: aggregation.ErrorInvalidValue},
+				{Pos: 33, End: 34, Kind: aggregation.ErrorUnbalancedParen},
+			},
+		},
+		{
+			`5 & name:"unclosed`, "",
+			[]aggregation.SyntaxError{{Pos: 9, End: 18, Kind: aggregation.ErrorUnclosedQuote}},
+		},
+		{
+			"5 & name:", "",
+			[]aggregation.SyntaxError{{Pos: 4, End: 9, Kind: aggregation.ErrorEmptyValue}},
+		},
+	}
+
+	for _, tt := range tests {
+		res := aggregation.ParseExprWithDiagnostics(tt.expr, tags)
+
+		// Messages aren't checked
+		errs := make([]aggregation.SyntaxError, 0, len(res.Errors))
+		for _, e := range res.Errors {
+			if e.Message == "" {
+				t.Errorf("%s: empty message of error %+v", tt.expr, e)
+			}
+			e.Message = ""
+			errs = append(errs, e)
+		}
+
+		if len(tt.errors) == 0 && len(errs) == 0 {
+			if tt.normalized != res.Normalized {
+				t.Errorf("%s: Want normalized: %s Got: %s", tt.expr, tt.normalized, res.Normalized)
+				continue
+			}
+
+			// The normalized expression must have the same meaning
+			expr, err := aggregation.ParseExpr(res.Normalized, tags)
+			if err != nil || expr != res.Expr {
+				t.Errorf("%s: normalized expression %s was parsed to %s (error: %v), want: %s", tt.expr, res.Normalized, expr, err, res.Expr)
+			}
+			continue
+		}
+
+		if !reflect.DeepEqual(tt.errors, errs) {
+			t.Errorf("%s:\nWant errors: %+v\nGot: %+v", tt.expr, tt.errors, errs)
+		}
+	}
+}
@@ -0,0 +1,410 @@
+package aggregation
+
+import (
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fields contains fields of a file which can be used in a logical expression
+type Fields struct {
+	Tags        []int
+	Filename    string
+	Type        string
+	Ext         string
+	Size        int64
+	AddTime     time.Time
+	Description string
+	Deleted     bool
+
+	// Fields of images. They are empty for other files and if they are unknown
+	TakenAt time.Time
+	Camera  string
+	Lens    string
+	Width   int
+	Height  int
+	ISO     int
+	HasGPS  bool
+}
+
+// Field names
+const (
+	fieldTag     = "tag"
+	fieldType    = "type"
+	fieldExt     = "ext"
+	fieldSize    = "size"
+	fieldAdded   = "added"
+	fieldName    = "name"
+	fieldDesc    = "desc"
+	fieldDeleted = "deleted"
+	fieldTaken   = "taken"
+	fieldCamera  = "camera"
+	fieldLens    = "lens"
+	fieldWidth   = "width"
+	fieldHeight  = "height"
+	fieldISO     = "iso"
+	fieldGPS     = "gps"
+)
+
+// Operators
+const (
+	opEqual        = ":"
+	opMatch        = ":~"
+	opGreater      = ">"
+	opGreaterEqual = ">="
+	opLess         = "<"
+	opLessEqual    = "<="
+)
+
+// rangeSeparator separates bounds of a date range
+const rangeSeparator = ".."
+
+// predicate is a condition on a field of a file
+type predicate struct {
+	field string
+	op    string
+	// value is a normalized value:
+	//   - type, ext, name, desc, camera and lens: lower case text (regexps aren't changed)
+	//   - size: number of bytes
+	//   - width, height and iso: a number
+	//   - added and taken: a half-open range of Unix time in nanoseconds "from..to", bounds can be empty
+	//   - deleted and gps: "true" or "false"
+	value string
+}
+
+// newPredicate checks and normalizes a predicate written by a user. It returns a kind
+// of an error if a predicate is invalid
+func newPredicate(field, op, value string) (predicate, ErrorKind) {
+	pred := predicate{field: field, op: op}
+
+	switch field {
+	case fieldType, fieldExt, fieldDeleted, fieldGPS:
+		if op != opEqual {
+			return predicate{}, ErrorInvalidOperator
+		}
+
+		pred.value = strings.ToLower(value)
+		switch {
+		case field == fieldExt && !strings.HasPrefix(pred.value, "."):
+			pred.value = "." + pred.value
+		case (field == fieldDeleted || field == fieldGPS) && pred.value != "true" && pred.value != "false":
+			return predicate{}, ErrorInvalidValue
+		}
+	case fieldSize:
+		if !isComparison(op) {
+			return predicate{}, ErrorInvalidOperator
+		}
+
+		size, ok := parseSize(value)
+		if !ok {
+			return predicate{}, ErrorInvalidValue
+		}
+		pred.value = strconv.FormatInt(size, 10)
+	case fieldWidth, fieldHeight, fieldISO:
+		if !isComparison(op) {
+			return predicate{}, ErrorInvalidOperator
+		}
+
+		n, err := strconv.ParseUint(value, 10, 31)
+		if err != nil {
+			return predicate{}, ErrorInvalidValue
+		}
+		pred.value = strconv.FormatUint(n, 10)
+	case fieldAdded, fieldTaken:
+		if !isComparison(op) {
+			return predicate{}, ErrorInvalidOperator
+		}
+
+		from, to, ok := parseDateRange(op, value)
+		if !ok {
+			return predicate{}, ErrorInvalidValue
+		}
+		// Comparisons are converted into ranges
+		pred.op = opEqual
+		pred.value = formatRange(from, to)
+	case fieldName, fieldDesc, fieldCamera, fieldLens:
+		switch op {
+		case opEqual:
+			pred.value = strings.ToLower(value)
+		case opMatch:
+			if _, err := regexp.Compile(value); err != nil {
+				return predicate{}, ErrorInvalidValue
+			}
+			pred.value = value
+		default:
+			return predicate{}, ErrorInvalidOperator
+		}
+	default:
+		return predicate{}, ErrorUnknownField
+	}
+
+	return pred, ""
+}
+
+func isComparison(op string) bool {
+	switch op {
+	case opEqual, opGreater, opGreaterEqual, opLess, opLessEqual:
+		return true
+	default:
+		return false
+	}
+}
+
+// String returns a predicate in the format of LogicalExpr
+func (p predicate) String() string {
+	return p.field + p.op + strconv.Quote(p.value)
+}
+
+// parsePredicate parses a predicate from LogicalExpr
+func parsePredicate(s string) (predicate, bool) {
+	i := strings.IndexAny(s, ":<>")
+	if i == -1 {
+		return predicate{}, false
+	}
+	j := strings.IndexByte(s, '"')
+	if j < i {
+		return predicate{}, false
+	}
+
+	value, err := strconv.Unquote(s[j:])
+	if err != nil {
+		return predicate{}, false
+	}
+
+	return predicate{field: s[:i], op: s[i:j], value: value}, true
+}
+
+// match checks if a file satisfies a predicate
+func (p predicate) match(f Fields) bool {
+	switch p.field {
+	case fieldType:
+		return strings.ToLower(f.Type) == p.value
+	case fieldExt:
+		return strings.ToLower(f.Ext) == p.value
+	case fieldDeleted:
+		return strconv.FormatBool(f.Deleted) == p.value
+	case fieldGPS:
+		return strconv.FormatBool(f.HasGPS) == p.value
+	case fieldSize:
+		size, _ := strconv.ParseInt(p.value, 10, 64)
+		return compare(f.Size, p.op, size)
+	case fieldWidth:
+		return matchNumber(f.Width, p.op, p.value)
+	case fieldHeight:
+		return matchNumber(f.Height, p.op, p.value)
+	case fieldISO:
+		return matchNumber(f.ISO, p.op, p.value)
+	case fieldAdded:
+		return matchTime(f.AddTime, p.value)
+	case fieldTaken:
+		// Files without the time of capture don't match
+		return !f.TakenAt.IsZero() && matchTime(f.TakenAt, p.value)
+	case fieldName:
+		return matchText(f.Filename, p.op, p.value)
+	case fieldDesc:
+		return matchText(f.Description, p.op, p.value)
+	case fieldCamera:
+		return matchText(f.Camera, p.op, p.value)
+	case fieldLens:
+		return matchText(f.Lens, p.op, p.value)
+	default:
+		return false
+	}
+}
+
+// matchNumber compares a number with a value of a predicate. Unknown (zero) numbers don't match
+func matchNumber(n int, op, value string) bool {
+	if n == 0 {
+		return false
+	}
+
+	v, _ := strconv.ParseInt(value, 10, 64)
+	return compare(int64(n), op, v)
+}
+
+// matchTime checks if t is in a range of a predicate
+func matchTime(t time.Time, value string) bool {
+	from, to := parseRange(value)
+	ns := t.UnixNano()
+	return from <= ns && ns < to
+}
+
+func compare(a int64, op string, b int64) bool {
+	switch op {
+	case opEqual:
+		return a == b
+	case opGreater:
+		return a > b
+	case opGreaterEqual:
+		return a >= b
+	case opLess:
+		return a < b
+	case opLessEqual:
+		return a <= b
+	default:
+		return false
+	}
+}
+
+// regexps is a cache of compiled regular expressions
+var regexps sync.Map
+
+func matchText(text, op, value string) bool {
+	if op != opMatch {
+		return strings.Contains(strings.ToLower(text), value)
+	}
+
+	reg, ok := regexps.Load(value)
+	if !ok {
+		// value was checked during parsing
+		compiled, err := regexp.Compile(value)
+		if err != nil {
+			return false
+		}
+		reg, _ = regexps.LoadOrStore(value, compiled)
+	}
+
+	return reg.(*regexp.Regexp).MatchString(text)
+}
+
+var sizeUnits = []struct {
+	suffix string
+	size   float64
+}{
+	// Longer suffixes must be checked first
+	{"kb", 1 << 10},
+	{"mb", 1 << 20},
+	{"gb", 1 << 30},
+	{"tb", 1 << 40},
+	{"b", 1},
+	{"k", 1 << 10},
+	{"m", 1 << 20},
+	{"g", 1 << 30},
+	{"t", 1 << 40},
+}
+
+// parseSize parses a size with an optional unit: "100", "1.5MB", "10kb"
+func parseSize(s string) (int64, bool) {
+	s = strings.ToLower(s)
+
+	mult := 1.0
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			mult = u.size
+			s = strings.TrimSuffix(s, u.suffix)
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 || math.IsInf(n, 0) || math.IsNaN(n) {
+		return 0, false
+	}
+
+	return int64(n * mult), true
+}
+
+// parseDateRange converts a date (or a range of dates for ':' operator) into a half-open range
+// of Unix time in nanoseconds. Open bounds are math.MinInt64 and math.MaxInt64
+func parseDateRange(op, s string) (from, to int64, ok bool) {
+	from, to = math.MinInt64, math.MaxInt64
+
+	if op == opEqual && strings.Contains(s, rangeSeparator) {
+		bounds := strings.SplitN(s, rangeSeparator, 2)
+		if bounds[0] == "" && bounds[1] == "" {
+			return 0, 0, false
+		}
+
+		if bounds[0] != "" {
+			start, _, ok := parseDate(bounds[0])
+			if !ok {
+				return 0, 0, false
+			}
+			from = start.UnixNano()
+		}
+		if bounds[1] != "" {
+			_, end, ok := parseDate(bounds[1])
+			if !ok {
+				return 0, 0, false
+			}
+			to = end.UnixNano()
+		}
+
+		return from, to, true
+	}
+
+	start, end, ok := parseDate(s)
+	if !ok {
+		return 0, 0, false
+	}
+
+	switch op {
+	case opEqual:
+		from, to = start.UnixNano(), end.UnixNano()
+	case opGreater:
+		from = end.UnixNano()
+	case opGreaterEqual:
+		from = start.UnixNano()
+	case opLess:
+		to = start.UnixNano()
+	case opLessEqual:
+		to = end.UnixNano()
+	}
+
+	return from, to, true
+}
+
+// parseDate parses a year, a month or a day and returns its bounds
+func parseDate(s string) (start, end time.Time, ok bool) {
+	layouts := []struct {
+		layout string
+		years  int
+		months int
+		days   int
+	}{
+		{"2006", 1, 0, 0},
+		{"2006-01", 0, 1, 0},
+		{"2006-01-02", 0, 0, 1},
+	}
+
+	for _, l := range layouts {
+		start, err := time.ParseInLocation(l.layout, s, time.Local)
+		if err == nil {
+			return start, start.AddDate(l.years, l.months, l.days), true
+		}
+	}
+
+	return time.Time{}, time.Time{}, false
+}
+
+func formatRange(from, to int64) string {
+	var b strings.Builder
+	if from != math.MinInt64 {
+		b.WriteString(strconv.FormatInt(from, 10))
+	}
+	b.WriteString(rangeSeparator)
+	if to != math.MaxInt64 {
+		b.WriteString(strconv.FormatInt(to, 10))
+	}
+	return b.String()
+}
+
+func parseRange(s string) (from, to int64) {
+	from, to = math.MinInt64, math.MaxInt64
+
+	bounds := strings.SplitN(s, rangeSeparator, 2)
+	if len(bounds) != 2 {
+		return 0, 0
+	}
+	if bounds[0] != "" {
+		from, _ = strconv.ParseInt(bounds[0], 10, 64)
+	}
+	if bounds[1] != "" {
+		to, _ = strconv.ParseInt(bounds[1], 10, 64)
+	}
+
+	return from, to
+}
@@ -0,0 +1,226 @@
+package aggregation
+
+import (
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// Index gives access to files for evaluation of a Program with set operations.
+// All returned slices must be sorted and mustn't be changed by a caller
+type Index interface {
+	// All returns ids of all files
+	All() []int
+	// Posting returns ids of files with passed tag
+	Posting(tag int) []int
+	// Filter returns ids of files from passed ids which satisfy match
+	Filter(ids []int, match func(Fields) bool) []int
+}
+
+// Program is a compiled logical expression. A nil Program matches all files
+type Program struct {
+	root *node
+}
+
+// Compile compiles an expression in reverse Polish notation received from ParseExpr()
+func Compile(expr LogicalExpr) (*Program, error) {
+	if expr == "" {
+		return nil, nil
+	}
+
+	var stack []*node
+	pop := func() *node {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		return n
+	}
+
+	for _, s := range splitExpr(string(expr)) {
+		switch s {
+		case "!":
+			if len(stack) < 1 {
+				return nil, ErrBadSyntax
+			}
+			stack = append(stack, &node{kind: nodeNot, left: pop()})
+		case "&", "|":
+			if len(stack) < 2 {
+				return nil, ErrBadSyntax
+			}
+			kind := nodeAnd
+			if s == "|" {
+				kind = nodeOr
+			}
+			right := pop()
+			left := pop()
+			stack = append(stack, &node{kind: kind, left: left, right: right})
+		default:
+			if id, err := strconv.Atoi(s); err == nil {
+				stack = append(stack, &node{kind: nodeTag, tags: []int{id}})
+				continue
+			}
+
+			pred, ok := parsePredicate(s)
+			if !ok {
+				return nil, errors.Wrapf(ErrBadSyntax, "invalid term %s", s)
+			}
+			stack = append(stack, &node{kind: nodePredicate, pred: pred})
+		}
+	}
+
+	if len(stack) != 1 {
+		return nil, ErrBadSyntax
+	}
+
+	return &Program{root: stack[0]}, nil
+}
+
+// Match checks if a file satisfies the expression
+func (p *Program) Match(file Fields) bool {
+	if p == nil {
+		return true
+	}
+	return p.root.match(file)
+}
+
+func (n *node) match(file Fields) bool {
+	switch n.kind {
+	case nodeOr:
+		return n.left.match(file) || n.right.match(file)
+	case nodeAnd:
+		return n.left.match(file) && n.right.match(file)
+	case nodeNot:
+		return !n.left.match(file)
+	case nodeTag:
+		for _, id := range n.tags {
+			if has(file.Tags, id) {
+				return true
+			}
+		}
+		return false
+	default:
+		return n.pred.match(file)
+	}
+}
+
+// Eval returns sorted ids of files which satisfy the expression. Tags are resolved with posting
+// lists of the index, so only predicates on other fields need to check files one by one.
+// The returned slice can be shared with the index, it mustn't be changed
+func (p *Program) Eval(idx Index) []int {
+	if p == nil {
+		return idx.All()
+	}
+
+	return p.root.eval(idx, nil, true)
+}
+
+// eval returns ids of files from candidates which satisfy the node. If all is true,
+// candidates are ignored and all files are checked
+func (n *node) eval(idx Index, candidates []int, all bool) []int {
+	switch n.kind {
+	case nodeOr:
+		return union(n.left.eval(idx, candidates, all), n.right.eval(idx, candidates, all))
+	case nodeAnd:
+		first, second := n.left, n.right
+		if second.cost() < first.cost() {
+			first, second = second, first
+		}
+		// The second operand checks only files found by the first one
+		return second.eval(idx, first.eval(idx, candidates, all), false)
+	case nodeNot:
+		if all {
+			candidates = idx.All()
+		}
+		return difference(candidates, n.left.eval(idx, candidates, false))
+	case nodeTag:
+		res := idx.Posting(n.tags[0])
+		for _, id := range n.tags[1:] {
+			res = union(res, idx.Posting(id))
+		}
+		if all {
+			return res
+		}
+		return intersect(candidates, res)
+	default:
+		if all {
+			candidates = idx.All()
+		}
+		return idx.Filter(candidates, n.pred.match)
+	}
+}
+
+// cost is a rough estimation of the node evaluation cost. Posting lists are cheap, predicates are expensive
+func (n *node) cost() int {
+	switch n.kind {
+	case nodeOr:
+		return n.left.cost() + n.right.cost()
+	case nodeAnd:
+		l, r := n.left.cost(), n.right.cost()
+		if l < r {
+			return l
+		}
+		return r
+	case nodeNot:
+		return n.left.cost() + 1
+	case nodeTag:
+		return 1
+	default:
+		return 10
+	}
+}
+
+// Operations on sorted sets. They always return new slices
+
+func union(a, b []int) []int {
+	res := make([]int, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			res = append(res, a[i])
+			i++
+		case a[i] > b[j]:
+			res = append(res, b[j])
+			j++
+		default:
+			res = append(res, a[i])
+			i++
+			j++
+		}
+	}
+	res = append(res, a[i:]...)
+	return append(res, b[j:]...)
+}
+
+func intersect(a, b []int) []int {
+	res := []int{}
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			res = append(res, a[i])
+			i++
+			j++
+		}
+	}
+	return res
+}
+
+// difference returns a \ b
+func difference(a, b []int) []int {
+	res := make([]int, 0, len(a))
+	j := 0
+	for _, id := range a {
+		for j < len(b) && b[j] < id {
+			j++
+		}
+		if j < len(b) && b[j] == id {
+			continue
+		}
+		res = append(res, id)
+	}
+	return res
+}
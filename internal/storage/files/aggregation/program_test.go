@@ -0,0 +1,195 @@
+package aggregation_test
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/tags-drive/core/internal/storage/files/aggregation"
+)
+
+// testIndex implements aggregation.Index. Id of a file is its index in files + 1
+type testIndex struct {
+	files    []aggregation.Fields
+	all      []int
+	postings map[int][]int
+}
+
+func newTestIndex(files []aggregation.Fields) *testIndex {
+	idx := &testIndex{files: files, postings: make(map[int][]int)}
+	for i, f := range files {
+		id := i + 1
+		idx.all = append(idx.all, id)
+		for _, tag := range f.Tags {
+			idx.postings[tag] = append(idx.postings[tag], id)
+		}
+	}
+
+	return idx
+}
+
+func (idx *testIndex) All() []int {
+	return idx.all
+}
+
+func (idx *testIndex) Posting(tag int) []int {
+	return idx.postings[tag]
+}
+
+func (idx *testIndex) Filter(ids []int, match func(aggregation.Fields) bool) []int {
+	res := []int{}
+	for _, id := range ids {
+		if match(idx.files[id-1]) {
+			res = append(res, id)
+		}
+	}
+	return res
+}
+
+// generateFiles returns files with random tags from [1, maxTag] and random sizes
+func generateFiles(n, maxTag int) []aggregation.Fields {
+	r := rand.New(rand.NewSource(1))
+
+	files := make([]aggregation.Fields, n)
+	for i := range files {
+		tags := make(map[int]bool)
+		for j := r.Intn(4); j > 0; j-- {
+			tags[r.Intn(maxTag)+1] = true
+		}
+
+		f := aggregation.Fields{
+			Tags:     []int{},
+			Filename: "file-" + strconv.Itoa(i) + ".txt",
+			Type:     "text",
+			Ext:      ".txt",
+			Size:     r.Int63n(10 << 20),
+			AddTime:  time.Now(),
+		}
+		for tag := range tags {
+			f.Tags = append(f.Tags, tag)
+		}
+		sort.Ints(f.Tags)
+
+		files[i] = f
+	}
+
+	return files
+}
+
+func TestEval(t *testing.T) {
+	files := generateFiles(500, 10)
+	idx := newTestIndex(files)
+
+	exprs := []string{
+		"",
+		"1",
+		"12&!7",
+		"!3",
+		"1 | 2 & !3",
+		"(1 | 2) & (3 | !4)",
+		"!(1 & 2) & (1 | 2)",
+		"size>5MB",
+		"!size>5MB & 5",
+		"(1 | size<1MB) & !name:~\"7$\"",
+		"name:file-1 | 9 & !(10 | size>=2MB)",
+	}
+
+	for _, expr := range exprs {
+		parsed, err := aggregation.ParseLogicalExpr(expr)
+		if err != nil {
+			t.Fatalf("%s: can't parse: %s", expr, err)
+		}
+
+		program, err := aggregation.Compile(parsed)
+		if err != nil {
+			t.Fatalf("%s: can't compile: %s", expr, err)
+		}
+
+		// Check the result of set operations with the result of a scan
+		want := []int{}
+		for i, f := range files {
+			if program.Match(f) {
+				want = append(want, i+1)
+			}
+		}
+
+		got := append([]int{}, program.Eval(idx)...)
+		if !reflect.DeepEqual(want, got) {
+			t.Errorf("%s:\nWant: %v\nGot: %v", expr, want, got)
+		}
+	}
+}
+
+func TestCompile(t *testing.T) {
+	for _, expr := range []aggregation.LogicalExpr{"&", "1 &", "1 2", "1 !!", `name"a"`} {
+		if _, err := aggregation.Compile(expr); err == nil {
+			t.Errorf("%s: Want: error", expr)
+		}
+	}
+}
+
+var benchmarkExprs = []struct {
+	name string
+	expr string
+}{
+	{"Tags", "12&!7"},
+	{"ComplexTags", "(1 | 2 | 3) & !(4 | 5) & 6"},
+	{"Predicates", "12 & size>5MB"},
+}
+
+// BenchmarkScan checks files one by one with a parsed expression (the old way)
+func BenchmarkScan(b *testing.B) {
+	files := generateFiles(50000, 20)
+
+	for _, bb := range benchmarkExprs {
+		expr, _ := aggregation.ParseLogicalExpr(bb.expr)
+		b.Run(bb.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				var res []int
+				for id, f := range files {
+					if aggregation.Match(expr, f) {
+						res = append(res, id+1)
+					}
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkCompiledScan checks files one by one with a compiled expression
+func BenchmarkCompiledScan(b *testing.B) {
+	files := generateFiles(50000, 20)
+
+	for _, bb := range benchmarkExprs {
+		expr, _ := aggregation.ParseLogicalExpr(bb.expr)
+		program, _ := aggregation.Compile(expr)
+		b.Run(bb.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				var res []int
+				for id, f := range files {
+					if program.Match(f) {
+						res = append(res, id+1)
+					}
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkEval uses set operations over posting lists
+func BenchmarkEval(b *testing.B) {
+	idx := newTestIndex(generateFiles(50000, 20))
+
+	for _, bb := range benchmarkExprs {
+		expr, _ := aggregation.ParseLogicalExpr(bb.expr)
+		program, _ := aggregation.Compile(expr)
+		b.Run(bb.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				program.Eval(idx)
+			}
+		})
+	}
+}
@@ -1,2 +1,253 @@
 // Package bs (Binary Storage) provides different ways to keep files
 package bs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/minio/minio-go"
+	"github.com/minio/sio"
+	"github.com/pkg/errors"
+)
+
+// blobsFolder is a folder (or a prefix of objects) for blobs.
+//
+// Blobs are stored by SHA-256 hash of their content, so identical content is stored only once.
+// A blob with hash "abcdef..." is kept as "blobs/ab/abcdef...".
+const blobsFolder = "blobs/"
+
+// thumbnailsFolder is a folder (or a prefix of objects) for thumbnails. It is kept in the resized images
+// folder (or bucket). Thumbnails of a file with id 1 are kept as "thumbs/1/{name}"
+const thumbnailsFolder = "thumbs/"
+
+// uploadsFolder is a folder (or a prefix of objects) for chunks of resumable uploads. A chunk of an upload
+// "abc..." which starts at offset 1024 is kept as "uploads/abc.../00000000000000001024"
+const uploadsFolder = "uploads/"
+
+// tempBlobPrefix is a prefix of temporary files (or objects) created during saving of blobs
+const tempBlobPrefix = blobsFolder + "tmp-"
+
+// Errors
+var (
+	// ErrInvalidHash is returned when a passed hash isn't a hex-encoded SHA-256 hash
+	ErrInvalidHash = errors.New("invalid hash")
+	// ErrNotTemporaryFile is returned when a passed name isn't a name of a temporary file
+	ErrNotTemporaryFile = errors.New("not a temporary file")
+	// ErrInvalidThumbnailName is returned when a name of a thumbnail is empty or contains slashes
+	ErrInvalidThumbnailName = errors.New("invalid thumbnail name")
+	// ErrInvalidUploadID is returned when an id of an upload isn't a hex string of 32 characters
+	ErrInvalidUploadID = errors.New("invalid upload id")
+)
+
+func getBlobName(hash string) (string, error) {
+	if _, err := hex.DecodeString(hash); err != nil || len(hash) != sha256.Size*2 {
+		return "", ErrInvalidHash
+	}
+
+	return blobsFolder + hash[:2] + "/" + hash, nil
+}
+
+func getThumbnailsPrefix(fileID int) string {
+	return thumbnailsFolder + strconv.Itoa(fileID) + "/"
+}
+
+func getThumbnailName(fileID int, name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", ErrInvalidThumbnailName
+	}
+
+	return getThumbnailsPrefix(fileID) + name, nil
+}
+
+func isValidUploadID(uploadID string) bool {
+	_, err := hex.DecodeString(uploadID)
+	return err == nil && len(uploadID) == 32
+}
+
+func getUploadPrefix(uploadID string) (string, error) {
+	if !isValidUploadID(uploadID) {
+		return "", ErrInvalidUploadID
+	}
+
+	return uploadsFolder + uploadID + "/", nil
+}
+
+func getUploadChunkName(uploadID string, offset int64) (string, error) {
+	prefix, err := getUploadPrefix(uploadID)
+	if err != nil {
+		return "", err
+	}
+
+	// Offsets are padded, so chunks are listed in order
+	return prefix + fmt.Sprintf("%020d", offset), nil
+}
+
+// hashingReader computes SHA-256 hash of all read data
+type hashingReader struct {
+	r      io.Reader
+	hasher hash.Hash
+}
+
+func newHashingReader(r io.Reader) *hashingReader {
+	hasher := sha256.New()
+	return &hashingReader{
+		r:      io.TeeReader(r, hasher),
+		hasher: hasher,
+	}
+}
+
+func (hr *hashingReader) Read(p []byte) (int, error) {
+	return hr.r.Read(p)
+}
+
+// Hash returns hex-encoded hash of read data
+func (hr *hashingReader) Hash() string {
+	return hex.EncodeToString(hr.hasher.Sum(nil))
+}
+
+// IsNotExist checks if an error was returned because a file (or an object) doesn't exist
+func IsNotExist(err error) bool {
+	err = errors.Cause(err)
+	if os.IsNotExist(err) {
+		return true
+	}
+
+	code := minio.ToErrorResponse(err).Code
+	return code == "NoSuchKey" || code == "NoSuchBucket"
+}
+
+// IsCorrupted checks if an error was returned because encrypted data is damaged
+func IsCorrupted(err error) bool {
+	_, ok := errors.Cause(err).(sio.Error)
+	return ok
+}
+
+// Inventory contains all files (or objects) kept in Binary Storage
+type Inventory struct {
+	// Blobs contains hashes of blobs
+	Blobs []string
+	// Files contains ids of files stored by id
+	Files []int
+	// Revisions contains archived revisions of files stored by id
+	Revisions []ArchivedRevision
+	// ResizedImages contains ids of files with resized images
+	ResizedImages []int
+	// Thumbnails contains ids of files with thumbnails. Every id is added once
+	Thumbnails []int
+	// Uploads contains ids of resumable uploads with stored chunks. Every id is added once
+	Uploads []string
+	// TemporaryFiles contains names of temporary files left after failed saving of blobs
+	TemporaryFiles []string
+	// Unknown contains names of files which weren't created by Binary Storage
+	Unknown []string
+}
+
+// ArchivedRevision is an old revision of a file stored by id
+type ArchivedRevision struct {
+	FileID   int
+	Revision int
+}
+
+// add classifies a file by its name. Name must be relative to the data (or resized images)
+// folder or bucket and use slashes as separators
+func (inv *Inventory) add(name string, resized bool) {
+	if resized {
+		if strings.HasPrefix(name, thumbnailsFolder) {
+			inv.addThumbnail(name)
+			return
+		}
+
+		if id, err := strconv.Atoi(name); err == nil {
+			inv.ResizedImages = append(inv.ResizedImages, id)
+		} else {
+			inv.Unknown = append(inv.Unknown, name)
+		}
+		return
+	}
+
+	if isTemporaryFile(name) {
+		inv.TemporaryFiles = append(inv.TemporaryFiles, name)
+		return
+	}
+
+	if strings.HasPrefix(name, uploadsFolder) {
+		inv.addUploadChunk(name)
+		return
+	}
+
+	if strings.HasPrefix(name, blobsFolder) {
+		hash := name[strings.LastIndex(name, "/")+1:]
+		if blobName, err := getBlobName(hash); err == nil && blobName == name {
+			inv.Blobs = append(inv.Blobs, hash)
+		} else {
+			inv.Unknown = append(inv.Unknown, name)
+		}
+		return
+	}
+
+	if id, err := strconv.Atoi(name); err == nil {
+		inv.Files = append(inv.Files, id)
+		return
+	}
+
+	// Check for an archived revision "{id}.{revision}"
+	if i := strings.Index(name, "."); i != -1 {
+		id, err1 := strconv.Atoi(name[:i])
+		rev, err2 := strconv.Atoi(name[i+1:])
+		if err1 == nil && err2 == nil {
+			inv.Revisions = append(inv.Revisions, ArchivedRevision{FileID: id, Revision: rev})
+			return
+		}
+	}
+
+	inv.Unknown = append(inv.Unknown, name)
+}
+
+// addThumbnail classifies a file in the thumbnails folder
+func (inv *Inventory) addThumbnail(name string) {
+	parts := strings.Split(strings.TrimPrefix(name, thumbnailsFolder), "/")
+	if len(parts) != 2 || parts[1] == "" {
+		inv.Unknown = append(inv.Unknown, name)
+		return
+	}
+
+	id, err := strconv.Atoi(parts[0])
+	if err != nil {
+		inv.Unknown = append(inv.Unknown, name)
+		return
+	}
+
+	// Thumbnails are listed in lexical order, so thumbnails of a file go one after another
+	if n := len(inv.Thumbnails); n == 0 || inv.Thumbnails[n-1] != id {
+		inv.Thumbnails = append(inv.Thumbnails, id)
+	}
+}
+
+// addUploadChunk classifies a file in the uploads folder
+func (inv *Inventory) addUploadChunk(name string) {
+	parts := strings.Split(strings.TrimPrefix(name, uploadsFolder), "/")
+	if len(parts) != 2 || !isValidUploadID(parts[0]) {
+		inv.Unknown = append(inv.Unknown, name)
+		return
+	}
+	if _, err := strconv.ParseInt(parts[1], 10, 64); err != nil {
+		inv.Unknown = append(inv.Unknown, name)
+		return
+	}
+
+	// Chunks of an upload go one after another
+	id := parts[0]
+	if n := len(inv.Uploads); n == 0 || inv.Uploads[n-1] != id {
+		inv.Uploads = append(inv.Uploads, id)
+	}
+}
+
+func isTemporaryFile(name string) bool {
+	return strings.HasPrefix(name, tempBlobPrefix) && !strings.Contains(name[len(blobsFolder):], "/")
+}
@@ -2,7 +2,9 @@ package bs
 
 import (
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 
@@ -32,6 +34,10 @@ func NewDiskStorage(cnf DiskStorageConfig) (*DiskStorage, error) {
 		return nil, errors.Wrap(err, "can't create ResizedImagesFolder")
 	}
 
+	if err := os.MkdirAll(filepath.Join(cnf.DataFolder, blobsFolder), 0700); err != nil {
+		return nil, errors.Wrap(err, "can't create a folder for blobs")
+	}
+
 	// Normalize paths
 	if !strings.HasSuffix(cnf.DataFolder, "/") {
 		cnf.DataFolder += "/"
@@ -46,8 +52,11 @@ func NewDiskStorage(cnf DiskStorageConfig) (*DiskStorage, error) {
 }
 
 func (ds DiskStorage) GetFile(w io.Writer, fileID int, resized bool) error {
-	path := ds.getFilePath(fileID, resized)
+	return ds.copyFile(w, ds.getFilePath(fileID, resized))
+}
 
+// copyFile decrypts (if needed) a file and writes it into passed io.Writer
+func (ds DiskStorage) copyFile(w io.Writer, path string) error {
 	f, err := os.Open(path)
 	if err != nil {
 		return errors.Wrapf(err, "can't open the file '%s'", path)
@@ -83,22 +92,33 @@ func (ds DiskStorage) GetFileStats(fileID int) (os.FileInfo, error) {
 }
 
 func (ds DiskStorage) SaveFile(r io.Reader, fileID int, fileSize int64, resized bool) error {
-	path := ds.getFilePath(fileID, resized)
+	return ds.writeFile(r, ds.getFilePath(fileID, resized))
+}
 
+// writeFile encrypts (if needed) data and writes it into a file
+func (ds DiskStorage) writeFile(r io.Reader, path string) error {
 	f, err := os.Create(path)
 	if err != nil {
 		return errors.Wrapf(err, "can't create a new file '%s'", path)
 	}
-	// TODO: delete file if an error occurred?
-	defer f.Close()
 
 	if ds.config.Encrypt {
-		_, err := sio.Encrypt(f, r, sio.Config{Key: ds.config.PassPhrase[:]})
-		return errors.Wrapf(err, "can't encrypt a file '%s'", err)
+		_, err = sio.Encrypt(f, r, sio.Config{Key: ds.config.PassPhrase[:]})
+		err = errors.Wrapf(err, "can't encrypt a file '%s'", path)
+	} else {
+		_, err = io.Copy(f, r)
+		err = errors.Wrapf(err, "can't copy io.Reader into a file '%s'", path)
+	}
+	if closeErr := f.Close(); err == nil && closeErr != nil {
+		err = errors.Wrapf(closeErr, "can't close a file '%s'", path)
+	}
+	if err != nil {
+		// Don't leave a partial file
+		os.Remove(path)
+		return err
 	}
 
-	_, err = io.Copy(f, r)
-	return errors.Wrapf(err, "can't copy io.Reader into a file '%s'", err)
+	return nil
 }
 
 func (ds DiskStorage) DeleteFile(fileID int, resized bool) error {
@@ -106,6 +126,271 @@ func (ds DiskStorage) DeleteFile(fileID int, resized bool) error {
 	return os.Remove(path)
 }
 
+// SaveThumbnail saves a thumbnail of a file
+func (ds DiskStorage) SaveThumbnail(r io.Reader, size int64, fileID int, name string) error {
+	name, err := getThumbnailName(fileID, name)
+	if err != nil {
+		return err
+	}
+	path := ds.config.ResizedImagesFolder + name
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return errors.Wrapf(err, "can't create a folder for the thumbnail '%s'", path)
+	}
+
+	return ds.writeFile(r, path)
+}
+
+// GetThumbnail writes a thumbnail of a file into passed io.Writer
+func (ds DiskStorage) GetThumbnail(w io.Writer, fileID int, name string) error {
+	name, err := getThumbnailName(fileID, name)
+	if err != nil {
+		return err
+	}
+
+	return ds.copyFile(w, ds.config.ResizedImagesFolder+name)
+}
+
+// DeleteThumbnails deletes all thumbnails of a file
+func (ds DiskStorage) DeleteThumbnails(fileID int) error {
+	path := ds.config.ResizedImagesFolder + getThumbnailsPrefix(fileID)
+
+	err := os.RemoveAll(path)
+	return errors.Wrapf(err, "can't delete the folder '%s'", path)
+}
+
+// SaveUploadChunk saves a chunk of a resumable upload
+func (ds DiskStorage) SaveUploadChunk(r io.Reader, size int64, uploadID string, offset int64) error {
+	name, err := getUploadChunkName(uploadID, offset)
+	if err != nil {
+		return err
+	}
+	path := ds.config.DataFolder + name
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return errors.Wrapf(err, "can't create a folder for the chunk '%s'", path)
+	}
+
+	return ds.writeFile(r, path)
+}
+
+// GetUploadChunk writes a chunk of a resumable upload into passed io.Writer
+func (ds DiskStorage) GetUploadChunk(w io.Writer, uploadID string, offset int64) error {
+	name, err := getUploadChunkName(uploadID, offset)
+	if err != nil {
+		return err
+	}
+
+	return ds.copyFile(w, ds.config.DataFolder+name)
+}
+
+// DeleteUpload deletes all chunks of a resumable upload
+func (ds DiskStorage) DeleteUpload(uploadID string) error {
+	prefix, err := getUploadPrefix(uploadID)
+	if err != nil {
+		return err
+	}
+	path := ds.config.DataFolder + prefix
+
+	err = os.RemoveAll(path)
+	return errors.Wrapf(err, "can't delete the folder '%s'", path)
+}
+
+// SaveBlob saves content and returns its SHA-256 hash. If a blob with the same hash already exists,
+// the new copy is discarded
+func (ds DiskStorage) SaveBlob(r io.Reader, size int64) (hash string, err error) {
+	// Content is written into a temporary file at first, because the hash is unknown till the end
+	tmpFile, err := ioutil.TempFile(ds.config.DataFolder+blobsFolder, "tmp-*")
+	if err != nil {
+		return "", errors.Wrap(err, "can't create a temporary file")
+	}
+	tmpPath := tmpFile.Name()
+
+	hr := newHashingReader(r)
+	if ds.config.Encrypt {
+		_, err = sio.Encrypt(tmpFile, hr, sio.Config{Key: ds.config.PassPhrase[:]})
+	} else {
+		_, err = io.Copy(tmpFile, hr)
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return "", errors.Wrapf(err, "can't write a temporary file '%s'", tmpPath)
+	}
+
+	hash = hr.Hash()
+	path, _ := ds.getBlobPath(hash)
+
+	if _, err := os.Stat(path); err == nil {
+		// Content is already stored
+		os.Remove(tmpPath)
+		return hash, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		os.Remove(tmpPath)
+		return "", errors.Wrapf(err, "can't create a folder for the blob '%s'", path)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return "", errors.Wrapf(err, "can't rename '%s' to '%s'", tmpPath, path)
+	}
+
+	return hash, nil
+}
+
+// GetBlob writes a blob into passed io.Writer
+func (ds DiskStorage) GetBlob(w io.Writer, hash string) error {
+	path, err := ds.getBlobPath(hash)
+	if err != nil {
+		return err
+	}
+
+	return ds.copyFile(w, path)
+}
+
+func (ds DiskStorage) GetBlobStats(hash string) (os.FileInfo, error) {
+	path, err := ds.getBlobPath(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	stats, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't get stats of the blob '%s'", path)
+	}
+
+	return stats, nil
+}
+
+func (ds DiskStorage) DeleteBlob(hash string) error {
+	path, err := ds.getBlobPath(hash)
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+func (ds DiskStorage) getBlobPath(hash string) (string, error) {
+	name, err := getBlobName(hash)
+	if err != nil {
+		return "", err
+	}
+
+	return ds.config.DataFolder + name, nil
+}
+
+// ArchiveFile copies the current version of a file into the archive of revisions
+func (ds DiskStorage) ArchiveFile(fileID, revision int) error {
+	src := ds.getFilePath(fileID, false)
+	dst := ds.getRevisionPath(fileID, revision)
+
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return errors.Wrapf(err, "can't open the file '%s'", src)
+	}
+	defer srcFile.Close()
+
+	dstFile, err := os.Create(dst)
+	if err != nil {
+		return errors.Wrapf(err, "can't create a new file '%s'", dst)
+	}
+	defer dstFile.Close()
+
+	// Copy data as is: it is already encrypted if needed
+	if _, err := io.Copy(dstFile, srcFile); err != nil {
+		os.Remove(dst)
+		return errors.Wrapf(err, "can't copy the file '%s' into '%s'", src, dst)
+	}
+
+	return nil
+}
+
+// GetFileRevision writes an archived revision of a file into passed io.Writer
+func (ds DiskStorage) GetFileRevision(w io.Writer, fileID, revision int) error {
+	return ds.copyFile(w, ds.getRevisionPath(fileID, revision))
+}
+
+// DeleteFileRevision deletes an archived revision of a file
+func (ds DiskStorage) DeleteFileRevision(fileID, revision int) error {
+	return os.Remove(ds.getRevisionPath(fileID, revision))
+}
+
+// getRevisionPath returns path of an archived revision. Revisions are kept next to original files
+func (ds DiskStorage) getRevisionPath(id, revision int) string {
+	return ds.config.DataFolder + strconv.Itoa(id) + "." + strconv.Itoa(revision)
+}
+
+// Inventory returns all files kept in DataFolder and ResizedImagesFolder
+func (ds DiskStorage) Inventory() (Inventory, error) {
+	var inv Inventory
+
+	walk := func(root string, resized bool) error {
+		return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if info.IsDir() {
+				if !resized && filepath.Clean(path) == filepath.Clean(ds.config.ResizedImagesFolder) {
+					// ResizedImagesFolder can be inside DataFolder
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			name, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			inv.add(filepath.ToSlash(name), resized)
+
+			return nil
+		})
+	}
+
+	if err := walk(ds.config.DataFolder, false); err != nil {
+		return Inventory{}, errors.Wrapf(err, "can't walk the folder '%s'", ds.config.DataFolder)
+	}
+	if err := walk(ds.config.ResizedImagesFolder, true); err != nil {
+		return Inventory{}, errors.Wrapf(err, "can't walk the folder '%s'", ds.config.ResizedImagesFolder)
+	}
+
+	return inv, nil
+}
+
+// ResizedImagesSize returns the total size of files kept in ResizedImagesFolder (resized images and thumbnails)
+func (ds DiskStorage) ResizedImagesSize() (int64, error) {
+	var size int64
+	err := filepath.Walk(ds.config.ResizedImagesFolder, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "can't walk the folder '%s'", ds.config.ResizedImagesFolder)
+	}
+
+	return size, nil
+}
+
+// DeleteTemporaryFile deletes a temporary file returned by Inventory
+func (ds DiskStorage) DeleteTemporaryFile(name string) error {
+	if !isTemporaryFile(name) {
+		return ErrNotTemporaryFile
+	}
+
+	return os.Remove(ds.config.DataFolder + name)
+}
+
 func (ds DiskStorage) getFilePath(id int, resized bool) string {
 	path := ds.config.DataFolder
 	if resized {
@@ -2,8 +2,11 @@ package bs_test
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
 	"testing"
 
@@ -246,6 +249,291 @@ func TestDiskStorage_DeleteFile(t *testing.T) {
 	}
 }
 
+func TestDiskStorage_Blobs(t *testing.T) {
+	for _, encrypt := range []bool{false, true} {
+		func() {
+			defer clearDisk()
+
+			assert := assert.New(t)
+
+			passPhrase := generatePassPhrase()
+			storage, err := bs.NewDiskStorage(bs.DiskStorageConfig{
+				DataFolder:          dataFolder,
+				ResizedImagesFolder: resizedImagesFolder,
+				Encrypt:             encrypt,
+				PassPhrase:          passPhrase,
+			})
+			if !assert.Nil(err) {
+				assert.FailNow("can't create a new DiskStorage")
+			}
+
+			data := generateRandomData(1024)
+			sum := sha256.Sum256(data)
+			wantHash := hex.EncodeToString(sum[:])
+
+			// Save the same content twice
+			for i := 0; i < 2; i++ {
+				hash, err := storage.SaveBlob(bytes.NewReader(data), int64(len(data)))
+				if !assert.Nilf(err, "encrypt: %t: can't save a blob", encrypt) {
+					assert.FailNow("can't save a blob. Fail now")
+				}
+				assert.Equalf(wantHash, hash, "encrypt: %t: wrong hash", encrypt)
+			}
+
+			// Content must be stored once. There must be no temporary files
+			var blobs []string
+			filepath.Walk(dataFolder+"/blobs", func(path string, info os.FileInfo, err error) error {
+				if err == nil && !info.IsDir() {
+					blobs = append(blobs, path)
+				}
+				return nil
+			})
+			assert.Equalf([]string{dataFolder + "/blobs/" + wantHash[:2] + "/" + wantHash}, blobs, "encrypt: %t", encrypt)
+			assert.Truef(checkFileOnDisk(blobs[0], data, encrypt, passPhrase[:]), "encrypt: %t: wrong content on disk", encrypt)
+
+			buff := &bytes.Buffer{}
+			assert.Nil(storage.GetBlob(buff, wantHash))
+			assert.Truef(bytes.Equal(data, buff.Bytes()), "encrypt: %t: get wrong content", encrypt)
+
+			// Delete the blob
+			assert.Nil(storage.DeleteBlob(wantHash))
+			assert.NotNil(storage.GetBlob(&bytes.Buffer{}, wantHash))
+
+			// Invalid hashes
+			assert.Equal(bs.ErrInvalidHash, storage.GetBlob(&bytes.Buffer{}, "../../secret"))
+			assert.Equal(bs.ErrInvalidHash, storage.DeleteBlob(""))
+		}()
+	}
+}
+
+func TestDiskStorage_FileRevisions(t *testing.T) {
+	for _, encrypt := range []bool{false, true} {
+		func() {
+			defer clearDisk()
+
+			assert := assert.New(t)
+
+			storage, err := bs.NewDiskStorage(bs.DiskStorageConfig{
+				DataFolder:          dataFolder,
+				ResizedImagesFolder: resizedImagesFolder,
+				Encrypt:             encrypt,
+				PassPhrase:          generatePassPhrase(),
+			})
+			if !assert.Nil(err) {
+				assert.FailNow("can't create a new DiskStorage")
+			}
+
+			revisions := [][]byte{generateRandomData(512), generateRandomData(256), generateRandomData(1024)}
+
+			// Save and archive every revision
+			for i, data := range revisions {
+				err := storage.SaveFile(bytes.NewReader(data), 1, int64(len(data)), false)
+				if !assert.Nilf(err, "encrypt: %t, revision #%d: can't save a file", encrypt, i+1) {
+					assert.FailNow("can't save a file. Fail now")
+				}
+
+				err = storage.ArchiveFile(1, i+1)
+				assert.Nilf(err, "encrypt: %t, revision #%d: can't archive a file", encrypt, i+1)
+			}
+
+			// Check archived revisions
+			for i, data := range revisions {
+				buff := &bytes.Buffer{}
+				err := storage.GetFileRevision(buff, 1, i+1)
+				if !assert.Nilf(err, "encrypt: %t, revision #%d: can't get a revision", encrypt, i+1) {
+					continue
+				}
+				assert.Truef(bytes.Equal(data, buff.Bytes()), "encrypt: %t, revision #%d: get wrong content", encrypt, i+1)
+			}
+
+			// The current file mustn't be changed
+			buff := &bytes.Buffer{}
+			assert.Nil(storage.GetFile(buff, 1, false))
+			assert.True(bytes.Equal(revisions[len(revisions)-1], buff.Bytes()))
+
+			// Delete a revision
+			assert.Nil(storage.DeleteFileRevision(1, 1))
+			assert.NotNil(storage.GetFileRevision(&bytes.Buffer{}, 1, 1))
+			assert.NotNil(storage.DeleteFileRevision(1, 1))
+
+			// Archive a non-existent file
+			assert.NotNil(storage.ArchiveFile(-1, 1))
+		}()
+	}
+}
+
+func TestDiskStorage_Inventory(t *testing.T) {
+	defer clearDisk()
+
+	assert := assert.New(t)
+
+	storage, err := bs.NewDiskStorage(bs.DiskStorageConfig{
+		DataFolder:          dataFolder,
+		ResizedImagesFolder: resizedImagesFolder,
+	})
+	if !assert.Nil(err) {
+		assert.FailNow("can't create a new DiskStorage")
+	}
+
+	data := generateRandomData(256)
+	hash, err := storage.SaveBlob(bytes.NewReader(data), int64(len(data)))
+	assert.Nil(err)
+	assert.Nil(storage.SaveFile(bytes.NewReader(data), 1, int64(len(data)), false))
+	assert.Nil(storage.ArchiveFile(1, 2))
+	assert.Nil(storage.SaveFile(bytes.NewReader(data), 3, int64(len(data)), true))
+	assert.Nil(storage.SaveThumbnail(bytes.NewReader(data), int64(len(data)), 3, "256-fit-1"))
+	assert.Nil(storage.SaveThumbnail(bytes.NewReader(data), int64(len(data)), 3, "512-crop-1"))
+	assert.Nil(storage.SaveUploadChunk(bytes.NewReader(data), int64(len(data)), testUploadID, 0))
+	assert.Nil(storage.SaveUploadChunk(bytes.NewReader(data), int64(len(data)), testUploadID, 256))
+
+	// Files left after a crash and files created by a user
+	assert.Nil(ioutil.WriteFile(filepath.Join(dataFolder, "blobs", "tmp-123"), data, 0600))
+	assert.Nil(ioutil.WriteFile(filepath.Join(dataFolder, "notes.txt"), data, 0600))
+
+	inv, err := storage.Inventory()
+	if !assert.Nil(err) {
+		assert.FailNow("can't get the inventory")
+	}
+
+	assert.Equal([]string{hash}, inv.Blobs)
+	assert.Equal([]int{1}, inv.Files)
+	assert.Equal([]bs.ArchivedRevision{{FileID: 1, Revision: 2}}, inv.Revisions)
+	assert.Equal([]int{3}, inv.ResizedImages)
+	assert.Equal([]int{3}, inv.Thumbnails)
+	assert.Equal([]string{testUploadID}, inv.Uploads)
+	assert.Equal([]string{"blobs/tmp-123"}, inv.TemporaryFiles)
+	assert.Equal([]string{"notes.txt"}, inv.Unknown)
+
+	// Delete the temporary file
+	assert.Nil(storage.DeleteTemporaryFile("blobs/tmp-123"))
+	assert.Equal(bs.ErrNotTemporaryFile, storage.DeleteTemporaryFile("notes.txt"))
+
+	inv, err = storage.Inventory()
+	assert.Nil(err)
+	assert.Empty(inv.TemporaryFiles)
+}
+
+func TestDiskStorage_Thumbnails(t *testing.T) {
+	defer clearDisk()
+
+	assert := assert.New(t)
+
+	cnf := bs.DiskStorageConfig{
+		DataFolder:          dataFolder,
+		ResizedImagesFolder: resizedImagesFolder,
+		Encrypt:             true,
+		PassPhrase:          generatePassPhrase(),
+	}
+	storage, err := bs.NewDiskStorage(cnf)
+	if !assert.Nil(err) {
+		assert.FailNow("can't create a new DiskStorage")
+	}
+
+	data := generateRandomData(512)
+	assert.Nil(storage.SaveThumbnail(bytes.NewReader(data), int64(len(data)), 1, "256-fit-1"))
+	assert.Nil(storage.SaveThumbnail(bytes.NewReader(data), int64(len(data)), 2, "256-fit-1"))
+
+	path := resizedImagesFolder + "/thumbs/1/256-fit-1"
+	assert.True(checkFileOnDisk(path, data, true, cnf.PassPhrase[:]), "files are not equal")
+
+	buff := &bytes.Buffer{}
+	assert.Nil(storage.GetThumbnail(buff, 1, "256-fit-1"))
+	assert.Equal(data, buff.Bytes())
+
+	err = storage.GetThumbnail(&bytes.Buffer{}, 1, "512-fit-1")
+	assert.True(bs.IsNotExist(err))
+
+	for _, name := range []string{"", "..", "../2/256-fit-1"} {
+		assert.Equal(bs.ErrInvalidThumbnailName, storage.SaveThumbnail(bytes.NewReader(data), int64(len(data)), 1, name))
+		assert.Equal(bs.ErrInvalidThumbnailName, storage.GetThumbnail(&bytes.Buffer{}, 1, name))
+	}
+
+	// Thumbnails of other files are kept
+	assert.Nil(storage.DeleteThumbnails(1))
+	assert.Nil(storage.DeleteThumbnails(1))
+
+	err = storage.GetThumbnail(&bytes.Buffer{}, 1, "256-fit-1")
+	assert.True(bs.IsNotExist(err))
+	assert.Nil(storage.GetThumbnail(&bytes.Buffer{}, 2, "256-fit-1"))
+}
+
+func TestDiskStorage_ResizedImagesSize(t *testing.T) {
+	defer clearDisk()
+
+	assert := assert.New(t)
+
+	cnf := bs.DiskStorageConfig{
+		DataFolder:          dataFolder,
+		ResizedImagesFolder: resizedImagesFolder,
+	}
+	storage, err := bs.NewDiskStorage(cnf)
+	if !assert.Nil(err) {
+		assert.FailNow("can't create a new DiskStorage")
+	}
+
+	size, err := storage.ResizedImagesSize()
+	assert.Nil(err)
+	assert.Equal(int64(0), size)
+
+	data := generateRandomData(512)
+	assert.Nil(storage.SaveFile(bytes.NewReader(data), 1, int64(len(data)), true))
+	assert.Nil(storage.SaveThumbnail(bytes.NewReader(data), int64(len(data)), 1, "256-fit-1"))
+	assert.Nil(storage.SaveThumbnail(bytes.NewReader(data[:100]), 100, 2, "256-fit-1"))
+	// Original files aren't counted
+	_, err = storage.SaveBlob(bytes.NewReader(data), int64(len(data)))
+	assert.Nil(err)
+
+	size, err = storage.ResizedImagesSize()
+	assert.Nil(err)
+	assert.Equal(int64(512+512+100), size)
+}
+
+const testUploadID = "0123456789abcdef0123456789abcdef"
+
+func TestDiskStorage_Uploads(t *testing.T) {
+	defer clearDisk()
+
+	assert := assert.New(t)
+
+	cnf := bs.DiskStorageConfig{
+		DataFolder:          dataFolder,
+		ResizedImagesFolder: resizedImagesFolder,
+		Encrypt:             true,
+		PassPhrase:          generatePassPhrase(),
+	}
+	storage, err := bs.NewDiskStorage(cnf)
+	if !assert.Nil(err) {
+		assert.FailNow("can't create a new DiskStorage")
+	}
+
+	first := generateRandomData(100)
+	second := generateRandomData(50)
+	assert.Nil(storage.SaveUploadChunk(bytes.NewReader(first), -1, testUploadID, 0))
+	assert.Nil(storage.SaveUploadChunk(bytes.NewReader(second), -1, testUploadID, 100))
+
+	path := dataFolder + "/uploads/" + testUploadID + "/00000000000000000100"
+	assert.True(checkFileOnDisk(path, second, true, cnf.PassPhrase[:]), "files are not equal")
+
+	buff := &bytes.Buffer{}
+	assert.Nil(storage.GetUploadChunk(buff, testUploadID, 0))
+	assert.Equal(first, buff.Bytes())
+
+	err = storage.GetUploadChunk(&bytes.Buffer{}, testUploadID, 50)
+	assert.True(bs.IsNotExist(err))
+
+	for _, id := range []string{"", "..", "../../blobs", "0123456789abcdef"} {
+		assert.Equal(bs.ErrInvalidUploadID, storage.SaveUploadChunk(bytes.NewReader(first), -1, id, 0))
+		assert.Equal(bs.ErrInvalidUploadID, storage.GetUploadChunk(&bytes.Buffer{}, id, 0))
+		assert.Equal(bs.ErrInvalidUploadID, storage.DeleteUpload(id))
+	}
+
+	assert.Nil(storage.DeleteUpload(testUploadID))
+	assert.Nil(storage.DeleteUpload(testUploadID))
+
+	err = storage.GetUploadChunk(&bytes.Buffer{}, testUploadID, 0)
+	assert.True(bs.IsNotExist(err))
+}
+
 // clear removes test folders
 func clearDisk() {
 	os.RemoveAll(testFolder)
@@ -1,6 +1,7 @@
 package bs
 
 import (
+	"bytes"
 	"io"
 	"os"
 	"strconv"
@@ -8,8 +9,14 @@ import (
 
 	"github.com/minio/minio-go"
 	"github.com/pkg/errors"
+
+	"github.com/tags-drive/core/internal/utils"
 )
 
+// s3PartSize is a size of parts of objects with unknown size. Every part is kept in memory before uploading,
+// so it limits memory used by a single upload. It can't be less than 5MB (S3 limit)
+const s3PartSize = 16 << 20 // 16MB
+
 type S3Storage struct {
 	client *minio.Client
 
@@ -94,6 +101,11 @@ func (s3 S3Storage) GetFile(w io.Writer, fileID int, resized bool) error {
 		bucket = s3.config.ResizedImagesBucket
 	}
 
+	return s3.copyObject(w, bucket, objectName)
+}
+
+// copyObject writes an object into passed io.Writer
+func (s3 S3Storage) copyObject(w io.Writer, bucket, objectName string) error {
 	obj, err := s3.client.GetObject(bucket, objectName, minio.GetObjectOptions{})
 	if err != nil {
 		return errors.Wrapf(err, "can't get an object '%s/%s'", bucket, objectName)
@@ -142,6 +154,302 @@ func (s3 S3Storage) DeleteFile(fileID int, resized bool) error {
 	return errors.Wrapf(err, "can't remove an object '%s/%s'", bucket, objectName)
 }
 
+// SaveThumbnail saves a thumbnail of a file
+func (s3 S3Storage) SaveThumbnail(r io.Reader, size int64, fileID int, name string) error {
+	objectName, err := getThumbnailName(fileID, name)
+	if err != nil {
+		return err
+	}
+
+	_, err = s3.client.PutObject(s3.config.ResizedImagesBucket, objectName, r, size, minio.PutObjectOptions{})
+	return errors.Wrap(err, "can't put an object")
+}
+
+// GetThumbnail writes a thumbnail of a file into passed io.Writer
+func (s3 S3Storage) GetThumbnail(w io.Writer, fileID int, name string) error {
+	objectName, err := getThumbnailName(fileID, name)
+	if err != nil {
+		return err
+	}
+
+	return s3.copyObject(w, s3.config.ResizedImagesBucket, objectName)
+}
+
+// DeleteThumbnails deletes all thumbnails of a file
+func (s3 S3Storage) DeleteThumbnails(fileID int) error {
+	bucket := s3.config.ResizedImagesBucket
+
+	done := make(chan struct{})
+	defer close(done)
+
+	for obj := range s3.client.ListObjects(bucket, getThumbnailsPrefix(fileID), true, done) {
+		if obj.Err != nil {
+			return errors.Wrapf(obj.Err, "can't list objects of the bucket '%s'", bucket)
+		}
+
+		if err := s3.client.RemoveObject(bucket, obj.Key); err != nil {
+			return errors.Wrapf(err, "can't remove an object '%s/%s'", bucket, obj.Key)
+		}
+	}
+
+	return nil
+}
+
+// SaveUploadChunk saves a chunk of a resumable upload. Every chunk is kept as a separate object, because
+// parts of S3 multipart uploads can't be smaller than 5MB. Size can be -1 if it is unknown
+func (s3 S3Storage) SaveUploadChunk(r io.Reader, size int64, uploadID string, offset int64) error {
+	objectName, err := getUploadChunkName(uploadID, offset)
+	if err != nil {
+		return err
+	}
+	bucket := s3.config.DataBucket
+
+	if size < 0 {
+		err = s3.putObjectStream(bucket, objectName, r)
+	} else {
+		_, err = s3.client.PutObject(bucket, objectName, r, size, minio.PutObjectOptions{})
+	}
+	return errors.Wrap(err, "can't put an object")
+}
+
+// GetUploadChunk writes a chunk of a resumable upload into passed io.Writer
+func (s3 S3Storage) GetUploadChunk(w io.Writer, uploadID string, offset int64) error {
+	objectName, err := getUploadChunkName(uploadID, offset)
+	if err != nil {
+		return err
+	}
+
+	return s3.copyObject(w, s3.config.DataBucket, objectName)
+}
+
+// DeleteUpload deletes all chunks of a resumable upload
+func (s3 S3Storage) DeleteUpload(uploadID string) error {
+	prefix, err := getUploadPrefix(uploadID)
+	if err != nil {
+		return err
+	}
+	bucket := s3.config.DataBucket
+
+	done := make(chan struct{})
+	defer close(done)
+
+	for obj := range s3.client.ListObjects(bucket, prefix, true, done) {
+		if obj.Err != nil {
+			return errors.Wrapf(obj.Err, "can't list objects of the bucket '%s'", bucket)
+		}
+
+		if err := s3.client.RemoveObject(bucket, obj.Key); err != nil {
+			return errors.Wrapf(err, "can't remove an object '%s/%s'", bucket, obj.Key)
+		}
+	}
+
+	return nil
+}
+
+// SaveBlob saves content and returns its SHA-256 hash. If a blob with the same hash already exists,
+// the new copy is discarded. Size can be -1 if it is unknown
+func (s3 S3Storage) SaveBlob(r io.Reader, size int64) (hash string, err error) {
+	bucket := s3.config.DataBucket
+
+	// Content is uploaded into a temporary object at first, because the hash is unknown till the end
+	tmpName := blobsFolder + "tmp-" + utils.GenerateRandomString(20)
+	defer s3.client.RemoveObject(bucket, tmpName)
+
+	hr := newHashingReader(r)
+	if size < 0 {
+		err = s3.putObjectStream(bucket, tmpName, hr)
+	} else {
+		_, err = s3.client.PutObject(bucket, tmpName, hr, size, minio.PutObjectOptions{})
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "can't put an object")
+	}
+
+	hash = hr.Hash()
+	objectName, _ := getBlobName(hash)
+
+	if _, err := s3.client.StatObject(bucket, objectName, minio.StatObjectOptions{}); err == nil {
+		// Content is already stored
+		return hash, nil
+	}
+
+	if err := s3.copyObjectWithin(bucket, tmpName, objectName); err != nil {
+		return "", err
+	}
+
+	return hash, nil
+}
+
+// copyObjectWithin copies an object inside a bucket. A single copy request can't copy objects larger than 5GB,
+// so large objects are copied by parts (minio.Client.ComposeObject does it)
+func (s3 S3Storage) copyObjectWithin(bucket, srcName, dstName string) error {
+	dst, err := minio.NewDestinationInfo(bucket, dstName, nil, nil)
+	if err != nil {
+		return errors.Wrapf(err, "can't create destination info for an object '%s/%s'", bucket, dstName)
+	}
+
+	err = s3.client.ComposeObject(dst, []minio.SourceInfo{minio.NewSourceInfo(bucket, srcName, nil)})
+	return errors.Wrapf(err, "can't copy an object '%s/%s' into '%s/%s'", bucket, srcName, bucket, dstName)
+}
+
+// putObjectStream uploads an object of unknown size. minio.Client reserves a buffer of hundreds of megabytes
+// for such objects, so content is uploaded by parts of s3PartSize
+func (s3 S3Storage) putObjectStream(bucket, objectName string, r io.Reader) error {
+	part := make([]byte, s3PartSize)
+
+	n, err := io.ReadFull(r, part)
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		// The whole content fits into a single part
+		_, err := s3.client.PutObject(bucket, objectName, bytes.NewReader(part[:n]), int64(n), minio.PutObjectOptions{})
+		return err
+	case err != nil:
+		return errors.Wrap(err, "can't read content")
+	}
+
+	core := minio.Core{Client: s3.client}
+	uploadID, err := core.NewMultipartUpload(bucket, objectName, minio.PutObjectOptions{})
+	if err != nil {
+		return errors.Wrap(err, "can't start a multipart upload")
+	}
+
+	var parts []minio.CompletePart
+	for n > 0 {
+		uploaded, err := core.PutObjectPart(bucket, objectName, uploadID, len(parts)+1, bytes.NewReader(part[:n]), int64(n), "", "", nil)
+		if err != nil {
+			core.AbortMultipartUpload(bucket, objectName, uploadID)
+			return errors.Wrapf(err, "can't upload part %d", len(parts)+1)
+		}
+		parts = append(parts, minio.CompletePart{PartNumber: uploaded.PartNumber, ETag: uploaded.ETag})
+
+		n, err = io.ReadFull(r, part)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			core.AbortMultipartUpload(bucket, objectName, uploadID)
+			return errors.Wrap(err, "can't read content")
+		}
+	}
+
+	if _, err := core.CompleteMultipartUpload(bucket, objectName, uploadID, parts); err != nil {
+		core.AbortMultipartUpload(bucket, objectName, uploadID)
+		return errors.Wrap(err, "can't complete a multipart upload")
+	}
+
+	return nil
+}
+
+// GetBlob writes a blob into passed io.Writer
+func (s3 S3Storage) GetBlob(w io.Writer, hash string) error {
+	objectName, err := getBlobName(hash)
+	if err != nil {
+		return err
+	}
+
+	return s3.copyObject(w, s3.config.DataBucket, objectName)
+}
+
+func (s3 S3Storage) GetBlobStats(hash string) (os.FileInfo, error) {
+	objectName, err := getBlobName(hash)
+	if err != nil {
+		return nil, err
+	}
+	bucket := s3.config.DataBucket
+
+	stats, err := s3.client.StatObject(bucket, objectName, minio.StatObjectOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't get stats for an object '%s/%s'", bucket, objectName)
+	}
+
+	return newFileInfo(stats), nil
+}
+
+func (s3 S3Storage) DeleteBlob(hash string) error {
+	objectName, err := getBlobName(hash)
+	if err != nil {
+		return err
+	}
+	bucket := s3.config.DataBucket
+
+	err = s3.client.RemoveObject(bucket, objectName)
+	return errors.Wrapf(err, "can't remove an object '%s/%s'", bucket, objectName)
+}
+
+// ArchiveFile copies the current version of a file into the archive of revisions
+func (s3 S3Storage) ArchiveFile(fileID, revision int) error {
+	bucket := s3.config.DataBucket
+	objectName := strconv.Itoa(fileID)
+	revisionName := getRevisionObjectName(fileID, revision)
+
+	return s3.copyObjectWithin(bucket, objectName, revisionName)
+}
+
+// GetFileRevision writes an archived revision of a file into passed io.Writer
+func (s3 S3Storage) GetFileRevision(w io.Writer, fileID, revision int) error {
+	return s3.copyObject(w, s3.config.DataBucket, getRevisionObjectName(fileID, revision))
+}
+
+// DeleteFileRevision deletes an archived revision of a file
+func (s3 S3Storage) DeleteFileRevision(fileID, revision int) error {
+	bucket := s3.config.DataBucket
+	objectName := getRevisionObjectName(fileID, revision)
+
+	err := s3.client.RemoveObject(bucket, objectName)
+	return errors.Wrapf(err, "can't remove an object '%s/%s'", bucket, objectName)
+}
+
+// getRevisionObjectName returns name of an archived revision. Revisions are kept next to original files
+func getRevisionObjectName(fileID, revision int) string {
+	return strconv.Itoa(fileID) + "." + strconv.Itoa(revision)
+}
+
+// Inventory returns all objects kept in DataBucket and ResizedImagesBucket
+func (s3 S3Storage) Inventory() (Inventory, error) {
+	var inv Inventory
+
+	done := make(chan struct{})
+	defer close(done)
+
+	for _, bucket := range []string{s3.config.DataBucket, s3.config.ResizedImagesBucket} {
+		resized := bucket == s3.config.ResizedImagesBucket
+
+		for obj := range s3.client.ListObjects(bucket, "", true, done) {
+			if obj.Err != nil {
+				return Inventory{}, errors.Wrapf(obj.Err, "can't list objects of the bucket '%s'", bucket)
+			}
+			inv.add(obj.Key, resized)
+		}
+	}
+
+	return inv, nil
+}
+
+// ResizedImagesSize returns the total size of objects kept in ResizedImagesBucket (resized images and thumbnails)
+func (s3 S3Storage) ResizedImagesSize() (int64, error) {
+	done := make(chan struct{})
+	defer close(done)
+
+	var size int64
+	bucket := s3.config.ResizedImagesBucket
+	for obj := range s3.client.ListObjects(bucket, "", true, done) {
+		if obj.Err != nil {
+			return 0, errors.Wrapf(obj.Err, "can't list objects of the bucket '%s'", bucket)
+		}
+		size += obj.Size
+	}
+
+	return size, nil
+}
+
+// DeleteTemporaryFile deletes a temporary object returned by Inventory
+func (s3 S3Storage) DeleteTemporaryFile(name string) error {
+	if !isTemporaryFile(name) {
+		return ErrNotTemporaryFile
+	}
+	bucket := s3.config.DataBucket
+
+	err := s3.client.RemoveObject(bucket, name)
+	return errors.Wrapf(err, "can't remove an object '%s/%s'", bucket, name)
+}
+
 func (s3 *S3Storage) Shutdown() error {
 	// We hadn't to shutdown minio.Client{}
 
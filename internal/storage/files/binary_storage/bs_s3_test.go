@@ -317,3 +317,32 @@ func clearS3(endpoint string, accessKeyID string, secretAccessKey string, secure
 
 	return nil
 }
+
+func TestS3Storage_SaveBlobWithUnknownSize(t *testing.T) {
+	assert := assert.New(t)
+
+	cnf, ok := getS3Config()
+	if !ok {
+		t.Skip("Skip test because env vars for connection to an S3 Storage weren't set")
+	}
+
+	storage, err := bs.NewS3Storage(cnf)
+	if !assert.Nil(err) {
+		assert.FailNow("can't init a new S3Storage")
+	}
+
+	// Small content is uploaded as a single object, big content is uploaded by parts
+	for _, size := range []int{512, 16<<20 + 512} {
+		data := generateRandomData(size)
+
+		hash, err := storage.SaveBlob(bytes.NewReader(data), -1)
+		if !assert.Nil(err) {
+			continue
+		}
+
+		buff := &bytes.Buffer{}
+		assert.Nil(storage.GetBlob(buff, hash))
+		assert.Equal(data, buff.Bytes())
+		assert.Nil(storage.DeleteBlob(hash))
+	}
+}
@@ -0,0 +1,456 @@
+package files
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+
+	"github.com/tags-drive/core/internal/storage/files/extensions"
+	"github.com/tags-drive/core/internal/utils"
+)
+
+const (
+	// contentIndexFile is a name of a file in config.VarFolder. The content index is kept there
+	contentIndexFile = "content_index.json"
+
+	// maxIndexedContentSize is a max number of bytes of a file which are indexed
+	maxIndexedContentSize = 1 << 20 // 1MB
+
+	// maxWordLength is a max length of indexed words. Longer words are usually hashes or encoded data
+	maxWordLength = 64
+
+	// snippetRadius is a number of runes before and after a match in a snippet
+	snippetRadius = 40
+	// maxSnippets is a max number of snippets of a single file
+	maxSnippets = 3
+)
+
+// errContentLimit is returned by limitedBuffer when the limit is reached
+var errContentLimit = errors.New("content limit is reached")
+
+// Snippet is a part of content of a file which matches a search query
+type Snippet struct {
+	Text string `json:"text"`
+	// Highlights contains positions of matched words in Text
+	Highlights []Highlight `json:"highlights"`
+}
+
+// Highlight is a matched word. Start and End are offsets in runes (End is exclusive)
+type Highlight struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// isIndexable checks if content of files with passed type can be indexed
+func isIndexable(ext extensions.Ext) bool {
+	return ext.FileType == extensions.FileTypeText || ext.FileType == extensions.FileTypeLanguage
+}
+
+// contentIndexData is a content of contentIndexFile. Only postings are stored, snippets are built from files
+type contentIndexData struct {
+	// Revisions maps ids of indexed files to numbers of indexed revisions
+	Revisions map[int]int `json:"revisions"`
+	// Words maps words to sorted ids of files which contain them
+	Words map[string][]int `json:"words"`
+}
+
+// contentIndex is an inverted index over content of text files
+type contentIndex struct {
+	mu *sync.RWMutex
+
+	// revisions maps ids of indexed files to numbers of indexed revisions
+	revisions map[int]int
+	// words maps words to ids of files which contain them
+	words map[string]map[int]struct{}
+}
+
+func newContentIndex() *contentIndex {
+	return &contentIndex{
+		mu:        new(sync.RWMutex),
+		revisions: make(map[int]int),
+		words:     make(map[string]map[int]struct{}),
+	}
+}
+
+// load loads the index from a file. It does nothing if the file doesn't exist. Files from an index
+// of an old format (with text of files) aren't loaded, so they are indexed again
+func (ci *contentIndex) load(path string, encrypt bool, passPhrase [32]byte) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "can't open file %s", path)
+	}
+	defer f.Close()
+
+	var data contentIndexData
+	if err := utils.Decode(f, &data, encrypt, passPhrase); err != nil {
+		return errors.Wrap(err, "can't decode the content index")
+	}
+
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+
+	ci.revisions = make(map[int]int, len(data.Revisions))
+	for id, revision := range data.Revisions {
+		ci.revisions[id] = revision
+	}
+	ci.words = make(map[string]map[int]struct{}, len(data.Words))
+	for w, ids := range data.Words {
+		set := make(map[int]struct{}, len(ids))
+		for _, id := range ids {
+			set[id] = struct{}{}
+		}
+		ci.words[w] = set
+	}
+
+	return nil
+}
+
+// save writes the index into a file
+func (ci *contentIndex) save(path string, encrypt bool, passPhrase [32]byte) error {
+	ci.mu.RLock()
+
+	data := contentIndexData{
+		Revisions: make(map[int]int, len(ci.revisions)),
+		Words:     make(map[string][]int, len(ci.words)),
+	}
+	for id, revision := range ci.revisions {
+		data.Revisions[id] = revision
+	}
+	for w, set := range ci.words {
+		ids := make([]int, 0, len(set))
+		for id := range set {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+		data.Words[w] = ids
+	}
+
+	ci.mu.RUnlock()
+
+	return utils.WriteFileAtomic(path, data, encrypt, passPhrase)
+}
+
+// set indexes a revision of a file. A previous revision is removed from the index
+func (ci *contentIndex) set(id, revision int, text string) {
+	tokens := tokenize([]rune(text))
+
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+
+	ci.remove(id)
+
+	ci.revisions[id] = revision
+	for _, t := range tokens {
+		ids, ok := ci.words[t.word]
+		if !ok {
+			ids = make(map[int]struct{})
+			ci.words[t.word] = ids
+		}
+		ids[id] = struct{}{}
+	}
+}
+
+// delete removes a file from the index
+func (ci *contentIndex) delete(id int) {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+
+	ci.remove(id)
+}
+
+// reset removes all files from the index
+func (ci *contentIndex) reset() {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+
+	ci.revisions = make(map[int]int)
+	ci.words = make(map[string]map[int]struct{})
+}
+
+// isIndexed checks if a revision of a file is indexed
+func (ci *contentIndex) isIndexed(id, revision int) bool {
+	ci.mu.RLock()
+	defer ci.mu.RUnlock()
+
+	r, ok := ci.revisions[id]
+	return ok && r == revision
+}
+
+// getIDs returns ids of all indexed files
+func (ci *contentIndex) getIDs() []int {
+	ci.mu.RLock()
+	defer ci.mu.RUnlock()
+
+	ids := make([]int, 0, len(ci.revisions))
+	for id := range ci.revisions {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	return ids
+}
+
+// remove must be called under Lock. Text of files isn't kept, so all postings are checked
+func (ci *contentIndex) remove(id int) {
+	if _, ok := ci.revisions[id]; !ok {
+		return
+	}
+	delete(ci.revisions, id)
+
+	for w, ids := range ci.words {
+		delete(ids, id)
+		if len(ids) == 0 {
+			delete(ci.words, w)
+		}
+	}
+}
+
+// filterFiles returns files which content contains all words of a query. Snippets aren't filled,
+// use FileStorage.fillSnippets
+func (ci *contentIndex) filterFiles(files []File, query string) []File {
+	queryWords := queryWords(query)
+	if len(queryWords) == 0 {
+		return []File{}
+	}
+
+	ci.mu.RLock()
+	defer ci.mu.RUnlock()
+
+	var res []File
+	for _, f := range files {
+		matched := true
+		for w := range queryWords {
+			if _, ok := ci.words[w][f.ID]; !ok {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			res = append(res, f)
+		}
+	}
+
+	return res
+}
+
+// queryWords returns a set of words of a search query
+func queryWords(query string) map[string]bool {
+	words := make(map[string]bool)
+	for _, w := range tokenize([]rune(query)) {
+		words[w.word] = true
+	}
+
+	return words
+}
+
+// makeSnippets returns parts of text around words from passed set
+func makeSnippets(text []rune, words map[string]bool) []Snippet {
+	var matches []token
+	for _, t := range tokenize(text) {
+		if words[t.word] {
+			matches = append(matches, t)
+		}
+	}
+
+	var snippets []Snippet
+	for i := 0; i < len(matches) && len(snippets) < maxSnippets; {
+		start := matches[i].start - snippetRadius
+		if start < 0 {
+			start = 0
+		}
+		end := matches[i].end + snippetRadius
+		if end > len(text) {
+			end = len(text)
+		}
+
+		// Highlight all matches inside the snippet
+		var highlights []Highlight
+		for ; i < len(matches) && matches[i].end <= end; i++ {
+			highlights = append(highlights, Highlight{
+				Start: matches[i].start - start,
+				End:   matches[i].end - start,
+			})
+		}
+
+		snippets = append(snippets, Snippet{
+			Text:       string(text[start:end]),
+			Highlights: highlights,
+		})
+	}
+
+	return snippets
+}
+
+// token is a word in a text. start and end are offsets in runes
+type token struct {
+	word       string
+	start, end int
+}
+
+// tokenize splits text into lower case words. Letters, digits and underscores are parts of words
+func tokenize(text []rune) []token {
+	isWordRune := func(r rune) bool {
+		return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+	}
+
+	var (
+		tokens []token
+		word   []rune
+	)
+	for i := 0; i <= len(text); i++ {
+		if i < len(text) && isWordRune(text[i]) {
+			word = append(word, unicode.ToLower(text[i]))
+			continue
+		}
+
+		if len(word) > 0 && len(word) <= maxWordLength {
+			tokens = append(tokens, token{word: string(word), start: i - len(word), end: i})
+		}
+		word = word[:0]
+	}
+
+	return tokens
+}
+
+// limitedBuffer keeps only first limit bytes. Write returns errContentLimit when the limit is reached
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if free := b.limit - b.Len(); len(p) > free {
+		b.Buffer.Write(p[:free])
+		return free, errContentLimit
+	}
+
+	return b.Buffer.Write(p)
+}
+
+// String returns the kept text. A rune cut by the limit is dropped
+func (b *limitedBuffer) String() string {
+	data := b.Bytes()
+	// A cut rune leaves at most utf8.UTFMax-1 bytes, every one of them is decoded as an invalid rune
+	for i := 0; i < utf8.UTFMax-1 && len(data) > 0; i++ {
+		if r, size := utf8.DecodeLastRune(data); r != utf8.RuneError || size != 1 {
+			break
+		}
+		data = data[:len(data)-1]
+	}
+
+	return string(data)
+}
+
+// indexFile indexes the current revision of a file if it is a text file
+func (fs FileStorage) indexFile(file File) error {
+	if !isIndexable(file.Type) {
+		return nil
+	}
+
+	text, err := fs.readIndexedContent(file)
+	if err != nil {
+		return err
+	}
+
+	fs.contentIndex.set(file.ID, file.CurrentRevision().Number, text)
+	return nil
+}
+
+// readIndexedContent returns the indexed part of content of the current revision of a file
+func (fs FileStorage) readIndexedContent(file File) (string, error) {
+	buff := &limitedBuffer{limit: maxIndexedContentSize}
+	err := fs.copyRevision(buff, file, file.CurrentRevision())
+	if err != nil && errors.Cause(err) != errContentLimit {
+		return "", errors.Wrapf(err, "can't read content of file with id %d", file.ID)
+	}
+
+	return buff.String(), nil
+}
+
+// fillSnippets fills snippets of files found by a content search. Files are read again, so it should
+// be called only for returned files. Errors are only logged, snippets of such files stay empty
+func (fs FileStorage) fillSnippets(files []File, query string) {
+	words := queryWords(query)
+	for i := range files {
+		text, err := fs.readIndexedContent(files[i])
+		if err != nil {
+			fs.logger.Errorf("can't make snippets for file \"%s\": %s\n", files[i].Filename, err)
+			continue
+		}
+		files[i].Snippets = makeSnippets([]rune(text), words)
+	}
+}
+
+// updateContentIndex indexes text files which weren't indexed (for example, after a crash or an update)
+// and removes deleted files from the index. It has to be run in goroutine
+func (fs FileStorage) updateContentIndex() {
+	files := fs.metaStorage.getFiles("", "", false)
+
+	exist := make(map[int]bool, len(files))
+	indexed := 0
+	for _, file := range files {
+		if !isIndexable(file.Type) {
+			continue
+		}
+		exist[file.ID] = true
+
+		if fs.contentIndex.isIndexed(file.ID, file.CurrentRevision().Number) {
+			continue
+		}
+
+		if err := fs.indexFile(file); err != nil {
+			fs.logger.Errorf("can't index file \"%s\": %s\n", file.Filename, err)
+			continue
+		}
+		indexed++
+	}
+
+	for _, id := range fs.contentIndex.getIDs() {
+		if !exist[id] {
+			fs.contentIndex.delete(id)
+		}
+	}
+
+	if indexed > 0 {
+		fs.logger.Infof("%d file(s) were added into the content index\n", indexed)
+	}
+
+	if err := fs.saveContentIndex(); err != nil {
+		fs.logger.Errorf("can't save the content index: %s\n", err)
+	}
+}
+
+// RebuildContentIndex indexes content of all text files from scratch. It returns a number of indexed files.
+// Errors of indexing of single files are only logged
+func (fs FileStorage) RebuildContentIndex() (int, error) {
+	fs.contentIndex.reset()
+
+	indexed := 0
+	for _, file := range fs.metaStorage.getFiles("", "", false) {
+		if !isIndexable(file.Type) {
+			continue
+		}
+
+		if err := fs.indexFile(file); err != nil {
+			fs.logger.Errorf("can't index file \"%s\": %s\n", file.Filename, err)
+			continue
+		}
+		indexed++
+	}
+
+	return indexed, fs.saveContentIndex()
+}
+
+func (fs FileStorage) saveContentIndex() error {
+	path := filepath.Join(fs.config.VarFolder, contentIndexFile)
+	return errors.Wrap(fs.contentIndex.save(path, fs.config.Encrypt, fs.config.PassPhrase), "can't save the content index")
+}
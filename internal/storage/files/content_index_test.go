@@ -0,0 +1,126 @@
+package files
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tags-drive/core/internal/utils"
+)
+
+func TestTokenize(t *testing.T) {
+	assert := assert.New(t)
+
+	tokens := tokenize([]rune("Hello, Мир! snake_case 42"))
+	assert.Equal([]token{
+		{word: "hello", start: 0, end: 5},
+		{word: "мир", start: 7, end: 10},
+		{word: "snake_case", start: 12, end: 22},
+		{word: "42", start: 23, end: 25},
+	}, tokens)
+}
+
+func TestContentIndex(t *testing.T) {
+	assert := assert.New(t)
+
+	index := newContentIndex()
+	index.set(1, 1, "The quick brown fox jumps over the lazy dog")
+	index.set(2, 1, "Quick sort is a sorting algorithm")
+	index.set(3, 1, "Nothing interesting")
+
+	files := []File{{ID: 1}, {ID: 2}, {ID: 3}}
+
+	res := index.filterFiles(files, "QUICK")
+	if assert.Len(res, 2) {
+		assert.Equal(1, res[0].ID)
+		assert.Equal(2, res[1].ID)
+		// Snippets are filled only for returned files
+		assert.Empty(res[0].Snippets)
+	}
+
+	// All words must be matched
+	res = index.filterFiles(files, "quick fox")
+	if assert.Len(res, 1) {
+		assert.Equal(1, res[0].ID)
+	}
+
+	assert.Empty(index.filterFiles(files, "cat"))
+	assert.Empty(index.filterFiles(files, "!!!"))
+
+	// Update and delete
+	index.set(1, 2, "slow turtle")
+	assert.True(index.isIndexed(1, 2))
+	assert.False(index.isIndexed(1, 1))
+	assert.Len(index.filterFiles(files, "quick"), 1)
+
+	index.delete(2)
+	assert.Empty(index.filterFiles(files, "quick"))
+	assert.Equal([]int{1, 3}, index.getIDs())
+
+	// Save and load
+	path := filepath.Join(os.TempDir(), contentIndexFile)
+	defer os.Remove(path)
+
+	assert.NoError(index.save(path, true, [32]byte{1}))
+
+	loaded := newContentIndex()
+	assert.NoError(loaded.load(path, true, [32]byte{1}))
+	assert.Equal(index.revisions, loaded.revisions)
+	assert.Equal(index.words, loaded.words)
+
+	// An index of the old format is ignored, files are indexed again
+	assert.NoError(utils.WriteFileAtomic(path, map[int]struct {
+		Revision int    `json:"revision"`
+		Text     string `json:"text"`
+	}{1: {Revision: 2, Text: "slow turtle"}}, false, [32]byte{}))
+
+	loaded = newContentIndex()
+	assert.NoError(loaded.load(path, false, [32]byte{}))
+	assert.Empty(loaded.getIDs())
+}
+
+func TestMakeSnippets(t *testing.T) {
+	assert := assert.New(t)
+
+	text := []rune("match " + string(make([]rune, 100)) + " match")
+	for i := range text {
+		if text[i] == 0 {
+			text[i] = ' '
+		}
+	}
+
+	snippets := makeSnippets(text, map[string]bool{"match": true})
+	if assert.Len(snippets, 2) {
+		assert.Equal(Highlight{Start: 0, End: 5}, snippets[0].Highlights[0])
+		assert.Equal(Highlight{Start: snippetRadius, End: snippetRadius + 5}, snippets[1].Highlights[0])
+	}
+}
+
+func TestLimitedBuffer(t *testing.T) {
+	assert := assert.New(t)
+
+	for i, tt := range []struct {
+		limit int
+		text  string
+		want  string
+	}{
+		{limit: 5, text: "abc", want: "abc"},
+		{limit: 3, text: "abcdef", want: "abc"},
+		{limit: 3, text: "aМир", want: "aМ"},
+		{limit: 2, text: "aМир", want: "a"},
+		{limit: 4, text: "a😀", want: "a"},
+		{limit: 5, text: "a😀b", want: "a😀"},
+		{limit: 4, text: "a�b", want: "a�"},
+	} {
+		buff := &limitedBuffer{limit: tt.limit}
+		_, err := buff.Write([]byte(tt.text))
+		if len(tt.text) > tt.limit {
+			assert.Equalf(errContentLimit, err, "#%d", i)
+		} else {
+			assert.NoErrorf(err, "#%d", i)
+		}
+		assert.Equalf(tt.want, buff.String(), "#%d", i)
+	}
+}
@@ -0,0 +1,165 @@
+package files
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DuplicatePolicy defines what is done when an uploaded file is a duplicate of existing files
+type DuplicatePolicy string
+
+const (
+	// DuplicateKeep keeps both the existing and the uploaded files
+	DuplicateKeep DuplicatePolicy = "keep"
+	// DuplicateReject rejects the uploaded file with ErrAlreadyExist
+	DuplicateReject DuplicatePolicy = "reject"
+	// DuplicateMerge adds tags of the uploaded file to the existing one. If the content differs (the file
+	// was found by its filename), the content is saved as a new revision of the existing file
+	DuplicateMerge DuplicatePolicy = "merge"
+	// DuplicateReplace saves the uploaded file and moves the existing files into the Trash
+	DuplicateReplace DuplicatePolicy = "replace"
+)
+
+// IsValid checks if a policy is known
+func (p DuplicatePolicy) IsValid() bool {
+	switch p {
+	case DuplicateKeep, DuplicateReject, DuplicateMerge, DuplicateReplace:
+		return true
+	default:
+		return false
+	}
+}
+
+// UploadResult describes how an uploaded file was saved
+type UploadResult struct {
+	// File is the created file or the existing file the upload was merged into
+	File File
+	// Duplicates contains ids of existing files with the same content (or the same filename)
+	Duplicates []int
+	// Action is a policy applied to the duplicates. It is empty if there were no duplicates
+	Action DuplicatePolicy
+}
+
+// DuplicateGroup is a group of files with the same content or with the same filename
+type DuplicateGroup struct {
+	// Hash is set for a group of files with the same content
+	Hash string `json:"hash,omitempty"`
+	// Filename is set for a group of files with the same filename
+	Filename string `json:"filename,omitempty"`
+	Files    []File `json:"files"`
+}
+
+func (fs FileStorage) duplicatePolicy() DuplicatePolicy {
+	if fs.config.DuplicatePolicy == "" {
+		return DuplicateKeep
+	}
+	return fs.config.DuplicatePolicy
+}
+
+// lockDuplicates locks uploads which can be duplicates of each other: uploads of the same content
+// (and of the same filename if Config.DuplicatesByFilename is true). Nothing is locked with DuplicateKeep,
+// because all files are kept. It returns a function which unlocks the uploads
+func (fs FileStorage) lockDuplicates(hash, filename string) (unlock func()) {
+	if fs.duplicatePolicy() == DuplicateKeep {
+		return func() {}
+	}
+
+	keys := []string{"hash:" + hash}
+	if fs.config.DuplicatesByFilename {
+		keys = append(keys, "filename:"+filename)
+	}
+	return fs.duplicateLocks.lockAll(keys...)
+}
+
+// findDuplicates returns duplicates of a new file. Files with the same content precede files
+// with the same filename
+func (fs FileStorage) findDuplicates(hash, filename string) ([]File, error) {
+	if !fs.config.DuplicatesByFilename {
+		filename = ""
+	}
+
+	files, err := fs.metaStorage.findDuplicates(hash, filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't find duplicates")
+	}
+	sort.SliceStable(files, func(i, j int) bool { return files[i].Hash == hash && files[j].Hash != hash })
+
+	return files, nil
+}
+
+// mergeUpload merges a new file into an existing one. It must be called under blobsMutex.RLock.
+// It returns true if the content was saved as a new revision
+func (fs FileStorage) mergeUpload(target File, tags []int, hash string, size int64) (File, bool, error) {
+	revisionAdded := false
+	if target.Hash != hash {
+		// Tags are applied only after the content is merged
+		if _, err := fs.addStoredRevision(target, hash, size); err != nil {
+			return File{}, false, err
+		}
+		revisionAdded = true
+	}
+
+	if len(tags) > 0 {
+		fs.metaStorage.addTagsToFiles([]int{target.ID}, tags)
+	}
+
+	file, err := fs.metaStorage.getFile(target.ID)
+	return file, revisionAdded, err
+}
+
+// GetDuplicates returns groups of files with the same content. Groups of files with the same filename are
+// returned too if byFilename is true. Files in Trash are skipped
+func (fs FileStorage) GetDuplicates(byFilename bool) []DuplicateGroup {
+	files := fs.metaStorage.getFiles("", "", false)
+	sort.Slice(files, func(i, j int) bool { return files[i].ID < files[j].ID })
+
+	var (
+		byHash = make(map[string][]File)
+		byName = make(map[string][]File)
+	)
+	for _, file := range files {
+		if file.Deleted {
+			continue
+		}
+		if file.Hash != "" {
+			byHash[file.Hash] = append(byHash[file.Hash], file)
+		}
+		if byFilename {
+			byName[file.Filename] = append(byName[file.Filename], file)
+		}
+	}
+
+	groups := []DuplicateGroup{}
+	for hash, files := range byHash {
+		if len(files) > 1 {
+			groups = append(groups, DuplicateGroup{Hash: hash, Files: files})
+		}
+	}
+	for filename, files := range byName {
+		if len(files) > 1 {
+			groups = append(groups, DuplicateGroup{Filename: filename, Files: files})
+		}
+	}
+
+	// Groups by content go first. Groups of the same kind are sorted by the first file
+	sort.Slice(groups, func(i, j int) bool {
+		if (groups[i].Hash == "") != (groups[j].Hash == "") {
+			return groups[i].Hash != ""
+		}
+		return groups[i].Files[0].ID < groups[j].Files[0].ID
+	})
+
+	return groups
+}
+
+// describeFiles returns a list of files for error messages: `"1.jpg" (id 1), "2.jpg" (id 2)`
+func describeFiles(files []File) string {
+	names := make([]string, len(files))
+	for i, f := range files {
+		names[i] = fmt.Sprintf("%q (id %d)", f.Filename, f.ID)
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,184 @@
+// Package exif extracts metadata of images: dimensions and EXIF data (camera, capture time,
+// orientation, GPS coordinates and lens)
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	// Register decoders for image.DecodeConfig
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+)
+
+// ErrUnknownFormat is returned when data isn't an image of a supported format
+var ErrUnknownFormat = errors.New("unknown image format")
+
+// Metadata contains metadata of an image. Fields are empty if they are unknown
+type Metadata struct {
+	// Width and Height are dimensions of the stored image (before applying Orientation)
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+	// Orientation is a value of the EXIF Orientation tag (1-8)
+	Orientation int `json:"orientation,omitempty"`
+
+	CameraMake  string `json:"cameraMake,omitempty"`
+	CameraModel string `json:"cameraModel,omitempty"`
+	LensMake    string `json:"lensMake,omitempty"`
+	LensModel   string `json:"lensModel,omitempty"`
+
+	// FocalLength is in millimeters
+	FocalLength float64 `json:"focalLength,omitempty"`
+	FNumber     float64 `json:"fNumber,omitempty"`
+	// ExposureTime is in seconds
+	ExposureTime float64 `json:"exposureTime,omitempty"`
+	ISO          int     `json:"iso,omitempty"`
+
+	// TakenAt is the time of capture. Time without an offset is in the server time zone
+	TakenAt *time.Time `json:"takenAt,omitempty"`
+
+	GPS *GPS `json:"gps,omitempty"`
+}
+
+// GPS contains coordinates of the place of capture
+type GPS struct {
+	// Latitude and Longitude are in degrees. South and West are negative
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	// Altitude is in meters above sea level
+	Altitude float64 `json:"altitude,omitempty"`
+}
+
+// Camera returns the make and the model of a camera separated by a space. The make is skipped
+// if the model already contains it
+func (m Metadata) Camera() string {
+	if m.CameraMake == "" || strings.HasPrefix(strings.ToLower(m.CameraModel), strings.ToLower(m.CameraMake)) {
+		return m.CameraModel
+	}
+	return strings.TrimSpace(m.CameraMake + " " + m.CameraModel)
+}
+
+// Lens returns the make and the model of a lens like Camera
+func (m Metadata) Lens() string {
+	if m.LensMake == "" || strings.HasPrefix(strings.ToLower(m.LensModel), strings.ToLower(m.LensMake)) {
+		return m.LensModel
+	}
+	return strings.TrimSpace(m.LensMake + " " + m.LensModel)
+}
+
+// Read reads metadata of an image. An image without EXIF data isn't an error, only dimensions
+// are returned. Invalid EXIF data is ignored
+func Read(data []byte) (*Metadata, error) {
+	meta := &Metadata{}
+
+	cnf, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err == nil {
+		meta.Width, meta.Height = cnf.Width, cnf.Height
+	}
+
+	tiff := findTIFF(data)
+	if tiff == nil {
+		if err != nil {
+			return nil, ErrUnknownFormat
+		}
+		return meta, nil
+	}
+
+	readTIFF(tiff, meta)
+
+	return meta, nil
+}
+
+// findTIFF returns the TIFF structure with EXIF data of an image. It supports JPEG, PNG, WebP and TIFF
+func findTIFF(data []byte) []byte {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8}):
+		return findJPEGExif(data)
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return findPNGChunk(data[8:], "eXIf")
+	case len(data) >= 12 && bytes.Equal(data[:4], []byte("RIFF")) && bytes.Equal(data[8:12], []byte("WEBP")):
+		return bytes.TrimPrefix(findRIFFChunk(data[12:], "EXIF"), exifHeader)
+	case bytes.HasPrefix(data, []byte("II*\x00")), bytes.HasPrefix(data, []byte("MM\x00*")):
+		return data
+	default:
+		return nil
+	}
+}
+
+// exifHeader precedes the TIFF structure in an APP1 segment of a JPEG file
+var exifHeader = []byte("Exif\x00\x00")
+
+func findJPEGExif(data []byte) []byte {
+	// Skip SOI
+	data = data[2:]
+	for len(data) >= 4 && data[0] == 0xFF {
+		marker := data[1]
+		if marker == 0xFF {
+			// Fill byte
+			data = data[1:]
+			continue
+		}
+		if marker == 0xDA || marker == 0xD9 {
+			// Start of scan or end of image: there are no metadata segments after them
+			return nil
+		}
+
+		size := int(binary.BigEndian.Uint16(data[2:4]))
+		if size < 2 || len(data) < 2+size {
+			return nil
+		}
+
+		segment := data[4 : 2+size]
+		if marker == 0xE1 && bytes.HasPrefix(segment, exifHeader) {
+			return segment[len(exifHeader):]
+		}
+		data = data[2+size:]
+	}
+
+	return nil
+}
+
+// findPNGChunk returns data of a PNG chunk. A chunk consists of a length, a type, data and a CRC
+func findPNGChunk(data []byte, name string) []byte {
+	for len(data) >= 12 {
+		size := int(binary.BigEndian.Uint32(data[:4]))
+		if size < 0 || len(data)-12 < size {
+			return nil
+		}
+		if string(data[4:8]) == name {
+			return data[8 : 8+size]
+		}
+		data = data[12+size:]
+	}
+
+	return nil
+}
+
+// findRIFFChunk returns data of a RIFF chunk. A chunk consists of a type, a length and data padded
+// to an even size
+func findRIFFChunk(data []byte, name string) []byte {
+	for len(data) >= 8 {
+		size := int(binary.LittleEndian.Uint32(data[4:8]))
+		if size < 0 || len(data)-8 < size {
+			return nil
+		}
+		if string(data[:4]) == name {
+			return data[8 : 8+size]
+		}
+
+		next := 8 + size + size%2
+		if next > len(data) {
+			return nil
+		}
+		data = data[next:]
+	}
+
+	return nil
+}
@@ -0,0 +1,200 @@
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+func asciiEntry(tag uint16, s string) testEntry {
+	return testEntry{tag, typeASCII, uint32(len(s) + 1), append([]byte(s), 0)}
+}
+
+func shortEntry(tag uint16, v uint16) testEntry {
+	b := make([]byte, 2)
+	binary.LittleEndian.PutUint16(b, v)
+	return testEntry{tag, typeShort, 1, b}
+}
+
+func longEntry(tag uint16, v uint32) testEntry {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return testEntry{tag, typeLong, 1, b}
+}
+
+func rationalEntry(tag uint16, values ...uint32) testEntry {
+	b := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint32(b[i*4:], v)
+	}
+	return testEntry{tag, typeRational, uint32(len(values) / 2), b}
+}
+
+// buildTIFF builds a little-endian TIFF structure with IFD0, Exif IFD and GPS IFD
+func buildTIFF(ifd0, exif, gps []testEntry) []byte {
+	ifdSize := func(entries []testEntry) int {
+		size := 2 + len(entries)*12 + 4
+		for _, e := range entries {
+			if len(e.value) > 4 {
+				size += len(e.value)
+			}
+		}
+		return size
+	}
+
+	exifOffset := 8 + ifdSize(ifd0) + 24 // there are 2 extra entries in IFD0
+	gpsOffset := exifOffset + ifdSize(exif)
+	ifd0 = append(ifd0, longEntry(tagExifIFD, uint32(exifOffset)), longEntry(tagGPSIFD, uint32(gpsOffset)))
+
+	buf := []byte("II*\x00\x08\x00\x00\x00")
+	for _, entries := range [][]testEntry{ifd0, exif, gps} {
+		start := len(buf)
+		dataOffset := start + 2 + len(entries)*12 + 4
+
+		var data []byte
+		buf = append(buf, 0, 0)
+		binary.LittleEndian.PutUint16(buf[start:], uint16(len(entries)))
+		for _, e := range entries {
+			raw := make([]byte, 12)
+			binary.LittleEndian.PutUint16(raw[0:], e.tag)
+			binary.LittleEndian.PutUint16(raw[2:], e.typ)
+			binary.LittleEndian.PutUint32(raw[4:], e.count)
+			if len(e.value) <= 4 {
+				copy(raw[8:], e.value)
+			} else {
+				binary.LittleEndian.PutUint32(raw[8:], uint32(dataOffset+len(data)))
+				data = append(data, e.value...)
+			}
+			buf = append(buf, raw...)
+		}
+		buf = append(buf, 0, 0, 0, 0) // no next IFD
+		buf = append(buf, data...)
+	}
+
+	return buf
+}
+
+func testImage() image.Image {
+	return image.NewRGBA(image.Rect(0, 0, 30, 20))
+}
+
+func TestReadJPEG(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	tiff := buildTIFF(
+		[]testEntry{
+			asciiEntry(tagMake, "Canon"),
+			asciiEntry(tagModel, "Canon EOS 5D  "),
+			shortEntry(tagOrientation, 6),
+			asciiEntry(tagDateTime, "2019:01:01 00:00:00"),
+		},
+		[]testEntry{
+			rationalEntry(tagExposureTime, 1, 200),
+			rationalEntry(tagFNumber, 28, 10),
+			shortEntry(tagISO, 400),
+			asciiEntry(tagDateTimeOriginal, "2018:07:15 18:30:05"),
+			asciiEntry(tagOffsetTimeOriginal, "+03:00"),
+			rationalEntry(tagFocalLength, 50, 1),
+			shortEntry(tagPixelXDimension, 3000),
+			shortEntry(tagPixelYDimension, 2000),
+			asciiEntry(tagLensMake, "Canon"),
+			asciiEntry(tagLensModel, "EF50mm f/1.8"),
+		},
+		[]testEntry{
+			asciiEntry(tagGPSLatitudeRef, "N"),
+			rationalEntry(tagGPSLatitude, 55, 1, 45, 1, 36, 1),
+			asciiEntry(tagGPSLongitudeRef, "W"),
+			rationalEntry(tagGPSLongitude, 37, 1, 37, 1, 12, 1),
+			{tagGPSAltitudeRef, typeByte, 1, []byte{0}},
+			rationalEntry(tagGPSAltitude, 1505, 10),
+		},
+	)
+
+	var img bytes.Buffer
+	require.NoError(jpeg.Encode(&img, testImage(), nil))
+
+	// Insert APP1 segment after SOI
+	segment := append(append([]byte{}, exifHeader...), tiff...)
+	size := make([]byte, 2)
+	binary.BigEndian.PutUint16(size, uint16(len(segment)+2))
+
+	data := append([]byte{0xFF, 0xD8, 0xFF, 0xE1}, size...)
+	data = append(data, segment...)
+	data = append(data, img.Bytes()[2:]...)
+
+	meta, err := Read(data)
+	require.NoError(err)
+
+	// Dimensions of the image have priority over EXIF tags
+	assert.Equal(30, meta.Width)
+	assert.Equal(20, meta.Height)
+	assert.Equal(6, meta.Orientation)
+	assert.Equal("Canon EOS 5D", meta.Camera())
+	assert.Equal("Canon EF50mm f/1.8", meta.Lens())
+	assert.Equal(0.005, meta.ExposureTime)
+	assert.Equal(2.8, meta.FNumber)
+	assert.Equal(400, meta.ISO)
+	assert.Equal(50.0, meta.FocalLength)
+
+	require.NotNil(meta.TakenAt)
+	assert.True(time.Date(2018, 7, 15, 15, 30, 5, 0, time.UTC).Equal(*meta.TakenAt))
+
+	require.NotNil(meta.GPS)
+	assert.InDelta(55.76, meta.GPS.Latitude, 1e-9)
+	assert.InDelta(-37.62, meta.GPS.Longitude, 1e-9)
+	assert.InDelta(150.5, meta.GPS.Altitude, 1e-9)
+}
+
+func TestReadWithoutExif(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var img bytes.Buffer
+	require.NoError(png.Encode(&img, testImage()))
+
+	meta, err := Read(img.Bytes())
+	require.NoError(err)
+	assert.Equal(&Metadata{Width: 30, Height: 20}, meta)
+
+	_, err = Read([]byte("some text"))
+	assert.Equal(ErrUnknownFormat, err)
+}
+
+func TestReadInvalidExif(t *testing.T) {
+	assert := assert.New(t)
+
+	tiff := buildTIFF([]testEntry{asciiEntry(tagModel, "Camera")}, nil, nil)
+
+	// Truncated data mustn't cause a panic
+	for i := range tiff {
+		_, err := Read(tiff[:i])
+		assert.True(err == nil || err == ErrUnknownFormat)
+	}
+
+	meta, err := Read(tiff)
+	assert.NoError(err)
+	assert.Equal("Camera", meta.CameraModel)
+
+	// Broken offsets of the Exif and GPS IFDs (values of the 2nd and the 3rd entries of IFD0)
+	binary.LittleEndian.PutUint32(tiff[8+2+12+8:], 0xFFFFFFFF)
+	binary.LittleEndian.PutUint32(tiff[8+2+24+8:], 0xFFFFFFFF)
+	meta, err = Read(tiff)
+	assert.NoError(err)
+	assert.Equal("Camera", meta.CameraModel)
+	assert.Nil(meta.GPS)
+}
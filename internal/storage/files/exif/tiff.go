@@ -0,0 +1,279 @@
+package exif
+
+import (
+	"encoding/binary"
+	"math"
+	"strings"
+	"time"
+)
+
+// Tags
+const (
+	// IFD0
+	tagMake        = 0x010F
+	tagModel       = 0x0110
+	tagOrientation = 0x0112
+	tagDateTime    = 0x0132
+	tagExifIFD     = 0x8769
+	tagGPSIFD      = 0x8825
+
+	// Exif IFD
+	tagExposureTime       = 0x829A
+	tagFNumber            = 0x829D
+	tagISO                = 0x8827
+	tagDateTimeOriginal   = 0x9003
+	tagDateTimeDigitized  = 0x9004
+	tagOffsetTimeOriginal = 0x9011
+	tagFocalLength        = 0x920A
+	tagPixelXDimension    = 0xA002
+	tagPixelYDimension    = 0xA003
+	tagLensMake           = 0xA433
+	tagLensModel          = 0xA434
+
+	// GPS IFD
+	tagGPSLatitudeRef  = 0x0001
+	tagGPSLatitude     = 0x0002
+	tagGPSLongitudeRef = 0x0003
+	tagGPSLongitude    = 0x0004
+	tagGPSAltitudeRef  = 0x0005
+	tagGPSAltitude     = 0x0006
+)
+
+// Types of values
+const (
+	typeByte      = 1
+	typeASCII     = 2
+	typeShort     = 3
+	typeLong      = 4
+	typeRational  = 5
+	typeUndefined = 7
+	typeSLong     = 9
+	typeSRational = 10
+)
+
+var typeSizes = map[uint16]int{
+	typeByte:      1,
+	typeASCII:     1,
+	typeShort:     2,
+	typeLong:      4,
+	typeRational:  8,
+	typeUndefined: 1,
+	typeSLong:     4,
+	typeSRational: 8,
+}
+
+// maxEntries limits a number of entries in an IFD to not process garbage
+const maxEntries = 1000
+
+// dateTimeLayout is a layout of EXIF dates
+const dateTimeLayout = "2006:01:02 15:04:05"
+
+// entry is an entry of an IFD
+type entry struct {
+	typ   uint16
+	count int
+	// value contains count values of the type
+	value []byte
+	order binary.ByteOrder
+}
+
+// readTIFF reads EXIF tags from a TIFF structure into meta. Invalid tags are skipped
+func readTIFF(data []byte, meta *Metadata) {
+	if len(data) < 8 {
+		return
+	}
+
+	var order binary.ByteOrder
+	switch string(data[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return
+	}
+
+	ifd0 := readIFD(data, order, order.Uint32(data[4:8]))
+	meta.CameraMake = ifd0[tagMake].string()
+	meta.CameraModel = ifd0[tagModel].string()
+	if o := ifd0[tagOrientation].uint(); o >= 1 && o <= 8 {
+		meta.Orientation = o
+	}
+
+	var exif map[uint16]entry
+	if ifd0[tagExifIFD].count > 0 {
+		exif = readIFD(data, order, uint32(ifd0[tagExifIFD].uint()))
+	}
+	meta.LensMake = exif[tagLensMake].string()
+	meta.LensModel = exif[tagLensModel].string()
+	meta.FocalLength = exif[tagFocalLength].rational(0)
+	meta.FNumber = exif[tagFNumber].rational(0)
+	meta.ExposureTime = exif[tagExposureTime].rational(0)
+	meta.ISO = exif[tagISO].uint()
+	if meta.Width == 0 || meta.Height == 0 {
+		meta.Width, meta.Height = exif[tagPixelXDimension].uint(), exif[tagPixelYDimension].uint()
+	}
+
+	for _, e := range []entry{exif[tagDateTimeOriginal], exif[tagDateTimeDigitized], ifd0[tagDateTime]} {
+		if t, ok := parseDateTime(e.string(), exif[tagOffsetTimeOriginal].string()); ok {
+			meta.TakenAt = &t
+			break
+		}
+	}
+
+	if ifd0[tagGPSIFD].count > 0 {
+		meta.GPS = readGPS(readIFD(data, order, uint32(ifd0[tagGPSIFD].uint())))
+	}
+}
+
+// readIFD reads entries of an IFD at passed offset
+func readIFD(data []byte, order binary.ByteOrder, offset uint32) map[uint16]entry {
+	if offset < 8 || int64(offset)+2 > int64(len(data)) {
+		return nil
+	}
+
+	n := int(order.Uint16(data[offset:]))
+	if n > maxEntries || int(offset)+2+n*12 > len(data) {
+		return nil
+	}
+
+	entries := make(map[uint16]entry, n)
+	for i := 0; i < n; i++ {
+		raw := data[int(offset)+2+i*12:]
+
+		e := entry{
+			typ:   order.Uint16(raw[2:4]),
+			count: int(order.Uint32(raw[4:8])),
+			order: order,
+		}
+		size, ok := typeSizes[e.typ]
+		if !ok || e.count <= 0 || e.count > len(data) {
+			continue
+		}
+
+		total := size * e.count
+		if total <= 4 {
+			e.value = raw[8 : 8+total]
+		} else {
+			valueOffset := int64(order.Uint32(raw[8:12]))
+			if valueOffset+int64(total) > int64(len(data)) {
+				continue
+			}
+			e.value = data[valueOffset : valueOffset+int64(total)]
+		}
+
+		entries[order.Uint16(raw[:2])] = e
+	}
+
+	return entries
+}
+
+func readGPS(gps map[uint16]entry) *GPS {
+	lat, latOK := degrees(gps[tagGPSLatitude])
+	lon, lonOK := degrees(gps[tagGPSLongitude])
+	if !latOK || !lonOK || math.Abs(lat) > 90 || math.Abs(lon) > 180 {
+		return nil
+	}
+
+	if strings.EqualFold(gps[tagGPSLatitudeRef].string(), "S") {
+		lat = -lat
+	}
+	if strings.EqualFold(gps[tagGPSLongitudeRef].string(), "W") {
+		lon = -lon
+	}
+
+	res := &GPS{Latitude: lat, Longitude: lon}
+	if alt := gps[tagGPSAltitude]; alt.count > 0 {
+		res.Altitude = alt.rational(0)
+		if gps[tagGPSAltitudeRef].uint() == 1 {
+			// Below sea level
+			res.Altitude = -res.Altitude
+		}
+	}
+
+	return res
+}
+
+// degrees converts degrees, minutes and seconds into degrees
+func degrees(e entry) (float64, bool) {
+	if e.count < 3 || (e.typ != typeRational && e.typ != typeSRational) {
+		return 0, false
+	}
+
+	return e.rational(0) + e.rational(1)/60 + e.rational(2)/3600, true
+}
+
+// parseDateTime parses an EXIF date with an optional offset ("+03:00")
+func parseDateTime(s, offset string) (time.Time, bool) {
+	if s == "" || strings.HasPrefix(s, "0000") {
+		return time.Time{}, false
+	}
+
+	if offset != "" {
+		t, err := time.Parse(dateTimeLayout+"-07:00", s+offset)
+		if err == nil {
+			return t, true
+		}
+	}
+
+	t, err := time.ParseInLocation(dateTimeLayout, s, time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// string returns an ASCII value without trailing NULs and spaces
+func (e entry) string() string {
+	if e.typ != typeASCII && e.typ != typeUndefined {
+		return ""
+	}
+
+	s := string(e.value)
+	if i := strings.IndexByte(s, 0); i != -1 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s)
+}
+
+// uint returns the first value of an integer type
+func (e entry) uint() int {
+	if e.count == 0 {
+		return 0
+	}
+
+	switch e.typ {
+	case typeByte:
+		return int(e.value[0])
+	case typeShort:
+		return int(e.order.Uint16(e.value))
+	case typeLong:
+		return int(e.order.Uint32(e.value))
+	default:
+		return 0
+	}
+}
+
+// rational returns the i-th value of a rational type
+func (e entry) rational(i int) float64 {
+	if i >= e.count {
+		return 0
+	}
+
+	switch e.typ {
+	case typeRational:
+		num, denom := e.order.Uint32(e.value[i*8:]), e.order.Uint32(e.value[i*8+4:])
+		if denom == 0 {
+			return 0
+		}
+		return float64(num) / float64(denom)
+	case typeSRational:
+		num, denom := int32(e.order.Uint32(e.value[i*8:])), int32(e.order.Uint32(e.value[i*8+4:]))
+		if denom == 0 {
+			return 0
+		}
+		return float64(num) / float64(denom)
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,51 @@
+package files
+
+import (
+	"strings"
+
+	"github.com/tags-drive/core/internal/storage/files/extensions"
+)
+
+// monthLayout is a layout of keys of Facets.Months
+const monthLayout = "2006-01"
+
+// Facets contains numbers of files with every tag, type, extension and upload month
+type Facets struct {
+	Tags  map[int]int                 `json:"tags"`
+	Types map[extensions.FileType]int `json:"types"`
+	// Extensions are in lower case with a dot. Files without an extension are counted with an empty key
+	Extensions map[string]int `json:"extensions"`
+	// Months are in format YYYY-MM in the server time zone
+	Months map[string]int `json:"months"`
+}
+
+func newFacets() Facets {
+	return Facets{
+		Tags:       make(map[int]int),
+		Types:      make(map[extensions.FileType]int),
+		Extensions: make(map[string]int),
+		Months:     make(map[string]int),
+	}
+}
+
+// add counts a file. Tags are counted only if countTags is true
+func (f Facets) add(file File, countTags bool) {
+	if countTags {
+		for _, tag := range file.Tags {
+			f.Tags[tag]++
+		}
+	}
+
+	f.Types[file.Type.FileType]++
+	f.Extensions[strings.ToLower(file.Type.Ext)]++
+	f.Months[file.AddTime.Local().Format(monthLayout)]++
+}
+
+// fileIDs returns ids of passed files
+func fileIDs(files []File) []int {
+	ids := make([]int, len(files))
+	for i := range files {
+		ids[i] = files[i].ID
+	}
+	return ids
+}
@@ -3,12 +3,14 @@ package files
 import (
 	"archive/zip"
 	"bytes"
+	"image"
 	"io"
 	"mime/multipart"
+	"net/http"
 	"os"
 	"path/filepath"
-	"runtime"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/ShoshinNikita/go-disk-buffer"
@@ -17,6 +19,7 @@ import (
 
 	"github.com/tags-drive/core/internal/storage/files/aggregation"
 	bs "github.com/tags-drive/core/internal/storage/files/binary_storage"
+	"github.com/tags-drive/core/internal/storage/files/exif"
 	"github.com/tags-drive/core/internal/storage/files/extensions"
 	"github.com/tags-drive/core/internal/storage/files/resizing"
 	"github.com/tags-drive/core/internal/utils"
@@ -24,11 +27,12 @@ import (
 
 // Errors
 var (
-	ErrFileIsNotExist    = errors.New("the file doesn't exist")
-	ErrAlreadyExist      = errors.New("file already exists")
-	ErrFileDeletedAgain  = errors.New("file can't be deleted again")
-	ErrOffsetOutOfBounds = errors.New("offset is out of bounds")
-	ErrEmptyNewName      = errors.New("new name can't be empty")
+	ErrFileIsNotExist     = errors.New("the file doesn't exist")
+	ErrAlreadyExist       = errors.New("file already exists")
+	ErrFileDeletedAgain   = errors.New("file can't be deleted again")
+	ErrOffsetOutOfBounds  = errors.New("offset is out of bounds")
+	ErrEmptyNewName       = errors.New("new name can't be empty")
+	ErrRevisionIsNotExist = errors.New("the revision doesn't exist")
 )
 
 // FileStorage exposes methods for interactions with files
@@ -37,7 +41,18 @@ type FileStorage struct {
 
 	metaStorage metadataStorage
 	binStorage  binaryStorage
-	logger      *clog.Logger
+	// blobsMutex guards blobs. Refs to new blobs are added under RLock, blobs are released under Lock
+	blobsMutex     *sync.RWMutex
+	thumbnailLocks *thumbnailLocks
+	// duplicateLocks serializes uploads which can be duplicates of each other (see lockDuplicates)
+	duplicateLocks *keyedMutex
+	processing     *processingQueue
+	uploads        *resumableUploads
+	uploadJobs     *uploadJobs
+	quotas         *quotaTracker
+	importClient   *http.Client
+	contentIndex   *contentIndex
+	logger         *clog.Logger
 }
 
 // NewFileStorage creates new FileStorage
@@ -55,13 +70,15 @@ func NewFileStorage(cnf Config, lg *clog.Logger) (*FileStorage, error) {
 
 	// Init metadata storage
 	switch cnf.MetadataStorageType {
+	case "sqlite":
+		metaStorage = newSqliteFileStorage(cnf, lg)
 	case "json":
 		fallthrough
 	default:
 		metaStorage = newJsonFileStorage(cnf, lg)
-		if err := metaStorage.init(); err != nil {
-			return nil, errors.Wrap(err, "can't init a new Metadata Storage")
-		}
+	}
+	if err := metaStorage.init(); err != nil {
+		return nil, errors.Wrap(err, "can't init a new Metadata Storage")
 	}
 
 	// Init binary storage
@@ -95,17 +112,51 @@ func NewFileStorage(cnf Config, lg *clog.Logger) (*FileStorage, error) {
 		}
 	}
 
-	return &FileStorage{
-		config:      cnf,
-		metaStorage: metaStorage,
-		binStorage:  binStorage,
-		logger:      lg,
-	}, nil
+	// Load content index. It can be rebuilt, so errors are only logged
+	index := newContentIndex()
+	if err := index.load(filepath.Join(cnf.VarFolder, contentIndexFile), cnf.Encrypt, cnf.PassPhrase); err != nil {
+		lg.Errorf("can't load the content index, it will be rebuilt: %s\n", err)
+	}
+
+	// Load states of resumable uploads. Chunks of lost uploads are deleted by fsck
+	uploads := newResumableUploads(cnf)
+	if err := uploads.load(); err != nil {
+		lg.Errorf("can't load resumable uploads: %s\n", err)
+	}
+
+	fs := &FileStorage{
+		config:         cnf,
+		metaStorage:    metaStorage,
+		binStorage:     binStorage,
+		blobsMutex:     new(sync.RWMutex),
+		thumbnailLocks: newThumbnailLocks(cnf.ProcessingWorkers),
+		duplicateLocks: newKeyedMutex(),
+		uploads:        uploads,
+		uploadJobs:     newUploadJobs(),
+		quotas:         newQuotaTracker(),
+		importClient:   newImportClient(cnf),
+		contentIndex:   index,
+		logger:         lg,
+	}
+	fs.quotas.init(metaStorage.getFiles("", "", false))
+	fs.processing = newProcessingQueue(cnf.ProcessingWorkers, fs.processFile, fs.failProcessing, lg)
+
+	return fs, nil
 }
 
 // StartBackgroundJobs starts all background services
 func (fs FileStorage) StartBackgroundJobs() {
+	fs.resumeProcessing()
+	fs.processing.start()
+
 	go fs.scheduleDeleting()
+	go fs.scheduleUploadsExpiration()
+	go fs.scheduleUploadJobsExpiration()
+	go fs.updateContentIndex()
+
+	if fs.config.ScrubInterval > 0 {
+		go fs.scheduleScrubbing()
+	}
 }
 
 // Get returns all "good" sorted files
@@ -117,37 +168,71 @@ func (fs FileStorage) Get(cnf GetFilesConfig) ([]File, error) {
 		count  = cnf.Count
 	)
 
-	parsedExpr, err := aggregation.ParseLogicalExpr(cnf.Expr)
+	files, err := fs.getSortedFiles(cnf)
 	if err != nil {
 		return []File{}, err
 	}
-
-	search := strings.ToLower(cnf.Search)
-	files := fs.metaStorage.getFiles(parsedExpr, search, cnf.IsRegexp)
 	if len(files) == 0 && offset == 0 {
 		// We don't return error, when there're no files and offset isn't set
 		return []File{}, nil
 	}
 
-	// Filter files at first
-	if cnf.Filter != nil {
-		files, err = cnf.Filter(files)
-		if err != nil {
-			return []File{}, err
-		}
-	}
-
 	if offset >= len(files) {
 		return []File{}, ErrOffsetOutOfBounds
 	}
 
-	sortFiles(cnf.SortMode, files)
-
 	if count == 0 || offset+count > len(files) {
 		count = len(files) - offset
 	}
 
-	return files[offset : offset+count], nil
+	files = files[offset : offset+count]
+	if cnf.ContentSearch != "" {
+		fs.fillSnippets(files, cnf.ContentSearch)
+	}
+
+	return files, nil
+}
+
+// getSortedFiles returns all "good" files sorted according to cnf.SortMode or cnf.Sort
+func (fs FileStorage) getSortedFiles(cnf GetFilesConfig) ([]File, error) {
+	spec := cnf.sortSpec()
+	if err := spec.Check(); err != nil {
+		return nil, err
+	}
+
+	if cnf.Area != nil {
+		if err := cnf.Area.Check(); err != nil {
+			return nil, err
+		}
+	}
+
+	parsedExpr, err := aggregation.ParseExpr(cnf.Expr, cnf.Tags)
+	if err != nil {
+		return nil, err
+	}
+
+	search := strings.ToLower(cnf.Search)
+	files := fs.metaStorage.getFiles(parsedExpr, search, cnf.IsRegexp)
+	if cnf.Area != nil {
+		files, err = fs.filterFilesByArea(files, *cnf.Area)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cnf.ContentSearch != "" {
+		files = fs.contentIndex.filterFiles(files, cnf.ContentSearch)
+	}
+
+	if cnf.Filter != nil {
+		files, err = cnf.Filter(files)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sortFilesBySpec(spec, files)
+
+	return files, nil
 }
 
 // GetFile returns a file with passed id
@@ -157,7 +242,29 @@ func (fs FileStorage) GetFile(id int) (File, error) {
 
 // CopyFile copies files from disk or another storage to a passed io.Writer
 func (fs FileStorage) CopyFile(w io.Writer, fileID int, resizedImage bool) error {
-	return fs.binStorage.GetFile(w, fileID, resizedImage)
+	if resizedImage {
+		return fs.binStorage.GetFile(w, fileID, true)
+	}
+
+	file, err := fs.metaStorage.getFile(fileID)
+	if err != nil {
+		return err
+	}
+
+	return fs.copyRevision(w, file, file.CurrentRevision())
+}
+
+// copyRevision writes content of a revision into passed io.Writer
+func (fs FileStorage) copyRevision(w io.Writer, file File, revision Revision) error {
+	switch {
+	case revision.Hash != "":
+		return fs.binStorage.GetBlob(w, revision.Hash)
+	case revision.Number == file.CurrentRevision().Number:
+		// Content of old files is stored by id
+		return fs.binStorage.GetFile(w, file.ID, false)
+	default:
+		return fs.binStorage.GetFileRevision(w, file.ID, revision.Number)
+	}
 }
 
 // CheckFile checks if file with passed id exists
@@ -194,7 +301,12 @@ func (fs FileStorage) Archive(ids []int) (body io.Reader, err error) {
 
 		// Get stats and create a header
 
-		stat, err := fs.binStorage.GetFileStats(id)
+		var stat os.FileInfo
+		if fileInfo.Hash != "" {
+			stat, err = fs.binStorage.GetBlobStats(fileInfo.Hash)
+		} else {
+			stat, err = fs.binStorage.GetFileStats(id)
+		}
 		if err != nil {
 			fs.logger.Errorf("can't load file \"%s\"\n", fileInfo.Filename)
 			continue
@@ -210,7 +322,7 @@ func (fs FileStorage) Archive(ids []int) (body io.Reader, err error) {
 			continue
 		}
 
-		err = fs.binStorage.GetFile(wr, id, false)
+		err = fs.copyRevision(wr, fileInfo, fileInfo.CurrentRevision())
 		if err != nil {
 			fs.logger.Errorf("can't load file \"%s\"\n", fileInfo.Filename)
 			continue
@@ -221,91 +333,404 @@ func (fs FileStorage) Archive(ids []int) (body io.Reader, err error) {
 }
 
 // Upload uploads a new file
-func (fs FileStorage) Upload(f *multipart.FileHeader, tags []int) (err error) {
+func (fs FileStorage) Upload(f *multipart.FileHeader, tags []int) error {
 	file, err := f.Open()
 	if err != nil {
 		return errors.Wrap(err, "can't open a file")
 	}
 	defer file.Close()
 
-	ext := filepath.Ext(f.Filename)
-	fileType := extensions.GetExt(ext)
+	_, err = fs.upload(file, f.Size, f.Filename, tags)
+	return err
+}
 
-	newFileID := fs.metaStorage.addFile(f.Filename, fileType, tags, f.Size, time.Now())
+// UploadReader uploads a new file from io.Reader. The size of the content can be unknown,
+// so it is computed while the content is being saved. The content isn't held in memory
+func (fs FileStorage) UploadReader(r io.Reader, filename string, tags []int) (UploadResult, error) {
+	return fs.upload(r, -1, filename, tags)
+}
 
-	// If we will get a major error, we will have to panic to delete record in file storage
-	defer func() {
-		if r := recover(); r != nil {
-			// Remove record in storage
-			// We can only log this error
-			e := fs.metaStorage.deleteFileForce(newFileID)
-			if e != nil {
-				fs.logger.Errorf("can't delete record in file storage after error in Upload function: %s\n", e)
-			}
+// upload uploads a new file. size can be -1 if it is unknown.
+//
+// Duplicates are detected by the hash of the content (and by the filename if Config.DuplicatesByFilename
+// is true) and handled according to Config.DuplicatePolicy. If the file is rejected, ErrAlreadyExist
+// is returned (wrapped) with the result which contains the duplicates
+func (fs FileStorage) upload(r io.Reader, size int64, filename string, tags []int) (UploadResult, error) {
+	fileType := extensions.GetExt(filepath.Ext(filename))
+	tags = uniqueTags(tags)
+
+	// Check quotas before saving anything
+	quota, err := fs.reserveQuota(fileType.FileType, size)
+	if err != nil {
+		return UploadResult{}, err
+	}
+	defer quota.release()
 
-			e, ok := r.(error)
-			if !ok {
-				err = errors.New("unexpected error")
-				return
+	var (
+		res UploadResult
+		// revisionAdded is true if content was saved as a new revision of a merged file
+		revisionAdded bool
+		// unlock unlocks possible duplicates of the file. It is set when the content is saved
+		unlock func()
+	)
+	err = fs.storeContent(quota.wrap(r), size, func(hash string, size int64) (err error) {
+		// Duplicates are searched and the file is added under the lock, so a concurrent upload of
+		// the same content can't pass the check. Replaced files are moved into the Trash under it too
+		unlock = fs.lockDuplicates(hash, filename)
+		defer func() {
+			if err != nil {
+				// The blob is released after an error, it can't be done under the lock
+				unlock()
+				unlock = nil
 			}
+		}()
 
-			err = e
+		duplicates, err := fs.findDuplicates(hash, filename)
+		if err != nil {
+			return err
+		}
+		if len(duplicates) > 0 {
+			res.Duplicates = fileIDs(duplicates)
+			res.Action = fs.duplicatePolicy()
 		}
-	}()
 
-	// Save file
-	switch fileType.FileType {
-	case extensions.FileTypeImage:
-		// Create 2 io.Reader from file
-		imageReader := new(bytes.Buffer)
-		fileReader := io.TeeReader(file, imageReader)
+		switch res.Action {
+		case DuplicateReject:
+			return errors.Wrapf(ErrAlreadyExist, "duplicate of %s", describeFiles(duplicates))
+		case DuplicateMerge:
+			res.File, revisionAdded, err = fs.mergeUpload(duplicates[0], tags, hash, size)
+			return errors.Wrapf(err, "can't merge the file into %q", duplicates[0].Filename)
+		}
 
-		// Save an original image
-		err = fs.binStorage.SaveFile(fileReader, newFileID, f.Size, false)
+		res.File.ID, err = fs.metaStorage.addFile(filename, fileType, tags, size, hash, time.Now())
 		if err != nil {
-			// Panic will be recovered
-			panic(err)
+			return errors.Wrap(err, "can't add a file into Metadata Storage")
+		}
+		fs.quotas.setFile(File{ID: res.File.ID, Type: fileType, Size: size, Hash: hash})
+		return nil
+	})
+	if err != nil {
+		if quota.err != nil {
+			// Content doesn't fit into the quota
+			return UploadResult{}, quota.err
+		}
+		if errors.Cause(err) == ErrAlreadyExist {
+			return res, err
+		}
+		return UploadResult{}, err
+	}
+
+	if res.Action == DuplicateReplace {
+		// The new file is saved. Errors can only be logged
+		for _, id := range res.Duplicates {
+			if err := fs.metaStorage.deleteFile(id); err != nil && err != ErrFileDeletedAgain {
+				fs.logger.Errorf("can't move the replaced file (id is '%d') into the Trash: %s\n", id, err)
+			}
 		}
+	}
+	unlock()
 
-		// After saving the original file we can ignore errors and only log them.
+	if res.Action == DuplicateMerge {
+		if revisionAdded {
+			if res.File, err = fs.revisionAdded(res.File); err != nil {
+				return UploadResult{}, err
+			}
+		}
+		return res, nil
+	}
 
-		// Convert imageReader into image.Image
-		img, err := resizing.Decode(imageReader)
-		if err != nil {
-			fs.logger.Errorf("can't decode an image %s: %s\n", f.Filename, err)
-			break
+	// After saving the original file we can ignore errors and only log them.
+	if fileType.FileType == extensions.FileTypeImage {
+		fs.scheduleProcessing(res.File.ID)
+	}
+
+	if res.File, err = fs.metaStorage.getFile(res.File.ID); err != nil {
+		return UploadResult{}, err
+	}
+
+	if isIndexable(fileType) {
+		if err := fs.indexFile(res.File); err != nil {
+			fs.logger.Errorf("can't index file \"%s\": %s\n", filename, err)
+		}
+	}
+
+	return res, nil
+}
+
+// storeContent saves content into Binary Storage and calls commit to add the hash and the size of the content
+// into Metadata Storage. The size is counted while the content is being saved, so passed size can be -1.
+// The blob is released if commit returns an error
+func (fs FileStorage) storeContent(r io.Reader, size int64, commit func(hash string, size int64) error) error {
+	counter := &countingReader{r: r}
+
+	// Blobs can't be released till refs to them are added into Metadata Storage
+	fs.blobsMutex.RLock()
+
+	hash, err := fs.binStorage.SaveBlob(counter, size)
+	if err != nil {
+		fs.blobsMutex.RUnlock()
+		return errors.Wrap(err, "can't save a file into Binary Storage")
+	}
+
+	err = commit(hash, counter.n)
+	fs.blobsMutex.RUnlock()
+	if err != nil {
+		// We can only log this error
+		if e := fs.releaseBlobs(hash); e != nil {
+			fs.logger.Errorf("can't release a blob after an error: %s\n", e)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// countingReader counts read bytes
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// releaseBlobs deletes blobs which aren't referenced by any file
+func (fs FileStorage) releaseBlobs(hashes ...string) error {
+	fs.blobsMutex.Lock()
+	defer fs.blobsMutex.Unlock()
+
+	var lastErr error
+	checked := make(map[string]bool)
+	for _, hash := range hashes {
+		if checked[hash] {
+			continue
 		}
+		checked[hash] = true
 
-		// Save a resized image
-		img = resizing.Resize(img)
-		r, err := resizing.Encode(img, ext)
+		refs, err := fs.metaStorage.countBlobRefs(hash)
 		if err != nil {
-			fs.logger.Errorf("can't encode a resized image %s: %s\n", f.Filename, err)
-			break
+			lastErr = err
+			continue
+		}
+		if refs > 0 {
+			// Content is used by other files
+			continue
 		}
 
-		var size int64
-		r, size = utils.GetReaderSize(r)
-		fs.binStorage.SaveFile(r, newFileID, size, true)
+		if err := fs.binStorage.DeleteBlob(hash); err != nil {
+			lastErr = errors.Wrapf(err, "can't delete blob %s", hash)
+		}
+	}
+
+	return lastErr
+}
+
+// createResizedImage resizes an image and saves it
+func (fs FileStorage) createResizedImage(content []byte, id int, filename string) error {
+	// Convert image into image.Image
+	img, err := decodeImage(content)
+	if err != nil {
+		return errors.Wrapf(err, "can't decode an image %s", filename)
+	}
+
+	// Save a resized image
+	img = resizing.Resize(img)
+	r, err := resizing.Encode(img, filepath.Ext(filename))
+	if err != nil {
+		return errors.Wrapf(err, "can't encode a resized image %s", filename)
+	}
+
+	var size int64
+	r, size = utils.GetReaderSize(r)
+	err = fs.binStorage.SaveFile(r, id, size, true)
+	if err != nil {
+		return errors.Wrapf(err, "can't save a resized image %s", filename)
+	}
+
+	return nil
+}
+
+// decodeImage decodes an image and applies its EXIF orientation
+func decodeImage(content []byte) (image.Image, error) {
+	img, err := resizing.Decode(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+
+	// Invalid EXIF data isn't an error. Orientation is 0 if it is unknown
+	if meta, err := exif.Read(content); err == nil {
+		img = resizing.Orient(img, meta.Orientation)
+	}
+
+	return img, nil
+}
+
+// GetRevisions returns all revisions of a file
+func (fs FileStorage) GetRevisions(id int) ([]Revision, error) {
+	file, err := fs.metaStorage.getFile(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return file.GetRevisions(), nil
+}
+
+// CopyFileRevision copies a revision of a file to a passed io.Writer
+func (fs FileStorage) CopyFileRevision(w io.Writer, id, revision int) error {
+	file, err := fs.metaStorage.getFile(id)
+	if err != nil {
+		return err
+	}
+
+	rev, ok := file.getRevision(revision)
+	if !ok {
+		return ErrRevisionIsNotExist
+	}
+
+	return fs.copyRevision(w, file, rev)
+}
+
+// UploadRevision replaces the content of a file. The previous content is kept as an old revision
+func (fs FileStorage) UploadRevision(id int, f *multipart.FileHeader) (File, error) {
+	fileInfo, err := fs.metaStorage.getFile(id)
+	if err != nil {
+		return File{}, err
+	}
+
+	content, err := f.Open()
+	if err != nil {
+		return File{}, errors.Wrap(err, "can't open a file")
+	}
+	defer content.Close()
+
+	return fs.addRevision(fileInfo, content, f.Size)
+}
+
+// RestoreRevision makes an old revision the current one. The restored content is saved as a new revision,
+// so the history isn't changed
+func (fs FileStorage) RestoreRevision(id, revision int) (File, error) {
+	fileInfo, err := fs.metaStorage.getFile(id)
+	if err != nil {
+		return File{}, err
+	}
+
+	rev, ok := fileInfo.getRevision(revision)
+	if !ok {
+		return File{}, ErrRevisionIsNotExist
+	}
+
+	current := fileInfo.CurrentRevision()
+	if rev.Number == current.Number {
+		// Nothing to restore
+		return fileInfo, nil
+	}
+
+	if rev.Hash == "" || current.Hash == "" {
+		// Content is stored by id. Have to save it as a blob
+
+		// Max size of a revision in memory is 20MB
+		buff := buffer.NewBufferWithMaxMemorySize(20 << 20)
+		defer buff.Reset()
+
+		err = fs.copyRevision(buff, fileInfo, rev)
 		if err != nil {
-			fs.logger.Errorf("can't save a resized image %s: %s\n", f.Filename, err)
+			return File{}, errors.Wrapf(err, "can't load revision %d", revision)
 		}
-	default:
-		// Save a file
-		err = fs.binStorage.SaveFile(file, newFileID, f.Size, false)
+
+		return fs.addRevision(fileInfo, buff, int64(buff.Len()))
+	}
+
+	// The blob is already stored. Just add a new ref to it
+	fs.blobsMutex.RLock()
+	newFileInfo, err := fs.addStoredRevision(fileInfo, rev.Hash, rev.Size)
+	fs.blobsMutex.RUnlock()
+	if err != nil {
+		return File{}, err
+	}
+
+	return fs.revisionAdded(newFileInfo)
+}
+
+// addRevision saves content as a new revision of a file, deletes thumbnails and schedules processing of images
+func (fs FileStorage) addRevision(fileInfo File, content io.Reader, size int64) (File, error) {
+	// Check quotas before saving anything
+	quota, err := fs.reserveQuota(fileInfo.Type.FileType, size)
+	if err != nil {
+		return File{}, err
+	}
+	defer quota.release()
+
+	var newFileInfo File
+	err = fs.storeContent(quota.wrap(content), size, func(hash string, size int64) (err error) {
+		newFileInfo, err = fs.addStoredRevision(fileInfo, hash, size)
+		return err
+	})
+	if err != nil {
+		if quota.err != nil {
+			// Content doesn't fit into the quota
+			return File{}, quota.err
+		}
+		return File{}, err
+	}
+
+	return fs.revisionAdded(newFileInfo)
+}
+
+// addStoredRevision adds a stored blob as a new revision of a file. Content of files without a hash
+// is moved into the archive of revisions. It must be called under blobsMutex.RLock
+func (fs FileStorage) addStoredRevision(fileInfo File, hash string, size int64) (File, error) {
+	current := fileInfo.CurrentRevision()
+
+	if current.Hash == "" {
+		err := fs.binStorage.ArchiveFile(fileInfo.ID, current.Number)
 		if err != nil {
-			// Panic will be recovered
-			panic(err)
+			return File{}, errors.Wrap(err, "can't archive the current revision")
 		}
 	}
 
-	// TODO: does it really help?
-	// resizing.Decode() allocates a lot of memory. GC doesn't keep up to free it
-	// when there are a lot of Upload() calls. Calling runtime.GC() can
-	// decrease max memory usage by 1.5 times with very small performance drop.
-	runtime.GC()
+	newFileInfo, err := fs.metaStorage.addFileRevision(fileInfo.ID, size, hash, time.Now())
+	if err != nil {
+		if current.Hash == "" {
+			// We can only log this error
+			if e := fs.binStorage.DeleteFileRevision(fileInfo.ID, current.Number); e != nil {
+				fs.logger.Errorf("can't delete an archived revision after an error: %s\n", e)
+			}
+		}
+		return File{}, errors.Wrap(err, "can't add a new revision into Metadata Storage")
+	}
+	fs.quotas.setFile(newFileInfo)
 
-	return nil
+	if current.Hash == "" {
+		// The content was archived
+		if err := fs.binStorage.DeleteFile(fileInfo.ID, false); err != nil {
+			fs.logger.Errorf("can't delete the original file (id is '%d'): %s\n", fileInfo.ID, err)
+		}
+	}
+
+	return newFileInfo, nil
+}
+
+// revisionAdded deletes thumbnails and schedules processing of an image, indexes content of a file
+// after a new revision is added. It returns the updated file
+func (fs FileStorage) revisionAdded(fileInfo File) (File, error) {
+	if fileInfo.Type.FileType == extensions.FileTypeImage {
+		fs.deleteThumbnails(fileInfo.ID)
+		fs.scheduleProcessing(fileInfo.ID)
+
+		var err error
+		if fileInfo, err = fs.metaStorage.getFile(fileInfo.ID); err != nil {
+			return File{}, err
+		}
+	}
+
+	if err := fs.indexFile(fileInfo); err != nil {
+		fs.logger.Errorf("can't index file \"%s\": %s\n", fileInfo.Filename, err)
+	}
+
+	return fileInfo, nil
 }
 
 // Rename renames a file
@@ -321,7 +746,7 @@ func (fs FileStorage) Rename(id int, newName string) (File, error) {
 
 // ChangeTags changes the tags
 func (fs FileStorage) ChangeTags(id int, tags []int) (File, error) {
-	return fs.metaStorage.updateFileTags(id, tags)
+	return fs.metaStorage.updateFileTags(id, uniqueTags(tags))
 }
 
 // ChangeDescription changes the description
@@ -350,11 +775,36 @@ func (fs FileStorage) DeleteForce(id int) error {
 	if err != nil {
 		return err
 	}
+	fs.quotas.removeFile(id)
 
-	var errMsg string
-	// Delete the original file
-	err = fs.binStorage.DeleteFile(file.ID, false)
-	if err != nil {
+	fs.contentIndex.delete(id)
+
+	var (
+		errMsg string
+		hashes []string
+	)
+	current := file.CurrentRevision().Number
+	for _, r := range file.GetRevisions() {
+		switch {
+		case r.Hash != "":
+			hashes = append(hashes, r.Hash)
+		case r.Number == current:
+			// Delete the original file. Content of old files is stored by id
+			err = fs.binStorage.DeleteFile(file.ID, false)
+			if err != nil {
+				errMsg = "can't delete the original file (id is '%d')"
+			}
+		default:
+			// Delete an archived revision. We can only log errors
+			if err := fs.binStorage.DeleteFileRevision(file.ID, r.Number); err != nil {
+				fs.logger.Errorf("can't delete revision %d of file with id %d: %s\n", r.Number, file.ID, err)
+			}
+		}
+	}
+
+	// Blobs are deleted only if there are no other refs to them
+	if e := fs.releaseBlobs(hashes...); e != nil {
+		err = e
 		errMsg = "can't delete the original file (id is '%d')"
 	}
 
@@ -368,6 +818,7 @@ func (fs FileStorage) DeleteForce(id int) error {
 			errMsg = "can't delete the resized image (id is '%d')"
 			err = err1
 		}
+		fs.deleteThumbnails(file.ID)
 	}
 
 	return errors.Wrapf(err, errMsg, file.ID)
@@ -411,5 +862,16 @@ func (fs FileStorage) scheduleDeleting() {
 
 // Shutdown gracefully shutdown FileStorage
 func (fs FileStorage) Shutdown() error {
+	// Wait for files of upload jobs and resumable uploads which are stored at the moment
+	fs.uploadJobs.storing.Wait()
+	fs.uploads.finishing.Wait()
+	// Wait for images which are processed at the moment
+	fs.processing.stop()
+
+	if err := fs.saveContentIndex(); err != nil {
+		// The index will be updated on the next start
+		fs.logger.Errorf("%s\n", err)
+	}
+
 	return fs.metaStorage.shutdown()
 }
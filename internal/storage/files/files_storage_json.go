@@ -2,78 +2,117 @@ package files
 
 import (
 	"os"
-	"regexp"
-	"strings"
+	"sort"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	clog "github.com/ShoshinNikita/log/v2"
 	"github.com/pkg/errors"
 
 	"github.com/tags-drive/core/internal/storage/files/aggregation"
+	"github.com/tags-drive/core/internal/storage/files/exif"
 	"github.com/tags-drive/core/internal/storage/files/extensions"
 	"github.com/tags-drive/core/internal/utils"
 )
 
-// saveInterval is used in saveOnDisk. It defines interval between calls of jfs.write()
-const saveInterval = time.Second * 10
+const (
+	// saveInterval is used in saveOnDisk. It defines interval between checks of the journal
+	saveInterval = time.Second * 10
+	// compactInterval is a max interval between compactions of a non-empty journal
+	compactInterval = time.Hour
+	// maxJournalRecords is a number of journal records after which the journal is compacted
+	maxJournalRecords = 1000
+)
+
+// journalRecord describes a change of jsonFileStorage.files. It contains the final state of changed files,
+// so a record can be applied several times (for example, if the app was killed between a snapshot write
+// and the journal reset)
+type journalRecord struct {
+	Put    []File `json:"put,omitempty"`
+	Delete []int  `json:"delete,omitempty"`
+}
 
 // jsonFileStorage implements files.storage interface.
 // It is a map (id: FileInfo) with RWMutex
+//
+// Every change is written into the journal before it is applied. The journal is replayed
+// on start and periodically compacted into config.FilesJSONFile
 type jsonFileStorage struct {
 	config Config
 
 	// maxID is max id of current files. It is computed in init() method
 	maxID int
 	files map[int]File
-	mutex *sync.RWMutex
+	// tags is an index of tags of jfs.files
+	tags *tagIndex
+	// locations is an index of coordinates of jfs.files
+	locations *geoIndex
+	mutex     *sync.RWMutex
+
+	journal        *utils.Journal
+	lastCompaction time.Time
 
 	logger *clog.Logger
 
 	shutdownChan chan struct{}
-	// number of changes since last write() call
-	changes *uint32
 }
 
 func newJsonFileStorage(cnf Config, lg *clog.Logger) *jsonFileStorage {
-	changes := new(uint32)
-	atomic.StoreUint32(changes, 0)
-
 	return &jsonFileStorage{
 		config:       cnf,
 		maxID:        0,
 		files:        make(map[int]File),
+		tags:         newTagIndex(),
+		locations:    newGeoIndex(),
 		mutex:        new(sync.RWMutex),
 		logger:       lg,
 		shutdownChan: make(chan struct{}),
-		changes:      changes,
 	}
 }
 
 func (jfs *jsonFileStorage) init() error {
-	f, err := os.OpenFile(jfs.config.FilesJSONFile, os.O_RDWR, 0666)
+	f, err := os.Open(jfs.config.FilesJSONFile)
 	if err != nil {
-		// Have to create a new file
-		if os.IsNotExist(err) {
-			// We don't have to compute maxID, because there're no any files
-			// Can exit because we don't need to decode files from the file
-			err := jfs.createNewFile()
-			if err != nil {
-				return err
-			}
+		if !os.IsNotExist(err) {
+			return errors.Wrapf(err, "can't open file %s", jfs.config.FilesJSONFile)
+		}
 
-			go jfs.saveOnDisk()
-			return nil
+		// Have to create a new file
+		err := jfs.createNewFile()
+		if err != nil {
+			return err
 		}
+	} else {
+		err = utils.Decode(f, &jfs.files, jfs.config.Encrypt, jfs.config.PassPhrase)
+		f.Close()
+		if err != nil {
+			return errors.Wrap(err, "can't decode file")
+		}
+	}
+	jfs.tags.rebuild(jfs.files)
+	jfs.locations.rebuild(jfs.files)
 
-		return errors.Wrapf(err, "can't open file %s", jfs.config.FilesJSONFile)
+	// Apply changes made after the last snapshot
+	jfs.journal, err = utils.OpenJournal(jfs.config.FilesJSONFile+".journal", jfs.config.Encrypt, jfs.config.PassPhrase)
+	if err != nil {
+		return err
 	}
-	defer f.Close()
 
-	err = utils.Decode(f, &jfs.files, jfs.config.Encrypt, jfs.config.PassPhrase)
+	err = jfs.journal.Replay(func(data []byte) error {
+		var rec journalRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return err
+		}
+		jfs.apply(rec)
+
+		return nil
+	})
 	if err != nil {
-		return errors.Wrap(err, "can't decode file")
+		return errors.Wrap(err, "can't replay journal")
+	}
+
+	if n := jfs.journal.Len(); n > 0 {
+		jfs.logger.Infof("%d change(s) were restored from the journal\n", n)
 	}
 
 	// Compute maxID
@@ -83,40 +122,36 @@ func (jfs *jsonFileStorage) init() error {
 		}
 	}
 
+	jfs.lastCompaction = time.Now()
+
 	go jfs.saveOnDisk()
 
 	return nil
 }
 
-func (jfs jsonFileStorage) createNewFile() error {
+func (jfs *jsonFileStorage) createNewFile() error {
 	jfs.logger.Debugf("file %s doesn't exist. Need to create a new file\n", jfs.config.FilesJSONFile)
 
-	// Just create a new file
-	f, err := os.OpenFile(jfs.config.FilesJSONFile, os.O_CREATE|os.O_RDWR, 0666)
+	// Write empty files map
+	err := utils.WriteFileAtomic(jfs.config.FilesJSONFile, jfs.files, jfs.config.Encrypt, jfs.config.PassPhrase)
 	if err != nil {
 		return errors.Wrap(err, "can't create a new file")
 	}
-	f.Close()
-
-	// Write empty files map
-	jfs.write()
 
 	return nil
 }
 
-// saveOnDisk calls jfs.write() every saveInterval seconds. It must be ran in goroutine
+// saveOnDisk checks the journal every saveInterval seconds and calls jfs.compact() when the journal
+// is too long or wasn't compacted for compactInterval. It must be ran in goroutine
 // It finishes when jfs.shutdownChan is closed.
 func (jfs *jsonFileStorage) saveOnDisk() {
 	ticker := time.NewTicker(saveInterval)
 	for {
 		select {
 		case <-ticker.C:
-			changed := atomic.LoadUint32(jfs.changes) != 0
-			// Reset jfs.changes
-			atomic.StoreUint32(jfs.changes, 0)
-
-			if changed {
-				jfs.write()
+			n := jfs.journal.Len()
+			if n >= maxJournalRecords || (n > 0 && time.Since(jfs.lastCompaction) >= compactInterval) {
+				jfs.compact()
 			}
 
 		case <-jfs.shutdownChan:
@@ -126,26 +161,52 @@ func (jfs *jsonFileStorage) saveOnDisk() {
 	}
 }
 
-// write writes js.info into jfs.config.FilesJSONFile
-func (jfs jsonFileStorage) write() {
+// compact writes jfs.files into jfs.config.FilesJSONFile and clears the journal
+func (jfs *jsonFileStorage) compact() {
+	// Changes are blocked till the journal reset
 	jfs.mutex.RLock()
 	defer jfs.mutex.RUnlock()
 
-	f, err := os.OpenFile(jfs.config.FilesJSONFile, os.O_TRUNC|os.O_RDWR, 0666)
+	err := utils.WriteFileAtomic(jfs.config.FilesJSONFile, jfs.files, jfs.config.Encrypt, jfs.config.PassPhrase)
 	if err != nil {
-		jfs.logger.Errorf("can't open file %s: %s\n", jfs.config.FilesJSONFile, err)
+		jfs.logger.Warnf("can't write '%s': %s\n", jfs.config.FilesJSONFile, err)
 		return
 	}
-	defer f.Close()
 
-	err = utils.Encode(f, jfs.files, jfs.config.Encrypt, jfs.config.PassPhrase)
-	if err != nil {
-		jfs.logger.Warnf("can't write '%s': %s\n", jfs.config.FilesJSONFile, err)
+	if err := jfs.journal.Reset(); err != nil {
+		jfs.logger.Errorf("can't reset journal: %s\n", err)
+	}
+
+	jfs.lastCompaction = time.Now()
+}
+
+// commit writes a record into the journal and applies it. jfs.mutex must be locked
+func (jfs *jsonFileStorage) commit(rec journalRecord) error {
+	if err := jfs.journal.Append(rec); err != nil {
+		return errors.Wrap(err, "can't write a change into the journal")
+	}
+
+	jfs.apply(rec)
+
+	return nil
+}
+
+// apply applies a record to jfs.files and updates the indexes
+func (jfs *jsonFileStorage) apply(rec journalRecord) {
+	for _, f := range rec.Put {
+		jfs.files[f.ID] = f
+		jfs.tags.set(f.ID, f.Tags)
+		jfs.locations.set(f)
+	}
+	for _, id := range rec.Delete {
+		delete(jfs.files, id)
+		jfs.tags.delete(id)
+		jfs.locations.delete(id)
 	}
 }
 
 // checkFile return true if file with passed filename exists
-func (jfs jsonFileStorage) checkFile(id int) bool {
+func (jfs *jsonFileStorage) checkFile(id int) bool {
 	jfs.mutex.RLock()
 	defer jfs.mutex.RUnlock()
 
@@ -153,7 +214,7 @@ func (jfs jsonFileStorage) checkFile(id int) bool {
 	return ok
 }
 
-func (jfs jsonFileStorage) getFile(id int) (File, error) {
+func (jfs *jsonFileStorage) getFile(id int) (File, error) {
 	jfs.mutex.RLock()
 	defer jfs.mutex.RUnlock()
 
@@ -164,7 +225,7 @@ func (jfs jsonFileStorage) getFile(id int) (File, error) {
 	return f, nil
 }
 
-func (jfs jsonFileStorage) getFilesWithIDs(ids ...int) []File {
+func (jfs *jsonFileStorage) getFilesWithIDs(ids ...int) []File {
 	jfs.mutex.RLock()
 	defer jfs.mutex.RUnlock()
 
@@ -178,49 +239,72 @@ func (jfs jsonFileStorage) getFilesWithIDs(ids ...int) []File {
 	return files
 }
 
-// getFiles returns slice of FileInfo. If parsedExpr == "", it returns all files
-func (jfs jsonFileStorage) getFiles(parsedExpr aggregation.LogicalExpr, search string, isRegexp bool) (files []File) {
+func (jfs *jsonFileStorage) countFacets(ids []int) (Facets, error) {
 	jfs.mutex.RLock()
+	defer jfs.mutex.RUnlock()
 
-	files = make([]File, 0, len(jfs.files))
-	for _, v := range jfs.files {
-		if aggregation.IsGoodFile(parsedExpr, v.Tags) {
-			files = append(files, v)
+	facets := newFacets()
+	for _, id := range ids {
+		if f, ok := jfs.files[id]; ok {
+			facets.add(f, true)
 		}
 	}
 
-	jfs.mutex.RUnlock()
+	return facets, nil
+}
 
-	if search == "" {
-		return files
+func (jfs *jsonFileStorage) getLocations(box BoundingBox) ([]Location, error) {
+	jfs.mutex.RLock()
+	defer jfs.mutex.RUnlock()
+
+	return jfs.locations.get(box), nil
+}
+
+// getFiles returns slice of FileInfo. If parsedExpr == "", it returns all files
+func (jfs *jsonFileStorage) getFiles(parsedExpr aggregation.LogicalExpr, search string, isRegexp bool) (files []File) {
+	program, err := aggregation.Compile(parsedExpr)
+	if err != nil {
+		jfs.logger.Errorf("can't compile expression \"%s\": %s\n", parsedExpr, err)
+		return []File{}
 	}
 
-	var reg *regexp.Regexp
-	if isRegexp {
-		// search must be valid regular expression
-		reg = regexp.MustCompile(search)
+	jfs.mutex.RLock()
+
+	ids := program.Eval(jsonIndex{jfs.tags, jfs.files})
+	files = make([]File, 0, len(ids))
+	for _, id := range ids {
+		files = append(files, jfs.files[id])
 	}
 
-	// Need to remove files with incorrect name
-	var goodFiles []File
-	for i := range files {
-		if isRegexp && reg.MatchString(files[i].Filename) {
-			goodFiles = append(goodFiles, files[i])
-		} else if strings.Contains(strings.ToLower(files[i].Filename), search) {
-			goodFiles = append(goodFiles, files[i])
+	jfs.mutex.RUnlock()
+
+	return filterFilesByName(files, search, isRegexp)
+}
+
+// jsonIndex implements aggregation.Index. It must be used under jfs.mutex
+type jsonIndex struct {
+	*tagIndex
+	files map[int]File
+}
+
+func (idx jsonIndex) Filter(ids []int, match func(aggregation.Fields) bool) []int {
+	res := []int{}
+	for _, id := range ids {
+		if match(idx.files[id].fields()) {
+			res = append(res, id)
 		}
 	}
-
-	return goodFiles
+	return res
 }
 
-// addFile adds an element into js.files and call js.write()
-func (jfs *jsonFileStorage) addFile(filename string, fileType extensions.Ext, tags []int, size int64, addTime time.Time) (id int) {
+// addFile adds an element into jfs.files
+func (jfs *jsonFileStorage) addFile(filename string, fileType extensions.Ext, tags []int, size int64, hash string, addTime time.Time) (id int, err error) {
 	fileInfo := File{Filename: filename,
 		Type:    fileType,
 		Tags:    tags,
 		Size:    size,
 		AddTime: addTime,
+		Hash:    hash,
 	}
 
 	// We need a special var for thread safety
@@ -234,15 +318,15 @@ func (jfs *jsonFileStorage) addFile(filename string, fileType extensions.Ext, ta
 	defer jfs.mutex.Unlock()
 
 	// Set id
-	jfs.maxID++
-	fileID = jfs.maxID
+	fileID = jfs.maxID + 1
 	fileInfo.ID = fileID
 
-	jfs.files[jfs.maxID] = fileInfo
-
-	atomic.AddUint32(jfs.changes, 1)
+	if err := jfs.commit(journalRecord{Put: []File{fileInfo}}); err != nil {
+		return 0, err
+	}
+	jfs.maxID = fileID
 
-	return fileID
+	return fileID, nil
 }
 
 // renameFile renames a file
@@ -260,9 +344,10 @@ func (jfs *jsonFileStorage) renameFile(id int, newName string) (File, error) {
 
 	f := jfs.files[id]
 	f.Filename = newName
-	jfs.files[id] = f
 
-	atomic.AddUint32(jfs.changes, 1)
+	if err := jfs.commit(journalRecord{Put: []File{f}}); err != nil {
+		return File{}, err
+	}
 
 	return f, nil
 }
@@ -281,9 +366,10 @@ func (jfs *jsonFileStorage) updateFileTags(id int, changedTagsID []int) (File, e
 
 	f := jfs.files[id]
 	f.Tags = changedTagsID
-	jfs.files[id] = f
 
-	atomic.AddUint32(jfs.changes, 1)
+	if err := jfs.commit(journalRecord{Put: []File{f}}); err != nil {
+		return File{}, err
+	}
 
 	return f, nil
 }
@@ -298,9 +384,84 @@ func (jfs *jsonFileStorage) updateFileDescription(id int, newDesc string) (File,
 
 	f := jfs.files[id]
 	f.Description = newDesc
-	jfs.files[id] = f
 
-	atomic.AddUint32(jfs.changes, 1)
+	if err := jfs.commit(journalRecord{Put: []File{f}}); err != nil {
+		return File{}, err
+	}
+
+	return f, nil
+}
+
+func (jfs *jsonFileStorage) updateFileProcessing(id int, status ProcessingStatus) (File, error) {
+	if !jfs.checkFile(id) {
+		return File{}, ErrFileIsNotExist
+	}
+
+	jfs.mutex.Lock()
+	defer jfs.mutex.Unlock()
+
+	f := jfs.files[id]
+	f.Processing = status
+
+	if err := jfs.commit(journalRecord{Put: []File{f}}); err != nil {
+		return File{}, err
+	}
+
+	return f, nil
+}
+
+func (jfs *jsonFileStorage) updateFileImage(id int, image *exif.Metadata) (File, error) {
+	if !jfs.checkFile(id) {
+		return File{}, ErrFileIsNotExist
+	}
+
+	jfs.mutex.Lock()
+	defer jfs.mutex.Unlock()
+
+	f := jfs.files[id]
+	f.Image = image
+
+	if err := jfs.commit(journalRecord{Put: []File{f}}); err != nil {
+		return File{}, err
+	}
+
+	return f, nil
+}
+
+func (jfs *jsonFileStorage) addFileRevision(id int, size int64, hash string, addTime time.Time) (File, error) {
+	if !jfs.checkFile(id) {
+		return File{}, ErrFileIsNotExist
+	}
+
+	jfs.mutex.Lock()
+	defer jfs.mutex.Unlock()
+
+	f := jfs.files[id]
+	f.addRevision(size, hash, addTime)
+
+	if err := jfs.commit(journalRecord{Put: []File{f}}); err != nil {
+		return File{}, err
+	}
+
+	return f, nil
+}
+
+func (jfs *jsonFileStorage) setRevisionHash(id, revision int, hash string) (File, error) {
+	if !jfs.checkFile(id) {
+		return File{}, ErrFileIsNotExist
+	}
+
+	jfs.mutex.Lock()
+	defer jfs.mutex.Unlock()
+
+	f := jfs.files[id]
+	if !f.setRevisionHash(revision, hash) {
+		return File{}, ErrRevisionIsNotExist
+	}
+
+	if err := jfs.commit(journalRecord{Put: []File{f}}); err != nil {
+		return File{}, err
+	}
 
 	return f, nil
 }
@@ -323,14 +484,11 @@ func (jfs *jsonFileStorage) deleteFile(id int) error {
 
 	f.Deleted = true
 	f.TimeToDelete = deleteTime.Unix()
-	jfs.files[id] = f
-
-	atomic.AddUint32(jfs.changes, 1)
 
-	return nil
+	return jfs.commit(journalRecord{Put: []File{f}})
 }
 
-// deleteFile deletes an element (from structure) and call js.write()
+// deleteFileForce deletes an element (from structure)
 func (jfs *jsonFileStorage) deleteFileForce(id int) error {
 	if !jfs.checkFile(id) {
 		return ErrFileIsNotExist
@@ -339,11 +497,7 @@ func (jfs *jsonFileStorage) deleteFileForce(id int) error {
 	jfs.mutex.Lock()
 	defer jfs.mutex.Unlock()
 
-	delete(jfs.files, id)
-
-	atomic.AddUint32(jfs.changes, 1)
-
-	return nil
+	return jfs.commit(journalRecord{Delete: []int{id}})
 }
 
 // recover sets Deleted = false
@@ -362,29 +516,13 @@ func (jfs *jsonFileStorage) recover(id int) {
 	f := jfs.files[id]
 	f.Deleted = false
 	f.TimeToDelete = 0
-	jfs.files[id] = f
 
-	atomic.AddUint32(jfs.changes, 1)
+	if err := jfs.commit(journalRecord{Put: []File{f}}); err != nil {
+		jfs.logger.Errorf("can't recover file with id %d: %s\n", id, err)
+	}
 }
 
 func (jfs *jsonFileStorage) addTagsToFiles(filesIDs, tagsID []int) {
-	merge := func(a, b []int) []int {
-		t := make(map[int]struct{}, len(a)+len(b))
-		for i := range a {
-			t[a[i]] = struct{}{}
-		}
-		for i := range b {
-			t[b[i]] = struct{}{}
-		}
-
-		res := make([]int, 0, len(a)+len(b))
-		for k := range t {
-			res = append(res, k)
-		}
-
-		return res
-	}
-
 	goodID := func(id int) bool {
 		for i := range filesIDs {
 			if filesIDs[i] == id {
@@ -398,39 +536,23 @@ func (jfs *jsonFileStorage) addTagsToFiles(filesIDs, tagsID []int) {
 	jfs.mutex.Lock()
 	defer jfs.mutex.Unlock()
 
+	var rec journalRecord
 	for id, f := range jfs.files {
 		if !goodID(id) {
 			continue
 		}
 
-		f.Tags = merge(f.Tags, tagsID)
+		f.Tags = mergeTags(f.Tags, tagsID)
 
-		jfs.files[id] = f
+		rec.Put = append(rec.Put, f)
 	}
 
-	atomic.AddUint32(jfs.changes, 1)
+	if err := jfs.commit(rec); err != nil {
+		jfs.logger.Errorf("can't add tags to files: %s\n", err)
+	}
 }
 
 func (jfs *jsonFileStorage) removeTagsFromFiles(filesIDs, tagsID []int) {
-	exclude := func(a, b []int) []int {
-		t := make(map[int]bool, len(a)+len(b))
-		for i := range a {
-			t[a[i]] = true
-		}
-		for i := range b {
-			t[b[i]] = false
-		}
-
-		res := make([]int, 0, len(a)+len(b))
-		for k, v := range t {
-			if v {
-				res = append(res, k)
-			}
-		}
-
-		return res
-	}
-
 	goodID := func(id int) bool {
 		for i := range filesIDs {
 			if filesIDs[i] == id {
@@ -444,24 +566,28 @@ func (jfs *jsonFileStorage) removeTagsFromFiles(filesIDs, tagsID []int) {
 	jfs.mutex.Lock()
 	defer jfs.mutex.Unlock()
 
+	var rec journalRecord
 	for id, f := range jfs.files {
 		if !goodID(id) {
 			continue
 		}
 
-		f.Tags = exclude(f.Tags, tagsID)
+		f.Tags = excludeTags(f.Tags, tagsID)
 
-		jfs.files[id] = f
+		rec.Put = append(rec.Put, f)
 	}
 
-	atomic.AddUint32(jfs.changes, 1)
+	if err := jfs.commit(rec); err != nil {
+		jfs.logger.Errorf("can't remove tags from files: %s\n", err)
+	}
 }
 
 func (jfs *jsonFileStorage) removeTagFromAllFiles(tagID int) {
 	jfs.mutex.Lock()
 	defer jfs.mutex.Unlock()
 
-	for id, f := range jfs.files {
+	var rec journalRecord
+	for _, f := range jfs.files {
 		index := -1
 		for i := range f.Tags {
 			if f.Tags[i] == tagID {
@@ -473,12 +599,14 @@ func (jfs *jsonFileStorage) removeTagFromAllFiles(tagID int) {
 			continue
 		}
 		// Erase tag
-		f.Tags = append(f.Tags[0:index], f.Tags[index+1:]...)
+		f.Tags = append(f.Tags[:index:index], f.Tags[index+1:]...)
 
-		jfs.files[id] = f
+		rec.Put = append(rec.Put, f)
 	}
 
-	atomic.AddUint32(jfs.changes, 1)
+	if err := jfs.commit(rec); err != nil {
+		jfs.logger.Errorf("can't remove tag with id %d from files: %s\n", tagID, err)
+	}
 }
 
 // getExpiredDeletedFiles returns ids of files with expired TimeToDelete
@@ -497,18 +625,41 @@ func (jfs *jsonFileStorage) getExpiredDeletedFiles() []int {
 	return filesForDeleting
 }
 
-func (jfs jsonFileStorage) shutdown() error {
+func (jfs *jsonFileStorage) countBlobRefs(hash string) (int, error) {
+	jfs.mutex.RLock()
+	defer jfs.mutex.RUnlock()
+
+	refs := 0
+	for _, file := range jfs.files {
+		refs += file.countRefs(hash)
+	}
+
+	return refs, nil
+}
+
+func (jfs *jsonFileStorage) findDuplicates(hash, filename string) ([]File, error) {
+	jfs.mutex.RLock()
+	defer jfs.mutex.RUnlock()
+
+	files := []File{}
+	for _, file := range jfs.files {
+		if file.isDuplicate(hash, filename) {
+			files = append(files, file)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ID < files[j].ID })
+
+	return files, nil
+}
+
+func (jfs *jsonFileStorage) shutdown() error {
 	// Stop saveOnDisk goroutine
 	close(jfs.shutdownChan)
 
-	// Wait for all locks
-	jfs.mutex.Lock()
-	jfs.mutex.Unlock()
-
-	// Write changes
-	jfs.write()
+	// Write changes. compact() waits for all locks
+	jfs.compact()
 
 	// There will be no any new requests.
 
-	return nil
+	return jfs.journal.Close()
 }
@@ -0,0 +1,974 @@
+package files
+
+import (
+	"database/sql"
+	"os"
+	"strings"
+	"time"
+
+	clog "github.com/ShoshinNikita/log/v2"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+
+	"github.com/tags-drive/core/internal/storage/files/aggregation"
+	"github.com/tags-drive/core/internal/storage/files/exif"
+	"github.com/tags-drive/core/internal/storage/files/extensions"
+	"github.com/tags-drive/core/internal/utils"
+)
+
+var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+// sqliteFilesSchema describes the table for files. Every file is kept as a json document,
+// fields used in queries are duplicated into separate columns.
+const sqliteFilesSchema = `
+	CREATE TABLE IF NOT EXISTS files (
+		id             INTEGER PRIMARY KEY AUTOINCREMENT,
+		deleted        BOOLEAN NOT NULL DEFAULT 0,
+		time_to_delete INTEGER NOT NULL DEFAULT 0,
+		data           TEXT    NOT NULL,
+		filename       TEXT    NOT NULL DEFAULT ''
+	);
+
+	CREATE INDEX IF NOT EXISTS files_trash ON files (deleted, time_to_delete);
+	CREATE INDEX IF NOT EXISTS files_filename ON files (filename);
+
+	-- file_blobs contains hashes of all revisions of files. It is used to count refs to blobs
+	CREATE TABLE IF NOT EXISTS file_blobs (
+		file_id  INTEGER NOT NULL REFERENCES files(id) ON DELETE CASCADE,
+		hash     TEXT    NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS file_blobs_hash ON file_blobs (hash);
+	CREATE INDEX IF NOT EXISTS file_blobs_file_id ON file_blobs (file_id);
+
+	-- file_tags contains tags of files. It is used as posting lists (tag -> files) for logical expressions
+	CREATE TABLE IF NOT EXISTS file_tags (
+		file_id  INTEGER NOT NULL REFERENCES files(id) ON DELETE CASCADE,
+		tag_id   INTEGER NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS file_tags_tag_id ON file_tags (tag_id, file_id);
+	CREATE INDEX IF NOT EXISTS file_tags_file_id ON file_tags (file_id);
+
+	-- file_locations contains GPS coordinates of files. It is used for geographic search
+	CREATE TABLE IF NOT EXISTS file_locations (
+		file_id    INTEGER PRIMARY KEY REFERENCES files(id) ON DELETE CASCADE,
+		latitude   REAL    NOT NULL,
+		longitude  REAL    NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS file_locations_coords ON file_locations (latitude, longitude);`
+
+// maxSQLiteVariables is a max number of variables in a single query
+const maxSQLiteVariables = 500
+
+// sqliteFileStorage implements files.metadataStorage interface.
+// Every change is committed into the database immediately, so nothing is lost on crash
+type sqliteFileStorage struct {
+	config Config
+
+	db *sql.DB
+
+	logger *clog.Logger
+}
+
+// sqlQueryer is implemented by both *sql.DB and *sql.Tx
+type sqlQueryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func newSqliteFileStorage(cnf Config, lg *clog.Logger) *sqliteFileStorage {
+	return &sqliteFileStorage{
+		config: cnf,
+		logger: lg,
+	}
+}
+
+func (sfs *sqliteFileStorage) init() (err error) {
+	sfs.db, err = utils.OpenSQLite(sfs.config.SQLiteFile)
+	if err != nil {
+		return err
+	}
+
+	// Tables are created in the same transaction in which files are imported and indexes are rebuilt.
+	// So, if something fails, nothing is committed and everything is repeated on the next start
+	tx, err := sfs.db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "can't begin a transaction")
+	}
+	defer tx.Rollback()
+
+	tableExists, err := checkTable(tx, "files")
+	if err != nil {
+		return err
+	}
+	blobsTableExists, err := checkTable(tx, "file_blobs")
+	if err != nil {
+		return err
+	}
+	tagsTableExists, err := checkTable(tx, "file_tags")
+	if err != nil {
+		return err
+	}
+	locationsTableExists, err := checkTable(tx, "file_locations")
+	if err != nil {
+		return err
+	}
+
+	// The column 'filename' was added after the table. It must exist before the index is created
+	addFilenames := false
+	if tableExists {
+		filenameExists, err := checkColumn(tx, "files", "filename")
+		if err != nil {
+			return err
+		}
+		if !filenameExists {
+			if _, err := tx.Exec(`ALTER TABLE files ADD COLUMN filename TEXT NOT NULL DEFAULT ''`); err != nil {
+				return errors.Wrap(err, "can't add the column 'filename'")
+			}
+			addFilenames = true
+		}
+	}
+
+	if _, err := tx.Exec(sqliteFilesSchema); err != nil {
+		return errors.Wrap(err, "can't create the table 'files'")
+	}
+
+	imported := 0
+	switch {
+	case !tableExists:
+		// The table was just created. Import files from the json storage to not lose them
+		// after switching from "json" to "sqlite"
+		if imported, err = sfs.importFromJSON(tx); err != nil {
+			return err
+		}
+	case !blobsTableExists || !tagsTableExists || !locationsTableExists || addFilenames:
+		// The database was created by a previous version
+		n, err := rebuildIndexes(tx, !blobsTableExists, !tagsTableExists, !locationsTableExists, addFilenames)
+		if err != nil {
+			return err
+		}
+		sfs.logger.Infof("indexes of %d file(s) were rebuilt\n", n)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "can't commit the schema")
+	}
+
+	if imported > 0 {
+		sfs.logger.Infof("%d file(s) were imported from %s\n", imported, sfs.config.FilesJSONFile)
+	}
+
+	return nil
+}
+
+func checkTable(q sqlQueryer, name string) (bool, error) {
+	var exists bool
+	err := q.QueryRow(`SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = ?)`, name).Scan(&exists)
+	if err != nil {
+		return false, errors.Wrapf(err, "can't check the table '%s'", name)
+	}
+
+	return exists, nil
+}
+
+func checkColumn(q sqlQueryer, table, column string) (bool, error) {
+	var exists bool
+	err := q.QueryRow(`SELECT EXISTS(SELECT 1 FROM pragma_table_info(?) WHERE name = ?)`, table, column).Scan(&exists)
+	if err != nil {
+		return false, errors.Wrapf(err, "can't check the column '%s' of the table '%s'", column, table)
+	}
+
+	return exists, nil
+}
+
+// rebuildIndexes fills the tables 'file_blobs', 'file_tags', 'file_locations' and the column 'filename'
+// (only the chosen ones). It returns a number of indexed files
+func rebuildIndexes(q sqlQueryer, blobs, tags, locations, filenames bool) (int, error) {
+	files, err := selectFiles(q, `SELECT data FROM files`)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, file := range files {
+		if blobs {
+			if err := saveFileBlobs(q, file); err != nil {
+				return 0, err
+			}
+		}
+		if tags {
+			if err := saveFileTags(q, file); err != nil {
+				return 0, err
+			}
+		}
+		if locations {
+			if err := saveFileLocation(q, file); err != nil {
+				return 0, err
+			}
+		}
+		if filenames {
+			_, err := q.Exec(`UPDATE files SET filename = ? WHERE id = ?`, file.Filename, file.ID)
+			if err != nil {
+				return 0, errors.Wrapf(err, "can't update filename of file with id %d", file.ID)
+			}
+		}
+	}
+
+	return len(files), nil
+}
+
+// importFromJSON copies files from config.FilesJSONFile into the database. IDs are preserved.
+// It returns a number of imported files
+func (sfs *sqliteFileStorage) importFromJSON(q sqlQueryer) (int, error) {
+	if _, err := os.Stat(sfs.config.FilesJSONFile); os.IsNotExist(err) {
+		return 0, nil
+	}
+
+	// Load files with jsonFileStorage to apply changes from its journal
+	jsonStorage := newJsonFileStorage(sfs.config, sfs.logger)
+	if err := jsonStorage.init(); err != nil {
+		return 0, errors.Wrapf(err, "can't load files from %s", sfs.config.FilesJSONFile)
+	}
+	defer jsonStorage.shutdown()
+
+	for _, file := range jsonStorage.files {
+		if _, err := insertFile(q, file); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(jsonStorage.files), nil
+}
+
+// insertFile inserts a file with file.ID. If file.ID is 0, a new id is generated.
+// It returns id of the inserted file
+func insertFile(q sqlQueryer, file File) (int, error) {
+	data, err := json.Marshal(file)
+	if err != nil {
+		return 0, errors.Wrap(err, "can't marshal a file")
+	}
+
+	var id interface{}
+	if file.ID != 0 {
+		id = file.ID
+	}
+
+	res, err := q.Exec(`INSERT INTO files (id, deleted, time_to_delete, data, filename) VALUES (?, ?, ?, ?, ?)`,
+		id, file.Deleted, file.TimeToDelete, string(data), file.Filename)
+	if err != nil {
+		return 0, errors.Wrap(err, "can't insert a file")
+	}
+
+	newID, err := res.LastInsertId()
+	if err != nil {
+		return 0, errors.Wrap(err, "can't get id of an inserted file")
+	}
+
+	file.ID = int(newID)
+	if err := saveFileBlobs(q, file); err != nil {
+		return 0, err
+	}
+	if err := saveFileTags(q, file); err != nil {
+		return 0, err
+	}
+	if err := saveFileLocation(q, file); err != nil {
+		return 0, err
+	}
+
+	return file.ID, nil
+}
+
+// saveFile updates a file with file.ID
+func saveFile(q sqlQueryer, file File) error {
+	data, err := json.Marshal(file)
+	if err != nil {
+		return errors.Wrap(err, "can't marshal a file")
+	}
+
+	_, err = q.Exec(`UPDATE files SET deleted = ?, time_to_delete = ?, data = ?, filename = ? WHERE id = ?`,
+		file.Deleted, file.TimeToDelete, string(data), file.Filename, file.ID)
+	if err != nil {
+		return errors.Wrapf(err, "can't update file with id %d", file.ID)
+	}
+
+	if err := saveFileBlobs(q, file); err != nil {
+		return err
+	}
+	if err := saveFileTags(q, file); err != nil {
+		return err
+	}
+	return saveFileLocation(q, file)
+}
+
+// saveFileBlobs updates hashes of file revisions in the table 'file_blobs'
+func saveFileBlobs(q sqlQueryer, file File) error {
+	if _, err := q.Exec(`DELETE FROM file_blobs WHERE file_id = ?`, file.ID); err != nil {
+		return errors.Wrapf(err, "can't delete blobs of file with id %d", file.ID)
+	}
+
+	for _, r := range file.GetRevisions() {
+		if r.Hash == "" {
+			continue
+		}
+
+		_, err := q.Exec(`INSERT INTO file_blobs (file_id, hash) VALUES (?, ?)`, file.ID, r.Hash)
+		if err != nil {
+			return errors.Wrapf(err, "can't insert a blob of file with id %d", file.ID)
+		}
+	}
+
+	return nil
+}
+
+// saveFileTags updates tags of a file in the table 'file_tags'
+func saveFileTags(q sqlQueryer, file File) error {
+	if _, err := q.Exec(`DELETE FROM file_tags WHERE file_id = ?`, file.ID); err != nil {
+		return errors.Wrapf(err, "can't delete tags of file with id %d", file.ID)
+	}
+
+	for _, tag := range uniqueTags(file.Tags) {
+		_, err := q.Exec(`INSERT INTO file_tags (file_id, tag_id) VALUES (?, ?)`, file.ID, tag)
+		if err != nil {
+			return errors.Wrapf(err, "can't insert a tag of file with id %d", file.ID)
+		}
+	}
+
+	return nil
+}
+
+// saveFileLocation updates coordinates of a file in the table 'file_locations'
+func saveFileLocation(q sqlQueryer, file File) error {
+	if _, err := q.Exec(`DELETE FROM file_locations WHERE file_id = ?`, file.ID); err != nil {
+		return errors.Wrapf(err, "can't delete location of file with id %d", file.ID)
+	}
+
+	lat, lon, ok := file.location()
+	if !ok {
+		return nil
+	}
+
+	_, err := q.Exec(`INSERT INTO file_locations (file_id, latitude, longitude) VALUES (?, ?, ?)`, file.ID, lat, lon)
+	return errors.Wrapf(err, "can't insert location of file with id %d", file.ID)
+}
+
+func selectFile(q sqlQueryer, id int) (File, error) {
+	var data []byte
+	err := q.QueryRow(`SELECT data FROM files WHERE id = ?`, id).Scan(&data)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return File{}, ErrFileIsNotExist
+		}
+		return File{}, errors.Wrapf(err, "can't select file with id %d", id)
+	}
+
+	var file File
+	if err := json.Unmarshal(data, &file); err != nil {
+		return File{}, errors.Wrapf(err, "can't unmarshal file with id %d", id)
+	}
+
+	return file, nil
+}
+
+// selectFiles returns files selected by passed query. The query must select only the "data" column
+func selectFiles(q sqlQueryer, query string, args ...interface{}) ([]File, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't select files")
+	}
+	defer rows.Close()
+
+	files := []File{}
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, errors.Wrap(err, "can't scan a file")
+		}
+
+		var file File
+		if err := json.Unmarshal(data, &file); err != nil {
+			return nil, errors.Wrap(err, "can't unmarshal a file")
+		}
+		files = append(files, file)
+	}
+
+	return files, errors.Wrap(rows.Err(), "can't select files")
+}
+
+// updateFile calls update for a file with passed id and saves the changed file in a single transaction
+func (sfs *sqliteFileStorage) updateFile(id int, update func(f *File) error) (File, error) {
+	tx, err := sfs.db.Begin()
+	if err != nil {
+		return File{}, errors.Wrap(err, "can't begin a transaction")
+	}
+	defer tx.Rollback()
+
+	f, err := selectFile(tx, id)
+	if err != nil {
+		return File{}, err
+	}
+
+	if err := update(&f); err != nil {
+		return File{}, err
+	}
+
+	if err := saveFile(tx, f); err != nil {
+		return File{}, err
+	}
+
+	return f, errors.Wrap(tx.Commit(), "can't commit a transaction")
+}
+
+// updateFiles calls update for every file with id from ids. Non-existent files are skipped
+func (sfs *sqliteFileStorage) updateFiles(ids []int, update func(f *File)) error {
+	tx, err := sfs.db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "can't begin a transaction")
+	}
+	defer tx.Rollback()
+
+	for _, id := range ids {
+		f, err := selectFile(tx, id)
+		if err == ErrFileIsNotExist {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		update(&f)
+
+		if err := saveFile(tx, f); err != nil {
+			return err
+		}
+	}
+
+	return errors.Wrap(tx.Commit(), "can't commit a transaction")
+}
+
+func (sfs *sqliteFileStorage) getFile(id int) (File, error) {
+	return selectFile(sfs.db, id)
+}
+
+func (sfs *sqliteFileStorage) checkFile(id int) bool {
+	var exists bool
+	err := sfs.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM files WHERE id = ?)`, id).Scan(&exists)
+	if err != nil {
+		sfs.logger.Errorf("can't check file with id %d: %s\n", id, err)
+		return false
+	}
+
+	return exists
+}
+
+func (sfs *sqliteFileStorage) getFilesWithIDs(ids ...int) []File {
+	files := []File{}
+	for _, id := range ids {
+		f, err := selectFile(sfs.db, id)
+		if err != nil {
+			if err != ErrFileIsNotExist {
+				sfs.logger.Errorf("can't get file with id %d: %s\n", id, err)
+			}
+			continue
+		}
+		files = append(files, f)
+	}
+
+	return files
+}
+
+func (sfs *sqliteFileStorage) getLocations(box BoundingBox) ([]Location, error) {
+	query := `SELECT file_id, latitude, longitude FROM file_locations
+		WHERE latitude BETWEEN ? AND ? AND longitude BETWEEN ? AND ?`
+	if box.West > box.East {
+		// The box crosses the antimeridian
+		query = `SELECT file_id, latitude, longitude FROM file_locations
+			WHERE latitude BETWEEN ? AND ? AND (longitude >= ? OR longitude <= ?)`
+	}
+
+	rows, err := sfs.db.Query(query, box.South, box.North, box.West, box.East)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't select locations")
+	}
+	defer rows.Close()
+
+	locations := []Location{}
+	for rows.Next() {
+		var l Location
+		if err := rows.Scan(&l.FileID, &l.Latitude, &l.Longitude); err != nil {
+			return nil, errors.Wrap(err, "can't scan a location")
+		}
+		locations = append(locations, l)
+	}
+
+	return locations, errors.Wrap(rows.Err(), "can't select locations")
+}
+
+// countFacets counts tags with the table 'file_tags'. Other fields are kept only in json documents,
+// so files are loaded
+func (sfs *sqliteFileStorage) countFacets(ids []int) (Facets, error) {
+	facets := newFacets()
+
+	err := forEachIDsChunk(ids, func(in string, args []interface{}) error {
+		query := `SELECT tag_id, COUNT(*) FROM file_tags WHERE file_id IN ` + in + ` GROUP BY tag_id`
+		return countTags(sfs.db, facets.Tags, query, args...)
+	})
+	if err != nil {
+		return Facets{}, err
+	}
+
+	files, err := selectFilesWithIDs(sfs.db, ids)
+	if err != nil {
+		return Facets{}, err
+	}
+	for _, f := range files {
+		facets.add(f, false)
+	}
+
+	return facets, nil
+}
+
+// countTags adds numbers of files with tags selected by a query to counts. The query must select
+// a tag id and a number of files
+func countTags(q sqlQueryer, counts map[int]int, query string, args ...interface{}) error {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return errors.Wrap(err, "can't count tags")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var tag, n int
+		if err := rows.Scan(&tag, &n); err != nil {
+			return errors.Wrap(err, "can't scan a number of files with a tag")
+		}
+		counts[tag] += n
+	}
+
+	return errors.Wrap(rows.Err(), "can't count tags")
+}
+
+func (sfs *sqliteFileStorage) getFiles(parsedExpr aggregation.LogicalExpr, search string, isRegexp bool) []File {
+	program, err := aggregation.Compile(parsedExpr)
+	if err != nil {
+		sfs.logger.Errorf("can't compile expression \"%s\": %s\n", parsedExpr, err)
+		return []File{}
+	}
+
+	var files []File
+	if program == nil {
+		files, err = selectFiles(sfs.db, `SELECT data FROM files`)
+	} else {
+		files, err = sfs.evalProgram(program)
+	}
+	if err != nil {
+		sfs.logger.Errorf("can't get files: %s\n", err)
+		return []File{}
+	}
+
+	return filterFilesByName(files, search, isRegexp)
+}
+
+// evalProgram returns files which satisfy a program. Tags are resolved with the table 'file_tags',
+// so only candidates are loaded to check predicates on other fields
+func (sfs *sqliteFileStorage) evalProgram(program *aggregation.Program) ([]File, error) {
+	idx := &sqliteIndex{db: sfs.db, files: make(map[int]File)}
+
+	ids := program.Eval(idx)
+	if idx.err != nil {
+		return nil, idx.err
+	}
+
+	if err := idx.load(ids); err != nil {
+		return nil, err
+	}
+
+	files := make([]File, 0, len(ids))
+	for _, id := range ids {
+		// A file could be deleted during the evaluation
+		if f, ok := idx.files[id]; ok {
+			files = append(files, f)
+		}
+	}
+	return files, nil
+}
+
+// selectFilesWithIDs returns files with passed ids. Non-existent files are skipped
+func selectFilesWithIDs(q sqlQueryer, ids []int) ([]File, error) {
+	files := make([]File, 0, len(ids))
+	err := forEachIDsChunk(ids, func(in string, args []interface{}) error {
+		res, err := selectFiles(q, `SELECT data FROM files WHERE id IN `+in+` ORDER BY id`, args...)
+		files = append(files, res...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// forEachIDsChunk splits ids into chunks with maxSQLiteVariables ids and calls f for every chunk.
+// in is a list of placeholders "(?, ?, ...)", args contains ids of a chunk
+func forEachIDsChunk(ids []int, f func(in string, args []interface{}) error) error {
+	for len(ids) > 0 {
+		n := len(ids)
+		if n > maxSQLiteVariables {
+			n = maxSQLiteVariables
+		}
+
+		args := make([]interface{}, n)
+		for i := range args {
+			args[i] = ids[i]
+		}
+		if err := f("(?"+strings.Repeat(", ?", n-1)+")", args); err != nil {
+			return err
+		}
+
+		ids = ids[n:]
+	}
+
+	return nil
+}
+
+// sqliteIndex implements aggregation.Index. The first error is saved into err, subsequent calls return nil
+type sqliteIndex struct {
+	db *sql.DB
+
+	all []int
+	// files contains files loaded by Filter
+	files map[int]File
+
+	err error
+}
+
+func (idx *sqliteIndex) All() []int {
+	if idx.all == nil && idx.err == nil {
+		idx.all, idx.err = selectIDs(idx.db, `SELECT id FROM files ORDER BY id`)
+	}
+	return idx.all
+}
+
+func (idx *sqliteIndex) Posting(tag int) []int {
+	if idx.err != nil {
+		return nil
+	}
+
+	var ids []int
+	ids, idx.err = selectIDs(idx.db, `SELECT file_id FROM file_tags WHERE tag_id = ? ORDER BY file_id`, tag)
+	return ids
+}
+
+func (idx *sqliteIndex) Filter(ids []int, match func(aggregation.Fields) bool) []int {
+	if idx.err == nil {
+		idx.err = idx.load(ids)
+	}
+	if idx.err != nil {
+		return nil
+	}
+
+	res := []int{}
+	for _, id := range ids {
+		if f, ok := idx.files[id]; ok && match(f.fields()) {
+			res = append(res, id)
+		}
+	}
+	return res
+}
+
+// load loads files which weren't loaded yet
+func (idx *sqliteIndex) load(ids []int) error {
+	var missing []int
+	for _, id := range ids {
+		if _, ok := idx.files[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+
+	var (
+		files []File
+		err   error
+	)
+	switch {
+	case len(missing) == 0:
+		return nil
+	case len(missing) == len(idx.all):
+		// All files are needed
+		files, err = selectFiles(idx.db, `SELECT data FROM files`)
+	default:
+		files, err = selectFilesWithIDs(idx.db, missing)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		idx.files[f.ID] = f
+	}
+	return nil
+}
+
+func selectIDs(q sqlQueryer, query string, args ...interface{}) ([]int, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't select ids")
+	}
+	defer rows.Close()
+
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, errors.Wrap(err, "can't scan an id")
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, errors.Wrap(rows.Err(), "can't select ids")
+}
+
+func (sfs *sqliteFileStorage) addFile(filename string, fileType extensions.Ext, tags []int, size int64, hash string, addTime time.Time) (int, error) {
+	if tags == nil {
+		tags = []int{} // https://github.com/tags-drive/core/issues/19
+	}
+
+	tx, err := sfs.db.Begin()
+	if err != nil {
+		return 0, errors.Wrap(err, "can't begin a transaction")
+	}
+	defer tx.Rollback()
+
+	file := File{
+		Filename: filename,
+		Type:     fileType,
+		Tags:     tags,
+		Size:     size,
+		AddTime:  addTime,
+		Hash:     hash,
+	}
+
+	// The id is generated by the database. So, we have to update the json document after the insertion
+	file.ID, err = insertFile(tx, file)
+	if err != nil {
+		return 0, err
+	}
+	if err := saveFile(tx, file); err != nil {
+		return 0, err
+	}
+
+	return file.ID, errors.Wrap(tx.Commit(), "can't commit a transaction")
+}
+
+func (sfs *sqliteFileStorage) renameFile(id int, newName string) (File, error) {
+	if newName == "" {
+		return File{}, ErrEmptyNewName
+	}
+
+	return sfs.updateFile(id, func(f *File) error {
+		f.Filename = newName
+		return nil
+	})
+}
+
+func (sfs *sqliteFileStorage) updateFileTags(id int, changedTagsID []int) (File, error) {
+	if changedTagsID == nil {
+		changedTagsID = []int{} // https://github.com/tags-drive/core/issues/19
+	}
+
+	return sfs.updateFile(id, func(f *File) error {
+		f.Tags = changedTagsID
+		return nil
+	})
+}
+
+func (sfs *sqliteFileStorage) updateFileDescription(id int, newDesc string) (File, error) {
+	return sfs.updateFile(id, func(f *File) error {
+		f.Description = newDesc
+		return nil
+	})
+}
+
+func (sfs *sqliteFileStorage) updateFileImage(id int, image *exif.Metadata) (File, error) {
+	return sfs.updateFile(id, func(f *File) error {
+		f.Image = image
+		return nil
+	})
+}
+
+func (sfs *sqliteFileStorage) updateFileProcessing(id int, status ProcessingStatus) (File, error) {
+	return sfs.updateFile(id, func(f *File) error {
+		f.Processing = status
+		return nil
+	})
+}
+
+func (sfs *sqliteFileStorage) addFileRevision(id int, size int64, hash string, addTime time.Time) (File, error) {
+	return sfs.updateFile(id, func(f *File) error {
+		f.addRevision(size, hash, addTime)
+		return nil
+	})
+}
+
+func (sfs *sqliteFileStorage) setRevisionHash(id, revision int, hash string) (File, error) {
+	return sfs.updateFile(id, func(f *File) error {
+		if !f.setRevisionHash(revision, hash) {
+			return ErrRevisionIsNotExist
+		}
+		return nil
+	})
+}
+
+func (sfs *sqliteFileStorage) deleteFile(id int) error {
+	deleteTime := time.Now().Add(sfs.config.TimeBeforeDeleting)
+
+	_, err := sfs.updateFile(id, func(f *File) error {
+		if f.Deleted {
+			return ErrFileDeletedAgain
+		}
+
+		f.Deleted = true
+		f.TimeToDelete = deleteTime.Unix()
+		return nil
+	})
+	return err
+}
+
+func (sfs *sqliteFileStorage) deleteFileForce(id int) error {
+	res, err := sfs.db.Exec(`DELETE FROM files WHERE id = ?`, id)
+	if err != nil {
+		return errors.Wrapf(err, "can't delete file with id %d", id)
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrFileIsNotExist
+	}
+
+	return nil
+}
+
+func (sfs *sqliteFileStorage) recover(id int) {
+	err := sfs.updateFiles([]int{id}, func(f *File) {
+		f.Deleted = false
+		f.TimeToDelete = 0
+	})
+	if err != nil {
+		sfs.logger.Errorf("can't recover file with id %d: %s\n", id, err)
+	}
+}
+
+func (sfs *sqliteFileStorage) addTagsToFiles(filesIDs, tagsID []int) {
+	err := sfs.updateFiles(filesIDs, func(f *File) {
+		f.Tags = mergeTags(f.Tags, tagsID)
+	})
+	if err != nil {
+		sfs.logger.Errorf("can't add tags to files: %s\n", err)
+	}
+}
+
+func (sfs *sqliteFileStorage) removeTagsFromFiles(filesIDs, tagsID []int) {
+	err := sfs.updateFiles(filesIDs, func(f *File) {
+		f.Tags = excludeTags(f.Tags, tagsID)
+	})
+	if err != nil {
+		sfs.logger.Errorf("can't remove tags from files: %s\n", err)
+	}
+}
+
+func (sfs *sqliteFileStorage) removeTagFromAllFiles(tagID int) {
+	tx, err := sfs.db.Begin()
+	if err != nil {
+		sfs.logger.Errorf("can't begin a transaction: %s\n", err)
+		return
+	}
+	defer tx.Rollback()
+
+	files, err := selectFiles(tx, `SELECT data FROM files WHERE id IN (SELECT file_id FROM file_tags WHERE tag_id = ?)`, tagID)
+	if err != nil {
+		sfs.logger.Errorf("can't remove tag %d from files: %s\n", tagID, err)
+		return
+	}
+
+	for _, f := range files {
+		index := -1
+		for i := range f.Tags {
+			if f.Tags[i] == tagID {
+				index = i
+				break
+			}
+		}
+		if index == -1 {
+			continue
+		}
+		// Erase tag
+		f.Tags = append(f.Tags[0:index], f.Tags[index+1:]...)
+
+		if err := saveFile(tx, f); err != nil {
+			sfs.logger.Errorf("can't remove tag %d from files: %s\n", tagID, err)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		sfs.logger.Errorf("can't remove tag %d from files: %s\n", tagID, err)
+	}
+}
+
+func (sfs *sqliteFileStorage) getExpiredDeletedFiles() []int {
+	rows, err := sfs.db.Query(`SELECT id FROM files WHERE deleted AND time_to_delete < ?`, time.Now().Unix())
+	if err != nil {
+		sfs.logger.Errorf("can't select expired files: %s\n", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			sfs.logger.Errorf("can't scan id of an expired file: %s\n", err)
+			return ids
+		}
+		ids = append(ids, id)
+	}
+
+	return ids
+}
+
+func (sfs *sqliteFileStorage) countBlobRefs(hash string) (int, error) {
+	var refs int
+	err := sfs.db.QueryRow(`SELECT COUNT(*) FROM file_blobs WHERE hash = ?`, hash).Scan(&refs)
+	if err != nil {
+		return 0, errors.Wrapf(err, "can't count refs to blob %s", hash)
+	}
+
+	return refs, nil
+}
+
+func (sfs *sqliteFileStorage) findDuplicates(hash, filename string) ([]File, error) {
+	query := `SELECT data FROM files WHERE deleted = 0 AND id IN (SELECT file_id FROM file_blobs WHERE hash = ?)`
+	args := []interface{}{hash}
+	if filename != "" {
+		query += ` OR deleted = 0 AND filename = ?`
+		args = append(args, filename)
+	}
+
+	candidates, err := selectFiles(sfs.db, query+` ORDER BY id`, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	// Hashes of old revisions are kept in 'file_blobs' too
+	files := make([]File, 0, len(candidates))
+	for _, file := range candidates {
+		if file.isDuplicate(hash, filename) {
+			files = append(files, file)
+		}
+	}
+
+	return files, nil
+}
+
+func (sfs *sqliteFileStorage) shutdown() error {
+	return sfs.db.Close()
+}
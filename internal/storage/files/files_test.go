@@ -0,0 +1,1522 @@
+package files
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	clog "github.com/ShoshinNikita/log/v2"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tags-drive/core/internal/storage/files/exif"
+	"github.com/tags-drive/core/internal/storage/files/extensions"
+)
+
+func TestDeduplication(t *testing.T) {
+	assert := assert.New(t)
+
+	defer os.RemoveAll(testVarFolder)
+
+	fs := newTestFileStorage(t)
+	defer fs.Shutdown()
+
+	data := []byte("same content")
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	blobPath := filepath.Join(testVarFolder, "data", "blobs", hash[:2], hash)
+
+	// Upload the same content twice
+	assert.NoError(fs.Upload(newFileHeader(t, "1.txt", data), nil))
+	assert.NoError(fs.Upload(newFileHeader(t, "2.txt", data), nil))
+
+	files := fs.GetFiles(1, 2)
+	if !assert.Len(files, 2) {
+		t.FailNow()
+	}
+	for _, f := range files {
+		assert.Equal(hash, f.Hash)
+
+		buff := new(bytes.Buffer)
+		assert.NoError(fs.CopyFile(buff, f.ID, false))
+		assert.Equal(data, buff.Bytes())
+	}
+
+	// The blob must be kept till the last ref is deleted
+	assert.NoError(fs.DeleteForce(1))
+	_, err := os.Stat(blobPath)
+	assert.NoError(err)
+
+	assert.NoError(fs.DeleteForce(2))
+	_, err = os.Stat(blobPath)
+	assert.True(os.IsNotExist(err))
+}
+
+func TestDuplicatePolicies(t *testing.T) {
+	assert := assert.New(t)
+
+	defer os.RemoveAll(testVarFolder)
+
+	fs := newTestFileStorage(t)
+	defer fs.Shutdown()
+
+	var (
+		first  = []byte("first content")
+		second = []byte("second content")
+		third  = []byte("third content")
+	)
+
+	upload := func(filename string, data []byte, tags []int) (UploadResult, error) {
+		return fs.UploadReader(bytes.NewReader(data), filename, tags)
+	}
+
+	_, err := upload("1.txt", first, []int{1})
+	assert.NoError(err)
+
+	// Reject
+	fs.config.DuplicatePolicy = DuplicateReject
+	res, err := upload("copy.txt", first, []int{2})
+	assert.Equal(ErrAlreadyExist, errors.Cause(err))
+	assert.Contains(err.Error(), `duplicate of "1.txt" (id 1)`)
+	assert.Equal([]int{1}, res.Duplicates)
+	assert.Len(fs.metaStorage.getFiles("", "", false), 1)
+
+	// Filenames are checked only if it is enabled
+	res, err = upload("1.txt", second, nil)
+	assert.NoError(err)
+	assert.Empty(res.Duplicates)
+	assert.NoError(fs.DeleteForce(res.File.ID))
+
+	// Merge tags
+	fs.config.DuplicatePolicy = DuplicateMerge
+	res, err = upload("copy.txt", first, []int{2})
+	if assert.NoError(err) {
+		assert.Equal(DuplicateMerge, res.Action)
+		assert.Equal(1, res.File.ID)
+		assert.Equal("1.txt", res.File.Filename)
+		assert.ElementsMatch([]int{1, 2}, res.File.Tags)
+	}
+
+	// Merge content of a file with the same name as a new revision
+	fs.config.DuplicatesByFilename = true
+	res, err = upload("1.txt", second, []int{3})
+	if assert.NoError(err) {
+		assert.Equal([]int{1}, res.Duplicates)
+		assert.ElementsMatch([]int{1, 2, 3}, res.File.Tags)
+		assert.Len(res.File.Revisions, 2)
+
+		buff := new(bytes.Buffer)
+		assert.NoError(fs.CopyFile(buff, 1, false))
+		assert.Equal(second, buff.Bytes())
+	}
+
+	// Tags aren't changed if the content can't be merged. Content of the old file is missing,
+	// so it can't be archived
+	legacyID, err := fs.metaStorage.addFile("legacy.txt", extensions.GetExt(".txt"), []int{1}, 10, "", time.Now())
+	assert.NoError(err)
+	_, err = upload("legacy.txt", []byte("new legacy content"), []int{4})
+	assert.Error(err)
+	legacy, err := fs.GetFile(legacyID)
+	assert.NoError(err)
+	assert.Equal([]int{1}, legacy.Tags)
+	assert.Len(legacy.Revisions, 0)
+	assert.NoError(fs.metaStorage.deleteFileForce(legacyID))
+
+	// Replace
+	fs.config.DuplicatePolicy = DuplicateReplace
+	res, err = upload("other.txt", second, nil)
+	if assert.NoError(err) {
+		assert.Equal(DuplicateReplace, res.Action)
+		assert.Equal([]int{1}, res.Duplicates)
+		assert.NotEqual(1, res.File.ID)
+	}
+	replaced, err := fs.GetFile(1)
+	assert.NoError(err)
+	assert.True(replaced.Deleted)
+	otherID := res.File.ID
+
+	// Keep. Files in Trash aren't duplicates
+	fs.config.DuplicatePolicy = DuplicateKeep
+	res, err = upload("other.txt", third, nil)
+	if assert.NoError(err) {
+		assert.Equal(DuplicateKeep, res.Action)
+		assert.Equal([]int{otherID}, res.Duplicates)
+	}
+	thirdID := res.File.ID
+	res, err = upload("third.txt", third, nil)
+	assert.NoError(err)
+	assert.Equal([]int{thirdID}, res.Duplicates)
+	lastID := res.File.ID
+
+	groups := fs.GetDuplicates(false)
+	if assert.Len(groups, 1) {
+		assert.NotEmpty(groups[0].Hash)
+		assert.Equal([]int{thirdID, lastID}, fileIDs(groups[0].Files))
+	}
+
+	groups = fs.GetDuplicates(true)
+	if assert.Len(groups, 2) {
+		assert.Equal([]int{thirdID, lastID}, fileIDs(groups[0].Files))
+		assert.Equal("other.txt", groups[1].Filename)
+		assert.Equal([]int{otherID, thirdID}, fileIDs(groups[1].Files))
+	}
+
+	// Chunks of a rejected resumable upload are deleted
+	fs.config.DuplicatePolicy = DuplicateReject
+	upl, err := fs.CreateUpload("resumable.txt", nil, int64(len(third)))
+	if assert.NoError(err) {
+		_, err = fs.WriteUploadChunk(upl.ID, 0, bytes.NewReader(third))
+		assert.NoError(err)
+		fs.uploads.finishing.Wait()
+
+		upl, err = fs.GetUpload(upl.ID)
+		assert.NoError(err)
+		assert.Equal(UploadRejected, upl.Status)
+		assert.Contains(upl.Error, ErrAlreadyExist.Error())
+		assert.Equal([]int{thirdID, lastID}, upl.Duplicates)
+		assert.Empty(upl.Chunks)
+
+		inv, err := fs.binStorage.Inventory()
+		assert.NoError(err)
+		assert.Empty(inv.Uploads)
+	}
+
+	// Concurrent uploads of the same content are checked one by one
+	uploadConcurrently := func(data []byte) (stored int) {
+		var (
+			wg sync.WaitGroup
+			mu sync.Mutex
+		)
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+
+				_, err := upload(fmt.Sprintf("concurrent-%d.txt", i), data, nil)
+				if err != nil {
+					assert.Equal(ErrAlreadyExist, errors.Cause(err))
+					return
+				}
+				mu.Lock()
+				stored++
+				mu.Unlock()
+			}(i)
+		}
+		wg.Wait()
+		return stored
+	}
+	countFiles := func(data []byte) (count int) {
+		sum := sha256.Sum256(data)
+		for _, f := range fs.metaStorage.getFiles("", "", false) {
+			if !f.Deleted && f.Hash == hex.EncodeToString(sum[:]) {
+				count++
+			}
+		}
+		return count
+	}
+
+	fs.config.DuplicatePolicy = DuplicateReject
+	assert.Equal(1, uploadConcurrently([]byte("rejected concurrent content")))
+	assert.Equal(1, countFiles([]byte("rejected concurrent content")))
+
+	fs.config.DuplicatePolicy = DuplicateReplace
+	assert.Equal(8, uploadConcurrently([]byte("replaced concurrent content")))
+	assert.Equal(1, countFiles([]byte("replaced concurrent content")))
+
+	assert.Empty(fs.duplicateLocks.locks)
+}
+
+func TestUploadReader(t *testing.T) {
+	assert := assert.New(t)
+
+	defer os.RemoveAll(testVarFolder)
+
+	fs := newTestFileStorage(t)
+	defer fs.Shutdown()
+
+	// The size of the content is unknown
+	data := bytes.Repeat([]byte("streamed content "), 1<<16)
+	sum := sha256.Sum256(data)
+
+	res, err := fs.UploadReader(bytes.NewReader(data), "file.txt", []int{1})
+	if !assert.NoError(err) {
+		t.FailNow()
+	}
+	assert.Empty(res.Duplicates)
+
+	file, err := fs.GetFile(1)
+	if !assert.NoError(err) {
+		t.FailNow()
+	}
+	assert.Equal(file, res.File)
+	assert.Equal("file.txt", file.Filename)
+	assert.Equal(int64(len(data)), file.Size)
+	assert.Equal(hex.EncodeToString(sum[:]), file.Hash)
+	assert.Equal([]int{1}, file.Tags)
+
+	buff := new(bytes.Buffer)
+	assert.NoError(fs.CopyFile(buff, file.ID, false))
+	assert.Equal(data, buff.Bytes())
+}
+
+func TestResumableUpload(t *testing.T) {
+	assert := assert.New(t)
+
+	defer os.RemoveAll(testVarFolder)
+
+	fs := newTestFileStorage(t)
+
+	data := bytes.Repeat([]byte("resumable content "), 1000)
+	sum := sha256.Sum256(data)
+
+	upload, err := fs.CreateUpload("file.txt", []int{1}, int64(len(data)))
+	if !assert.NoError(err) {
+		t.FailNow()
+	}
+
+	upload, err = fs.WriteUploadChunk(upload.ID, 0, bytes.NewReader(data[:5000]))
+	assert.NoError(err)
+	assert.Equal(int64(5000), upload.Offset)
+	assert.False(upload.Finished())
+
+	// Wrong offset
+	_, err = fs.WriteUploadChunk(upload.ID, 0, bytes.NewReader(data))
+	assert.Equal(ErrBadUploadOffset, err)
+
+	// A broken connection. Received data must be kept
+	broken := io.MultiReader(bytes.NewReader(data[5000:8000]), iotest.TimeoutReader(bytes.NewReader(data[8000:])))
+	upload, err = fs.WriteUploadChunk(upload.ID, 5000, iotest.OneByteReader(broken))
+	assert.Error(err)
+	assert.Equal(int64(8001), upload.Offset)
+
+	// The upload must survive a restart
+	assert.NoError(fs.Shutdown())
+	fs = newTestFileStorage(t)
+	defer fs.Shutdown()
+
+	upload, err = fs.GetUpload(upload.ID)
+	if !assert.NoError(err) {
+		t.FailNow()
+	}
+	assert.Equal(int64(8001), upload.Offset)
+
+	// Content beyond the length is ignored. The file can't be created because of the quota,
+	// the upload is kept
+	fs.config.Quota = 1
+	tail := append(append([]byte{}, data[8001:]...), "extra"...)
+	upload, err = fs.WriteUploadChunk(upload.ID, 8001, bytes.NewReader(tail))
+	assert.NoError(err)
+	assert.True(upload.Finished())
+	// The file is created in background
+	assert.Equal(UploadFinishing, upload.Status)
+	fs.uploads.finishing.Wait()
+
+	upload, err = fs.GetUpload(upload.ID)
+	assert.NoError(err)
+	assert.Equal(UploadFailed, upload.Status)
+	assert.Contains(upload.Error, ErrQuotaExceeded.Error())
+	assert.NotEmpty(upload.Chunks)
+
+	// Failed uploads are finished again in background
+	fs.config.Quota = 0
+	assert.NoError(fs.retryUpload(upload.ID))
+
+	upload, err = fs.GetUpload(upload.ID)
+	assert.NoError(err)
+	assert.Equal(UploadFinished, upload.Status)
+	assert.Empty(upload.Error)
+	assert.NotZero(upload.FileID)
+
+	// The result is kept, repeated chunks don't change anything
+	finished, err := fs.WriteUploadChunk(upload.ID, upload.Length, bytes.NewReader(nil))
+	assert.NoError(err)
+	assert.Equal(upload.FileID, finished.FileID)
+	assert.Equal(UploadFinished, finished.Status)
+
+	file, err := fs.GetFile(upload.FileID)
+	assert.NoError(err)
+	assert.Equal("file.txt", file.Filename)
+	assert.Equal([]int{1}, file.Tags)
+	assert.Equal(int64(len(data)), file.Size)
+	assert.Equal(hex.EncodeToString(sum[:]), file.Hash)
+
+	// Chunks must be deleted
+	inv, err := fs.binStorage.Inventory()
+	assert.NoError(err)
+	assert.Empty(inv.Uploads)
+
+	// An empty file is created at once
+	upload, err = fs.CreateUpload("empty.txt", nil, 0)
+	assert.NoError(err)
+	assert.Equal(UploadFinished, upload.Status)
+	assert.NotZero(upload.FileID)
+
+	// Termination
+	upload, err = fs.CreateUpload("deleted.txt", nil, 10)
+	assert.NoError(err)
+	_, err = fs.WriteUploadChunk(upload.ID, 0, bytes.NewReader([]byte("12345")))
+	assert.NoError(err)
+	assert.NoError(fs.DeleteUpload(upload.ID))
+	assert.Equal(ErrUploadIsNotExist, fs.DeleteUpload(upload.ID))
+
+	inv, err = fs.binStorage.Inventory()
+	assert.NoError(err)
+	assert.Empty(inv.Uploads)
+
+	_, err = fs.CreateUpload("", nil, 10)
+	assert.Equal(ErrEmptyFilename, err)
+	_, err = fs.CreateUpload("file.txt", nil, -1)
+	assert.Equal(ErrBadUploadLength, err)
+}
+
+func TestImportURL(t *testing.T) {
+	assert := assert.New(t)
+
+	defer os.RemoveAll(testVarFolder)
+
+	fs := newTestFileStorage(t)
+	defer fs.Shutdown()
+
+	fs.config.ImportMaxSize = 100
+	fs.config.ImportContentTypes = []string{"image/*", "text/plain"}
+	// The test server listens on the loopback
+	fs.config.ImportAllowedHosts = []string{"127.0.0.1"}
+	fs.importClient = newImportClient(fs.config)
+
+	small := []byte("imported content")
+	big := bytes.Repeat([]byte("a"), 101)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/disposition", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="../notes.txt"`)
+		w.Write(small)
+	})
+	mux.HandleFunc("/path/readme", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(small)
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/path/readme", http.StatusFound)
+	})
+	mux.HandleFunc("/big", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(big)
+	})
+	mux.HandleFunc("/big-chunked", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		// Content-Length is unknown
+		w.Write(big[:50])
+		w.(http.Flusher).Flush()
+		w.Write(big[50:])
+	})
+	mux.HandleFunc("/html", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write(small)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	res, err := fs.ImportURL(server.URL+"/disposition", []int{1})
+	if assert.NoError(err) {
+		file := res.File
+		assert.Equal("notes.txt", file.Filename)
+		assert.Equal([]int{1}, file.Tags)
+		assert.Equal(int64(len(small)), file.Size)
+
+		buff := new(bytes.Buffer)
+		assert.NoError(fs.CopyFile(buff, file.ID, false))
+		assert.Equal(small, buff.Bytes())
+	}
+
+	// The name is taken from the url after redirects. The extension is added according to Content-Type
+	res, err = fs.ImportURL(server.URL+"/redirect", nil)
+	if assert.NoError(err) {
+		assert.Equal("readme.txt", res.File.Filename)
+	}
+
+	_, err = fs.ImportURL(server.URL+"/big", nil)
+	assert.Equal(ErrImportTooLarge, err)
+	_, err = fs.ImportURL(server.URL+"/big-chunked", nil)
+	assert.Equal(ErrImportTooLarge, err)
+	_, err = fs.ImportURL(server.URL+"/html", nil)
+	assert.Equal(ErrImportBadContentType, err)
+	_, err = fs.ImportURL(server.URL+"/not-found", nil)
+	assert.Error(err)
+
+	for _, u := range []string{"", "file:///etc/passwd", "ftp://example.com/file", "http://"} {
+		_, err = fs.ImportURL(u, nil)
+		assert.Equal(ErrImportBadURL, err, u)
+	}
+
+	// Only successful imports are stored
+	assert.Len(fs.GetFiles(1, 2, 3), 2)
+}
+
+func TestImportInternalHosts(t *testing.T) {
+	assert := assert.New(t)
+
+	defer os.RemoveAll(testVarFolder)
+
+	fs := newTestFileStorage(t)
+	defer fs.Shutdown()
+
+	var server *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("internal"))
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, server.URL+"/file.txt", http.StatusFound)
+	})
+	server = httptest.NewServer(mux)
+	defer server.Close()
+
+	_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if !assert.NoError(err) {
+		t.FailNow()
+	}
+
+	for _, u := range []string{
+		server.URL + "/file.txt",
+		"http://localhost:" + port + "/file.txt",
+		"http://169.254.169.254/latest/meta-data/",
+	} {
+		_, err = fs.ImportURL(u, nil)
+		assert.Equal(ErrImportInternalHost, errors.Cause(err), u)
+	}
+
+	// Only the allowed host name can be used, the redirect to the ip is rejected
+	fs.config.ImportAllowedHosts = []string{"localhost"}
+	fs.importClient = newImportClient(fs.config)
+
+	_, err = fs.ImportURL("http://localhost:"+port+"/file.txt", nil)
+	assert.NoError(err)
+	_, err = fs.ImportURL("http://localhost:"+port+"/redirect", nil)
+	assert.Equal(ErrImportInternalHost, errors.Cause(err))
+
+	// Networks can be allowed
+	fs.config.ImportAllowedHosts = []string{"127.0.0.0/8"}
+	fs.importClient = newImportClient(fs.config)
+
+	_, err = fs.ImportURL(server.URL+"/redirect", nil)
+	assert.NoError(err)
+
+	assert.Len(fs.GetFiles(1, 2, 3), 2)
+
+	for ip, internal := range map[string]bool{
+		"127.0.0.1":        true,
+		"10.1.2.3":         true,
+		"172.20.0.1":       true,
+		"192.168.1.1":      true,
+		"169.254.169.254":  true,
+		"0.0.0.0":          true,
+		"::1":              true,
+		"::ffff:127.0.0.1": true,
+		"fd00:ec2::254":    true,
+		"fe80::1":          true,
+		"8.8.8.8":          false,
+		"2001:4860::8888":  false,
+	} {
+		assert.Equal(internal, isInternalIP(net.ParseIP(ip)), ip)
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	assert := assert.New(t)
+
+	defer os.RemoveAll(testVarFolder)
+
+	fs := newTestFileStorage(t)
+	defer fs.Shutdown()
+
+	fs.config.Quota = 100
+	fs.config.TypeQuotas = map[extensions.FileType]int64{extensions.FileTypeLanguage: 60}
+
+	assert.NoError(fs.Upload(newFileHeader(t, "1.txt", bytes.Repeat([]byte("a"), 50)), nil))
+
+	// The quota for text files is exceeded
+	err := fs.Upload(newFileHeader(t, "2.txt", bytes.Repeat([]byte("b"), 20)), nil)
+	assert.Equal(ErrQuotaExceeded, errors.Cause(err))
+	assert.Contains(err.Error(), "quota for lang files is 60 B, 10 B is available")
+
+	_, err = fs.CreateUpload("2.txt", nil, 20)
+	assert.Equal(ErrQuotaExceeded, errors.Cause(err))
+
+	// Other types are limited only by the total quota
+	assert.NoError(fs.Upload(newFileHeader(t, "1.bin", bytes.Repeat([]byte("c"), 40)), nil))
+
+	// The size of streamed content is unknown, so the upload fails while the content is being saved
+	_, err = fs.UploadReader(iotest.OneByteReader(bytes.NewReader(bytes.Repeat([]byte("d"), 20))), "2.bin", nil)
+	assert.Equal(ErrQuotaExceeded, errors.Cause(err))
+	assert.Contains(err.Error(), "total quota is 100 B, 0 B is available")
+
+	assert.Len(fs.metaStorage.getFiles("", "", false), 2)
+	inv, err := fs.binStorage.Inventory()
+	assert.NoError(err)
+	assert.Len(inv.Blobs, 2)
+	assert.Empty(inv.TemporaryFiles)
+
+	// All reservations are released
+	assert.Equal(int64(0), fs.quotas.pendingTotal)
+	for _, pending := range fs.quotas.pendingTypes {
+		assert.Equal(int64(0), pending)
+	}
+
+	// Deleted files free the space
+	assert.NoError(fs.DeleteForce(2))
+	_, err = fs.UploadReader(bytes.NewReader(bytes.Repeat([]byte("d"), 20)), "2.bin", nil)
+	assert.NoError(err)
+
+	// New revisions are limited too
+	_, err = fs.UploadRevision(1, newFileHeader(t, "1.txt", bytes.Repeat([]byte("e"), 20)))
+	assert.Equal(ErrQuotaExceeded, errors.Cause(err))
+	revisions, err := fs.GetRevisions(1)
+	assert.NoError(err)
+	assert.Len(revisions, 1)
+}
+
+func TestStorageUsage(t *testing.T) {
+	assert := assert.New(t)
+
+	defer os.RemoveAll(testVarFolder)
+
+	fs := newTestFileStorage(t)
+	defer fs.Shutdown()
+
+	fs.config.Quota = 1 << 20
+	fs.config.TypeQuotas = map[extensions.FileType]int64{extensions.FileTypeImage: 1 << 10}
+
+	same := []byte("0123456789")
+	assert.NoError(fs.Upload(newFileHeader(t, "1.txt", same), []int{1}))
+	assert.NoError(fs.Upload(newFileHeader(t, "2.txt", same), []int{1, 2}))
+	assert.NoError(fs.Upload(newFileHeader(t, "3.bin", []byte("12345")), []int{2}))
+	_, err := fs.UploadRevision(3, newFileHeader(t, "3.bin", []byte("1234567")))
+	assert.NoError(err)
+	assert.NoError(fs.Delete(1))
+
+	usage, err := fs.GetStorageUsage()
+	if !assert.NoError(err) {
+		t.FailNow()
+	}
+
+	// Identical content is counted once
+	assert.Equal(int64(22), usage.Used)
+	assert.Equal(int64(1<<20), usage.Quota)
+	assert.Equal(3, usage.Files)
+	assert.Equal(map[extensions.FileType]TypeUsage{
+		extensions.FileTypeLanguage:    {Usage: Usage{Size: 10, Files: 2}},
+		extensions.FileTypeUnsupported: {Usage: Usage{Size: 12, Files: 1}},
+		extensions.FileTypeImage:       {Quota: 1 << 10},
+	}, usage.Types)
+	assert.Equal(map[int]Usage{
+		1: {Size: 20, Files: 2},
+		2: {Size: 22, Files: 2},
+	}, usage.Tags)
+	assert.Equal(Usage{Size: 10, Files: 1}, usage.Trash)
+	assert.Equal(int64(0), usage.Thumbnails)
+
+	// Quotas are checked with counters which must match the usage
+	checkCounters := func(tracker *quotaTracker) {
+		usage := fs.countUsage()
+		assert.Equal(usage.Used, tracker.used)
+		for fileType, typeUsage := range usage.Types {
+			assert.Equal(typeUsage.Size, tracker.usedTypes[fileType], fileType)
+		}
+	}
+	checkCounters(fs.quotas)
+
+	// Shared content is attributed to the next file
+	assert.NoError(fs.DeleteForce(1))
+	checkCounters(fs.quotas)
+	assert.NoError(fs.DeleteForce(3))
+	checkCounters(fs.quotas)
+	assert.Equal(int64(10), fs.quotas.used)
+
+	tracker := newQuotaTracker()
+	tracker.init(fs.metaStorage.getFiles("", "", false))
+	checkCounters(tracker)
+}
+
+func TestScrub(t *testing.T) {
+	assert := assert.New(t)
+
+	defer os.RemoveAll(testVarFolder)
+
+	fs := newTestFileStorage(t)
+	defer fs.Shutdown()
+
+	_, err := fs.LastScrubReport()
+	assert.Equal(ErrNoScrubReport, err)
+
+	blobPath := func(data []byte) string {
+		sum := sha256.Sum256(data)
+		hash := hex.EncodeToString(sum[:])
+		return filepath.Join(testVarFolder, "data", "blobs", hash[:2], hash)
+	}
+
+	healthy := []byte("healthy")
+	corrupted := []byte("corrupted")
+	missing := []byte("missing")
+
+	assert.NoError(fs.Upload(newFileHeader(t, "1.txt", healthy), nil))
+	assert.NoError(fs.Upload(newFileHeader(t, "2.txt", corrupted), nil))
+	assert.NoError(fs.Upload(newFileHeader(t, "3.txt", missing), nil))
+
+	report, err := fs.Scrub()
+	assert.NoError(err)
+	assert.True(report.OK())
+	assert.Equal(3, report.Checked)
+
+	// Damage files
+	assert.NoError(ioutil.WriteFile(blobPath(corrupted), []byte("damaged"), 0600))
+	assert.NoError(os.Remove(blobPath(missing)))
+
+	report, err = fs.Scrub()
+	assert.NoError(err)
+	assert.False(report.OK())
+	assert.Equal(3, report.Checked)
+	assert.Empty(report.Unreadable)
+	if assert.Len(report.Corrupted, 1) {
+		assert.Equal(2, report.Corrupted[0].FileID)
+		assert.Equal(1, report.Corrupted[0].Revision)
+	}
+	if assert.Len(report.Missing, 1) {
+		assert.Equal(3, report.Missing[0].FileID)
+		assert.Equal("3.txt", report.Missing[0].Filename)
+	}
+
+	// The report must be saved
+	saved, err := fs.LastScrubReport()
+	assert.NoError(err)
+	assert.Equal(report.Corrupted, saved.Corrupted)
+	assert.Equal(report.Missing, saved.Missing)
+}
+
+func TestMigrateToBlobs(t *testing.T) {
+	assert := assert.New(t)
+
+	defer os.RemoveAll(testVarFolder)
+
+	fs := newTestFileStorage(t)
+	defer fs.Shutdown()
+
+	hashOf := func(data []byte) string {
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:])
+	}
+	// addOldFile adds a file stored by id as before the introduction of hashes
+	addOldFile := func(filename string, data []byte, size int64) int {
+		id, err := fs.metaStorage.addFile(filename, extensions.GetExt(".txt"), nil, size, "", time.Now())
+		assert.NoError(err)
+		assert.NoError(fs.binStorage.SaveFile(bytes.NewReader(data), id, int64(len(data)), false))
+		return id
+	}
+
+	same := []byte("same content")
+	first, second := []byte("first revision"), []byte("second revision")
+
+	addOldFile("1.txt", same, int64(len(same)))
+	id := addOldFile("2.txt", first, int64(len(first)))
+	file, err := fs.GetFile(id)
+	assert.NoError(err)
+	// The first revision is archived by id
+	_, err = fs.addRevision(file, bytes.NewReader(second), int64(len(second)))
+	assert.NoError(err)
+	// The recorded size doesn't match the content
+	addOldFile("3.txt", []byte("damaged"), 100)
+	assert.NoError(fs.Upload(newFileHeader(t, "4.txt", same), nil))
+
+	migrated, failed := fs.MigrateToBlobs()
+	assert.Equal(2, migrated)
+	assert.Equal(1, failed)
+
+	files := fs.GetFiles(1, 2, 3)
+	if !assert.Len(files, 3) {
+		t.FailNow()
+	}
+	assert.Equal(hashOf(same), files[0].Hash)
+	assert.Equal(hashOf(first), files[1].GetRevisions()[0].Hash)
+	assert.Equal(hashOf(second), files[1].Hash)
+	assert.Empty(files[2].Hash)
+
+	buff := new(bytes.Buffer)
+	assert.NoError(fs.CopyFile(buff, 1, false))
+	assert.Equal(same, buff.Bytes())
+	buff.Reset()
+	assert.NoError(fs.CopyFileRevision(buff, 2, 1))
+	assert.Equal(first, buff.Bytes())
+
+	// Migrated files are found as duplicates
+	groups := fs.GetDuplicates(false)
+	if assert.Len(groups, 1) {
+		assert.Equal(hashOf(same), groups[0].Hash)
+	}
+
+	// The original content must be deleted
+	report, err := fs.Fsck(false)
+	assert.NoError(err)
+	assert.True(report.OK())
+
+	// Nothing to migrate the second time
+	migrated, failed = fs.MigrateToBlobs()
+	assert.Equal(0, migrated)
+	assert.Equal(1, failed)
+}
+
+func TestFsck(t *testing.T) {
+	assert := assert.New(t)
+
+	defer os.RemoveAll(testVarFolder)
+
+	fs := newTestFileStorage(t)
+	defer fs.Shutdown()
+
+	assert.NoError(fs.Upload(newFileHeader(t, "1.txt", []byte("first")), nil))
+	assert.NoError(fs.Upload(newFileHeader(t, "2.txt", []byte("second")), nil))
+
+	report, err := fs.Fsck(false)
+	assert.NoError(err)
+	assert.True(report.OK())
+
+	// Orphan content
+	orphan := []byte("orphan")
+	hash, err := fs.binStorage.SaveBlob(bytes.NewReader(orphan), int64(len(orphan)))
+	assert.NoError(err)
+	assert.NoError(fs.binStorage.SaveFile(bytes.NewReader(orphan), 10, int64(len(orphan)), false))
+	assert.NoError(fs.binStorage.SaveFile(bytes.NewReader(orphan), 10, int64(len(orphan)), true))
+	assert.NoError(fs.binStorage.SaveThumbnail(bytes.NewReader(orphan), int64(len(orphan)), 10, "256-fit-1"))
+	orphanUploadID := "0123456789abcdef0123456789abcdef"
+	assert.NoError(fs.binStorage.SaveUploadChunk(bytes.NewReader(orphan), -1, orphanUploadID, 0))
+
+	// Chunks of unfinished uploads aren't orphans
+	upload, err := fs.CreateUpload("3.txt", nil, 100)
+	assert.NoError(err)
+	_, err = fs.WriteUploadChunk(upload.ID, 0, bytes.NewReader(orphan))
+	assert.NoError(err)
+
+	// Missing content
+	second, err := fs.GetFile(2)
+	assert.NoError(err)
+	assert.NoError(fs.binStorage.DeleteBlob(second.Hash))
+
+	report, err = fs.Fsck(false)
+	assert.NoError(err)
+	assert.False(report.OK())
+	assert.Equal([]string{hash}, report.OrphanBlobs)
+	assert.Equal([]int{10}, report.OrphanFiles)
+	assert.Equal([]int{10}, report.OrphanResizedImages)
+	assert.Equal([]int{10}, report.OrphanThumbnails)
+	assert.Equal([]string{orphanUploadID}, report.OrphanUploads)
+	assert.Equal([]FsckProblem{
+		{FileID: 2, Filename: "2.txt", Revision: 1, Hash: second.Hash, Current: true},
+	}, report.MissingContent)
+
+	// Repair
+	report, err = fs.Fsck(true)
+	assert.NoError(err)
+	assert.True(report.Repaired)
+	assert.Empty(report.RepairErrors)
+
+	second, err = fs.GetFile(2)
+	assert.NoError(err)
+	assert.True(second.Deleted, "file without content must be moved into Trash")
+
+	report, err = fs.Fsck(false)
+	assert.NoError(err)
+	assert.Empty(report.OrphanBlobs)
+	assert.Empty(report.OrphanFiles)
+	assert.Empty(report.OrphanResizedImages)
+	assert.Empty(report.OrphanThumbnails)
+	assert.Empty(report.OrphanUploads)
+	// Content can't be restored
+	assert.Len(report.MissingContent, 1)
+}
+
+func TestContentSearch(t *testing.T) {
+	assert := assert.New(t)
+
+	defer os.RemoveAll(testVarFolder)
+
+	fs := newTestFileStorage(t)
+
+	assert.NoError(fs.Upload(newFileHeader(t, "1.txt", []byte("first file about cats")), nil))
+	assert.NoError(fs.Upload(newFileHeader(t, "2.go", []byte("package cats")), nil))
+	// Content of binary files isn't indexed
+	assert.NoError(fs.Upload(newFileHeader(t, "3.zip", []byte("cats")), nil))
+
+	files, err := fs.Get(GetFilesConfig{ContentSearch: "cats", SortMode: SortByNameAsc})
+	assert.NoError(err)
+	if assert.Len(files, 2) {
+		assert.Equal("1.txt", files[0].Filename)
+		assert.Equal([]Highlight{{Start: 17, End: 21}}, files[0].Snippets[0].Highlights)
+		assert.Equal("2.go", files[1].Filename)
+	}
+
+	// New revisions are indexed
+	_, err = fs.UploadRevision(1, newFileHeader(t, "1.txt", []byte("about dogs")))
+	assert.NoError(err)
+
+	files, err = fs.Get(GetFilesConfig{ContentSearch: "cats"})
+	assert.NoError(err)
+	assert.Len(files, 1)
+
+	// The index is saved on shutdown
+	assert.NoError(fs.Shutdown())
+
+	fs = newTestFileStorage(t)
+	defer fs.Shutdown()
+
+	// Snippets are built from content of files
+	files, err = fs.Get(GetFilesConfig{ContentSearch: "dogs"})
+	assert.NoError(err)
+	if assert.Len(files, 1) {
+		assert.Equal([]Snippet{{Text: "about dogs", Highlights: []Highlight{{Start: 6, End: 10}}}}, files[0].Snippets)
+	}
+
+	page, err := fs.GetPage(GetFilesConfig{ContentSearch: "package"})
+	assert.NoError(err)
+	if assert.Len(page.Files, 1) {
+		assert.Equal("package cats", page.Files[0].Snippets[0].Text)
+	}
+
+	n, err := fs.RebuildContentIndex()
+	assert.NoError(err)
+	assert.Equal(2, n)
+}
+
+func TestImageMetadata(t *testing.T) {
+	assert := assert.New(t)
+
+	defer os.RemoveAll(testVarFolder)
+
+	fs := newTestFileStorage(t)
+	defer fs.Shutdown()
+
+	img := new(bytes.Buffer)
+	assert.NoError(png.Encode(img, image.NewRGBA(image.Rect(0, 0, 40, 30))))
+
+	assert.NoError(fs.Upload(newFileHeader(t, "1.png", img.Bytes()), nil))
+	assert.NoError(fs.Upload(newFileHeader(t, "2.txt", []byte("text")), nil))
+	assert.NoError(fs.Upload(newFileHeader(t, "3.png", img.Bytes()), nil))
+	fs.processing.wait()
+
+	files := fs.GetFiles(1, 2, 3)
+	if assert.Len(files, 3) {
+		assert.Equal(&exif.Metadata{Width: 40, Height: 30}, files[0].Image)
+		assert.Nil(files[1].Image)
+	}
+
+	// Metadata of old images is extracted by ExtractImageMetadata
+	for _, id := range []int{1, 3} {
+		_, err := fs.metaStorage.updateFileImage(id, nil)
+		assert.NoError(err)
+	}
+
+	n, err := fs.ExtractImageMetadata()
+	assert.NoError(err)
+	assert.Equal(2, n)
+
+	files, err = fs.Get(GetFilesConfig{Expr: "width:40 & height<=30", SortMode: SortByNameAsc})
+	assert.NoError(err)
+	assert.Equal([]int{1, 3}, fileIDs(files))
+
+	// Pages sorted by the time of capture
+	spec, err := ParseSortSpec("-taken")
+	assert.NoError(err)
+
+	var ids []int
+	cnf := GetFilesConfig{Sort: spec, Count: 1}
+	for {
+		page, err := fs.GetPage(cnf)
+		if !assert.NoError(err) {
+			break
+		}
+		ids = append(ids, fileIDs(page.Files)...)
+
+		if page.NextCursor == "" {
+			break
+		}
+		cnf.Cursor = page.NextCursor
+	}
+	assert.ElementsMatch([]int{1, 2, 3}, ids)
+}
+
+func TestThumbnails(t *testing.T) {
+	assert := assert.New(t)
+
+	defer os.RemoveAll(testVarFolder)
+
+	fs := newTestFileStorage(t)
+	defer fs.Shutdown()
+
+	newImage := func(width, height int) []byte {
+		img := new(bytes.Buffer)
+		assert.NoError(png.Encode(img, image.NewRGBA(image.Rect(0, 0, width, height))))
+		return img.Bytes()
+	}
+	getSize := func(id, size int, mode ThumbnailMode) [2]int {
+		buff := new(bytes.Buffer)
+		if !assert.NoError(fs.CopyThumbnail(buff, id, size, mode)) {
+			return [2]int{}
+		}
+		cnf, err := png.DecodeConfig(buff)
+		assert.NoError(err)
+		return [2]int{cnf.Width, cnf.Height}
+	}
+
+	assert.NoError(fs.Upload(newFileHeader(t, "1.png", newImage(1024, 512)), nil))
+	assert.NoError(fs.Upload(newFileHeader(t, "2.txt", []byte("text")), nil))
+	fs.processing.wait()
+
+	assert.Equal([2]int{256, 128}, getSize(1, 256, ""))
+	assert.Equal([2]int{256, 256}, getSize(1, 256, ThumbnailModeCrop))
+	assert.Equal([2]int{512, 256}, getSize(1, 512, ThumbnailModeFit))
+
+	// Thumbnails are cached
+	inv, err := fs.binStorage.Inventory()
+	assert.NoError(err)
+	assert.Equal([]int{1}, inv.Thumbnails)
+	assert.Equal([2]int{256, 128}, getSize(1, 256, ThumbnailModeFit))
+
+	// New content
+	_, err = fs.UploadRevision(1, newFileHeader(t, "1.png", newImage(512, 1024)))
+	assert.NoError(err)
+	fs.processing.wait()
+	assert.Equal([2]int{128, 256}, getSize(1, 256, ThumbnailModeFit))
+
+	// Concurrent requests of the same thumbnail get the same result
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		size := []int{512, 1024}[i%2]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Equal([2]int{size / 2, size}, getSize(1, size, ThumbnailModeFit))
+		}()
+	}
+	wg.Wait()
+	assert.Empty(fs.thumbnailLocks.keys.locks)
+	assert.Empty(fs.thumbnailLocks.workers)
+
+	assert.Equal(ErrBadThumbnailSize, fs.CopyThumbnail(new(bytes.Buffer), 1, 100, ThumbnailModeFit))
+	assert.Equal(ErrBadThumbnailMode, fs.CopyThumbnail(new(bytes.Buffer), 1, 256, "stretch"))
+	assert.Equal(ErrFileIsNotImage, fs.CopyThumbnail(new(bytes.Buffer), 2, 256, ThumbnailModeFit))
+	assert.Equal(ErrFileIsNotExist, fs.CopyThumbnail(new(bytes.Buffer), 3, 256, ThumbnailModeFit))
+
+	// Thumbnails are deleted with a file
+	assert.NoError(fs.DeleteForce(1))
+	inv, err = fs.binStorage.Inventory()
+	assert.NoError(err)
+	assert.Empty(inv.Thumbnails)
+}
+
+func TestImageOrientation(t *testing.T) {
+	assert := assert.New(t)
+
+	defer os.RemoveAll(testVarFolder)
+
+	fs := newTestFileStorage(t)
+	defer fs.Shutdown()
+
+	decodeSize := func(r *bytes.Buffer) [2]int {
+		cnf, _, err := image.DecodeConfig(r)
+		assert.NoError(err)
+		return [2]int{cnf.Width, cnf.Height}
+	}
+
+	// A landscape JPEG which must be rotated by 90° (Orientation = 6)
+	img := new(bytes.Buffer)
+	assert.NoError(jpeg.Encode(img, image.NewRGBA(image.Rect(0, 0, 40, 20)), nil))
+	tiff := []byte{
+		'I', 'I', 42, 0, 8, 0, 0, 0, // header
+		1, 0, // number of entries
+		0x12, 0x01, 3, 0, 1, 0, 0, 0, 6, 0, 0, 0, // Orientation
+		0, 0, 0, 0, // next IFD
+	}
+	app1 := append([]byte("Exif\x00\x00"), tiff...)
+	photo := append([]byte{0xFF, 0xD8, 0xFF, 0xE1, 0, byte(len(app1) + 2)}, app1...)
+	photo = append(photo, img.Bytes()[2:]...)
+
+	assert.NoError(fs.Upload(newFileHeader(t, "1.jpg", photo), nil))
+	assert.NoError(fs.Upload(newFileHeader(t, "2.png", img.Bytes()), nil))
+	assert.NoError(fs.Upload(newFileHeader(t, "3.txt", []byte("text")), nil))
+	fs.processing.wait()
+
+	file, err := fs.GetFile(1)
+	assert.NoError(err)
+	if assert.NotNil(file.Image) {
+		assert.Equal(6, file.Image.Orientation)
+	}
+
+	resized := new(bytes.Buffer)
+	assert.NoError(fs.CopyFile(resized, 1, true))
+	assert.Equal([2]int{256, 512}, decodeSize(resized))
+
+	thumbnail := new(bytes.Buffer)
+	assert.NoError(fs.CopyThumbnail(thumbnail, 1, 256, ThumbnailModeFit))
+	assert.Equal([2]int{20, 40}, decodeSize(thumbnail))
+
+	// Regeneration
+	assert.NoError(fs.binStorage.DeleteFile(1, true))
+	assert.NoError(fs.binStorage.DeleteFile(2, true))
+
+	n, err := fs.RegenerateResizedImages(GetFilesConfig{Expr: "height:20"}, 2)
+	assert.NoError(err)
+	assert.Equal(2, n)
+
+	n, err = fs.RegenerateResizedImages(GetFilesConfig{}, 2)
+	assert.NoError(err)
+	assert.Equal(2, n)
+
+	resized.Reset()
+	assert.NoError(fs.CopyFile(resized, 1, true))
+	assert.Equal([2]int{256, 512}, decodeSize(resized))
+
+	// Cached thumbnails are deleted
+	inv, err := fs.binStorage.Inventory()
+	assert.NoError(err)
+	assert.Empty(inv.Thumbnails)
+
+	_, err = fs.RegenerateResizedImages(GetFilesConfig{Expr: "height:"}, 1)
+	assert.Error(err)
+}
+
+func TestImageProcessing(t *testing.T) {
+	assert := assert.New(t)
+
+	defer os.RemoveAll(testVarFolder)
+
+	fs := newTestFileStorage(t)
+	defer fs.Shutdown()
+
+	img := new(bytes.Buffer)
+	assert.NoError(png.Encode(img, image.NewRGBA(image.Rect(0, 0, 40, 30))))
+
+	assert.NoError(fs.Upload(newFileHeader(t, "1.png", img.Bytes()), nil))
+	assert.NoError(fs.Upload(newFileHeader(t, "2.png", []byte("damaged image")), nil))
+	assert.NoError(fs.Upload(newFileHeader(t, "3.txt", []byte("text")), nil))
+
+	// Uploads don't wait for processing
+	files := fs.GetFiles(1, 2, 3)
+	if assert.Len(files, 3) {
+		assert.Empty(files[2].Processing)
+	}
+
+	fs.processing.wait()
+
+	files = fs.GetFiles(1, 2, 3)
+	if assert.Len(files, 3) {
+		assert.Equal(ProcessingDone, files[0].Processing)
+		assert.NotNil(files[0].Image)
+		// Failed images are retried
+		assert.Equal(ProcessingFailed, files[1].Processing)
+		assert.Empty(files[2].Processing)
+	}
+	assert.NoError(fs.CopyFile(new(bytes.Buffer), 1, true))
+
+	// Pending images are processed after a restart
+	assert.NoError(fs.binStorage.DeleteFile(1, true))
+	_, err := fs.metaStorage.updateFileProcessing(1, ProcessingPending)
+	assert.NoError(err)
+
+	fs.resumeProcessing()
+	fs.processing.wait()
+
+	file, err := fs.GetFile(1)
+	assert.NoError(err)
+	assert.Equal(ProcessingDone, file.Processing)
+	assert.NoError(fs.CopyFile(new(bytes.Buffer), 1, true))
+}
+
+func TestUploadJobs(t *testing.T) {
+	assert := assert.New(t)
+
+	defer os.RemoveAll(testVarFolder)
+
+	fs := newTestFileStorage(t)
+	defer fs.Shutdown()
+
+	img := new(bytes.Buffer)
+	assert.NoError(png.Encode(img, image.NewRGBA(image.Rect(0, 0, 40, 30))))
+	text := []byte("text")
+
+	job, err := fs.CreateUploadJob()
+	if !assert.NoError(err) {
+		t.FailNow()
+	}
+	assert.Equal(UploadJobReceiving, job.Status)
+
+	// Only a single request can send files
+	assert.NoError(fs.StartUploadJob(job.ID))
+	assert.Equal(ErrUploadJobIsStarted, fs.StartUploadJob(job.ID))
+	assert.Equal(ErrUploadJobIsNotExist, fs.StartUploadJob("unknown"))
+
+	assert.NoError(fs.UploadToJob(job.ID, bytes.NewReader(img.Bytes()), "1.png", []int{1}))
+	assert.NoError(fs.UploadToJob(job.ID, bytes.NewReader(text), "2.txt", nil))
+	assert.Equal(ErrUploadJobIsNotExist, fs.UploadToJob("unknown", bytes.NewReader(text), "3.txt", nil))
+	// Rejected by the quota before the content is read
+	fs.config.Quota = 1
+	assert.NoError(fs.UploadToJob(job.ID, bytes.NewReader(text), "4.txt", nil))
+	fs.config.Quota = 0
+
+	// Files are stored in background
+	fs.uploadJobs.storing.Wait()
+
+	job, err = fs.GetUploadJob(job.ID)
+	assert.NoError(err)
+	assert.Equal(UploadJobReceiving, job.Status)
+	assert.Nil(job.Finished)
+	if assert.Len(job.Files, 3) {
+		assert.Equal([]UploadJobFile{
+			{Filename: "1.png", BytesReceived: int64(img.Len()), Status: UploadJobFileStored, FileID: 1, Processing: ProcessingPending},
+			{Filename: "2.txt", BytesReceived: int64(len(text)), Status: UploadJobFileStored, FileID: 2},
+		}, job.Files[:2])
+		assert.Equal(UploadJobFileFailed, job.Files[2].Status)
+		assert.Contains(job.Files[2].Error, ErrQuotaExceeded.Error())
+	}
+
+	fs.processing.wait()
+	fs.FinishUploadJob(job.ID, nil)
+	fs.FinishUploadJob(job.ID, errors.New("late error"))
+
+	job, err = fs.GetUploadJob(job.ID)
+	assert.NoError(err)
+	assert.Equal(UploadJobDone, job.Status)
+	assert.NotNil(job.Finished)
+	// The job was already finished
+	assert.Empty(job.Error)
+	assert.Equal(ProcessingDone, job.Files[0].Processing)
+	assert.Len(fs.GetUploadJobs(), 1)
+
+	// Finished jobs are kept for a while
+	fs.deleteExpiredUploadJobs(time.Now())
+	_, err = fs.GetUploadJob(job.ID)
+	assert.NoError(err)
+
+	fs.deleteExpiredUploadJobs(time.Now().Add(UploadJobRetention + time.Minute))
+	_, err = fs.GetUploadJob(job.ID)
+	assert.Equal(ErrUploadJobIsNotExist, err)
+
+	// Jobs which weren't started are deleted too
+	job, err = fs.CreateUploadJob()
+	assert.NoError(err)
+	fs.deleteExpiredUploadJobs(time.Now())
+	_, err = fs.GetUploadJob(job.ID)
+	assert.NoError(err)
+
+	fs.deleteExpiredUploadJobs(time.Now().Add(UploadJobRetention + time.Minute))
+	_, err = fs.GetUploadJob(job.ID)
+	assert.Equal(ErrUploadJobIsNotExist, err)
+}
+
+func TestGeoSearch(t *testing.T) {
+	assert := assert.New(t)
+
+	defer os.RemoveAll(testVarFolder)
+
+	fs := newTestFileStorage(t)
+	defer fs.Shutdown()
+
+	locations := []struct {
+		name     string
+		lat, lon float64
+		tags     []int
+	}{
+		{"kremlin.jpg", 55.7520, 37.6175, []int{1}},
+		{"red-square.jpg", 55.7539, 37.6208, []int{1, 2}},
+		{"hermitage.jpg", 59.9398, 30.3146, []int{1}},
+		{"opera.jpg", -33.8568, 151.2153, []int{2}},
+		{"no-gps.jpg", 0, 0, []int{1}},
+	}
+	for i, l := range locations {
+		assert.NoError(fs.Upload(newFileHeader(t, l.name, []byte(l.name)), l.tags))
+		if l.name == "no-gps.jpg" {
+			continue
+		}
+		_, err := fs.metaStorage.updateFileImage(i+1, &exif.Metadata{GPS: &exif.GPS{Latitude: l.lat, Longitude: l.lon}})
+		assert.NoError(err)
+	}
+
+	names := func(cnf GetFilesConfig) []string {
+		cnf.SortMode = SortByNameAsc
+		files, err := fs.Get(cnf)
+		assert.NoError(err)
+
+		res := []string{}
+		for _, f := range files {
+			res = append(res, f.Filename)
+		}
+		return res
+	}
+
+	moscow := &Circle{Latitude: 55.7558, Longitude: 37.6173, Radius: 1000}
+	assert.Equal([]string{"kremlin.jpg", "red-square.jpg"}, names(GetFilesConfig{Area: &GeoArea{Circle: moscow}}))
+	assert.Equal([]string{"red-square.jpg"}, names(GetFilesConfig{Expr: "2", Area: &GeoArea{Circle: moscow}}))
+
+	// Saint Petersburg is ~630km from Moscow
+	moscow.Radius = 640000
+	assert.Equal([]string{"hermitage.jpg", "kremlin.jpg", "red-square.jpg"}, names(GetFilesConfig{Area: &GeoArea{Circle: moscow}}))
+
+	russia := &BoundingBox{South: 41, West: 19, North: 82, East: 180}
+	assert.Equal([]string{"hermitage.jpg"}, names(GetFilesConfig{Area: &GeoArea{Box: russia, Circle: &Circle{59.9, 30.3, 10000}}}))
+	assert.Equal([]string{"opera.jpg"}, names(GetFilesConfig{Area: &GeoArea{Box: &BoundingBox{South: -50, West: 150, North: 0, East: -170}}}))
+
+	// A share filter is applied to found files
+	filter := func(files []File) ([]File, error) {
+		res := []File{}
+		for _, f := range files {
+			if f.ID == 3 {
+				res = append(res, f)
+			}
+		}
+		return res, nil
+	}
+	assert.Equal([]string{"hermitage.jpg"}, names(GetFilesConfig{Area: &GeoArea{Box: russia}, Filter: filter}))
+
+	for _, area := range []GeoArea{
+		{Box: &BoundingBox{South: 10, North: 5}},
+		{Box: &BoundingBox{South: -91, North: 5}},
+		{Circle: &Circle{Latitude: 10, Longitude: 10}},
+		{Circle: &Circle{Latitude: 10, Longitude: 190, Radius: 10}},
+	} {
+		_, err := fs.Get(GetFilesConfig{Area: &area})
+		assert.Equal(ErrBadGeoArea, errors.Cause(err))
+	}
+
+	// Clusters
+
+	clusters, err := fs.GetClusters(GetFilesConfig{SortMode: SortByNameAsc}, 1)
+	assert.NoError(err)
+	if assert.Len(clusters, 2) {
+		// Moscow and Saint Petersburg are in the same cluster
+		assert.Equal(3, clusters[0].Count)
+		assert.Equal(3, clusters[0].FileID)
+		assert.Equal(BoundingBox{South: 55.7520, West: 30.3146, North: 59.9398, East: 37.6208}, clusters[0].Bounds)
+		assert.InDelta((55.7520+55.7539+59.9398)/3, clusters[0].Latitude, 1e-9)
+
+		assert.Equal(1, clusters[1].Count)
+		assert.Equal(4, clusters[1].FileID)
+	}
+
+	clusters, err = fs.GetClusters(GetFilesConfig{Area: &GeoArea{Box: russia}}, 10)
+	assert.NoError(err)
+	if assert.Len(clusters, 2) {
+		assert.Equal(2, clusters[0].Count)
+		assert.Equal(1, clusters[1].Count)
+	}
+
+	_, err = fs.GetClusters(GetFilesConfig{}, MaxZoom+1)
+	assert.Equal(ErrBadZoom, err)
+}
+
+const testVarFolder = "test-var"
+
+// newTestFileStorage returns FileStorage with json metadata storage and disk binary storage in testVarFolder
+func TestGetPage(t *testing.T) {
+	assert := assert.New(t)
+
+	defer os.RemoveAll(testVarFolder)
+
+	fs := newTestFileStorage(t)
+	defer fs.Shutdown()
+
+	// Files with equal sizes are ordered by id
+	for _, f := range []struct{ name, data string }{
+		{"a", "111"}, {"b", "1"}, {"c", "333"}, {"d", "22"}, {"e", "555"},
+	} {
+		assert.NoError(fs.Upload(newFileHeader(t, f.name, []byte(f.data)), nil))
+	}
+
+	filenames := func(page FilesPage) (res []string) {
+		for _, f := range page.Files {
+			res = append(res, f.Filename)
+		}
+		return res
+	}
+
+	cnf := GetFilesConfig{SortMode: SortBySizeAsc, Count: 2}
+
+	page, err := fs.GetPage(cnf)
+	assert.NoError(err)
+	assert.Equal([]string{"b", "d"}, filenames(page))
+	assert.Equal(5, page.Total)
+	assert.Empty(page.PrevCursor)
+
+	// A new file must not shift the next page
+	assert.NoError(fs.Upload(newFileHeader(t, "f", []byte("0")), nil))
+	assert.NoError(fs.Upload(newFileHeader(t, "g", []byte("4444")), nil))
+
+	cnf.Cursor = page.NextCursor
+	page, err = fs.GetPage(cnf)
+	assert.NoError(err)
+	assert.Equal([]string{"a", "c"}, filenames(page))
+	assert.Equal(7, page.Total)
+
+	cnf.Cursor = page.NextCursor
+	page, err = fs.GetPage(cnf)
+	assert.NoError(err)
+	assert.Equal([]string{"e", "g"}, filenames(page))
+	assert.Empty(page.NextCursor)
+
+	// Go back
+	cnf.Cursor = page.PrevCursor
+	page, err = fs.GetPage(cnf)
+	assert.NoError(err)
+	assert.Equal([]string{"a", "c"}, filenames(page))
+
+	// "f" has the same size as "b" and a greater id
+	cnf.Cursor = page.PrevCursor
+	page, err = fs.GetPage(cnf)
+	assert.NoError(err)
+	assert.Equal([]string{"f", "d"}, filenames(page))
+
+	cnf.Cursor = page.PrevCursor
+	page, err = fs.GetPage(cnf)
+	assert.NoError(err)
+	assert.Equal([]string{"b"}, filenames(page))
+	assert.Empty(page.PrevCursor)
+
+	// Offset mode
+	// Files with equal sizes are ordered by id in descending order too
+	page, err = fs.GetPage(GetFilesConfig{SortMode: SortBySizeDecs, Offset: 5, Count: 5})
+	assert.NoError(err)
+	assert.Equal([]string{"b", "f"}, filenames(page))
+	assert.NotEmpty(page.PrevCursor)
+	assert.Empty(page.NextCursor)
+
+	page, err = fs.GetPage(GetFilesConfig{Offset: 10})
+	assert.NoError(err)
+	assert.Empty(page.Files)
+	assert.Equal(7, page.Total)
+
+	// A cursor can't be used with another sort mode
+	_, err = fs.GetPage(GetFilesConfig{SortMode: SortByNameAsc, Cursor: "abc"})
+	assert.Equal(ErrInvalidCursor, err)
+	_, err = fs.GetPage(GetFilesConfig{SortMode: SortByNameAsc, Cursor: cnf.Cursor})
+	assert.Equal(ErrInvalidCursor, err)
+
+	// Multi-key specification
+	spec, err := ParseSortSpec("-size,name")
+	assert.NoError(err)
+	cnf = GetFilesConfig{Sort: spec, Count: 3}
+	page, err = fs.GetPage(cnf)
+	assert.NoError(err)
+	assert.Equal([]string{"g", "a", "c"}, filenames(page))
+
+	cnf.Cursor = page.NextCursor
+	page, err = fs.GetPage(cnf)
+	assert.NoError(err)
+	assert.Equal([]string{"e", "d", "b"}, filenames(page))
+
+	// The seed isn't used without the random key, but the locale changes the order
+	spec.Seed = 1
+	_, err = fs.GetPage(GetFilesConfig{Sort: spec, Cursor: cnf.Cursor})
+	assert.NoError(err)
+	spec.Locale = "ru"
+	_, err = fs.GetPage(GetFilesConfig{Sort: spec, Cursor: cnf.Cursor})
+	assert.Equal(ErrInvalidCursor, err)
+
+	spec.Locale = "?"
+	_, err = fs.GetPage(GetFilesConfig{Sort: spec})
+	assert.Equal(ErrBadSortSpec, errors.Cause(err))
+}
+
+func TestGetPageFacets(t *testing.T) {
+	assert := assert.New(t)
+
+	defer os.RemoveAll(testVarFolder)
+
+	fs := newTestFileStorage(t)
+	defer fs.Shutdown()
+
+	assert.NoError(fs.Upload(newFileHeader(t, "1.txt", []byte("1")), []int{1}))
+	assert.NoError(fs.Upload(newFileHeader(t, "2.txt", []byte("2")), []int{1, 2}))
+	assert.NoError(fs.Upload(newFileHeader(t, "3.go", []byte("3")), []int{2}))
+
+	// Facets are counted over all found files, not only over the page
+	page, err := fs.GetPage(GetFilesConfig{Expr: "2", Count: 1, Facets: true})
+	assert.NoError(err)
+	assert.Len(page.Files, 1)
+	if assert.NotNil(page.Facets) {
+		assert.Equal(map[int]int{1: 1, 2: 2}, page.Facets.Tags)
+		assert.Equal(map[string]int{".txt": 1, ".go": 1}, page.Facets.Extensions)
+	}
+
+	// Files hidden by a filter (for example, by a share token) aren't counted
+	page, err = fs.GetPage(GetFilesConfig{
+		Facets: true,
+		Filter: func(files []File) ([]File, error) {
+			var res []File
+			for _, f := range files {
+				if f.Filename != "2.txt" {
+					res = append(res, f)
+				}
+			}
+			return res, nil
+		},
+	})
+	assert.NoError(err)
+	if assert.NotNil(page.Facets) {
+		assert.Equal(map[int]int{1: 1, 2: 1}, page.Facets.Tags)
+	}
+
+	page, err = fs.GetPage(GetFilesConfig{})
+	assert.NoError(err)
+	assert.Nil(page.Facets)
+}
+
+func newTestFileStorage(t *testing.T) *FileStorage {
+	fs, err := NewFileStorage(Config{
+		VarFolder:     testVarFolder,
+		FilesJSONFile: testVarFolder + "/files.json",
+		DiskStorage: Config_DiskStorage{
+			DataFolder:          testVarFolder + "/data",
+			ResizedImagesFolder: testVarFolder + "/data/resized",
+		},
+	}, clog.NewProdLogger())
+	if err != nil {
+		t.Fatalf("can't create FileStorage: %s", err)
+	}
+
+	// Images are processed in background. Tests call fs.processing.wait()
+	fs.processing.retryDelay = time.Millisecond
+	fs.processing.start()
+
+	return fs
+}
+
+// newFileHeader returns a header of an uploaded file
+func newFileHeader(t *testing.T, filename string, data []byte) *multipart.FileHeader {
+	body := new(bytes.Buffer)
+	w := multipart.NewWriter(body)
+	part, err := w.CreateFormFile("file", filename)
+	if err != nil {
+		t.Fatalf("can't create a form file: %s", err)
+	}
+	part.Write(data)
+	w.Close()
+
+	form, err := multipart.NewReader(body, w.Boundary()).ReadForm(1 << 20)
+	if err != nil {
+		t.Fatalf("can't read a form: %s", err)
+	}
+
+	return form.File["file"][0]
+}
@@ -0,0 +1,316 @@
+package files
+
+import (
+	"bytes"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+
+	bs "github.com/tags-drive/core/internal/storage/files/binary_storage"
+	"github.com/tags-drive/core/internal/storage/files/extensions"
+)
+
+// FsckReport is a result of the reconciliation of Metadata Storage with Binary Storage
+type FsckReport struct {
+	Time time.Time `json:"time"`
+
+	// Content without records in Metadata Storage
+
+	// OrphanBlobs contains hashes of blobs which aren't referenced by any file
+	OrphanBlobs []string `json:"orphanBlobs"`
+	// OrphanFiles contains ids of files stored by id without records
+	OrphanFiles []int `json:"orphanFiles"`
+	// OrphanRevisions contains archived revisions without records
+	OrphanRevisions []bs.ArchivedRevision `json:"orphanRevisions"`
+	// OrphanResizedImages contains ids of resized images without records
+	OrphanResizedImages []int `json:"orphanResizedImages"`
+	// OrphanThumbnails contains ids of files with cached thumbnails but without records
+	OrphanThumbnails []int `json:"orphanThumbnails"`
+	// OrphanUploads contains ids of resumable uploads with chunks but without saved states
+	OrphanUploads []string `json:"orphanUploads"`
+	// TemporaryFiles contains names of temporary files left after failed uploads
+	TemporaryFiles []string `json:"temporaryFiles"`
+	// UnknownFiles contains names of files which weren't created by Tags Drive. They are never deleted
+	UnknownFiles []string `json:"unknownFiles"`
+
+	// Records without content
+
+	// MissingContent contains revisions which content doesn't exist in Binary Storage
+	MissingContent []FsckProblem `json:"missingContent"`
+	// MissingResizedImages contains images without resized versions
+	MissingResizedImages []FsckProblem `json:"missingResizedImages"`
+
+	// Repaired is true if problems were repaired
+	Repaired bool `json:"repaired"`
+	// RepairErrors contains errors occurred during the repair
+	RepairErrors []string `json:"repairErrors"`
+}
+
+// OK returns true if no problems were found. Unknown files aren't considered as problems
+func (r FsckReport) OK() bool {
+	return len(r.OrphanBlobs) == 0 && len(r.OrphanFiles) == 0 && len(r.OrphanRevisions) == 0 &&
+		len(r.OrphanResizedImages) == 0 && len(r.OrphanThumbnails) == 0 && len(r.OrphanUploads) == 0 && len(r.TemporaryFiles) == 0 &&
+		len(r.MissingContent) == 0 && len(r.MissingResizedImages) == 0
+}
+
+// FsckProblem describes a file with missing content
+type FsckProblem struct {
+	FileID   int    `json:"fileID"`
+	Filename string `json:"filename"`
+	Revision int    `json:"revision"`
+	Hash     string `json:"hash,omitempty"`
+	// Current is true if the revision is the current one
+	Current bool `json:"current"`
+}
+
+// Fsck walks Metadata Storage and Binary Storage and finds stored content without records and records
+// without content. If repair is true, it deletes orphan content, regenerates missing resized images and
+// moves files without current content into Trash.
+//
+// Files must not be uploaded or deleted during Fsck: new content can be considered as orphan
+func (fs FileStorage) Fsck(repair bool) (FsckReport, error) {
+	report := FsckReport{
+		Time:                 time.Now(),
+		OrphanBlobs:          []string{},
+		OrphanFiles:          []int{},
+		OrphanRevisions:      []bs.ArchivedRevision{},
+		OrphanResizedImages:  []int{},
+		OrphanThumbnails:     []int{},
+		OrphanUploads:        []string{},
+		TemporaryFiles:       []string{},
+		UnknownFiles:         []string{},
+		MissingContent:       []FsckProblem{},
+		MissingResizedImages: []FsckProblem{},
+		RepairErrors:         []string{},
+	}
+
+	inv, err := fs.binStorage.Inventory()
+	if err != nil {
+		return report, errors.Wrap(err, "can't list files in Binary Storage")
+	}
+
+	var (
+		storedBlobs     = make(map[string]bool)
+		storedFiles     = make(map[int]bool)
+		storedRevisions = make(map[bs.ArchivedRevision]bool)
+		storedResized   = make(map[int]bool)
+	)
+	for _, hash := range inv.Blobs {
+		storedBlobs[hash] = true
+	}
+	for _, id := range inv.Files {
+		storedFiles[id] = true
+	}
+	for _, rev := range inv.Revisions {
+		storedRevisions[rev] = true
+	}
+	for _, id := range inv.ResizedImages {
+		storedResized[id] = true
+	}
+
+	var (
+		usedBlobs     = make(map[string]bool)
+		usedFiles     = make(map[int]bool)
+		usedRevisions = make(map[bs.ArchivedRevision]bool)
+		usedResized   = make(map[int]bool)
+	)
+
+	files := fs.metaStorage.getFiles("", "", false)
+	sort.Slice(files, func(i, j int) bool { return files[i].ID < files[j].ID })
+
+	for _, file := range files {
+		current := file.CurrentRevision()
+
+		for _, rev := range file.GetRevisions() {
+			var stored bool
+			switch {
+			case rev.Hash != "":
+				usedBlobs[rev.Hash] = true
+				stored = storedBlobs[rev.Hash]
+			case rev.Number == current.Number:
+				usedFiles[file.ID] = true
+				stored = storedFiles[file.ID]
+			default:
+				archived := bs.ArchivedRevision{FileID: file.ID, Revision: rev.Number}
+				usedRevisions[archived] = true
+				stored = storedRevisions[archived]
+			}
+
+			if !stored {
+				report.MissingContent = append(report.MissingContent, FsckProblem{
+					FileID:   file.ID,
+					Filename: file.Filename,
+					Revision: rev.Number,
+					Hash:     rev.Hash,
+					Current:  rev.Number == current.Number,
+				})
+			}
+		}
+
+		if file.Type.FileType == extensions.FileTypeImage {
+			usedResized[file.ID] = true
+			if !storedResized[file.ID] {
+				report.MissingResizedImages = append(report.MissingResizedImages, FsckProblem{
+					FileID:   file.ID,
+					Filename: file.Filename,
+					Revision: current.Number,
+					Hash:     current.Hash,
+					Current:  true,
+				})
+			}
+		}
+	}
+
+	for _, hash := range inv.Blobs {
+		if !usedBlobs[hash] {
+			report.OrphanBlobs = append(report.OrphanBlobs, hash)
+		}
+	}
+	for _, id := range inv.Files {
+		if !usedFiles[id] {
+			report.OrphanFiles = append(report.OrphanFiles, id)
+		}
+	}
+	for _, rev := range inv.Revisions {
+		if !usedRevisions[rev] {
+			report.OrphanRevisions = append(report.OrphanRevisions, rev)
+		}
+	}
+	for _, id := range inv.ResizedImages {
+		if !usedResized[id] {
+			report.OrphanResizedImages = append(report.OrphanResizedImages, id)
+		}
+	}
+	for _, id := range inv.Thumbnails {
+		// Thumbnails are generated only for images, as resized images
+		if !usedResized[id] {
+			report.OrphanThumbnails = append(report.OrphanThumbnails, id)
+		}
+	}
+	for _, id := range inv.Uploads {
+		if _, ok := fs.uploads.get(id); !ok {
+			report.OrphanUploads = append(report.OrphanUploads, id)
+		}
+	}
+	report.TemporaryFiles = append(report.TemporaryFiles, inv.TemporaryFiles...)
+	report.UnknownFiles = append(report.UnknownFiles, inv.Unknown...)
+
+	sort.Strings(report.OrphanBlobs)
+	sort.Ints(report.OrphanFiles)
+	sort.Slice(report.OrphanRevisions, func(i, j int) bool {
+		a, b := report.OrphanRevisions[i], report.OrphanRevisions[j]
+		if a.FileID != b.FileID {
+			return a.FileID < b.FileID
+		}
+		return a.Revision < b.Revision
+	})
+	sort.Ints(report.OrphanResizedImages)
+	sort.Ints(report.OrphanThumbnails)
+	sort.Strings(report.OrphanUploads)
+	sort.Strings(report.TemporaryFiles)
+	sort.Strings(report.UnknownFiles)
+
+	if repair {
+		fs.repair(&report)
+	}
+
+	return report, nil
+}
+
+// repair fixes problems found by Fsck. Errors are saved into report.RepairErrors
+func (fs FileStorage) repair(report *FsckReport) {
+	addError := func(err error) {
+		report.RepairErrors = append(report.RepairErrors, err.Error())
+	}
+
+	// Delete orphans
+
+	for _, hash := range report.OrphanBlobs {
+		// releaseBlobs checks refs again
+		if err := fs.releaseBlobs(hash); err != nil {
+			addError(err)
+		}
+	}
+	for _, id := range report.OrphanFiles {
+		if err := fs.binStorage.DeleteFile(id, false); err != nil {
+			addError(errors.Wrapf(err, "can't delete the orphan file with id %d", id))
+		}
+	}
+	for _, rev := range report.OrphanRevisions {
+		if err := fs.binStorage.DeleteFileRevision(rev.FileID, rev.Revision); err != nil {
+			addError(errors.Wrapf(err, "can't delete the orphan revision %d of file with id %d", rev.Revision, rev.FileID))
+		}
+	}
+	for _, id := range report.OrphanResizedImages {
+		if err := fs.binStorage.DeleteFile(id, true); err != nil {
+			addError(errors.Wrapf(err, "can't delete the orphan resized image with id %d", id))
+		}
+	}
+	for _, id := range report.OrphanThumbnails {
+		if err := fs.binStorage.DeleteThumbnails(id); err != nil {
+			addError(errors.Wrapf(err, "can't delete orphan thumbnails of file with id %d", id))
+		}
+	}
+	for _, id := range report.OrphanUploads {
+		if err := fs.binStorage.DeleteUpload(id); err != nil {
+			addError(errors.Wrapf(err, "can't delete chunks of the orphan upload %s", id))
+		}
+	}
+	for _, name := range report.TemporaryFiles {
+		if err := fs.binStorage.DeleteTemporaryFile(name); err != nil {
+			addError(errors.Wrapf(err, "can't delete the temporary file %s", name))
+		}
+	}
+
+	// Move files without content into Trash
+
+	lostFiles := make(map[int]bool)
+	for _, p := range report.MissingContent {
+		if !p.Current {
+			// Old revisions can't be repaired
+			continue
+		}
+		lostFiles[p.FileID] = true
+
+		file, err := fs.metaStorage.getFile(p.FileID)
+		if err != nil {
+			addError(errors.Wrapf(err, "can't get file with id %d", p.FileID))
+			continue
+		}
+		if file.Deleted {
+			continue
+		}
+
+		if err := fs.metaStorage.deleteFile(p.FileID); err != nil {
+			addError(errors.Wrapf(err, "can't move file with id %d into Trash", p.FileID))
+		}
+	}
+
+	// Regenerate resized images
+
+	for _, p := range report.MissingResizedImages {
+		if lostFiles[p.FileID] {
+			// There's no content to resize
+			continue
+		}
+
+		file, err := fs.metaStorage.getFile(p.FileID)
+		if err != nil {
+			addError(errors.Wrapf(err, "can't get file with id %d", p.FileID))
+			continue
+		}
+
+		image := new(bytes.Buffer)
+		if err := fs.copyRevision(image, file, file.CurrentRevision()); err != nil {
+			addError(errors.Wrapf(err, "can't load an image %s", file.Filename))
+			continue
+		}
+
+		if err := fs.createResizedImage(image.Bytes(), file.ID, file.Filename); err != nil {
+			addError(err)
+		}
+	}
+
+	report.Repaired = true
+}
@@ -0,0 +1,300 @@
+package files
+
+import (
+	"math"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrBadGeoArea is returned when a bounding box or a circle is invalid
+	ErrBadGeoArea = errors.New("bad geographic area")
+	// ErrBadZoom is returned when a zoom level is out of [0, MaxZoom]
+	ErrBadZoom = errors.New("bad zoom level")
+)
+
+const (
+	// MaxZoom is the max zoom level of map clusters
+	MaxZoom = 22
+
+	// earthRadius is the mean radius of the Earth in meters
+	earthRadius = 6371008.8
+	// maxMercatorLatitude is the max latitude which can be shown with Web Mercator projection
+	maxMercatorLatitude = 85.05112878
+	// clusterCellSize is a size of a cluster cell in pixels of a 256x256 tile
+	clusterCellSize = 64
+)
+
+// BoundingBox is an area between two parallels and two meridians (in degrees).
+// A box crossing the antimeridian has West > East
+type BoundingBox struct {
+	South float64 `json:"south"`
+	West  float64 `json:"west"`
+	North float64 `json:"north"`
+	East  float64 `json:"east"`
+}
+
+// Circle is an area within Radius meters of a point
+type Circle struct {
+	Latitude  float64
+	Longitude float64
+	Radius    float64
+}
+
+// GeoArea restricts found files to files with GPS coordinates in an area. If both Box and Circle
+// are set, a file must be inside both of them
+type GeoArea struct {
+	Box    *BoundingBox
+	Circle *Circle
+}
+
+// Location contains coordinates of a file
+type Location struct {
+	FileID    int
+	Latitude  float64
+	Longitude float64
+}
+
+// Cluster is a group of close files on a map
+type Cluster struct {
+	// Latitude and Longitude are the center of the cluster
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Count     int     `json:"count"`
+	// Bounds contains all files of the cluster
+	Bounds BoundingBox `json:"bounds"`
+	// FileID is an id of the first file of the cluster according to the requested sort order.
+	// It can be used for a preview
+	FileID int `json:"fileId"`
+}
+
+// Check checks bounds of a box
+func (b BoundingBox) Check() error {
+	if !validLatitude(b.South) || !validLatitude(b.North) || !validLongitude(b.West) || !validLongitude(b.East) {
+		return errors.Wrap(ErrBadGeoArea, "coordinates are out of range")
+	}
+	if b.South > b.North {
+		return errors.Wrap(ErrBadGeoArea, "south is greater than north")
+	}
+	return nil
+}
+
+func (b BoundingBox) contains(lat, lon float64) bool {
+	if lat < b.South || lat > b.North {
+		return false
+	}
+	if b.West > b.East {
+		// The box crosses the antimeridian
+		return lon >= b.West || lon <= b.East
+	}
+	return lon >= b.West && lon <= b.East
+}
+
+// Check checks the center and the radius of a circle
+func (c Circle) Check() error {
+	if !validLatitude(c.Latitude) || !validLongitude(c.Longitude) {
+		return errors.Wrap(ErrBadGeoArea, "coordinates are out of range")
+	}
+	if !(c.Radius > 0) || math.IsInf(c.Radius, 0) {
+		return errors.Wrap(ErrBadGeoArea, "radius must be positive")
+	}
+	return nil
+}
+
+func (c Circle) contains(lat, lon float64) bool {
+	return distance(c.Latitude, c.Longitude, lat, lon) <= c.Radius
+}
+
+// bounds returns the smallest box which contains the circle
+func (c Circle) bounds() BoundingBox {
+	delta := c.Radius / earthRadius * 180 / math.Pi
+
+	box := BoundingBox{South: c.Latitude - delta, North: c.Latitude + delta, West: -180, East: 180}
+	if box.South <= -90 || box.North >= 90 || delta >= 90 {
+		// The circle contains a pole
+		box.South, box.North = math.Max(box.South, -90), math.Min(box.North, 90)
+		return box
+	}
+
+	lonDelta := math.Asin(math.Sin(c.Radius/earthRadius)/math.Cos(c.Latitude*math.Pi/180)) * 180 / math.Pi
+	box.West, box.East = normalizeLongitude(c.Longitude-lonDelta), normalizeLongitude(c.Longitude+lonDelta)
+	return box
+}
+
+// Check checks the box and the circle of an area
+func (a GeoArea) Check() error {
+	if a.Box != nil {
+		if err := a.Box.Check(); err != nil {
+			return err
+		}
+	}
+	if a.Circle != nil {
+		if err := a.Circle.Check(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queryBox returns a box which is used to select candidates from an index
+func (a GeoArea) queryBox() BoundingBox {
+	switch {
+	case a.Box != nil:
+		return *a.Box
+	case a.Circle != nil:
+		return a.Circle.bounds()
+	default:
+		return BoundingBox{South: -90, West: -180, North: 90, East: 180}
+	}
+}
+
+func (a GeoArea) contains(lat, lon float64) bool {
+	return (a.Box == nil || a.Box.contains(lat, lon)) && (a.Circle == nil || a.Circle.contains(lat, lon))
+}
+
+// location returns coordinates of a file
+func (f File) location() (lat, lon float64, ok bool) {
+	if f.Image == nil || f.Image.GPS == nil {
+		return 0, 0, false
+	}
+	return f.Image.GPS.Latitude, f.Image.GPS.Longitude, true
+}
+
+// filterFilesByArea returns files located in an area. The order of files isn't changed
+func (fs FileStorage) filterFilesByArea(files []File, area GeoArea) ([]File, error) {
+	locations, err := fs.metaStorage.getLocations(area.queryBox())
+	if err != nil {
+		return nil, errors.Wrap(err, "can't get locations of files")
+	}
+
+	inArea := make(map[int]bool, len(locations))
+	for _, l := range locations {
+		if area.contains(l.Latitude, l.Longitude) {
+			inArea[l.FileID] = true
+		}
+	}
+
+	res := make([]File, 0, len(inArea))
+	for _, f := range files {
+		if inArea[f.ID] {
+			res = append(res, f)
+		}
+	}
+
+	return res, nil
+}
+
+// GetClusters groups "good" files with coordinates into clusters for a map with passed zoom level.
+// Files close to each other on the map are grouped into the same cluster. Clusters are sorted by
+// a number of files in descending order
+func (fs FileStorage) GetClusters(cnf GetFilesConfig, zoom int) ([]Cluster, error) {
+	if zoom < 0 || zoom > MaxZoom {
+		return nil, ErrBadZoom
+	}
+
+	files, err := fs.getSortedFiles(cnf)
+	if err != nil {
+		return nil, err
+	}
+
+	type cell struct{ x, y int }
+	type group struct {
+		cluster      Cluster
+		sumLat       float64
+		sumLon       float64
+		firstFilePos int
+	}
+
+	groups := make(map[cell]*group)
+	for i, f := range files {
+		lat, lon, ok := f.location()
+		if !ok {
+			continue
+		}
+
+		x, y := mercatorPixel(lat, lon, zoom)
+		c := cell{int(x / clusterCellSize), int(y / clusterCellSize)}
+
+		g, ok := groups[c]
+		if !ok {
+			g = &group{
+				cluster:      Cluster{FileID: f.ID, Bounds: BoundingBox{South: lat, West: lon, North: lat, East: lon}},
+				firstFilePos: i,
+			}
+			groups[c] = g
+		}
+
+		g.cluster.Count++
+		g.sumLat += lat
+		g.sumLon += lon
+		g.cluster.Bounds.South = math.Min(g.cluster.Bounds.South, lat)
+		g.cluster.Bounds.North = math.Max(g.cluster.Bounds.North, lat)
+		g.cluster.Bounds.West = math.Min(g.cluster.Bounds.West, lon)
+		g.cluster.Bounds.East = math.Max(g.cluster.Bounds.East, lon)
+	}
+
+	all := make([]*group, 0, len(groups))
+	for _, g := range groups {
+		g.cluster.Latitude = g.sumLat / float64(g.cluster.Count)
+		g.cluster.Longitude = g.sumLon / float64(g.cluster.Count)
+		all = append(all, g)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].cluster.Count != all[j].cluster.Count {
+			return all[i].cluster.Count > all[j].cluster.Count
+		}
+		return all[i].firstFilePos < all[j].firstFilePos
+	})
+
+	clusters := make([]Cluster, 0, len(all))
+	for _, g := range all {
+		clusters = append(clusters, g.cluster)
+	}
+
+	return clusters, nil
+}
+
+// mercatorPixel returns pixel coordinates of a point on a Web Mercator map with 256x256 tiles
+func mercatorPixel(lat, lon float64, zoom int) (x, y float64) {
+	lat = math.Max(math.Min(lat, maxMercatorLatitude), -maxMercatorLatitude)
+	size := 256 * math.Exp2(float64(zoom))
+
+	sin := math.Sin(lat * math.Pi / 180)
+	x = (lon + 180) / 360 * size
+	y = (0.5 - math.Log((1+sin)/(1-sin))/(4*math.Pi)) * size
+
+	// The east edge belongs to the last cell
+	return math.Min(x, size-1), math.Min(math.Max(y, 0), size-1)
+}
+
+// distance returns the great-circle distance between two points in meters (haversine formula)
+func distance(lat1, lon1, lat2, lon2 float64) float64 {
+	toRad := func(d float64) float64 { return d * math.Pi / 180 }
+
+	dLat := toRad(lat2 - lat1)
+	dLon := toRad(lon2 - lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(lat1))*math.Cos(toRad(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+func normalizeLongitude(lon float64) float64 {
+	switch {
+	case lon < -180:
+		return lon + 360
+	case lon > 180:
+		return lon - 360
+	default:
+		return lon
+	}
+}
+
+func validLatitude(lat float64) bool {
+	return lat >= -90 && lat <= 90
+}
+
+func validLongitude(lon float64) bool {
+	return lon >= -180 && lon <= 180
+}
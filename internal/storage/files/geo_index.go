@@ -0,0 +1,108 @@
+package files
+
+import (
+	"sort"
+)
+
+// geoIndex keeps locations of files sorted by latitude, so files in a range of latitudes can be found
+// with a binary search. It isn't thread-safe, it is guarded by a mutex of a metadata storage
+type geoIndex struct {
+	// locations are sorted by latitude and by id
+	locations []Location
+	// fileLocations contains indexed locations of every file. It is used to update locations
+	fileLocations map[int]Location
+}
+
+func newGeoIndex() *geoIndex {
+	return &geoIndex{
+		locations:     []Location{},
+		fileLocations: make(map[int]Location),
+	}
+}
+
+// rebuild indexes passed files from scratch
+func (gi *geoIndex) rebuild(files map[int]File) {
+	gi.locations = []Location{}
+	gi.fileLocations = make(map[int]Location)
+
+	for _, f := range files {
+		lat, lon, ok := f.location()
+		if !ok {
+			continue
+		}
+
+		l := Location{FileID: f.ID, Latitude: lat, Longitude: lon}
+		gi.locations = append(gi.locations, l)
+		gi.fileLocations[f.ID] = l
+	}
+
+	sort.Slice(gi.locations, func(i, j int) bool {
+		return locationLess(gi.locations[i], gi.locations[j])
+	})
+}
+
+// set adds, updates or removes a location of a file
+func (gi *geoIndex) set(f File) {
+	lat, lon, ok := f.location()
+	if old, indexed := gi.fileLocations[f.ID]; indexed {
+		if ok && old.Latitude == lat && old.Longitude == lon {
+			return
+		}
+		gi.delete(f.ID)
+	}
+	if !ok {
+		return
+	}
+
+	l := Location{FileID: f.ID, Latitude: lat, Longitude: lon}
+	i := gi.search(l)
+	gi.locations = append(gi.locations, Location{})
+	copy(gi.locations[i+1:], gi.locations[i:])
+	gi.locations[i] = l
+	gi.fileLocations[f.ID] = l
+}
+
+// delete removes a file from the index
+func (gi *geoIndex) delete(id int) {
+	l, ok := gi.fileLocations[id]
+	if !ok {
+		return
+	}
+
+	i := gi.search(l)
+	gi.locations = append(gi.locations[:i], gi.locations[i+1:]...)
+	delete(gi.fileLocations, id)
+}
+
+// search returns a position of a location in gi.locations
+func (gi *geoIndex) search(l Location) int {
+	return sort.Search(len(gi.locations), func(i int) bool {
+		return !locationLess(gi.locations[i], l)
+	})
+}
+
+// get returns locations of files in a box
+func (gi *geoIndex) get(box BoundingBox) []Location {
+	start := sort.Search(len(gi.locations), func(i int) bool {
+		return gi.locations[i].Latitude >= box.South
+	})
+
+	res := []Location{}
+	for _, l := range gi.locations[start:] {
+		if l.Latitude > box.North {
+			break
+		}
+		if box.contains(l.Latitude, l.Longitude) {
+			res = append(res, l)
+		}
+	}
+
+	return res
+}
+
+func locationLess(a, b Location) bool {
+	if a.Latitude != b.Latitude {
+		return a.Latitude < b.Latitude
+	}
+	return a.FileID < b.FileID
+}
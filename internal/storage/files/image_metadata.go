@@ -0,0 +1,55 @@
+package files
+
+import (
+	"bytes"
+
+	"github.com/pkg/errors"
+
+	"github.com/tags-drive/core/internal/storage/files/exif"
+	"github.com/tags-drive/core/internal/storage/files/extensions"
+)
+
+// updateImageMetadata extracts metadata of an image and saves it into Metadata Storage.
+// Errors are only logged
+func (fs FileStorage) updateImageMetadata(id int, filename string, content []byte) {
+	meta, err := exif.Read(content)
+	if err != nil {
+		fs.logger.Errorf("can't extract metadata of an image %s: %s\n", filename, err)
+		return
+	}
+
+	if _, err := fs.metaStorage.updateFileImage(id, meta); err != nil {
+		fs.logger.Errorf("can't save metadata of an image %s: %s\n", filename, err)
+	}
+}
+
+// ExtractImageMetadata extracts metadata of the current revisions of all images (including files in Trash).
+// It is used to fill metadata of images uploaded before its introduction. It returns a number of updated
+// images. Errors of reading of single images are only logged
+func (fs FileStorage) ExtractImageMetadata() (int, error) {
+	updated := 0
+	for _, file := range fs.metaStorage.getFiles("", "", false) {
+		if file.Type.FileType != extensions.FileTypeImage {
+			continue
+		}
+
+		content := new(bytes.Buffer)
+		if err := fs.copyRevision(content, file, file.CurrentRevision()); err != nil {
+			fs.logger.Errorf("can't load an image %s: %s\n", file.Filename, err)
+			continue
+		}
+
+		meta, err := exif.Read(content.Bytes())
+		if err != nil {
+			fs.logger.Errorf("can't extract metadata of an image %s: %s\n", file.Filename, err)
+			continue
+		}
+
+		if _, err := fs.metaStorage.updateFileImage(file.ID, meta); err != nil {
+			return updated, errors.Wrapf(err, "can't save metadata of an image %s", file.Filename)
+		}
+		updated++
+	}
+
+	return updated, nil
+}
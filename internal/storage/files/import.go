@@ -0,0 +1,344 @@
+package files
+
+import (
+	"context"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/tags-drive/core/internal/storage/files/extensions"
+)
+
+const (
+	// DefaultImportMaxSize is used when Config.ImportMaxSize isn't set
+	DefaultImportMaxSize = 1 << 30 // 1GB
+	// DefaultImportTimeout is used when Config.ImportTimeout isn't set
+	DefaultImportTimeout = 10 * time.Minute
+
+	// importedFilename is used when a filename can't be derived from a response
+	importedFilename = "imported"
+)
+
+// Errors
+var (
+	ErrImportBadURL         = errors.New("only http and https urls can be imported")
+	ErrImportTooLarge       = errors.New("the file is too large")
+	ErrImportBadContentType = errors.New("content type of the file isn't allowed")
+	ErrImportInternalHost   = errors.New("files can't be imported from internal hosts")
+)
+
+// internalNetworks are networks which files can't be imported from unless they are allowed
+// by Config.ImportAllowedHosts
+var internalNetworks = func() []*net.IPNet {
+	cidrs := []string{
+		"0.0.0.0/8",      // "this" network
+		"10.0.0.0/8",     // private
+		"100.64.0.0/10",  // carrier-grade NAT
+		"127.0.0.0/8",    // loopback
+		"169.254.0.0/16", // link-local, cloud metadata services
+		"172.16.0.0/12",  // private
+		"192.0.0.0/24",   // IETF protocol assignments
+		"192.168.0.0/16", // private
+		"198.18.0.0/15",  // benchmarking
+		"224.0.0.0/4",    // multicast
+		"240.0.0.0/4",    // reserved, broadcast
+		"::/128",         // unspecified
+		"::1/128",        // loopback
+		"64:ff9b::/96",   // IPv4/IPv6 translation
+		"fc00::/7",       // unique local
+		"fe80::/10",      // link-local
+		"ff00::/8",       // multicast
+	}
+
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}()
+
+func isInternalIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		// IPv4-mapped addresses are checked as IPv4 ones
+		ip = ip4
+	}
+	for _, network := range internalNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// importAllowlist contains internal hosts which files can be imported from (see Config.ImportAllowedHosts)
+type importAllowlist struct {
+	hosts    map[string]bool
+	networks []*net.IPNet
+}
+
+func newImportAllowlist(hosts []string) importAllowlist {
+	list := importAllowlist{hosts: make(map[string]bool)}
+	for _, host := range hosts {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if host == "" {
+			continue
+		}
+
+		if _, network, err := net.ParseCIDR(host); err == nil {
+			list.networks = append(list.networks, network)
+			continue
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			list.networks = append(list.networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+		list.hosts[host] = true
+	}
+	return list
+}
+
+func (list importAllowlist) allowIP(ip net.IP) bool {
+	for _, network := range list.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAddress is used as net.Dialer.Control. It is called after the resolution of a host name
+// for every connection (redirects too), so a host can't point to an internal address
+func (list importAllowlist) checkAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return errors.Errorf("invalid address %q", address)
+	}
+
+	if isInternalIP(ip) && !list.allowIP(ip) {
+		return errors.Wrapf(ErrImportInternalHost, "%s is an internal address", ip)
+	}
+	return nil
+}
+
+func newImportClient(cnf Config) *http.Client {
+	timeout := cnf.ImportTimeout
+	if timeout <= 0 {
+		timeout = DefaultImportTimeout
+	}
+
+	allowlist := newImportAllowlist(cnf.ImportAllowedHosts)
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   allowlist.checkAddress,
+	}
+	allowedDialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	transport := &http.Transport{
+		// Proxies from the environment aren't used: addresses must be checked by the dialer
+		Proxy: nil,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if host, _, err := net.SplitHostPort(addr); err == nil && allowlist.hosts[strings.ToLower(host)] {
+				return allowedDialer.DialContext(ctx, network, addr)
+			}
+			return dialer.DialContext(ctx, network, addr)
+		},
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+	}
+
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// isInternalHostError checks if a request failed because a host has an internal address
+func isInternalHostError(err error) bool {
+	for err != nil {
+		if errors.Cause(err) == ErrImportInternalHost {
+			return true
+		}
+
+		switch e := err.(type) {
+		case *url.Error:
+			err = e.Err
+		case *net.OpError:
+			err = e.Err
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+func (fs FileStorage) importMaxSize() int64 {
+	if fs.config.ImportMaxSize <= 0 {
+		return DefaultImportMaxSize
+	}
+	return fs.config.ImportMaxSize
+}
+
+// checkImportContentType checks a media type against Config.ImportContentTypes. Patterns can end
+// with "/*" ("image/*"). All types are allowed if there's no patterns
+func (fs FileStorage) checkImportContentType(mediaType string) bool {
+	if len(fs.config.ImportContentTypes) == 0 {
+		return true
+	}
+
+	for _, pattern := range fs.config.ImportContentTypes {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == mediaType {
+			return true
+		}
+		if strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// limitedReader returns ErrImportTooLarge when more than n bytes are read
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+
+	n, err := l.r.Read(p)
+	if int64(n) > l.n {
+		return 0, ErrImportTooLarge
+	}
+	l.n -= int64(n)
+	return n, err
+}
+
+// ImportURL downloads a file and uploads it as UploadReader does. The filename is taken from
+// Content-Disposition header or from the url path. The size of the file is limited by Config.ImportMaxSize,
+// the time of downloading - by Config.ImportTimeout. Files can't be imported from internal hosts (loopback,
+// private and link-local addresses) unless they are allowed by Config.ImportAllowedHosts
+func (fs FileStorage) ImportURL(rawURL string, tags []int) (UploadResult, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return UploadResult{}, ErrImportBadURL
+	}
+
+	resp, err := fs.importClient.Get(u.String())
+	if err != nil {
+		if isInternalHostError(err) {
+			return UploadResult{}, errors.Wrap(ErrImportInternalHost, "can't download the file")
+		}
+		return UploadResult{}, errors.Wrap(err, "can't download the file")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return UploadResult{}, errors.Errorf("server responded with status %s", resp.Status)
+	}
+
+	maxSize := fs.importMaxSize()
+	if resp.ContentLength > maxSize {
+		return UploadResult{}, ErrImportTooLarge
+	}
+
+	mediaType := "application/octet-stream"
+	if ct := resp.Header.Get("Content-Type"); ct != "" {
+		mediaType, _, err = mime.ParseMediaType(ct)
+		if err != nil {
+			return UploadResult{}, errors.Wrap(err, "invalid Content-Type")
+		}
+	}
+	if !fs.checkImportContentType(mediaType) {
+		return UploadResult{}, ErrImportBadContentType
+	}
+
+	filename := getImportFilename(resp.Header.Get("Content-Disposition"), resp.Request.URL, mediaType)
+
+	body := &limitedReader{r: resp.Body, n: maxSize}
+	res, err := fs.upload(body, resp.ContentLength, filename, tags)
+	if errors.Cause(err) == ErrImportTooLarge {
+		return UploadResult{}, ErrImportTooLarge
+	}
+	return res, err
+}
+
+// getImportFilename derives a filename from Content-Disposition header or from the last segment
+// of the url path (after redirects). An extension is added according to the media type if the name
+// doesn't have one
+func getImportFilename(contentDisposition string, u *url.URL, mediaType string) string {
+	clean := func(name string) string {
+		name = strings.TrimSpace(strings.Replace(name, `\`, "/", -1))
+		name = path.Base(name)
+		if name == "." || name == "/" || name == ".." {
+			return ""
+		}
+		return name
+	}
+
+	var filename string
+	if _, params, err := mime.ParseMediaType(contentDisposition); err == nil {
+		filename = clean(params["filename"])
+	}
+	if filename == "" && u != nil {
+		filename = clean(u.Path)
+	}
+	if filename == "" {
+		filename = importedFilename
+	}
+
+	if filepath.Ext(filename) == "" {
+		filename += getExtensionByType(mediaType)
+	}
+
+	return filename
+}
+
+// preferredExtensions are used for media types with several common extensions
+var preferredExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"text/plain": ".txt",
+	"video/mp4":  ".mp4",
+	"audio/mpeg": ".mp3",
+}
+
+// getExtensionByType returns an extension for a media type. Supported extensions are preferred
+func getExtensionByType(mediaType string) string {
+	if ext, ok := preferredExtensions[mediaType]; ok {
+		return ext
+	}
+
+	exts, err := mime.ExtensionsByType(mediaType)
+	if err != nil || len(exts) == 0 {
+		return ""
+	}
+
+	for _, ext := range exts {
+		if extensions.GetExt(ext).Supported {
+			return ext
+		}
+	}
+	return exts[0]
+}
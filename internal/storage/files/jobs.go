@@ -0,0 +1,418 @@
+package files
+
+import (
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// UploadJobStatus is a status of an upload job
+type UploadJobStatus string
+
+const (
+	// UploadJobReceiving means that files are still being received in the request
+	UploadJobReceiving UploadJobStatus = "receiving"
+	// UploadJobStoring means that all files are received, but some of them are still being stored
+	UploadJobStoring UploadJobStatus = "storing"
+	// UploadJobProcessing means that all files are stored, but some images are still processed
+	UploadJobProcessing UploadJobStatus = "processing"
+	// UploadJobDone means that all files are stored and processed (or failed)
+	UploadJobDone UploadJobStatus = "done"
+)
+
+// UploadJobFileStatus is a status of a file of an upload job
+type UploadJobFileStatus string
+
+const (
+	// UploadJobFileReceiving means that content of the file is being received. It is stored at the same time
+	UploadJobFileReceiving UploadJobFileStatus = "receiving"
+	// UploadJobFileStoring means that the whole content is received, but the file isn't saved yet
+	UploadJobFileStoring UploadJobFileStatus = "storing"
+	// UploadJobFileStored means that the file is saved
+	UploadJobFileStored UploadJobFileStatus = "stored"
+	// UploadJobFileFailed means that the file can't be received or stored. The reason is in UploadJobFile.Error
+	UploadJobFileFailed UploadJobFileStatus = "failed"
+)
+
+// UploadJobRetention is a time during which a finished job is kept
+const UploadJobRetention = time.Hour
+
+var (
+	// ErrUploadJobIsNotExist is returned when a job doesn't exist or was already deleted
+	ErrUploadJobIsNotExist = errors.New("the upload job doesn't exist")
+	// ErrUploadJobIsStarted is returned by StartUploadJob when files are already being received into a job
+	ErrUploadJobIsStarted = errors.New("the upload job is already started")
+)
+
+// UploadJob tracks progress of files uploaded by a single request. Jobs are kept in memory
+type UploadJob struct {
+	ID      string          `json:"id"`
+	Status  UploadJobStatus `json:"status"`
+	Created time.Time       `json:"created"`
+	// Finished is set when the job is done
+	Finished *time.Time      `json:"finished,omitempty"`
+	Files    []UploadJobFile `json:"files"`
+	// Error is set when the request was interrupted (for example, the form is invalid). Files received
+	// before the error are kept
+	Error string `json:"error,omitempty"`
+
+	// started is true when a request started to send files into the job
+	started bool
+	// storing is a number of files which are being stored
+	storing int
+	// order is held while a file is being stored. Files are stored one by one, so they get ids in
+	// the order they were received
+	order *sync.Mutex
+}
+
+// UploadJobFile is a progress of a single file
+type UploadJobFile struct {
+	Filename      string              `json:"filename"`
+	BytesReceived int64               `json:"bytesReceived"`
+	Status        UploadJobFileStatus `json:"status"`
+	// FileID is set when the file is stored
+	FileID int `json:"fileID,omitempty"`
+	// Processing is a status of processing of an image (see File.Processing). It is empty for other files.
+	// ProcessingDone means that the resized image is ready
+	Processing ProcessingStatus `json:"processing,omitempty"`
+	// Duplicates contains ids of existing files with the same content (or filename). Duplicate is a policy
+	// applied to them (see UploadResult)
+	Duplicates []int           `json:"duplicates,omitempty"`
+	Duplicate  DuplicatePolicy `json:"duplicate,omitempty"`
+	Error      string          `json:"error,omitempty"`
+}
+
+type uploadJobs struct {
+	mutex *sync.Mutex
+	jobs  map[string]*UploadJob
+	// storing tracks goroutines which store files
+	storing *sync.WaitGroup
+}
+
+func newUploadJobs() *uploadJobs {
+	return &uploadJobs{
+		mutex:   new(sync.Mutex),
+		jobs:    make(map[string]*UploadJob),
+		storing: new(sync.WaitGroup),
+	}
+}
+
+// update calls fn for a file of a job under the lock
+func (uj *uploadJobs) update(jobID string, index int, fn func(f *UploadJobFile)) {
+	uj.mutex.Lock()
+	defer uj.mutex.Unlock()
+
+	if job, ok := uj.jobs[jobID]; ok && index < len(job.Files) {
+		fn(&job.Files[index])
+	}
+}
+
+// updateStatus moves a job to the processing status when all received files are stored.
+// It must be called under the lock
+func (job *UploadJob) updateStatus() {
+	if job.Status == UploadJobStoring && job.storing == 0 {
+		job.Status = UploadJobProcessing
+	}
+}
+
+// progressReader reports a number of read bytes
+type progressReader struct {
+	r        io.Reader
+	progress func(n int64)
+	// err is the last read error except io.EOF
+	err error
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.progress(int64(n))
+	}
+	if err != nil && err != io.EOF {
+		p.err = err
+	}
+	return n, err
+}
+
+// CreateUploadJob creates a new job. Files are added by UploadToJob. FinishUploadJob must be called
+// after the last file. A job which isn't started (see StartUploadJob) is deleted after UploadJobRetention
+func (fs FileStorage) CreateUploadJob() (UploadJob, error) {
+	id, err := generateRandomID()
+	if err != nil {
+		return UploadJob{}, errors.Wrap(err, "can't generate an id of the job")
+	}
+
+	job := &UploadJob{
+		ID:      id,
+		Status:  UploadJobReceiving,
+		Created: time.Now(),
+		Files:   []UploadJobFile{},
+		order:   new(sync.Mutex),
+	}
+
+	fs.uploadJobs.mutex.Lock()
+	fs.uploadJobs.jobs[id] = job
+	fs.uploadJobs.mutex.Unlock()
+
+	return copyUploadJob(job), nil
+}
+
+// StartUploadJob marks that a request started to send files into a job. Only a single request can
+// send files into a job, so ErrUploadJobIsStarted is returned if the job was already started
+func (fs FileStorage) StartUploadJob(jobID string) error {
+	fs.uploadJobs.mutex.Lock()
+	defer fs.uploadJobs.mutex.Unlock()
+
+	job, ok := fs.uploadJobs.jobs[jobID]
+	if !ok {
+		return ErrUploadJobIsNotExist
+	}
+	if job.started || job.Status != UploadJobReceiving {
+		return ErrUploadJobIsStarted
+	}
+	job.started = true
+
+	return nil
+}
+
+// UploadToJob receives a new file and tracks its progress in a job. The file is stored (as UploadReader)
+// in a separate goroutine while the content is being read. UploadToJob returns when the whole content
+// is read, errors of storing are reported through the job. If the file is merged into an existing one,
+// FileID of the job file is the id of the existing file
+func (fs FileStorage) UploadToJob(jobID string, r io.Reader, filename string, tags []int) error {
+	fs.uploadJobs.mutex.Lock()
+	job, ok := fs.uploadJobs.jobs[jobID]
+	if !ok {
+		fs.uploadJobs.mutex.Unlock()
+		return ErrUploadJobIsNotExist
+	}
+	job.Files = append(job.Files, UploadJobFile{Filename: filename, Status: UploadJobFileReceiving})
+	job.storing++
+	index := len(job.Files) - 1
+	fs.uploadJobs.mutex.Unlock()
+
+	// Wait for the previous file
+	job.order.Lock()
+
+	pr, pw := io.Pipe()
+
+	fs.uploadJobs.storing.Add(1)
+	go func() {
+		defer fs.uploadJobs.storing.Done()
+		defer job.order.Unlock()
+
+		res, err := fs.upload(pr, -1, filename, tags)
+		// Unblock the writer if the file was rejected before the whole content was read
+		pr.CloseWithError(err)
+		fs.finishJobFile(jobID, index, res, err)
+	}()
+
+	progress := &progressReader{
+		r: r,
+		progress: func(n int64) {
+			fs.uploadJobs.update(jobID, index, func(f *UploadJobFile) { f.BytesReceived += n })
+		},
+	}
+	_, err := io.Copy(pw, progress)
+	if err != nil && progress.err == nil {
+		// The file was rejected, skip the rest of the content
+		_, err = io.Copy(ioutil.Discard, progress)
+	}
+	if err != nil {
+		pw.CloseWithError(err)
+		return errors.Wrapf(err, "can't receive file %q", filename)
+	}
+	pw.Close()
+
+	fs.uploadJobs.update(jobID, index, func(f *UploadJobFile) {
+		if f.Status == UploadJobFileReceiving {
+			f.Status = UploadJobFileStoring
+		}
+	})
+
+	return nil
+}
+
+// finishJobFile saves a result of storing of a job file
+func (fs FileStorage) finishJobFile(jobID string, index int, res UploadResult, err error) {
+	fs.uploadJobs.mutex.Lock()
+	defer fs.uploadJobs.mutex.Unlock()
+
+	job, ok := fs.uploadJobs.jobs[jobID]
+	if !ok {
+		return
+	}
+
+	f := &job.Files[index]
+	f.Duplicates = res.Duplicates
+	f.Duplicate = res.Action
+	if err != nil {
+		f.Status = UploadJobFileFailed
+		f.Error = err.Error()
+	} else {
+		f.Status = UploadJobFileStored
+		f.FileID = res.File.ID
+		f.Processing = res.File.Processing
+	}
+
+	job.storing--
+	job.updateStatus()
+}
+
+// FinishUploadJob marks that all files of a job were received. err is a reason why the request was
+// interrupted, it is nil if the whole request was received. It can be called several times
+func (fs FileStorage) FinishUploadJob(jobID string, err error) {
+	fs.uploadJobs.mutex.Lock()
+	defer fs.uploadJobs.mutex.Unlock()
+
+	if job, ok := fs.uploadJobs.jobs[jobID]; ok && job.Status == UploadJobReceiving {
+		if err != nil {
+			job.Error = err.Error()
+		}
+		job.Status = UploadJobStoring
+		job.updateStatus()
+	}
+}
+
+// GetUploadJob returns a job
+func (fs FileStorage) GetUploadJob(id string) (UploadJob, error) {
+	fs.refreshUploadJobs(id)
+
+	fs.uploadJobs.mutex.Lock()
+	defer fs.uploadJobs.mutex.Unlock()
+
+	job, ok := fs.uploadJobs.jobs[id]
+	if !ok {
+		return UploadJob{}, ErrUploadJobIsNotExist
+	}
+	return copyUploadJob(job), nil
+}
+
+// GetUploadJobs returns all jobs sorted by creation time
+func (fs FileStorage) GetUploadJobs() []UploadJob {
+	fs.refreshUploadJobs()
+
+	fs.uploadJobs.mutex.Lock()
+	defer fs.uploadJobs.mutex.Unlock()
+
+	jobs := make([]UploadJob, 0, len(fs.uploadJobs.jobs))
+	for _, job := range fs.uploadJobs.jobs {
+		jobs = append(jobs, copyUploadJob(job))
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Created.Before(jobs[j].Created) })
+
+	return jobs
+}
+
+// refreshUploadJobs updates statuses of processing of images and finishes jobs when all images are processed.
+// All jobs are refreshed if no ids are passed. Metadata Storage is queried without the lock
+func (fs FileStorage) refreshUploadJobs(ids ...string) {
+	// forEachJob calls fn for every job which is refreshed. It must be called under the lock
+	forEachJob := func(fn func(job *UploadJob)) {
+		if len(ids) == 0 {
+			for _, job := range fs.uploadJobs.jobs {
+				fn(job)
+			}
+			return
+		}
+		for _, id := range ids {
+			if job, ok := fs.uploadJobs.jobs[id]; ok {
+				fn(job)
+			}
+		}
+	}
+
+	// Collect images which are being processed
+	var pending []int
+	fs.uploadJobs.mutex.Lock()
+	forEachJob(func(job *UploadJob) {
+		if job.Status != UploadJobProcessing {
+			return
+		}
+		for _, f := range job.Files {
+			if f.Processing == ProcessingPending {
+				pending = append(pending, f.FileID)
+			}
+		}
+	})
+	fs.uploadJobs.mutex.Unlock()
+
+	statuses := make(map[int]ProcessingStatus, len(pending))
+	for _, id := range pending {
+		file, err := fs.metaStorage.getFile(id)
+		if err != nil {
+			// The file was deleted
+			statuses[id] = ""
+			continue
+		}
+		statuses[id] = file.Processing
+	}
+
+	fs.uploadJobs.mutex.Lock()
+	defer fs.uploadJobs.mutex.Unlock()
+
+	now := time.Now()
+	forEachJob(func(job *UploadJob) {
+		if job.Status != UploadJobProcessing {
+			return
+		}
+
+		done := true
+		for i := range job.Files {
+			f := &job.Files[i]
+			if status, ok := statuses[f.FileID]; ok && f.Processing == ProcessingPending {
+				f.Processing = status
+			}
+			if f.Processing == ProcessingPending {
+				done = false
+			}
+		}
+
+		if done {
+			finished := now
+			job.Status = UploadJobDone
+			job.Finished = &finished
+		}
+	})
+}
+
+func copyUploadJob(job *UploadJob) UploadJob {
+	res := *job
+	res.Files = make([]UploadJobFile, len(job.Files))
+	copy(res.Files, job.Files)
+	if job.Finished != nil {
+		finished := *job.Finished
+		res.Finished = &finished
+	}
+	return res
+}
+
+// scheduleUploadJobsExpiration deletes jobs finished (or created, but not started) more than UploadJobRetention ago
+// It has to be run in goroutine
+func (fs FileStorage) scheduleUploadJobsExpiration() {
+	ticker := time.NewTicker(time.Minute * 10)
+
+	for range ticker.C {
+		fs.deleteExpiredUploadJobs(time.Now())
+	}
+}
+
+func (fs FileStorage) deleteExpiredUploadJobs(now time.Time) {
+	fs.refreshUploadJobs()
+
+	fs.uploadJobs.mutex.Lock()
+	defer fs.uploadJobs.mutex.Unlock()
+
+	for id, job := range fs.uploadJobs.jobs {
+		finished := job.Finished != nil && now.Sub(*job.Finished) > UploadJobRetention
+		// The client created the job, but didn't send files
+		abandoned := !job.started && job.Status == UploadJobReceiving && now.Sub(job.Created) > UploadJobRetention
+		if finished || abandoned {
+			delete(fs.uploadJobs.jobs, id)
+		}
+	}
+}
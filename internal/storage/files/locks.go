@@ -0,0 +1,72 @@
+package files
+
+import (
+	"sort"
+	"sync"
+)
+
+// keyedMutex provides a mutex for every key. Mutexes are deleted when nobody holds or waits for them
+type keyedMutex struct {
+	mutex *sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	mutex *sync.Mutex
+	// waiters is a number of goroutines which hold or wait for the lock
+	waiters int
+}
+
+func newKeyedMutex() *keyedMutex {
+	return &keyedMutex{
+		mutex: new(sync.Mutex),
+		locks: make(map[string]*keyLock),
+	}
+}
+
+func (m *keyedMutex) lock(key string) {
+	m.mutex.Lock()
+	lock, ok := m.locks[key]
+	if !ok {
+		lock = &keyLock{mutex: new(sync.Mutex)}
+		m.locks[key] = lock
+	}
+	lock.waiters++
+	m.mutex.Unlock()
+
+	lock.mutex.Lock()
+}
+
+func (m *keyedMutex) unlock(key string) {
+	m.mutex.Lock()
+	lock := m.locks[key]
+	lock.waiters--
+	if lock.waiters == 0 {
+		delete(m.locks, key)
+	}
+	m.mutex.Unlock()
+
+	lock.mutex.Unlock()
+}
+
+// lockAll locks several keys. Keys are locked in the sorted order, so concurrent calls can't deadlock.
+// It returns a function which unlocks the keys
+func (m *keyedMutex) lockAll(keys ...string) (unlock func()) {
+	keys = append([]string(nil), keys...)
+	sort.Strings(keys)
+
+	locked := make([]string, 0, len(keys))
+	for i, key := range keys {
+		if i > 0 && key == keys[i-1] {
+			continue
+		}
+		m.lock(key)
+		locked = append(locked, key)
+	}
+
+	return func() {
+		for i := len(locked) - 1; i >= 0; i-- {
+			m.unlock(locked[i])
+		}
+	}
+}
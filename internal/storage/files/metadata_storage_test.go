@@ -0,0 +1,1507 @@
+package files
+
+import (
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	clog "github.com/ShoshinNikita/log/v2"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tags-drive/core/internal/storage/files/aggregation"
+	"github.com/tags-drive/core/internal/storage/files/exif"
+	"github.com/tags-drive/core/internal/storage/files/extensions"
+)
+
+func TestMain(m *testing.M) {
+	// Create "configs"folder
+	err := os.Mkdir("configs", 0700)
+	if err != nil {
+		clog.Fatalln("can't create folder \"configs\":", err)
+	}
+
+	code := m.Run()
+
+	// Remove folder "configs"
+	err = os.RemoveAll("configs")
+	if err != nil {
+		clog.Errorln("can't remove folder \"configs\":", err)
+	}
+	// Remove "data" folder created by storage.init()
+	err = os.RemoveAll("data")
+	if err != nil {
+		clog.Errorln("can't remove folder \"data\":", err)
+	}
+
+	os.Exit(code)
+}
+
+func TestCheckFile(t *testing.T) {
+	runForAllStorages(t, func(t *testing.T, storage metadataStorage) {
+		assert := assert.New(t)
+
+		addDefaultFiles(storage)
+
+		tests := []struct {
+			id  int
+			res bool
+		}{
+			{1, true},
+			{2, true},
+			{50, false},
+			{-1, false},
+		}
+
+		for i, tt := range tests {
+			res := storage.checkFile(tt.id)
+			assert.Equalf(tt.res, res, "iteration #%d", i+1)
+		}
+	})
+}
+
+func TestAddFile(t *testing.T) {
+	runForAllStorages(t, func(t *testing.T, storage metadataStorage) {
+		assert := assert.New(t)
+
+		// Strip the monotonic clock reading and use UTC: times are compared with reflect.DeepEqual
+		// and must stay equal after json encoding
+		now := time.Now().UTC().Round(0)
+
+		tests := []struct {
+			filename string
+			tags     []int
+			size     int64
+			hash     string
+			ext      extensions.Ext
+			time     time.Time
+			//
+			res map[int]File
+		}{
+			{
+				filename: "1.jpg",
+				tags:     []int{1, 2, 3},
+				size:     15,
+				time:     now,
+				ext:      extensions.Ext{},
+				res: map[int]File{
+					1: {
+						ID:       1,
+						Filename: "1.jpg",
+						Size:     15,
+						Tags:     []int{1, 2, 3},
+						AddTime:  now,
+						Type:     extensions.Ext{},
+					},
+				},
+			},
+			{
+				filename: "35.jpg",
+				tags:     []int{88},
+				size:     345,
+				hash:     testHash,
+				time:     now,
+				ext:      extensions.Ext{},
+				res: map[int]File{
+					1: {
+						ID:       1,
+						Filename: "1.jpg",
+						Size:     15,
+						Tags:     []int{1, 2, 3},
+						AddTime:  now,
+						Type:     extensions.Ext{},
+					},
+					2: {
+						ID:       2,
+						Filename: "35.jpg",
+						Size:     345,
+						Tags:     []int{88},
+						AddTime:  now,
+						Hash:     testHash,
+						Type:     extensions.Ext{},
+					},
+				},
+			},
+			{
+				filename: "545.jpg",
+				tags:     nil,
+				size:     666,
+				time:     now,
+				ext: extensions.Ext{
+					Ext:         ".jpg",
+					FileType:    extensions.FileTypeImage,
+					Supported:   true,
+					PreviewType: extensions.PreviewTypeImage,
+				},
+				res: map[int]File{
+					1: {
+						ID:       1,
+						Filename: "1.jpg",
+						Size:     15,
+						Tags:     []int{1, 2, 3},
+						AddTime:  now,
+						Type:     extensions.Ext{},
+					},
+					2: {
+						ID:       2,
+						Filename: "35.jpg",
+						Size:     345,
+						Tags:     []int{88},
+						AddTime:  now,
+						Hash:     testHash,
+						Type:     extensions.Ext{},
+					},
+					3: {
+						ID:       3,
+						Filename: "545.jpg",
+						Size:     666,
+						Tags:     []int{},
+						AddTime:  now,
+						Type: extensions.Ext{
+							Ext:         ".jpg",
+							FileType:    extensions.FileTypeImage,
+							Supported:   true,
+							PreviewType: extensions.PreviewTypeImage,
+						},
+					},
+				},
+			},
+		}
+
+		for i, tt := range tests {
+			storage.addFile(tt.filename, tt.ext, tt.tags, tt.size, tt.hash, now)
+
+			assert.Equalf(tt.res, getAllFiles(storage), "iteration #%d", i+1)
+		}
+	})
+}
+
+func TestGetFile(t *testing.T) {
+	runForAllStorages(t, func(t *testing.T, storage metadataStorage) {
+		assert := assert.New(t)
+
+		addDefaultFiles(storage)
+
+		tests := []struct {
+			id      int
+			res     string // filename
+			isError bool
+		}{
+			{1, "1", false},
+			{2, "2", false},
+			{50, "", true},
+			{-1, "", true},
+		}
+
+		for i, tt := range tests {
+			f, err := storage.getFile(tt.id)
+			if !assert.Equalf(tt.isError, err != nil, "iteration #%d, error: %v", i+1, err) {
+				continue
+			}
+
+			assert.Equalf(tt.res, f.Filename, "iteration #%d", i+1)
+		}
+	})
+}
+
+func TestGetFilesWithIDs(t *testing.T) {
+	runForAllStorages(t, func(t *testing.T, storage metadataStorage) {
+		assert := assert.New(t)
+
+		addDefaultFiles(storage)
+
+		tests := []struct {
+			ids []int
+			res []int // files ids
+		}{
+			{
+				ids: []int{1, 2, 3},
+				res: []int{1, 2, 3},
+			},
+			{
+				ids: []int{1, 2, 10, 20, 33},
+				res: []int{1, 2},
+			},
+			{
+				ids: []int{10, 20, 30},
+				res: []int{},
+			},
+		}
+
+		for i, tt := range tests {
+			files := storage.getFilesWithIDs(tt.ids...)
+			res := []int{}
+			for _, f := range files {
+				res = append(res, f.ID)
+			}
+
+			assert.Equal(tt.res, res, "iteration #%d", i+1)
+		}
+	})
+}
+
+func TestGetFiles(t *testing.T) {
+	runForAllStorages(t, func(t *testing.T, storage metadataStorage) {
+		assert := assert.New(t)
+
+		files := []struct {
+			filename string
+		}{
+			{filename: "123.jpg"},
+			{filename: "456.jpeg"},
+			{filename: "1.png"},
+			{filename: "test.exe"},
+			{filename: "123.png"},
+			{filename: "text.txt"},
+		}
+
+		now := time.Now()
+		for _, f := range files {
+			storage.addFile(f.filename, extensions.Ext{}, []int{}, 0, "", now)
+		}
+
+		requests := []struct {
+			search   string
+			isRegexp bool
+			result   []string // filenames
+		}{
+			{search: "", isRegexp: false, result: []string{"123.jpg", "456.jpeg", "1.png", "test.exe", "123.png", "text.txt"}},
+			{search: "123\\.jpg", isRegexp: false, result: []string{}},
+			{search: "123", isRegexp: false, result: []string{"123.jpg", "123.png"}},
+			//
+			{search: "", isRegexp: true, result: []string{"123.jpg", "456.jpeg", "1.png", "test.exe", "123.png", "text.txt"}},
+			{search: "123", isRegexp: true, result: []string{"123.jpg", "123.png"}},
+			{search: "123\\.jpg", isRegexp: true, result: []string{"123.jpg"}},
+			{search: "123\\.(jpg|png)", isRegexp: true, result: []string{"123.jpg", "123.png"}},
+			{search: "123\\.(jpg|png|txt)", isRegexp: true, result: []string{"123.jpg", "123.png"}},
+			{search: "^1.*g$", isRegexp: true, result: []string{"123.jpg", "123.png", "1.png"}},
+			{search: "\\.[^png]+$", isRegexp: true, result: []string{"test.exe", "text.txt"}},
+		}
+
+		for i, r := range requests {
+			files := storage.getFiles("", r.search, r.isRegexp)
+			if !assert.Equalf(len(r.result), len(files), "iteration #%d", i+1) {
+				continue
+			}
+
+			filenames := make([]string, len(files))
+			for i := range files {
+				filenames[i] = files[i].Filename
+			}
+
+			assert.ElementsMatchf(r.result, filenames, "iteration #%d", i+1)
+		}
+	})
+}
+
+func TestGetFilesWithExpr(t *testing.T) {
+	runForAllStorages(t, func(t *testing.T, storage metadataStorage) {
+		assert := assert.New(t)
+
+		jan := time.Date(2024, time.January, 15, 12, 0, 0, 0, time.Local)
+		jul := time.Date(2024, time.July, 1, 12, 0, 0, 0, time.Local)
+
+		files := []struct {
+			filename string
+			tags     []int
+			size     int64
+			addTime  time.Time
+		}{
+			{"photo.jpg", []int{1}, 5 << 20, jan},
+			{"report.pdf", []int{1, 2}, 20 << 20, jul},
+			{"notes.txt", []int{2}, 100, jul},
+		}
+		for _, f := range files {
+			storage.addFile(f.filename, extensions.GetExt(filepath.Ext(f.filename)), f.tags, f.size, "", f.addTime)
+		}
+		storage.updateFileDescription(3, "Invoice for July")
+		storage.deleteFile(3)
+
+		taken := time.Date(2023, time.August, 5, 12, 0, 0, 0, time.Local)
+		storage.updateFileImage(1, &exif.Metadata{
+			Width: 4000, Height: 3000, CameraMake: "Canon", CameraModel: "EOS 5D", TakenAt: &taken,
+			GPS: &exif.GPS{Latitude: 55.75, Longitude: 37.61},
+		})
+
+		requests := []struct {
+			expr   string
+			result []string
+		}{
+			{expr: "type:image", result: []string{"photo.jpg"}},
+			{expr: "ext:pdf | ext:.txt", result: []string{"report.pdf", "notes.txt"}},
+			{expr: "size>10MB", result: []string{"report.pdf"}},
+			{expr: "size<=5MB & 1", result: []string{"photo.jpg"}},
+			{expr: "added:2024-01", result: []string{"photo.jpg"}},
+			{expr: "added:2024-02..2024-12", result: []string{"report.pdf", "notes.txt"}},
+			{expr: "added>2024-01-15", result: []string{"report.pdf", "notes.txt"}},
+			{expr: `name:~"^(photo|notes)\\."`, result: []string{"photo.jpg", "notes.txt"}},
+			{expr: `desc:"invoice"`, result: []string{"notes.txt"}},
+			{expr: "deleted:true", result: []string{"notes.txt"}},
+			{expr: "!deleted:true & 2", result: []string{"report.pdf"}},
+			{expr: "taken:2023-08 & camera:canon", result: []string{"photo.jpg"}},
+			{expr: "width>=4000 | gps:true", result: []string{"photo.jpg"}},
+		}
+
+		for _, r := range requests {
+			expr, err := aggregation.ParseExpr(r.expr, nil)
+			if !assert.NoErrorf(err, "expr: %s", r.expr) {
+				continue
+			}
+
+			var filenames []string
+			for _, f := range storage.getFiles(expr, "", false) {
+				filenames = append(filenames, f.Filename)
+			}
+			assert.ElementsMatchf(r.result, filenames, "expr: %s", r.expr)
+		}
+	})
+}
+
+func TestGetFilesWithTagIndex(t *testing.T) {
+	runForAllStorages(t, func(t *testing.T, storage metadataStorage) {
+		assert := assert.New(t)
+
+		ext := extensions.GetExt(".txt")
+		for _, tags := range [][]int{{1}, {1, 2}, {2}, {3}, {}} {
+			storage.addFile("file", ext, tags, 10, "", time.Now())
+		}
+
+		check := func(step string, requests map[string][]int) {
+			for expr, want := range requests {
+				parsed, err := aggregation.ParseExpr(expr, nil)
+				if !assert.NoErrorf(err, "%s: expr: %s", step, expr) {
+					continue
+				}
+
+				ids := []int{}
+				for _, f := range storage.getFiles(parsed, "", false) {
+					ids = append(ids, f.ID)
+				}
+				assert.ElementsMatchf(want, ids, "%s: expr: %s", step, expr)
+			}
+		}
+
+		check("add", map[string][]int{
+			"1":          {1, 2},
+			"1 & !2":     {1},
+			"!1":         {3, 4, 5},
+			"2 | 3":      {2, 3, 4},
+			"!(1 | 2)":   {4, 5},
+			"4":          {},
+			"1 & size<5": {},
+		})
+
+		storage.updateFileTags(1, []int{2, 4})
+		storage.addTagsToFiles([]int{4, 5}, []int{1})
+		check("update", map[string][]int{
+			"1": {2, 4, 5},
+			"2": {1, 2, 3},
+			"4": {1},
+		})
+
+		storage.removeTagsFromFiles([]int{2}, []int{1, 2})
+		storage.removeTagFromAllFiles(4)
+		storage.deleteFileForce(5)
+		check("remove", map[string][]int{
+			"1":  {4},
+			"2":  {1, 3},
+			"4":  {},
+			"!3": {1, 2, 3},
+		})
+	})
+}
+
+func TestRepeatedTags(t *testing.T) {
+	runForAllStorages(t, func(t *testing.T, storage metadataStorage) {
+		assert := assert.New(t)
+
+		// Files saved before tags were deduplicated can have a tag several times
+		storage.addFile("file", extensions.GetExt(".txt"), []int{1, 1}, 10, "", time.Now())
+
+		if jfs, ok := storage.(*jsonFileStorage); ok {
+			// Emulate a restart
+			jfs.tags.rebuild(jfs.files)
+		}
+
+		parsed, err := aggregation.ParseExpr("1", nil)
+		if !assert.NoError(err) {
+			t.FailNow()
+		}
+		files := storage.getFiles(parsed, "", false)
+		if assert.Len(files, 1) {
+			assert.Equal(1, files[0].ID)
+		}
+
+		storage.removeTagsFromFiles([]int{1}, []int{1})
+		assert.Empty(storage.getFiles(parsed, "", false))
+	})
+
+	// tagIndex.rebuild must not duplicate ids in postings
+	ti := newTagIndex()
+	ti.rebuild(map[int]File{
+		5: {ID: 5, Tags: []int{1, 1, 2}},
+		7: {ID: 7, Tags: []int{1}},
+	})
+	assert.Equal(t, []int{5, 7}, ti.Posting(1))
+	assert.Equal(t, []int{5}, ti.Posting(2))
+
+	assert.Equal(t, []int{3, 1, 2}, uniqueTags([]int{3, 1, 3, 2, 1}))
+}
+
+func BenchmarkGetFiles(b *testing.B) {
+	cnf := Config{
+		FilesJSONFile: testFilesJSONFile,
+		SQLiteFile:    testSQLiteFile,
+		PassPhrase:    sha256.Sum256([]byte("sha256")),
+	}
+
+	for _, st := range testStorages {
+		b.Run(st.name, func(b *testing.B) {
+			storage := st.newStorage(cnf)
+			if err := storage.init(); err != nil {
+				b.Fatalf("can't init storage: %s", err)
+			}
+			defer func() {
+				storage.shutdown()
+				for _, path := range []string{
+					testFilesJSONFile, testFilesJSONFile + ".journal",
+					testSQLiteFile, testSQLiteFile + "-wal", testSQLiteFile + "-shm",
+				} {
+					os.Remove(path)
+				}
+			}()
+
+			ext := extensions.GetExt(".txt")
+			for i := 0; i < 5000; i++ {
+				storage.addFile("file", ext, []int{i%20 + 1, i%7 + 1}, int64(i), "", time.Now())
+			}
+
+			for _, expr := range []string{"12&!7", "12 & size>1000"} {
+				parsed, _ := aggregation.ParseExpr(expr, nil)
+				b.Run(expr, func(b *testing.B) {
+					for i := 0; i < b.N; i++ {
+						storage.getFiles(parsed, "", false)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestCountFacets(t *testing.T) {
+	runForAllStorages(t, func(t *testing.T, storage metadataStorage) {
+		assert := assert.New(t)
+
+		jan := time.Date(2024, time.January, 15, 12, 0, 0, 0, time.Local)
+		jul := time.Date(2024, time.July, 1, 12, 0, 0, 0, time.Local)
+
+		files := []struct {
+			filename string
+			tags     []int
+			addTime  time.Time
+		}{
+			{"photo.jpg", []int{1}, jan},
+			{"photo.JPG", []int{1, 2}, jul},
+			{"notes.txt", []int{2, 3}, jul},
+			{"README", []int{}, jul},
+		}
+		for _, f := range files {
+			storage.addFile(f.filename, extensions.GetExt(filepath.Ext(f.filename)), f.tags, 10, "", f.addTime)
+		}
+
+		facets, err := storage.countFacets([]int{1, 2, 3, 4, 100})
+		assert.NoError(err)
+		assert.Equal(map[int]int{1: 2, 2: 2, 3: 1}, facets.Tags)
+		assert.Equal(map[extensions.FileType]int{
+			extensions.FileTypeImage:       2,
+			extensions.FileTypeLanguage:    1,
+			extensions.FileTypeUnsupported: 1,
+		}, facets.Types)
+		assert.Equal(map[string]int{".jpg": 2, ".txt": 1, "": 1}, facets.Extensions)
+		assert.Equal(map[string]int{"2024-01": 1, "2024-07": 3}, facets.Months)
+
+		facets, err = storage.countFacets([]int{2, 3})
+		assert.NoError(err)
+		assert.Equal(map[int]int{1: 1, 2: 2, 3: 1}, facets.Tags)
+		assert.Equal(map[string]int{"2024-07": 2}, facets.Months)
+	})
+}
+
+func TestRenameFile(t *testing.T) {
+	runForAllStorages(t, func(t *testing.T, storage metadataStorage) {
+		assert := assert.New(t)
+
+		addDefaultFiles(storage)
+
+		tests := []struct {
+			id          int
+			newFilename string
+			res         map[int]string // id - filename
+			isError     bool
+		}{
+			{1, "123", map[int]string{1: "123", 2: "2", 3: "3", 4: "4", 5: "5", 6: "6"}, false},
+			{2, "123", map[int]string{1: "123", 2: "123", 3: "3", 4: "4", 5: "5", 6: "6"}, false},
+			{6, "654", map[int]string{1: "123", 2: "123", 3: "3", 4: "4", 5: "5", 6: "654"}, false},
+			{88, "000", map[int]string{1: "123", 2: "123", 3: "3", 4: "4", 5: "5", 6: "654"}, true},
+			{5, "", map[int]string{1: "123", 2: "123", 3: "3", 4: "4", 5: "5", 6: "654"}, true},
+		}
+
+		for i, tt := range tests {
+			_, err := storage.renameFile(tt.id, tt.newFilename)
+			if !assert.Equalf(tt.isError, err != nil, "iteration #%d, error: %v", i+1, err) {
+				continue
+			}
+
+			res := make(map[int]string)
+			for id, f := range getAllFiles(storage) {
+				res[id] = f.Filename
+			}
+
+			assert.Equalf(tt.res, res, "iteration #%d", i+1)
+		}
+	})
+}
+
+func TestUpdateTags(t *testing.T) {
+	runForAllStorages(t, func(t *testing.T, storage metadataStorage) {
+		assert := assert.New(t)
+
+		addDefaultFiles(storage)
+
+		tests := []struct {
+			id      int
+			newTags []int
+			res     map[int][]int // id - tags
+			isError bool
+		}{
+			{1, []int{1, 5}, map[int][]int{
+				1: {1, 5},
+				2: {1, 2, 7},
+				3: {3},
+				4: {2, 3},
+				5: {4, 5, 6},
+				6: {},
+			}, false},
+			{2, []int{}, map[int][]int{
+				1: {1, 5},
+				2: {},
+				3: {3},
+				4: {2, 3},
+				5: {4, 5, 6},
+				6: {},
+			}, false},
+			{3, nil, map[int][]int{
+				1: {1, 5},
+				2: {},
+				3: {},
+				4: {2, 3},
+				5: {4, 5, 6},
+				6: {},
+			}, false},
+			{88, nil, map[int][]int{
+				1: {1, 5},
+				2: {},
+				3: {},
+				4: {2, 3},
+				5: {4, 5, 6},
+				6: {},
+			}, true},
+		}
+
+		for i, tt := range tests {
+			_, err := storage.updateFileTags(tt.id, tt.newTags)
+			if !assert.Equalf(tt.isError, err != nil, "iteration #%d, error: %v", i+1, err) {
+				continue
+			}
+
+			res := make(map[int][]int)
+			for id, f := range getAllFiles(storage) {
+				res[id] = f.Tags
+			}
+
+			assert.Equalf(tt.res, res, "iteration #%d", i+1)
+		}
+	})
+}
+
+func TestUpdateDescription(t *testing.T) {
+	runForAllStorages(t, func(t *testing.T, storage metadataStorage) {
+		assert := assert.New(t)
+
+		addDefaultFiles(storage)
+
+		tests := []struct {
+			id      int
+			newDesc string
+			res     map[int]string // id - description
+			isError bool
+		}{
+			{1, "help", map[int]string{1: "help", 2: "", 3: "", 4: "", 5: "", 6: ""}, false},
+			{5, "help - 5", map[int]string{1: "help", 2: "", 3: "", 4: "", 5: "help - 5", 6: ""}, false},
+			{5, "АБВГД", map[int]string{1: "help", 2: "", 3: "", 4: "", 5: "АБВГД", 6: ""}, false},
+			{88, "123", map[int]string{1: "help", 2: "", 3: "", 4: "", 5: "АБВГД", 6: ""}, true},
+		}
+
+		for i, tt := range tests {
+			_, err := storage.updateFileDescription(tt.id, tt.newDesc)
+			if !assert.Equalf(tt.isError, err != nil, "iteration #%d, error: %v", i+1, err) {
+				continue
+			}
+
+			res := make(map[int]string)
+			for id, f := range getAllFiles(storage) {
+				res[id] = f.Description
+			}
+
+			assert.Equalf(tt.res, res, "iteration #%d", i+1)
+		}
+	})
+}
+
+func TestUpdateFileImage(t *testing.T) {
+	runForAllStorages(t, func(t *testing.T, storage metadataStorage) {
+		assert := assert.New(t)
+
+		addDefaultFiles(storage)
+
+		taken := time.Date(2019, time.May, 1, 10, 30, 0, 0, time.FixedZone("", 3*60*60))
+		image := &exif.Metadata{
+			Width:       1920,
+			Height:      1080,
+			Orientation: 6,
+			CameraModel: "iPhone XS",
+			ISO:         25,
+			TakenAt:     &taken,
+			GPS:         &exif.GPS{Latitude: -33.86, Longitude: 151.21, Altitude: 12.5},
+		}
+
+		file, err := storage.updateFileImage(2, image)
+		assert.NoError(err)
+		assert.Equal(image, file.Image)
+
+		file, err = storage.getFile(2)
+		assert.NoError(err)
+		if assert.NotNil(file.Image) && assert.NotNil(file.Image.TakenAt) {
+			assert.True(taken.Equal(*file.Image.TakenAt))
+			assert.Equal(image.GPS, file.Image.GPS)
+			assert.Equal("iPhone XS", file.Image.Camera())
+		}
+
+		_, err = storage.updateFileImage(88, image)
+		assert.Error(err)
+	})
+}
+
+func TestUpdateFileProcessing(t *testing.T) {
+	runForAllStorages(t, func(t *testing.T, storage metadataStorage) {
+		assert := assert.New(t)
+
+		addDefaultFiles(storage)
+
+		file, err := storage.updateFileProcessing(2, ProcessingPending)
+		assert.NoError(err)
+		assert.Equal(ProcessingPending, file.Processing)
+
+		_, err = storage.updateFileProcessing(2, ProcessingDone)
+		assert.NoError(err)
+
+		file, err = storage.getFile(2)
+		assert.NoError(err)
+		assert.Equal(ProcessingDone, file.Processing)
+
+		_, err = storage.updateFileProcessing(88, ProcessingDone)
+		assert.Equal(ErrFileIsNotExist, err)
+	})
+}
+
+func TestGetLocations(t *testing.T) {
+	runForAllStorages(t, func(t *testing.T, storage metadataStorage) {
+		assert := assert.New(t)
+
+		addDefaultFiles(storage)
+
+		setLocation := func(id int, lat, lon float64) {
+			_, err := storage.updateFileImage(id, &exif.Metadata{GPS: &exif.GPS{Latitude: lat, Longitude: lon}})
+			assert.NoError(err)
+		}
+		ids := func(box BoundingBox) []int {
+			locations, err := storage.getLocations(box)
+			assert.NoError(err)
+
+			res := []int{}
+			for _, l := range locations {
+				res = append(res, l.FileID)
+			}
+			return res
+		}
+
+		setLocation(1, 55.75, 37.61)   // Moscow
+		setLocation(2, 59.93, 30.31)   // Saint Petersburg
+		setLocation(3, -33.86, 151.21) // Sydney
+		setLocation(4, 64.73, 177.51)  // Anadyr
+		setLocation(5, 64.84, -147.72) // Fairbanks
+		// File 6 has no coordinates
+		_, err := storage.updateFileImage(6, &exif.Metadata{Width: 10, Height: 10})
+		assert.NoError(err)
+
+		world := BoundingBox{South: -90, West: -180, North: 90, East: 180}
+		assert.ElementsMatch([]int{1, 2, 3, 4, 5}, ids(world))
+		assert.ElementsMatch([]int{1, 2}, ids(BoundingBox{South: 50, West: 25, North: 60, East: 40}))
+		assert.ElementsMatch([]int{}, ids(BoundingBox{South: 0, West: 25, North: 50, East: 40}))
+		// The box crosses the antimeridian
+		assert.ElementsMatch([]int{4, 5}, ids(BoundingBox{South: 60, West: 170, North: 70, East: -140}))
+
+		// Locations are updated with files
+		setLocation(2, 55.7, 37.5)
+		_, err = storage.updateFileImage(3, nil)
+		assert.NoError(err)
+		assert.NoError(storage.deleteFileForce(4))
+		storage.deleteFile(5)
+
+		assert.ElementsMatch([]int{1, 2, 5}, ids(world))
+		assert.ElementsMatch([]int{1, 2}, ids(BoundingBox{South: 55, West: 37, North: 56, East: 38}))
+	})
+}
+
+func TestAddFileRevision(t *testing.T) {
+	runForAllStorages(t, func(t *testing.T, storage metadataStorage) {
+		assert := assert.New(t)
+
+		addDefaultFiles(storage)
+
+		first := getAllFiles(storage)[1]
+		secondTime := first.AddTime.Add(time.Hour)
+		thirdTime := first.AddTime.Add(2 * time.Hour)
+
+		// A file without revisions has an implicit first revision
+		assert.Equal([]Revision{{Number: 1, Size: 0, AddTime: first.AddTime}}, first.GetRevisions())
+
+		tests := []struct {
+			id        int
+			size      int64
+			hash      string
+			addTime   time.Time
+			revisions []Revision
+			isError   bool
+		}{
+			{
+				id: 1, size: 15, hash: testHash, addTime: secondTime,
+				revisions: []Revision{
+					{Number: 1, Size: 0, AddTime: first.AddTime},
+					{Number: 2, Size: 15, AddTime: secondTime, Hash: testHash},
+				},
+			},
+			{
+				id: 1, size: 20, hash: testAnotherHash, addTime: thirdTime,
+				revisions: []Revision{
+					{Number: 1, Size: 0, AddTime: first.AddTime},
+					{Number: 2, Size: 15, AddTime: secondTime, Hash: testHash},
+					{Number: 3, Size: 20, AddTime: thirdTime, Hash: testAnotherHash},
+				},
+			},
+			{id: 88, size: 1, hash: testHash, addTime: thirdTime, isError: true},
+		}
+
+		for i, tt := range tests {
+			res, err := storage.addFileRevision(tt.id, tt.size, tt.hash, tt.addTime)
+			if !assert.Equalf(tt.isError, err != nil, "iteration #%d, error: %v", i+1, err) || tt.isError {
+				continue
+			}
+
+			file := getAllFiles(storage)[tt.id]
+			assert.Equalf(res, file, "iteration #%d", i+1)
+			assert.Equalf(tt.revisions, file.Revisions, "iteration #%d", i+1)
+			assert.Equalf(tt.size, file.Size, "iteration #%d", i+1)
+			assert.Equalf(tt.hash, file.Hash, "iteration #%d", i+1)
+			assert.Equalf(tt.revisions[len(tt.revisions)-1], file.CurrentRevision(), "iteration #%d", i+1)
+			// Other fields mustn't be changed
+			assert.Equalf(first.AddTime, file.AddTime, "iteration #%d", i+1)
+		}
+
+		// Other files mustn't be changed
+		assert.Empty(getAllFiles(storage)[2].Revisions)
+	})
+}
+
+func TestSetRevisionHash(t *testing.T) {
+	runForAllStorages(t, func(t *testing.T, storage metadataStorage) {
+		assert := assert.New(t)
+
+		now := time.Now().UTC().Round(0)
+
+		id, _ := storage.addFile("file.txt", extensions.Ext{}, nil, 5, "", now)
+		storage.addFileRevision(id, 10, "", now)
+
+		file, err := storage.setRevisionHash(id, 1, testHash)
+		assert.Nil(err)
+		assert.Equal(testHash, file.GetRevisions()[0].Hash)
+		assert.Empty(file.Hash)
+
+		// The hash of the file is updated with the current revision
+		file, err = storage.setRevisionHash(id, 2, testAnotherHash)
+		assert.Nil(err)
+		assert.Equal(testAnotherHash, file.Hash)
+
+		refs, err := storage.countBlobRefs(testHash)
+		assert.Nil(err)
+		assert.Equal(1, refs)
+		refs, err = storage.countBlobRefs(testAnotherHash)
+		assert.Nil(err)
+		assert.Equal(1, refs)
+
+		_, err = storage.setRevisionHash(id, 3, testThirdHash)
+		assert.Equal(ErrRevisionIsNotExist, err)
+		_, err = storage.setRevisionHash(id+1, 1, testThirdHash)
+		assert.Equal(ErrFileIsNotExist, err)
+	})
+}
+
+func TestCountBlobRefs(t *testing.T) {
+	runForAllStorages(t, func(t *testing.T, storage metadataStorage) {
+		assert := assert.New(t)
+
+		now := time.Now().UTC().Round(0)
+
+		countRefs := func(hash string) int {
+			refs, err := storage.countBlobRefs(hash)
+			assert.Nil(err)
+			return refs
+		}
+
+		first, _ := storage.addFile("1", extensions.Ext{}, nil, 5, testHash, now)
+		second, _ := storage.addFile("2", extensions.Ext{}, nil, 5, testHash, now)
+		assert.Equal(2, countRefs(testHash))
+		assert.Equal(0, countRefs(testAnotherHash))
+
+		// Old revisions keep refs
+		storage.addFileRevision(first, 10, testAnotherHash, now)
+		assert.Equal(2, countRefs(testHash))
+		assert.Equal(1, countRefs(testAnotherHash))
+
+		// Files in Trash keep refs
+		storage.deleteFile(second)
+		assert.Equal(2, countRefs(testHash))
+
+		storage.deleteFileForce(second)
+		assert.Equal(1, countRefs(testHash))
+
+		storage.deleteFileForce(first)
+		assert.Equal(0, countRefs(testHash))
+		assert.Equal(0, countRefs(testAnotherHash))
+	})
+}
+
+func TestFindDuplicates(t *testing.T) {
+	runForAllStorages(t, func(t *testing.T, storage metadataStorage) {
+		assert := assert.New(t)
+
+		now := time.Now().UTC().Round(0)
+
+		findDuplicates := func(hash, filename string) []int {
+			files, err := storage.findDuplicates(hash, filename)
+			assert.Nil(err)
+			return fileIDs(files)
+		}
+
+		first, _ := storage.addFile("photo.jpg", extensions.Ext{}, nil, 5, testHash, now)
+		second, _ := storage.addFile(`"quoted" name.jpg`, extensions.Ext{}, nil, 5, testHash, now)
+		third, _ := storage.addFile("photo.jpg", extensions.Ext{}, nil, 10, testAnotherHash, now)
+
+		assert.Equal([]int{first, second}, findDuplicates(testHash, ""))
+		assert.Equal([]int{first, second, third}, findDuplicates(testHash, "photo.jpg"))
+		assert.Equal([]int{second}, findDuplicates(testThirdHash, `"quoted" name.jpg`))
+		assert.Equal([]int{}, findDuplicates(testThirdHash, "photo"))
+
+		// Only the current content is checked
+		storage.addFileRevision(first, 10, testThirdHash, now)
+		assert.Equal([]int{second}, findDuplicates(testHash, ""))
+		assert.Equal([]int{first}, findDuplicates(testThirdHash, ""))
+
+		// Files in Trash are skipped
+		storage.deleteFile(second)
+		assert.Equal([]int{}, findDuplicates(testHash, `"quoted" name.jpg`))
+	})
+}
+
+func TestDeleteFileForce(t *testing.T) {
+	runForAllStorages(t, func(t *testing.T, storage metadataStorage) {
+		assert := assert.New(t)
+
+		addDefaultFiles(storage)
+
+		tests := []struct {
+			id  int
+			res []int // ids
+		}{
+			{1, []int{2, 3, 4, 5, 6}},
+			{6, []int{2, 3, 4, 5}},
+			{4, []int{2, 3, 5}},
+			{1, []int{2, 3, 5}},
+		}
+
+		for i, tt := range tests {
+			storage.deleteFileForce(tt.id)
+
+			var ids []int
+			for id := range getAllFiles(storage) {
+				ids = append(ids, id)
+			}
+
+			assert.ElementsMatchf(tt.res, ids, "iteration #%d", i+1)
+		}
+	})
+}
+
+func TestDeleteAndRecover(t *testing.T) {
+	runForAllStorages(t, func(t *testing.T, storage metadataStorage) {
+		assert := assert.New(t)
+
+		addDefaultFiles(storage)
+
+		tests := []struct {
+			id            int
+			shouldRecover bool
+			//
+			res map[int]bool // id - deleted
+		}{
+			{
+				id:            1,
+				shouldRecover: false,
+				res: map[int]bool{
+					1: true,
+					2: false,
+					3: false,
+					4: false,
+					5: false,
+					6: false,
+				},
+			},
+			{
+				id:            1,
+				shouldRecover: false,
+				res: map[int]bool{
+					1: true,
+					2: false,
+					3: false,
+					4: false,
+					5: false,
+					6: false,
+				},
+			},
+			{
+				id:            5,
+				shouldRecover: false,
+				res: map[int]bool{
+					1: true,
+					2: false,
+					3: false,
+					4: false,
+					5: true,
+					6: false,
+				},
+			},
+			{
+				id:            1,
+				shouldRecover: true,
+				res: map[int]bool{
+					1: false,
+					2: false,
+					3: false,
+					4: false,
+					5: true,
+					6: false,
+				},
+			},
+			{
+				id:            1,
+				shouldRecover: true,
+				res: map[int]bool{
+					1: false,
+					2: false,
+					3: false,
+					4: false,
+					5: true,
+					6: false,
+				},
+			},
+			// non-existing files
+			{
+				id:            150,
+				shouldRecover: false,
+				res: map[int]bool{
+					1: false,
+					2: false,
+					3: false,
+					4: false,
+					5: true,
+					6: false,
+				},
+			},
+			{
+				id:            150,
+				shouldRecover: true,
+				res: map[int]bool{
+					1: false,
+					2: false,
+					3: false,
+					4: false,
+					5: true,
+					6: false,
+				},
+			},
+		}
+
+		for i, tt := range tests {
+			if tt.shouldRecover {
+				storage.recover(tt.id)
+			} else {
+				storage.deleteFile(tt.id)
+			}
+
+			res := make(map[int]bool)
+			for id, f := range getAllFiles(storage) {
+				res[id] = f.Deleted
+			}
+
+			assert.Equalf(tt.res, res, "iteration #%d", i+1)
+		}
+	})
+}
+
+func TestAddTagsToFiles(t *testing.T) {
+	runForAllStorages(t, func(t *testing.T, storage metadataStorage) {
+		assert := assert.New(t)
+
+		addDefaultFiles(storage)
+
+		tests := []struct {
+			files  []int
+			tags   []int
+			result [][]int // (index + 1) – id of a file
+		}{
+			{
+				files: []int{1, 2, 3, 4, 5, 6},
+				tags:  []int{1},
+				result: [][]int{
+					{1, 2, 3},    // 1
+					{1, 2, 7},    // 2
+					{1, 3},       // 3
+					{1, 2, 3},    // 4
+					{1, 4, 5, 6}, // 5
+					{1},          // 6
+				},
+			},
+			{
+				files: []int{4, 6},
+				tags:  []int{5},
+				result: [][]int{
+					{1, 2, 3},    // 1
+					{1, 2, 7},    // 2
+					{1, 3},       // 3
+					{1, 2, 3, 5}, // 4
+					{1, 4, 5, 6}, // 5
+					{1, 5},       // 6
+				},
+			},
+			{
+				files: []int{1},
+				tags:  []int{7, 8, 9},
+				result: [][]int{
+					{1, 2, 3, 7, 8, 9}, // 1
+					{1, 2, 7},          // 2
+					{1, 3},             // 3
+					{1, 2, 3, 5},       // 4
+					{1, 4, 5, 6},       // 5
+					{1, 5},             // 6
+				},
+			},
+			{
+				files: []int{1, 3, 5},
+				tags:  []int{20, 30, 40},
+				result: [][]int{
+					{1, 2, 3, 7, 8, 9, 20, 30, 40}, // 1
+					{1, 2, 7},                      // 2
+					{1, 3, 20, 30, 40},             // 3
+					{1, 2, 3, 5},                   // 4
+					{1, 4, 5, 6, 20, 30, 40},       // 5
+					{1, 5},                         // 6
+				},
+			},
+			{
+				files: []int{1, 2, 3, 4, 5, 6},
+				tags:  []int{1, 2, 3, 4},
+				result: [][]int{
+					{1, 2, 3, 4, 7, 8, 9, 20, 30, 40}, // 1
+					{1, 2, 3, 4, 7},                   // 2
+					{1, 2, 3, 4, 20, 30, 40},          // 3
+					{1, 2, 3, 4, 5},                   // 4
+					{1, 2, 3, 4, 5, 6, 20, 30, 40},    // 5
+					{1, 2, 3, 4, 5},                   // 6
+				},
+			},
+		}
+
+		for i, tt := range tests {
+			storage.addTagsToFiles(tt.files, tt.tags)
+			for id, res := range tt.result {
+				ok := storage.checkFile(id + 1)
+				if !assert.Equalf(true, ok, "iteration #%d: file with id %d doesn't exist", i+1, id+1) {
+					break
+				}
+
+				f := getAllFiles(storage)[id+1]
+				assert.ElementsMatchf(res, f.Tags, "iteration #%d: file with id %d has wrong tags", i+1, id+1)
+			}
+		}
+	})
+}
+
+func TestRemoveTagsFromFiles(t *testing.T) {
+	runForAllStorages(t, func(t *testing.T, storage metadataStorage) {
+		assert := assert.New(t)
+
+		addDefaultFiles(storage)
+
+		tests := []struct {
+			files  []int
+			tags   []int
+			result [][]int // (index + 1) – id of a file
+		}{
+			{
+				files: []int{1, 2, 3, 4, 5, 6},
+				tags:  []int{1},
+				result: [][]int{
+					{2, 3},    // 1
+					{2, 7},    // 2
+					{3},       // 3
+					{2, 3},    // 4
+					{4, 5, 6}, // 5
+					{},        // 6
+				},
+			},
+			{
+				files: []int{6},
+				tags:  []int{1, 2, 3},
+				result: [][]int{
+					{2, 3},    // 1
+					{2, 7},    // 2
+					{3},       // 3
+					{2, 3},    // 4
+					{4, 5, 6}, // 5
+					{},        // 6
+				},
+			},
+			{
+				files: []int{3, 4},
+				tags:  []int{1, 2, 3},
+				result: [][]int{
+					{2, 3},    // 1
+					{2, 7},    // 2
+					{},        // 3
+					{},        // 4
+					{4, 5, 6}, // 5
+					{},        // 6
+				},
+			},
+			{
+				files: []int{1, 2, 3, 4, 5, 6},
+				tags:  []int{2, 3, 4, 5, 6, 7},
+				result: [][]int{
+					{}, // 1
+					{}, // 2
+					{}, // 3
+					{}, // 4
+					{}, // 5
+					{}, // 6
+				},
+			},
+		}
+
+		for i, tt := range tests {
+			storage.removeTagsFromFiles(tt.files, tt.tags)
+			for id, res := range tt.result {
+				ok := storage.checkFile(id + 1)
+				if !assert.Equalf(true, ok, "iteration #%d: file with id %d doesn't exist", i+1, id+1) {
+					break
+				}
+
+				f := getAllFiles(storage)[id+1]
+				assert.ElementsMatchf(res, f.Tags, "iteration #%d: file with id %d has wrong tags", i+1, id+1)
+			}
+		}
+	})
+}
+
+func TestDeleteTagFromFiles(t *testing.T) {
+	runForAllStorages(t, func(t *testing.T, storage metadataStorage) {
+		assert := assert.New(t)
+
+		addDefaultFiles(storage)
+
+		tests := []struct {
+			idToDelete int
+			res        map[int][]int // id - tags
+		}{
+			{1, map[int][]int{
+				1: {2, 3},
+				2: {2, 7},
+				3: {3},
+				4: {2, 3},
+				5: {4, 5, 6},
+				6: {},
+			}},
+			{5, map[int][]int{
+				1: {2, 3},
+				2: {2, 7},
+				3: {3},
+				4: {2, 3},
+				5: {4, 6},
+				6: {},
+			}},
+			{20, map[int][]int{
+				1: {2, 3},
+				2: {2, 7},
+				3: {3},
+				4: {2, 3},
+				5: {4, 6},
+				6: {},
+			}},
+		}
+
+		for i, tt := range tests {
+			storage.removeTagFromAllFiles(tt.idToDelete)
+
+			res := make(map[int][]int)
+			for _, f := range getAllFiles(storage) {
+				res[f.ID] = f.Tags
+			}
+
+			assert.Equalf(tt.res, res, "iteration #%d", i+1)
+		}
+	})
+}
+
+func TestJournalReplay(t *testing.T) {
+	assert := assert.New(t)
+
+	cnf := Config{
+		FilesJSONFile:      testFilesJSONFile,
+		Encrypt:            true,
+		PassPhrase:         sha256.Sum256([]byte("sha256")),
+		TimeBeforeDeleting: time.Hour,
+	}
+	defer func() {
+		os.Remove(testFilesJSONFile)
+		os.Remove(testFilesJSONFile + ".journal")
+	}()
+
+	storage := newJsonFileStorage(cnf, clog.NewProdLogger())
+	if !assert.NoError(storage.init()) {
+		t.FailNow()
+	}
+
+	addDefaultFiles(storage)
+	storage.renameFile(1, "renamed")
+	storage.deleteFileForce(2)
+	storage.deleteFile(3)
+	storage.addTagsToFiles([]int{4, 5}, []int{10})
+	storage.removeTagFromAllFiles(3)
+
+	// Simulate a crash: the snapshot isn't written
+	want := getAllFiles(storage)
+	close(storage.shutdownChan)
+	storage.journal.Close()
+
+	restored := newJsonFileStorage(cnf, clog.NewProdLogger())
+	if !assert.NoError(restored.init()) {
+		t.FailNow()
+	}
+
+	assert.Equal(want, getAllFiles(restored))
+	assert.Equal(6, restored.maxID)
+
+	// Compaction must keep all changes
+	assert.NoError(restored.shutdown())
+
+	compacted := newJsonFileStorage(cnf, clog.NewProdLogger())
+	if !assert.NoError(compacted.init()) {
+		t.FailNow()
+	}
+
+	assert.Equal(0, compacted.journal.Len())
+	assert.Equal(want, getAllFiles(compacted))
+	assert.NoError(compacted.shutdown())
+}
+
+func TestSQLiteInit(t *testing.T) {
+	assert := assert.New(t)
+
+	cnf := Config{
+		FilesJSONFile: testFilesJSONFile,
+		SQLiteFile:    testSQLiteFile,
+		Encrypt:       true,
+		PassPhrase:    sha256.Sum256([]byte("sha256")),
+	}
+	defer func() {
+		for _, path := range []string{
+			testFilesJSONFile, testFilesJSONFile + ".journal",
+			testSQLiteFile, testSQLiteFile + "-wal", testSQLiteFile + "-shm",
+		} {
+			os.Remove(path)
+		}
+	}()
+
+	jsonStorage := newJsonFileStorage(cnf, clog.NewProdLogger())
+	if !assert.NoError(jsonStorage.init()) {
+		t.FailNow()
+	}
+	addDefaultFiles(jsonStorage)
+	jsonStorage.addFileRevision(1, 10, testHash, time.Now().UTC().Round(0))
+	want := getAllFiles(jsonStorage)
+	assert.NoError(jsonStorage.shutdown())
+
+	// The import fails. It must be repeated on the next start
+	wrongCnf := cnf
+	wrongCnf.PassPhrase = sha256.Sum256([]byte("wrong"))
+	storage := newSqliteFileStorage(wrongCnf, clog.NewProdLogger())
+	assert.Error(storage.init())
+	storage.shutdown()
+
+	storage = newSqliteFileStorage(cnf, clog.NewProdLogger())
+	if !assert.NoError(storage.init()) {
+		t.FailNow()
+	}
+	assert.Equal(want, getAllFiles(storage))
+
+	// Indexes are rebuilt for databases created by previous versions
+	_, err := storage.db.Exec(`
+		DROP TABLE file_blobs; DROP TABLE file_tags; DROP TABLE file_locations;
+		CREATE TABLE old_files (
+			id             INTEGER PRIMARY KEY AUTOINCREMENT,
+			deleted        BOOLEAN NOT NULL DEFAULT 0,
+			time_to_delete INTEGER NOT NULL DEFAULT 0,
+			data           TEXT    NOT NULL
+		);
+		INSERT INTO old_files SELECT id, deleted, time_to_delete, data FROM files;
+		DROP TABLE files;
+		ALTER TABLE old_files RENAME TO files`)
+	assert.NoError(err)
+	assert.NoError(storage.shutdown())
+
+	storage = newSqliteFileStorage(cnf, clog.NewProdLogger())
+	if !assert.NoError(storage.init()) {
+		t.FailNow()
+	}
+	defer storage.shutdown()
+
+	refs, err := storage.countBlobRefs(testHash)
+	assert.NoError(err)
+	assert.Equal(1, refs)
+	expr, err := aggregation.ParseExpr("1", nil)
+	assert.NoError(err)
+	assert.Len(storage.getFiles(expr, "", false), 2)
+
+	duplicates, err := storage.findDuplicates(testThirdHash, want[2].Filename)
+	assert.NoError(err)
+	if assert.Len(duplicates, 1) {
+		assert.Equal(2, duplicates[0].ID)
+	}
+}
+
+const (
+	testFilesJSONFile = "files.json"
+	testSQLiteFile    = "files.db"
+
+	testHash        = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	testAnotherHash = "486ea46224d1bb4fb680f34f7c9ad96a8f24ec88be73ea8e5a6c65260e9cb8a7"
+	testThirdHash   = "fcde2b2edba56bf408601fb721fe9b5c338d10ee429ea04fae5511b68fbf8fb9"
+)
+
+// testStorages contains constructors of all metadata storages. Every test is run for every storage
+var testStorages = []struct {
+	name       string
+	newStorage func(cnf Config) metadataStorage
+}{
+	{"json", func(cnf Config) metadataStorage { return newJsonFileStorage(cnf, clog.NewProdLogger()) }},
+	{"sqlite", func(cnf Config) metadataStorage { return newSqliteFileStorage(cnf, clog.NewProdLogger()) }},
+}
+
+// runForAllStorages creates every metadata storage, calls init() function and runs f.
+// Storages are removed after the test
+func runForAllStorages(t *testing.T, f func(t *testing.T, storage metadataStorage)) {
+	cnf := Config{
+		Debug: false,
+		DiskStorage: Config_DiskStorage{
+			DataFolder:          "./data",
+			ResizedImagesFolder: "./data/resizing",
+		},
+		FilesJSONFile: testFilesJSONFile,
+		SQLiteFile:    testSQLiteFile,
+		Encrypt:       true,
+		PassPhrase:    sha256.Sum256([]byte("sha256")),
+	}
+
+	for _, st := range testStorages {
+		t.Run(st.name, func(t *testing.T) {
+			cnf.MetadataStorageType = st.name
+
+			storage := st.newStorage(cnf)
+			if err := storage.init(); err != nil {
+				t.Fatalf("can't init storage: %s", err)
+			}
+			defer func() {
+				storage.shutdown()
+				for _, path := range []string{
+					testFilesJSONFile, testFilesJSONFile + ".journal",
+					testSQLiteFile, testSQLiteFile + "-wal", testSQLiteFile + "-shm",
+				} {
+					os.Remove(path)
+				}
+			}()
+
+			f(t, storage)
+		})
+	}
+}
+
+// getAllFiles returns all files from a storage
+func getAllFiles(storage metadataStorage) map[int]File {
+	files := make(map[int]File)
+	for _, f := range storage.getFiles("", "", false) {
+		files[f.ID] = f
+	}
+
+	return files
+}
+
+// addDefaultFiles adds next files into storage:
+//  | id | name | tags      |
+//  | -- | ---- | --------- |
+//  | 1  | 1    | [1, 2, 3] |
+//  | 2  | 2    | [1, 2, 7] |
+//  | 3  | 3    | [3]       |
+//  | 4  | 4    | [2, 3]    |
+//  | 5  | 5    | [4, 5, 6] |
+//  | 6  | 6    | []        |
+//
+func addDefaultFiles(storage metadataStorage) {
+	files := []struct {
+		filename string
+		tags     []int
+	}{
+		{"1", []int{1, 2, 3}},
+		{"2", []int{1, 2, 7}},
+		{"3", []int{3}},
+		{"4", []int{2, 3}},
+		{"5", []int{4, 5, 6}},
+		{"6", []int{}},
+	}
+
+	// Files must stay equal after json encoding (see TestAddFile)
+	now := time.Now().UTC().Round(0)
+
+	for _, f := range files {
+		storage.addFile(f.filename, extensions.Ext{}, f.tags, 0, "", now)
+	}
+}
@@ -0,0 +1,73 @@
+package files
+
+import (
+	"io"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// MigrateToBlobs moves content of revisions uploaded before the introduction of hashes (it is stored by file id)
+// into blobs. After that identical content is stored only once, the revisions are checked by Scrub and found
+// by the duplicate detection. Files in Trash are migrated too. It returns numbers of migrated and failed
+// revisions. Errors of single revisions are only logged
+func (fs FileStorage) MigrateToBlobs() (migrated, failed int) {
+	files := fs.metaStorage.getFiles("", "", false)
+	sort.Slice(files, func(i, j int) bool { return files[i].ID < files[j].ID })
+
+	for _, file := range files {
+		for _, rev := range file.GetRevisions() {
+			if rev.Hash != "" {
+				continue
+			}
+
+			if err := fs.migrateRevision(file, rev); err != nil {
+				fs.logger.Errorf("can't migrate revision %d of file \"%s\" (id: %d): %s\n", rev.Number, file.Filename, file.ID, err)
+				failed++
+				continue
+			}
+			migrated++
+		}
+	}
+
+	return migrated, failed
+}
+
+// migrateRevision saves content of a revision without a hash as a blob and deletes the original content
+func (fs FileStorage) migrateRevision(file File, rev Revision) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(fs.copyRevision(pw, file, rev))
+	}()
+	defer pr.Close()
+
+	err := fs.storeContent(pr, rev.Size, func(hash string, size int64) error {
+		if size != rev.Size {
+			// Don't record a hash of damaged content
+			return errors.Errorf("size of content (%d) doesn't match the recorded size (%d)", size, rev.Size)
+		}
+
+		updated, err := fs.metaStorage.setRevisionHash(file.ID, rev.Number, hash)
+		if err != nil {
+			return errors.Wrap(err, "can't save the hash into Metadata Storage")
+		}
+		fs.quotas.setFile(updated)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// The content is referenced by the hash now
+	if rev.Number == file.CurrentRevision().Number {
+		err = fs.binStorage.DeleteFile(file.ID, false)
+	} else {
+		err = fs.binStorage.DeleteFileRevision(file.ID, rev.Number)
+	}
+	if err != nil {
+		// The content will be reported as an orphan by Fsck
+		fs.logger.Errorf("can't delete the original content of revision %d of file with id %d: %s\n", rev.Number, file.ID, err)
+	}
+
+	return nil
+}
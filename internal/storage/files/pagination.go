@@ -0,0 +1,178 @@
+package files
+
+import (
+	"encoding/base64"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/tags-drive/core/internal/storage/files/exif"
+	"github.com/tags-drive/core/internal/storage/files/extensions"
+)
+
+// ErrInvalidCursor is returned when a cursor can't be decoded or was created for another sort specification
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// FilesPage is a page of files returned by FileStorage.GetPage
+type FilesPage struct {
+	Files []File `json:"files"`
+	// Total is a number of files which match a request
+	Total int `json:"total"`
+	// NextCursor points to the next page. It is empty if there are no more files
+	NextCursor string `json:"nextCursor"`
+	// PrevCursor points to the previous page. It is empty if it is the first page
+	PrevCursor string `json:"prevCursor"`
+	// Facets are counted over all found files (not only the page) if GetFilesConfig.Facets is true
+	Facets *Facets `json:"facets,omitempty"`
+}
+
+// Cursor directions
+const (
+	cursorAfter  = "a"
+	cursorBefore = "b"
+)
+
+// cursor points to a position between files. It contains the sort keys and the id of a file next to
+// the position, so the position doesn't shift when files are added or deleted
+type cursor struct {
+	// Spec is SortSpec.String()
+	Spec string `json:"s"`
+	// Dir is cursorAfter (files after the file are requested) or cursorBefore
+	Dir string `json:"d"`
+
+	ID       int                 `json:"i"`
+	Filename string              `json:"n,omitempty"`
+	Time     int64               `json:"t,omitempty"`
+	Size     int64               `json:"sz,omitempty"`
+	Ext      string              `json:"e,omitempty"`
+	Type     extensions.FileType `json:"ft,omitempty"`
+	Tags     int                 `json:"tg,omitempty"`
+	Taken    int64               `json:"tk,omitempty"`
+}
+
+func newCursor(spec SortSpec, dir string, f File) cursor {
+	c := cursor{Spec: spec.String(), Dir: dir, ID: f.ID}
+	for _, field := range spec.Fields {
+		switch field.Key {
+		case SortKeyName:
+			c.Filename = f.Filename
+		case SortKeyTime:
+			c.Time = f.AddTime.Unix()
+		case SortKeySize:
+			c.Size = f.Size
+		case SortKeyExt:
+			c.Ext = f.Type.Ext
+		case SortKeyType:
+			c.Type = f.Type.FileType
+		case SortKeyTags:
+			c.Tags = len(f.Tags)
+		case SortKeyTaken:
+			c.Taken = f.TakenTime().Unix()
+		}
+	}
+	return c
+}
+
+// file returns a file with the same position as the cursor
+func (c cursor) file() File {
+	taken := time.Unix(c.Taken, 0)
+	return File{
+		ID:       c.ID,
+		Filename: c.Filename,
+		AddTime:  time.Unix(c.Time, 0),
+		Size:     c.Size,
+		Type:     extensions.Ext{Ext: c.Ext, FileType: c.Type},
+		// Only the number of tags is used
+		Tags:  make([]int, c.Tags),
+		Image: &exif.Metadata{TakenAt: &taken},
+	}
+}
+
+func (c cursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor decodes a cursor and checks if it was created for passed sort specification
+func decodeCursor(s string, spec SortSpec) (cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cursor{}, ErrInvalidCursor
+	}
+
+	var c cursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return cursor{}, ErrInvalidCursor
+	}
+	if c.Spec != spec.String() || (c.Dir != cursorAfter && c.Dir != cursorBefore) || c.Tags < 0 {
+		return cursor{}, ErrInvalidCursor
+	}
+
+	return c, nil
+}
+
+// GetPage returns a page of "good" sorted files and the total number of files.
+//
+// If cnf.Cursor is set, the page starts right after (or ends right before) the file the cursor
+// points to, cnf.Offset is ignored. Otherwise, the page starts at cnf.Offset. An offset out of
+// bounds isn't an error, an empty page is returned
+func (fs FileStorage) GetPage(cnf GetFilesConfig) (FilesPage, error) {
+	files, err := fs.getSortedFiles(cnf)
+	if err != nil {
+		return FilesPage{}, err
+	}
+	spec := cnf.sortSpec()
+
+	start, end := cnf.Offset, len(files)
+	if cnf.Cursor != "" {
+		c, err := decodeCursor(cnf.Cursor, spec)
+		if err != nil {
+			return FilesPage{}, err
+		}
+
+		less := fileLess(spec)
+		cursorFile := c.file()
+		if c.Dir == cursorAfter {
+			// The first file after the cursor
+			start = sort.Search(len(files), func(i int) bool { return less(cursorFile, files[i]) })
+		} else {
+			// The first file which isn't before the cursor
+			end = sort.Search(len(files), func(i int) bool { return !less(files[i], cursorFile) })
+			start = 0
+			if cnf.Count > 0 && end-cnf.Count > 0 {
+				start = end - cnf.Count
+			}
+		}
+	}
+
+	if start > len(files) {
+		start = len(files)
+	}
+	if cnf.Count > 0 && start+cnf.Count < end {
+		end = start + cnf.Count
+	}
+
+	page := FilesPage{
+		Files: files[start:end],
+		Total: len(files),
+	}
+	if cnf.ContentSearch != "" {
+		fs.fillSnippets(page.Files, cnf.ContentSearch)
+	}
+	if cnf.Facets {
+		facets, err := fs.metaStorage.countFacets(fileIDs(files))
+		if err != nil {
+			return FilesPage{}, errors.Wrap(err, "can't count facets")
+		}
+		page.Facets = &facets
+	}
+	if end < len(files) && end > 0 {
+		page.NextCursor = newCursor(spec, cursorAfter, files[end-1]).encode()
+	}
+	if start > 0 && start < len(files) {
+		page.PrevCursor = newCursor(spec, cursorBefore, files[start]).encode()
+	}
+
+	return page, nil
+}
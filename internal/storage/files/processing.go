@@ -0,0 +1,250 @@
+package files
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	clog "github.com/ShoshinNikita/log/v2"
+	"github.com/pkg/errors"
+
+	"github.com/tags-drive/core/internal/storage/files/extensions"
+)
+
+// ProcessingStatus is a status of background processing of an image: extraction of metadata and creation
+// of a resized image. It is empty for other files and for images uploaded before the introduction of
+// background processing
+type ProcessingStatus string
+
+const (
+	// ProcessingPending means that an image is waiting for processing. A file icon should be shown
+	// instead of the resized image
+	ProcessingPending ProcessingStatus = "pending"
+	// ProcessingDone means that the resized image is ready
+	ProcessingDone ProcessingStatus = "done"
+	// ProcessingFailed means that an image can't be processed (for example, it is damaged)
+	ProcessingFailed ProcessingStatus = "failed"
+)
+
+const (
+	// DefaultProcessingWorkers is used when Config.ProcessingWorkers isn't set
+	DefaultProcessingWorkers = 2
+
+	// maxProcessingAttempts is a number of attempts to process a file before it is marked as failed
+	maxProcessingAttempts = 3
+	// processingRetryDelay is a delay before the first retry. Every next delay is longer
+	processingRetryDelay = 10 * time.Second
+)
+
+// processingQueue processes files in a bounded number of background workers. Failed jobs are retried
+// with increasing delays.
+//
+// The queue itself isn't persisted: the pending state is kept in Metadata Storage (see File.Processing),
+// so files which weren't processed before a shutdown are added into the queue on the next start
+type processingQueue struct {
+	workers    int
+	retryDelay time.Duration
+	// process processes a file. Errors are retried
+	process func(id int) error
+	// fail is called when a file can't be processed after maxProcessingAttempts attempts
+	fail func(id int, err error)
+
+	mutex *sync.Mutex
+	// cond is signaled on every change of the queue
+	cond     *sync.Cond
+	queue    []int
+	queued   map[int]bool
+	attempts map[int]int
+	// running is a number of files processed at the moment
+	running int
+	// delayed is a number of scheduled retries
+	delayed int
+	stopped bool
+
+	workersGroup *sync.WaitGroup
+	logger       *clog.Logger
+}
+
+func newProcessingQueue(workers int, process func(int) error, fail func(int, error), lg *clog.Logger) *processingQueue {
+	if workers < 1 {
+		workers = DefaultProcessingWorkers
+	}
+
+	mutex := new(sync.Mutex)
+	return &processingQueue{
+		workers:      workers,
+		retryDelay:   processingRetryDelay,
+		process:      process,
+		fail:         fail,
+		mutex:        mutex,
+		cond:         sync.NewCond(mutex),
+		queued:       make(map[int]bool),
+		attempts:     make(map[int]int),
+		workersGroup: new(sync.WaitGroup),
+		logger:       lg,
+	}
+}
+
+// start starts workers. Files can be added before the start
+func (q *processingQueue) start() {
+	for i := 0; i < q.workers; i++ {
+		q.workersGroup.Add(1)
+		go q.work()
+	}
+}
+
+// add adds a file into the queue. A file already waiting in the queue isn't added again
+func (q *processingQueue) add(id int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.stopped || q.queued[id] {
+		return
+	}
+
+	q.queue = append(q.queue, id)
+	q.queued[id] = true
+	q.cond.Broadcast()
+}
+
+func (q *processingQueue) work() {
+	defer q.workersGroup.Done()
+
+	for {
+		q.mutex.Lock()
+		for len(q.queue) == 0 && !q.stopped {
+			q.cond.Wait()
+		}
+		if q.stopped {
+			q.mutex.Unlock()
+			return
+		}
+
+		id := q.queue[0]
+		q.queue = q.queue[1:]
+		delete(q.queued, id)
+		q.running++
+		q.mutex.Unlock()
+
+		err := q.process(id)
+
+		q.mutex.Lock()
+		q.running--
+		if err != nil {
+			q.retry(id, err)
+		} else {
+			delete(q.attempts, id)
+		}
+		q.cond.Broadcast()
+		q.mutex.Unlock()
+	}
+}
+
+// retry schedules a new attempt to process a file or marks it as failed. It must be called under the lock
+func (q *processingQueue) retry(id int, err error) {
+	q.attempts[id]++
+	attempts := q.attempts[id]
+
+	if attempts >= maxProcessingAttempts {
+		delete(q.attempts, id)
+		q.fail(id, err)
+		return
+	}
+
+	q.logger.Warnf("can't process file with id %d (attempt %d of %d): %s\n", id, attempts, maxProcessingAttempts, err)
+
+	q.delayed++
+	time.AfterFunc(q.retryDelay*time.Duration(attempts), func() {
+		q.mutex.Lock()
+		q.delayed--
+		q.mutex.Unlock()
+
+		q.add(id)
+	})
+}
+
+// wait waits until all added files are processed (including retries)
+func (q *processingQueue) wait() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for !q.stopped && (len(q.queue) > 0 || q.running > 0 || q.delayed > 0) {
+		q.cond.Wait()
+	}
+}
+
+// stop stops workers and waits for files which are processed at the moment. Files left in the queue
+// keep the pending status
+func (q *processingQueue) stop() {
+	q.mutex.Lock()
+	q.stopped = true
+	q.cond.Broadcast()
+	q.mutex.Unlock()
+
+	q.workersGroup.Wait()
+}
+
+// scheduleProcessing marks an image as pending and adds it into the processing queue
+func (fs FileStorage) scheduleProcessing(id int) {
+	if _, err := fs.metaStorage.updateFileProcessing(id, ProcessingPending); err != nil {
+		// The image is still added into the queue, but it won't be resumed after a restart
+		fs.logger.Errorf("can't mark file with id %d as pending: %s\n", id, err)
+	}
+
+	fs.processing.add(id)
+}
+
+// resumeProcessing adds images which weren't processed before the last shutdown into the queue
+func (fs FileStorage) resumeProcessing() {
+	resumed := 0
+	for _, file := range fs.metaStorage.getFiles("", "", false) {
+		if file.Processing == ProcessingPending {
+			fs.processing.add(file.ID)
+			resumed++
+		}
+	}
+
+	if resumed > 0 {
+		fs.logger.Infof("%d image(s) were added into the processing queue\n", resumed)
+	}
+}
+
+// processFile extracts metadata of the current revision of an image and creates a resized image
+func (fs FileStorage) processFile(id int) error {
+	file, err := fs.metaStorage.getFile(id)
+	if err != nil {
+		if err == ErrFileIsNotExist {
+			// The file was deleted
+			return nil
+		}
+		return err
+	}
+	if file.Type.FileType != extensions.FileTypeImage {
+		return nil
+	}
+
+	content := new(bytes.Buffer)
+	if err := fs.copyRevision(content, file, file.CurrentRevision()); err != nil {
+		return errors.Wrapf(err, "can't load an image %s", file.Filename)
+	}
+
+	fs.updateImageMetadata(id, file.Filename, content.Bytes())
+	if err := fs.createResizedImage(content.Bytes(), id, file.Filename); err != nil {
+		return err
+	}
+
+	_, err = fs.metaStorage.updateFileProcessing(id, ProcessingDone)
+	if err == ErrFileIsNotExist {
+		return nil
+	}
+	return err
+}
+
+// failProcessing marks an image as failed
+func (fs FileStorage) failProcessing(id int, err error) {
+	fs.logger.Errorf("can't process file with id %d: %s\n", id, err)
+
+	if _, err := fs.metaStorage.updateFileProcessing(id, ProcessingFailed); err != nil && err != ErrFileIsNotExist {
+		fs.logger.Errorf("can't mark file with id %d as failed: %s\n", id, err)
+	}
+}
@@ -0,0 +1,423 @@
+package files
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/tags-drive/core/internal/storage/files/extensions"
+)
+
+// quotaReservationStep is a size of space reserved at once for content with unknown size
+const quotaReservationStep = 16 << 20 // 16MB
+
+// ErrQuotaExceeded is returned when there's no space for a file. It is wrapped with a description of the quota
+var ErrQuotaExceeded = errors.New("storage quota is exceeded")
+
+// Usage is a size of content of files
+type Usage struct {
+	Size  int64 `json:"size"`
+	Files int   `json:"files"`
+}
+
+// TypeUsage is a usage of files of a type
+type TypeUsage struct {
+	Usage
+	// Quota is 0 if there's no quota for the type
+	Quota int64 `json:"quota,omitempty"`
+}
+
+// StorageUsage describes space used by files. Old revisions and files in the Trash are counted too.
+//
+// Identical content is stored once, so it is counted only once in Used and Types. Sizes of Tags
+// and Trash include content of every file, so they can overlap
+type StorageUsage struct {
+	Used int64 `json:"used"`
+	// Quota is 0 if there's no total quota
+	Quota int64                             `json:"quota,omitempty"`
+	Files int                               `json:"files"`
+	Types map[extensions.FileType]TypeUsage `json:"types"`
+	Tags  map[int]Usage                     `json:"tags"`
+	Trash Usage                             `json:"trash"`
+	// Thumbnails is a size of resized images and thumbnails. It isn't limited by quotas
+	Thumbnails int64 `json:"thumbnails"`
+}
+
+// GetStorageUsage returns space used by files broken down by type, tag and Trash
+func (fs FileStorage) GetStorageUsage() (StorageUsage, error) {
+	usage := fs.countUsage()
+
+	usage.Quota = fs.config.Quota
+	for fileType, quota := range fs.config.TypeQuotas {
+		typeUsage := usage.Types[fileType]
+		typeUsage.Quota = quota
+		usage.Types[fileType] = typeUsage
+	}
+
+	thumbnails, err := fs.binStorage.ResizedImagesSize()
+	if err != nil {
+		return StorageUsage{}, errors.Wrap(err, "can't get size of resized images")
+	}
+	usage.Thumbnails = thumbnails
+
+	return usage, nil
+}
+
+// countUsage counts space used by all files
+func (fs FileStorage) countUsage() StorageUsage {
+	usage := StorageUsage{
+		Types: make(map[extensions.FileType]TypeUsage),
+		Tags:  make(map[int]Usage),
+	}
+
+	files := fs.metaStorage.getFiles("", "", false)
+	// Shared content is attributed to the oldest file
+	sort.Slice(files, func(i, j int) bool { return files[i].ID < files[j].ID })
+
+	counted := make(map[string]bool)
+	for _, file := range files {
+		var size, newSize int64
+		fileHashes := make(map[string]bool)
+		for _, rev := range file.GetRevisions() {
+			if rev.Hash == "" {
+				// Content is stored by file id
+				size += rev.Size
+				newSize += rev.Size
+				continue
+			}
+
+			if !fileHashes[rev.Hash] {
+				fileHashes[rev.Hash] = true
+				size += rev.Size
+			}
+			if !counted[rev.Hash] {
+				counted[rev.Hash] = true
+				newSize += rev.Size
+			}
+		}
+
+		usage.Used += newSize
+		usage.Files++
+
+		typeUsage := usage.Types[file.Type.FileType]
+		typeUsage.Size += newSize
+		typeUsage.Files++
+		usage.Types[file.Type.FileType] = typeUsage
+
+		for _, tag := range file.Tags {
+			tagUsage := usage.Tags[tag]
+			tagUsage.Size += size
+			tagUsage.Files++
+			usage.Tags[tag] = tagUsage
+		}
+
+		if file.Deleted {
+			usage.Trash.Size += size
+			usage.Trash.Files++
+		}
+	}
+
+	return usage
+}
+
+// quotaTracker keeps space used by saved files and space reserved by uploads in progress
+type quotaTracker struct {
+	mutex        *sync.Mutex
+	pendingTotal int64
+	pendingTypes map[extensions.FileType]int64
+
+	// used and usedTypes are counted like in FileStorage.countUsage. They are updated when files
+	// are added, changed or deleted, so quotas are checked without scanning all files
+	used      int64
+	usedTypes map[extensions.FileType]int64
+	files     map[int]fileUsage
+	blobs     map[string]*blobUsage
+}
+
+// fileUsage is content of a file counted by quotaTracker
+type fileUsage struct {
+	fileType extensions.FileType
+	// hashes contains sizes of blobs referenced by the file
+	hashes map[string]int64
+	// legacySize is a size of revisions stored by file id
+	legacySize int64
+}
+
+// blobUsage is a blob counted by quotaTracker. It is attributed to the oldest file
+type blobUsage struct {
+	size  int64
+	refs  map[int]bool
+	owner int
+}
+
+func newQuotaTracker() *quotaTracker {
+	return &quotaTracker{
+		mutex:        new(sync.Mutex),
+		pendingTypes: make(map[extensions.FileType]int64),
+		usedTypes:    make(map[extensions.FileType]int64),
+		files:        make(map[int]fileUsage),
+		blobs:        make(map[string]*blobUsage),
+	}
+}
+
+// init counts space used by passed files
+func (t *quotaTracker) init(files []File) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, file := range files {
+		t.set(file)
+	}
+}
+
+// setFile counts a new or changed file
+func (t *quotaTracker) setFile(file File) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.set(file)
+}
+
+// removeFile stops counting a deleted file
+func (t *quotaTracker) removeFile(id int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.remove(id)
+}
+
+func (t *quotaTracker) set(file File) {
+	t.remove(file.ID)
+
+	usage := fileUsage{
+		fileType: file.Type.FileType,
+		hashes:   make(map[string]int64),
+	}
+	for _, rev := range file.GetRevisions() {
+		if rev.Hash == "" {
+			usage.legacySize += rev.Size
+			continue
+		}
+		usage.hashes[rev.Hash] = rev.Size
+	}
+	t.files[file.ID] = usage
+
+	t.used += usage.legacySize
+	t.usedTypes[usage.fileType] += usage.legacySize
+
+	for hash, size := range usage.hashes {
+		blob, ok := t.blobs[hash]
+		if !ok {
+			t.blobs[hash] = &blobUsage{size: size, refs: map[int]bool{file.ID: true}, owner: file.ID}
+			t.used += size
+			t.usedTypes[usage.fileType] += size
+			continue
+		}
+
+		blob.refs[file.ID] = true
+		if file.ID < blob.owner {
+			t.moveBlob(blob, file.ID)
+		}
+	}
+}
+
+func (t *quotaTracker) remove(id int) {
+	usage, ok := t.files[id]
+	if !ok {
+		return
+	}
+
+	t.used -= usage.legacySize
+	t.usedTypes[usage.fileType] -= usage.legacySize
+
+	for hash := range usage.hashes {
+		blob := t.blobs[hash]
+		delete(blob.refs, id)
+
+		if len(blob.refs) == 0 {
+			delete(t.blobs, hash)
+			t.used -= blob.size
+			t.usedTypes[usage.fileType] -= blob.size
+			continue
+		}
+
+		if blob.owner == id {
+			owner := -1
+			for ref := range blob.refs {
+				if owner == -1 || ref < owner {
+					owner = ref
+				}
+			}
+			t.moveBlob(blob, owner)
+		}
+	}
+
+	delete(t.files, id)
+}
+
+// moveBlob attributes a blob to another file
+func (t *quotaTracker) moveBlob(blob *blobUsage, owner int) {
+	t.usedTypes[t.files[blob.owner].fileType] -= blob.size
+	t.usedTypes[t.files[owner].fileType] += blob.size
+	blob.owner = owner
+}
+
+func (fs FileStorage) hasQuotas() bool {
+	return fs.config.Quota > 0 || len(fs.config.TypeQuotas) > 0
+}
+
+// availableSpace returns a number of bytes which can be saved for a file of passed type and an error
+// which describes the quota that limits the space. It must be called under the lock
+func (fs FileStorage) availableSpace(fileType extensions.FileType) (int64, error) {
+	var (
+		available int64 = math.MaxInt64
+		quotaErr  error
+	)
+	if quota := fs.config.Quota; quota > 0 {
+		if left := quota - fs.quotas.used - fs.quotas.pendingTotal; left < available {
+			available = left
+			quotaErr = errors.Wrapf(ErrQuotaExceeded, "total quota is %s, %s is available",
+				formatSize(quota), formatSize(left))
+		}
+	}
+	if quota := fs.config.TypeQuotas[fileType]; quota > 0 {
+		if left := quota - fs.quotas.usedTypes[fileType] - fs.quotas.pendingTypes[fileType]; left < available {
+			available = left
+			quotaErr = errors.Wrapf(ErrQuotaExceeded, "quota for %s files is %s, %s is available",
+				fileType, formatSize(quota), formatSize(left))
+		}
+	}
+
+	return available, quotaErr
+}
+
+// checkQuota checks if there's space for a file of passed size. Space isn't reserved
+func (fs FileStorage) checkQuota(fileType extensions.FileType, size int64) error {
+	if !fs.hasQuotas() {
+		return nil
+	}
+
+	fs.quotas.mutex.Lock()
+	defer fs.quotas.mutex.Unlock()
+
+	if available, quotaErr := fs.availableSpace(fileType); available < size {
+		return quotaErr
+	}
+	return nil
+}
+
+// quotaReservation is space reserved for a file being saved
+type quotaReservation struct {
+	fs       FileStorage
+	fileType extensions.FileType
+	reserved int64
+	read     int64
+	// err is a reason of the last failed reservation
+	err error
+}
+
+// reserveQuota reserves space for a file. size can be -1 if it is unknown, then space is reserved
+// while the content is being read (see quotaReservation.wrap). The reservation must be released
+// after the file is saved
+func (fs FileStorage) reserveQuota(fileType extensions.FileType, size int64) (*quotaReservation, error) {
+	q := &quotaReservation{fs: fs, fileType: fileType}
+
+	var err error
+	if size >= 0 {
+		err = q.grow(size, size)
+	} else {
+		// Check that the quota isn't exhausted
+		err = q.grow(1, quotaReservationStep)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// grow reserves from min to max bytes. It returns an error if less than min bytes are available
+func (q *quotaReservation) grow(min, max int64) error {
+	if !q.fs.hasQuotas() {
+		return nil
+	}
+
+	tracker := q.fs.quotas
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	available, quotaErr := q.fs.availableSpace(q.fileType)
+	if available < min {
+		q.err = quotaErr
+		return quotaErr
+	}
+
+	n := max
+	if n > available {
+		n = available
+	}
+	q.reserved += n
+	tracker.pendingTotal += n
+	tracker.pendingTypes[q.fileType] += n
+
+	return nil
+}
+
+// release releases reserved space. The saved content must be counted by quotaTracker before that
+func (q *quotaReservation) release() {
+	if q.reserved == 0 {
+		return
+	}
+
+	tracker := q.fs.quotas
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	tracker.pendingTotal -= q.reserved
+	tracker.pendingTypes[q.fileType] -= q.reserved
+	q.reserved = 0
+}
+
+// wrap returns io.Reader which returns an error when read content doesn't fit into the quota
+func (q *quotaReservation) wrap(r io.Reader) io.Reader {
+	return &quotaReader{r: r, q: q}
+}
+
+type quotaReader struct {
+	r io.Reader
+	q *quotaReservation
+}
+
+func (qr *quotaReader) Read(p []byte) (int, error) {
+	n, err := qr.r.Read(p)
+	qr.q.read += int64(n)
+
+	if extra := qr.q.read - qr.q.reserved; extra > 0 {
+		if e := qr.q.grow(extra, extra+quotaReservationStep); e != nil {
+			return n, e
+		}
+	}
+	return n, err
+}
+
+// formatSize formats a size in bytes as "1.5 GB"
+func formatSize(size int64) string {
+	const unit = 1024
+
+	if size < 0 {
+		size = 0
+	}
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "KMGTPE"[exp])
+}
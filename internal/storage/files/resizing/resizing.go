@@ -21,11 +21,59 @@ func Decode(r io.Reader) (image.Image, error) {
 	return im, nil
 }
 
+// Orient rotates and flips an image according to a value of the EXIF Orientation tag, so it is
+// displayed correctly. Unknown values are ignored
+func Orient(img image.Image, orientation int) image.Image {
+	switch orientation {
+	case 2:
+		return imaging.FlipH(img)
+	case 3:
+		return imaging.Rotate180(img)
+	case 4:
+		return imaging.FlipV(img)
+	case 5:
+		return imaging.Transpose(img)
+	case 6:
+		return imaging.Rotate270(img)
+	case 7:
+		return imaging.Transverse(img)
+	case 8:
+		return imaging.Rotate90(img)
+	default:
+		return img
+	}
+}
+
 // Resize resizes an image
 func Resize(img image.Image) image.Image {
 	return imaging.Resize(img, width, height, imaging.Linear)
 }
 
+// Thumbnail scales an image down to fit into a square with passed side. If crop is true, an image
+// fills the square and the rest is cut off at the center. Images smaller than the square aren't enlarged
+func Thumbnail(img image.Image, size int, crop bool) image.Image {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+
+	if !crop {
+		if width <= size && height <= size {
+			return img
+		}
+		return imaging.Fit(img, size, size, imaging.Linear)
+	}
+
+	// The side of the square can't be greater than the shorter side of an image
+	if width < size {
+		size = width
+	}
+	if height < size {
+		size = height
+	}
+	if width == size && height == size {
+		return img
+	}
+	return imaging.Fill(img, size, size, imaging.Center, imaging.Linear)
+}
+
 // Encode encodes an image into io.Reader
 func Encode(im image.Image, ext string) (io.Reader, error) {
 	reader, writer := io.Pipe()
@@ -1,6 +1,8 @@
 package resizing_test
 
 import (
+	"image"
+	"image/color"
 	"io"
 	"os"
 	"path/filepath"
@@ -56,3 +58,62 @@ func TestResizing(t *testing.T) {
 		}
 	}
 }
+
+func TestThumbnail(t *testing.T) {
+	size := func(img image.Image) [2]int {
+		return [2]int{img.Bounds().Dx(), img.Bounds().Dy()}
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, 400, 200))
+
+	tests := []struct {
+		size int
+		crop bool
+		res  [2]int
+	}{
+		{100, false, [2]int{100, 50}},
+		{100, true, [2]int{100, 100}},
+		// Small images aren't enlarged
+		{1000, false, [2]int{400, 200}},
+		{1000, true, [2]int{200, 200}},
+		{300, true, [2]int{200, 200}},
+	}
+	for i, tt := range tests {
+		res := size(resizing.Thumbnail(img, tt.size, tt.crop))
+		if res != tt.res {
+			t.Errorf("Test #%d Want: %v Got: %v", i, tt.res, res)
+		}
+	}
+}
+
+func TestOrient(t *testing.T) {
+	// A 2x1 image with a white left pixel
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	img.Set(0, 0, color.White)
+
+	tests := []struct {
+		orientation int
+		size        image.Point
+		white       image.Point
+	}{
+		{0, image.Pt(2, 1), image.Pt(0, 0)},
+		{1, image.Pt(2, 1), image.Pt(0, 0)},
+		{2, image.Pt(2, 1), image.Pt(1, 0)},
+		{3, image.Pt(2, 1), image.Pt(1, 0)},
+		{4, image.Pt(2, 1), image.Pt(0, 0)},
+		{5, image.Pt(1, 2), image.Pt(0, 0)},
+		{6, image.Pt(1, 2), image.Pt(0, 0)},
+		{7, image.Pt(1, 2), image.Pt(0, 1)},
+		{8, image.Pt(1, 2), image.Pt(0, 1)},
+	}
+	for _, tt := range tests {
+		res := resizing.Orient(img, tt.orientation)
+		if size := res.Bounds().Size(); size != tt.size {
+			t.Errorf("Orientation %d: want size %v, got %v", tt.orientation, tt.size, size)
+			continue
+		}
+		if r, _, _, _ := res.At(tt.white.X, tt.white.Y).RGBA(); r != 0xffff {
+			t.Errorf("Orientation %d: pixel %v must be white", tt.orientation, tt.white)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package files
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+
+	bs "github.com/tags-drive/core/internal/storage/files/binary_storage"
+	"github.com/tags-drive/core/internal/utils"
+)
+
+// scrubReportFile is a name of a file in config.VarFolder. The report of the last scrub is kept there
+const scrubReportFile = "scrub_report.json"
+
+// ErrNoScrubReport is returned when files were never scrubbed
+var ErrNoScrubReport = errors.New("files were never scrubbed")
+
+// ScrubReport is a result of the integrity check of stored files
+type ScrubReport struct {
+	StartTime  time.Time `json:"startTime"`
+	FinishTime time.Time `json:"finishTime"`
+
+	// Checked is a number of checked revisions
+	Checked int `json:"checked"`
+	// Skipped is a number of revisions without a recorded hash (they were uploaded before
+	// the introduction of hashes and can't be verified)
+	Skipped int `json:"skipped"`
+
+	// Corrupted contains revisions with content which doesn't match the recorded hash
+	Corrupted []ScrubProblem `json:"corrupted"`
+	// Missing contains revisions with content which doesn't exist in Binary Storage
+	Missing []ScrubProblem `json:"missing"`
+	// Unreadable contains revisions with content which can't be read because of other errors
+	Unreadable []ScrubProblem `json:"unreadable"`
+}
+
+// OK returns true if no problems were found
+func (r ScrubReport) OK() bool {
+	return len(r.Corrupted) == 0 && len(r.Missing) == 0 && len(r.Unreadable) == 0
+}
+
+// ScrubProblem describes a damaged revision of a file
+type ScrubProblem struct {
+	FileID   int    `json:"fileID"`
+	Filename string `json:"filename"`
+	Revision int    `json:"revision"`
+	Hash     string `json:"hash"`
+	Error    string `json:"error,omitempty"`
+}
+
+type scrubResult int
+
+const (
+	scrubOK scrubResult = iota
+	scrubCorrupted
+	scrubMissing
+	scrubUnreadable
+)
+
+// Scrub re-reads content of all revisions of all files (including files in Trash) and compares
+// hashes of the content with the recorded ones. The report is saved and can be loaded with LastScrubReport
+func (fs FileStorage) Scrub() (ScrubReport, error) {
+	report := ScrubReport{
+		StartTime:  time.Now(),
+		Corrupted:  []ScrubProblem{},
+		Missing:    []ScrubProblem{},
+		Unreadable: []ScrubProblem{},
+	}
+
+	files := fs.metaStorage.getFiles("", "", false)
+	sort.Slice(files, func(i, j int) bool { return files[i].ID < files[j].ID })
+
+	// Identical content is stored once, so every blob is checked once
+	type checkedBlob struct {
+		res scrubResult
+		err error
+	}
+	checked := make(map[string]checkedBlob)
+
+	for _, file := range files {
+		for _, rev := range file.GetRevisions() {
+			if rev.Hash == "" {
+				report.Skipped++
+				continue
+			}
+
+			blob, ok := checked[rev.Hash]
+			if !ok {
+				blob.res, blob.err = fs.checkBlob(rev.Hash)
+				checked[rev.Hash] = blob
+			}
+			report.Checked++
+
+			if blob.res == scrubOK {
+				continue
+			}
+
+			if !fs.metaStorage.checkFile(file.ID) {
+				// The file was deleted during the scrub
+				continue
+			}
+
+			problem := ScrubProblem{
+				FileID:   file.ID,
+				Filename: file.Filename,
+				Revision: rev.Number,
+				Hash:     rev.Hash,
+			}
+			if blob.err != nil {
+				problem.Error = blob.err.Error()
+			}
+
+			switch blob.res {
+			case scrubCorrupted:
+				report.Corrupted = append(report.Corrupted, problem)
+			case scrubMissing:
+				report.Missing = append(report.Missing, problem)
+			case scrubUnreadable:
+				report.Unreadable = append(report.Unreadable, problem)
+			}
+		}
+	}
+
+	report.FinishTime = time.Now()
+
+	path := filepath.Join(fs.config.VarFolder, scrubReportFile)
+	err := utils.WriteFileAtomic(path, report, fs.config.Encrypt, fs.config.PassPhrase)
+	if err != nil {
+		return report, errors.Wrap(err, "can't save the scrub report")
+	}
+
+	return report, nil
+}
+
+// checkBlob reads a blob and compares the hash of its content with passed hash
+func (fs FileStorage) checkBlob(hash string) (scrubResult, error) {
+	hasher := sha256.New()
+
+	err := fs.binStorage.GetBlob(hasher, hash)
+	switch {
+	case err == nil:
+		// Check the hash
+	case bs.IsNotExist(err):
+		return scrubMissing, err
+	case bs.IsCorrupted(err):
+		// Encrypted data was changed
+		return scrubCorrupted, err
+	default:
+		return scrubUnreadable, err
+	}
+
+	if hex.EncodeToString(hasher.Sum(nil)) != hash {
+		return scrubCorrupted, nil
+	}
+
+	return scrubOK, nil
+}
+
+// LastScrubReport returns the report of the last scrub. It returns ErrNoScrubReport if files were never scrubbed
+func (fs FileStorage) LastScrubReport() (ScrubReport, error) {
+	path := filepath.Join(fs.config.VarFolder, scrubReportFile)
+
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ScrubReport{}, ErrNoScrubReport
+		}
+		return ScrubReport{}, errors.Wrapf(err, "can't open file %s", path)
+	}
+	defer f.Close()
+
+	var report ScrubReport
+	err = utils.Decode(f, &report, fs.config.Encrypt, fs.config.PassPhrase)
+	if err != nil {
+		return ScrubReport{}, errors.Wrap(err, "can't decode the scrub report")
+	}
+
+	return report, nil
+}
+
+// scheduleScrubbing scrubs files every config.ScrubInterval
+// It has to be run in goroutine
+func (fs FileStorage) scheduleScrubbing() {
+	ticker := time.NewTicker(fs.config.ScrubInterval)
+
+	for range ticker.C {
+		fs.logger.Debugln("scrub files")
+
+		report, err := fs.Scrub()
+		if err != nil {
+			fs.logger.Errorf("can't scrub files: %s\n", err)
+			continue
+		}
+
+		if !report.OK() {
+			fs.logger.Warnf("scrub found damaged files: %d corrupted, %d missing, %d unreadable\n",
+				len(report.Corrupted), len(report.Missing), len(report.Unreadable))
+		} else {
+			fs.logger.Debugf("scrub is finished: %d revision(s) were checked\n", report.Checked)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package files
+
+import (
+	"regexp"
+	"strings"
+)
+
+// filterFilesByName returns files which names match search
+//     search - string, which filename has to contain (lower case)
+//     isRegexp - is search a regular expression (if it is true, search must be valid regular expression)
+func filterFilesByName(files []File, search string, isRegexp bool) []File {
+	if search == "" {
+		return files
+	}
+
+	var reg *regexp.Regexp
+	if isRegexp {
+		// search must be valid regular expression
+		reg = regexp.MustCompile(search)
+	}
+
+	// Need to remove files with incorrect name
+	var goodFiles []File
+	for i := range files {
+		if isRegexp && reg.MatchString(files[i].Filename) {
+			goodFiles = append(goodFiles, files[i])
+		} else if strings.Contains(strings.ToLower(files[i].Filename), search) {
+			goodFiles = append(goodFiles, files[i])
+		}
+	}
+
+	return goodFiles
+}
+
+// mergeTags returns union of passed tags
+func mergeTags(a, b []int) []int {
+	t := make(map[int]struct{}, len(a)+len(b))
+	for i := range a {
+		t[a[i]] = struct{}{}
+	}
+	for i := range b {
+		t[b[i]] = struct{}{}
+	}
+
+	res := make([]int, 0, len(a)+len(b))
+	for k := range t {
+		res = append(res, k)
+	}
+
+	return res
+}
+
+// uniqueTags returns tags without repeated ones. The order is preserved
+func uniqueTags(tags []int) []int {
+	res := make([]int, 0, len(tags))
+	for _, tag := range tags {
+		if !hasTag(res, tag) {
+			res = append(res, tag)
+		}
+	}
+	return res
+}
+
+// excludeTags returns tags from a which are not in b
+func excludeTags(a, b []int) []int {
+	t := make(map[int]bool, len(a)+len(b))
+	for i := range a {
+		t[a[i]] = true
+	}
+	for i := range b {
+		t[b[i]] = false
+	}
+
+	res := make([]int, 0, len(a)+len(b))
+	for k, v := range t {
+		if v {
+			res = append(res, k)
+		}
+	}
+
+	return res
+}
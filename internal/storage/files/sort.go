@@ -2,35 +2,249 @@ package files
 
 import (
 	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/fvbommel/util/sortorder"
+	"github.com/pkg/errors"
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
 )
 
-func sortFiles(s FilesSortMode, files []File) {
+// ErrBadSortSpec is returned when a sort specification can't be parsed
+var ErrBadSortSpec = errors.New("bad sort specification")
+
+// SortKey is a key which files can be sorted by
+type SortKey string
+
+// Sort keys
+const (
+	SortKeyName SortKey = "name"
+	SortKeyTime SortKey = "time"
+	SortKeySize SortKey = "size"
+	SortKeyExt  SortKey = "ext"
+	SortKeyType SortKey = "type"
+	// SortKeyTags sorts files by a number of tags
+	SortKeyTags SortKey = "tags"
+	// SortKeyTaken sorts files by the time of capture of images. The time of upload is used
+	// for other files (see File.TakenTime)
+	SortKeyTaken SortKey = "taken"
+	// SortKeyRandom shuffles files. The order depends only on SortSpec.Seed and ids of files,
+	// so it doesn't change between pages
+	SortKeyRandom SortKey = "random"
+)
+
+// SortField is a key with a direction
+type SortField struct {
+	Key  SortKey
+	Desc bool
+}
+
+// SortSpec describes the order of files. Files are compared by Fields one by one. Files with
+// equal keys are ordered by id, so the order is always total
+type SortSpec struct {
+	Fields []SortField
+	// Seed is used by SortKeyRandom
+	Seed int64
+	// Locale is a BCP 47 language tag (for example, "ru" or "zh"). If it is set, names are compared
+	// according to the rules of the language. Otherwise, names are compared in natural order
+	Locale string
+}
+
+// ParseSortSpec parses a comma-separated list of keys. A key with the '-' prefix is sorted in
+// descending order. For example: "type,-time,name"
+func ParseSortSpec(s string) (SortSpec, error) {
+	var spec SortSpec
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+
+		var f SortField
+		if strings.HasPrefix(field, "-") {
+			f.Desc = true
+			field = field[1:]
+		}
+		f.Key = SortKey(strings.ToLower(field))
+
+		switch f.Key {
+		case SortKeyName, SortKeyTime, SortKeySize, SortKeyExt, SortKeyType, SortKeyTags, SortKeyTaken, SortKeyRandom:
+		default:
+			return SortSpec{}, errors.Wrapf(ErrBadSortSpec, "unknown key \"%s\"", field)
+		}
+
+		spec.Fields = append(spec.Fields, f)
+	}
+
+	return spec, nil
+}
+
+// Check checks the locale. Keys are checked by ParseSortSpec
+func (s SortSpec) Check() error {
+	if s.Locale == "" {
+		return nil
+	}
+	if _, err := language.Parse(s.Locale); err != nil {
+		return errors.Wrapf(ErrBadSortSpec, "invalid locale \"%s\"", s.Locale)
+	}
+	return nil
+}
+
+// String returns the specification in the format of ParseSortSpec. The seed and the locale are
+// added after ';' if they are used
+func (s SortSpec) String() string {
+	var b strings.Builder
+	random := false
+	for i, f := range s.Fields {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		if f.Desc {
+			b.WriteByte('-')
+		}
+		b.WriteString(string(f.Key))
+
+		random = random || f.Key == SortKeyRandom
+	}
+
+	if random {
+		b.WriteString(";seed=")
+		b.WriteString(strconv.FormatInt(s.Seed, 10))
+	}
+	if s.Locale != "" {
+		b.WriteString(";locale=")
+		b.WriteString(s.Locale)
+	}
+
+	return b.String()
+}
+
+// spec returns a specification of the sort mode
+func (s FilesSortMode) spec() SortSpec {
+	var f SortField
 	switch s {
-	case SortByNameAsc:
-		sort.Slice(files, func(i, j int) bool {
-			return sortorder.NaturalLess(files[i].Filename, files[j].Filename)
-		})
-	case SortByNameDesc:
-		sort.Slice(files, func(i, j int) bool {
-			return !sortorder.NaturalLess(files[i].Filename, files[j].Filename)
-		})
-	case SortByTimeAsc:
-		sort.Slice(files, func(i, j int) bool {
-			return files[i].AddTime.Unix() < files[j].AddTime.Unix()
-		})
-	case SortByTimeDesc:
-		sort.Slice(files, func(i, j int) bool {
-			return files[i].AddTime.Unix() > files[j].AddTime.Unix()
-		})
-	case SortBySizeAsc:
-		sort.Slice(files, func(i, j int) bool {
-			return files[i].Size < files[j].Size
-		})
-	case SortBySizeDecs:
-		sort.Slice(files, func(i, j int) bool {
-			return files[i].Size > files[j].Size
-		})
+	case SortByNameAsc, SortByNameDesc:
+		f.Key = SortKeyName
+	case SortByTimeAsc, SortByTimeDesc:
+		f.Key = SortKeyTime
+	case SortBySizeAsc, SortBySizeDecs:
+		f.Key = SortKeySize
+	default:
+		return SortSpec{}
+	}
+	f.Desc = s == SortByNameDesc || s == SortByTimeDesc || s == SortBySizeDecs
+
+	return SortSpec{Fields: []SortField{f}}
+}
+
+func sortFiles(s FilesSortMode, files []File) {
+	sortFilesBySpec(s.spec(), files)
+}
+
+func sortFilesBySpec(spec SortSpec, files []File) {
+	less := fileLess(spec)
+	sort.Slice(files, func(i, j int) bool {
+		return less(files[i], files[j])
+	})
+}
+
+// fileLess returns a function which defines the order of files for passed specification.
+// The returned function isn't thread-safe
+func fileLess(spec SortSpec) func(a, b File) bool {
+	cmps := make([]func(a, b File) int, 0, len(spec.Fields))
+	for _, f := range spec.Fields {
+		cmp := fileComparator(f.Key, spec)
+		if f.Desc {
+			asc := cmp
+			cmp = func(a, b File) int { return asc(b, a) }
+		}
+		cmps = append(cmps, cmp)
+	}
+
+	return func(a, b File) bool {
+		for _, cmp := range cmps {
+			if c := cmp(a, b); c != 0 {
+				return c < 0
+			}
+		}
+		return a.ID < b.ID
+	}
+}
+
+func fileComparator(key SortKey, spec SortSpec) func(a, b File) int {
+	switch key {
+	case SortKeyName:
+		if tag, err := language.Parse(spec.Locale); spec.Locale != "" && err == nil {
+			// Collator isn't thread-safe
+			col := collate.New(tag, collate.Numeric, collate.IgnoreCase)
+			return func(a, b File) int {
+				return col.CompareString(a.Filename, b.Filename)
+			}
+		}
+		return func(a, b File) int {
+			switch {
+			case sortorder.NaturalLess(a.Filename, b.Filename):
+				return -1
+			case sortorder.NaturalLess(b.Filename, a.Filename):
+				return 1
+			default:
+				return 0
+			}
+		}
+	case SortKeyTime:
+		return func(a, b File) int {
+			return compareInt64(a.AddTime.Unix(), b.AddTime.Unix())
+		}
+	case SortKeySize:
+		return func(a, b File) int {
+			return compareInt64(a.Size, b.Size)
+		}
+	case SortKeyExt:
+		return func(a, b File) int {
+			return strings.Compare(strings.ToLower(a.Type.Ext), strings.ToLower(b.Type.Ext))
+		}
+	case SortKeyType:
+		return func(a, b File) int {
+			return strings.Compare(string(a.Type.FileType), string(b.Type.FileType))
+		}
+	case SortKeyTags:
+		return func(a, b File) int {
+			return compareInt64(int64(len(a.Tags)), int64(len(b.Tags)))
+		}
+	case SortKeyTaken:
+		return func(a, b File) int {
+			return compareInt64(a.TakenTime().Unix(), b.TakenTime().Unix())
+		}
+	case SortKeyRandom:
+		return func(a, b File) int {
+			ha, hb := shuffleHash(spec.Seed, a.ID), shuffleHash(spec.Seed, b.ID)
+			switch {
+			case ha < hb:
+				return -1
+			case ha > hb:
+				return 1
+			default:
+				return 0
+			}
+		}
+	default:
+		return func(a, b File) int { return 0 }
+	}
+}
+
+// shuffleHash mixes a seed and an id (splitmix64)
+func shuffleHash(seed int64, id int) uint64 {
+	x := uint64(seed) ^ uint64(id)*0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
 	}
 }
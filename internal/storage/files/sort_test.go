@@ -3,6 +3,12 @@ package files
 import (
 	"testing"
 	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tags-drive/core/internal/storage/files/exif"
+	"github.com/tags-drive/core/internal/storage/files/extensions"
 )
 
 func TestSortFiles(t *testing.T) {
@@ -167,3 +173,130 @@ func TestSortFiles(t *testing.T) {
 		}
 	}
 }
+
+func TestParseSortSpec(t *testing.T) {
+	assert := assert.New(t)
+
+	spec, err := ParseSortSpec("type, -TIME,name")
+	assert.NoError(err)
+	assert.Equal([]SortField{
+		{Key: SortKeyType},
+		{Key: SortKeyTime, Desc: true},
+		{Key: SortKeyName},
+	}, spec.Fields)
+	assert.Equal("type,-time,name", spec.String())
+
+	spec.Fields = append(spec.Fields, SortField{Key: SortKeyRandom})
+	spec.Seed = 15
+	spec.Locale = "ru"
+	assert.Equal("type,-time,name,random;seed=15;locale=ru", spec.String())
+
+	for _, s := range []string{"", "name,", "-", "--name", "name,owner"} {
+		_, err := ParseSortSpec(s)
+		assert.Equal(ErrBadSortSpec, errors.Cause(err), s)
+	}
+}
+
+func TestSortFilesBySpec(t *testing.T) {
+	assert := assert.New(t)
+
+	ext := func(e string, t extensions.FileType) extensions.Ext {
+		return extensions.Ext{Ext: e, FileType: t}
+	}
+	ids := func(files []File) (res []int) {
+		for _, f := range files {
+			res = append(res, f.ID)
+		}
+		return res
+	}
+
+	files := []File{
+		{ID: 1, Filename: "b.png", Type: ext(".png", extensions.FileTypeImage), Size: 10, Tags: []int{1}},
+		{ID: 2, Filename: "a.txt", Type: ext(".txt", extensions.FileTypeLanguage), Size: 20},
+		{ID: 3, Filename: "c.JPG", Type: ext(".JPG", extensions.FileTypeImage), Size: 10, Tags: []int{1, 2}},
+		{ID: 4, Filename: "a.png", Type: ext(".png", extensions.FileTypeImage), Size: 30},
+		{ID: 5, Filename: "a.txt", Type: ext(".txt", extensions.FileTypeLanguage), Size: 20},
+	}
+
+	tests := []struct {
+		spec string
+		ids  []int
+	}{
+		{"type,-size,name", []int{4, 1, 3, 2, 5}},
+		{"ext,name", []int{3, 4, 1, 2, 5}},
+		{"-tags,name", []int{3, 1, 4, 2, 5}},
+		// Files with equal keys are ordered by id in both directions
+		{"name", []int{4, 2, 5, 1, 3}},
+		{"-name", []int{3, 1, 2, 5, 4}},
+		{"-size", []int{4, 2, 5, 1, 3}},
+	}
+	for _, tt := range tests {
+		spec, err := ParseSortSpec(tt.spec)
+		assert.NoError(err)
+
+		sortFilesBySpec(spec, files)
+		assert.Equal(tt.ids, ids(files), tt.spec)
+	}
+
+	// The random order depends only on the seed
+	spec := SortSpec{Fields: []SortField{{Key: SortKeyRandom}}, Seed: 42}
+	sortFilesBySpec(spec, files)
+	first := ids(files)
+
+	sortFilesBySpec(SortSpec{Fields: []SortField{{Key: SortKeyName}}}, files)
+	sortFilesBySpec(spec, files)
+	assert.Equal(first, ids(files))
+	assert.ElementsMatch([]int{1, 2, 3, 4, 5}, first)
+}
+
+func TestSortFilesByTakenTime(t *testing.T) {
+	assert := assert.New(t)
+
+	date := func(day int) time.Time {
+		return time.Date(2020, time.January, day, 0, 0, 0, 0, time.UTC)
+	}
+	image := func(day int) *exif.Metadata {
+		t := date(day)
+		return &exif.Metadata{TakenAt: &t}
+	}
+
+	files := []File{
+		{ID: 1, AddTime: date(10), Image: image(3)},
+		{ID: 2, AddTime: date(2)},
+		{ID: 3, AddTime: date(10), Image: &exif.Metadata{Width: 10}},
+		{ID: 4, AddTime: date(10), Image: image(1)},
+	}
+
+	// The time of upload is used if the time of capture is unknown
+	sortFilesBySpec(SortSpec{Fields: []SortField{{Key: SortKeyTaken}}}, files)
+	for i, id := range []int{4, 2, 1, 3} {
+		assert.Equal(id, files[i].ID)
+	}
+}
+
+func TestSortFilesByLocale(t *testing.T) {
+	assert := assert.New(t)
+
+	names := func(files []File) (res []string) {
+		for _, f := range files {
+			res = append(res, f.Filename)
+		}
+		return res
+	}
+
+	files := []File{
+		{ID: 1, Filename: "ёлка"},
+		{ID: 2, Filename: "Жук"},
+		{ID: 3, Filename: "ель"},
+		{ID: 4, Filename: "апельсин 10"},
+		{ID: 5, Filename: "апельсин 9"},
+		{ID: 6, Filename: "Яблоко"},
+	}
+
+	sortFilesBySpec(SortSpec{Fields: []SortField{{Key: SortKeyName}}, Locale: "ru"}, files)
+	assert.Equal([]string{"апельсин 9", "апельсин 10", "ёлка", "ель", "Жук", "Яблоко"}, names(files))
+
+	// Natural order compares code points: capital letters go first and 'ё' goes after 'я'
+	sortFilesBySpec(SortSpec{Fields: []SortField{{Key: SortKeyName}}}, files)
+	assert.Equal([]string{"Жук", "Яблоко", "апельсин 9", "апельсин 10", "ель", "ёлка"}, names(files))
+}
@@ -0,0 +1,148 @@
+package files
+
+import (
+	"sort"
+)
+
+// tagIndex is an inverted index: tag id -> sorted ids of files with this tag.
+// It isn't thread-safe, it is guarded by a mutex of a metadata storage. Slices
+// returned to aggregation.Program.Eval must be used only under this mutex
+type tagIndex struct {
+	// all contains sorted ids of all files
+	all []int
+	// postings contains sorted ids of files for every tag
+	postings map[int][]int
+	// fileTags contains indexed tags of every file. It is used to update postings
+	fileTags map[int][]int
+}
+
+func newTagIndex() *tagIndex {
+	return &tagIndex{
+		all:      []int{},
+		postings: make(map[int][]int),
+		fileTags: make(map[int][]int),
+	}
+}
+
+// rebuild indexes passed files from scratch
+func (ti *tagIndex) rebuild(files map[int]File) {
+	ti.all = make([]int, 0, len(files))
+	ti.postings = make(map[int][]int)
+	ti.fileTags = make(map[int][]int, len(files))
+
+	for id, f := range files {
+		ti.all = append(ti.all, id)
+		for _, tag := range f.Tags {
+			ti.postings[tag] = append(ti.postings[tag], id)
+		}
+		ti.fileTags[id] = append([]int{}, f.Tags...)
+	}
+
+	sort.Ints(ti.all)
+	for tag, ids := range ti.postings {
+		sort.Ints(ids)
+		// Files saved before tags were deduplicated can have a tag several times
+		ti.postings[tag] = compactIDs(ids)
+	}
+}
+
+// set adds a file into the index or updates tags of an indexed file
+func (ti *tagIndex) set(id int, tags []int) {
+	oldTags, ok := ti.fileTags[id]
+	if !ok {
+		ti.all = insertID(ti.all, id)
+	}
+
+	for _, tag := range oldTags {
+		if !hasTag(tags, tag) {
+			ti.removePosting(tag, id)
+		}
+	}
+	for _, tag := range tags {
+		if !hasTag(oldTags, tag) {
+			ti.postings[tag] = insertID(ti.postings[tag], id)
+		}
+	}
+
+	ti.fileTags[id] = append([]int{}, tags...)
+}
+
+// delete removes a file from the index
+func (ti *tagIndex) delete(id int) {
+	tags, ok := ti.fileTags[id]
+	if !ok {
+		return
+	}
+
+	for _, tag := range tags {
+		ti.removePosting(tag, id)
+	}
+	ti.all = removeID(ti.all, id)
+	delete(ti.fileTags, id)
+}
+
+func (ti *tagIndex) removePosting(tag, id int) {
+	ids := removeID(ti.postings[tag], id)
+	if len(ids) == 0 {
+		delete(ti.postings, tag)
+		return
+	}
+	ti.postings[tag] = ids
+}
+
+// All returns sorted ids of all files
+func (ti *tagIndex) All() []int {
+	return ti.all
+}
+
+// Posting returns sorted ids of files with passed tag
+func (ti *tagIndex) Posting(tag int) []int {
+	return ti.postings[tag]
+}
+
+// insertID inserts an id into a sorted slice
+func insertID(ids []int, id int) []int {
+	i := sort.SearchInts(ids, id)
+	if i < len(ids) && ids[i] == id {
+		return ids
+	}
+
+	ids = append(ids, 0)
+	copy(ids[i+1:], ids[i:])
+	ids[i] = id
+	return ids
+}
+
+// compactIDs removes repeated ids from a sorted slice
+func compactIDs(ids []int) []int {
+	if len(ids) == 0 {
+		return ids
+	}
+
+	res := ids[:1]
+	for _, id := range ids[1:] {
+		if id != res[len(res)-1] {
+			res = append(res, id)
+		}
+	}
+	return res
+}
+
+// removeID removes an id from a sorted slice
+func removeID(ids []int, id int) []int {
+	i := sort.SearchInts(ids, id)
+	if i == len(ids) || ids[i] != id {
+		return ids
+	}
+
+	return append(ids[:i], ids[i+1:]...)
+}
+
+func hasTag(tags []int, tag int) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,236 @@
+package files
+
+import (
+	"bytes"
+	"io"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	bs "github.com/tags-drive/core/internal/storage/files/binary_storage"
+	"github.com/tags-drive/core/internal/storage/files/extensions"
+	"github.com/tags-drive/core/internal/storage/files/resizing"
+)
+
+// ThumbnailMode defines how an image is fitted into a square thumbnail
+type ThumbnailMode string
+
+const (
+	// ThumbnailModeFit scales an image down to fit into a square. The aspect ratio is preserved
+	ThumbnailModeFit ThumbnailMode = "fit"
+	// ThumbnailModeCrop scales an image down to fill a square. The rest is cut off at the center
+	ThumbnailModeCrop ThumbnailMode = "crop"
+)
+
+// DefaultThumbnailSizes are used when Config.ThumbnailSizes is empty
+var DefaultThumbnailSizes = []int{256, 512, 1024, 2048}
+
+// Errors
+var (
+	ErrBadThumbnailSize = errors.New("thumbnails of this size aren't available")
+	ErrBadThumbnailMode = errors.New("invalid thumbnail mode")
+	ErrFileIsNotImage   = errors.New("the file isn't an image")
+)
+
+// ThumbnailSizes returns available sizes of thumbnails
+func (fs FileStorage) ThumbnailSizes() []int {
+	if len(fs.config.ThumbnailSizes) == 0 {
+		return DefaultThumbnailSizes
+	}
+	return fs.config.ThumbnailSizes
+}
+
+func (fs FileStorage) checkThumbnailSize(size int) bool {
+	for _, s := range fs.ThumbnailSizes() {
+		if s == size {
+			return true
+		}
+	}
+	return false
+}
+
+// getThumbnailName returns a name of a cached thumbnail. The name contains the number of the current
+// revision, so thumbnails of old content are never served
+func getThumbnailName(file File, size int, mode ThumbnailMode) string {
+	return strconv.Itoa(size) + "-" + string(mode) + "-" + strconv.Itoa(file.CurrentRevision().Number)
+}
+
+// CopyThumbnail writes a thumbnail of an image into passed io.Writer. Thumbnails are generated
+// on the first request and cached in Binary Storage. An empty mode means ThumbnailModeFit
+func (fs FileStorage) CopyThumbnail(w io.Writer, id, size int, mode ThumbnailMode) error {
+	if !fs.checkThumbnailSize(size) {
+		return ErrBadThumbnailSize
+	}
+	switch mode {
+	case "":
+		mode = ThumbnailModeFit
+	case ThumbnailModeFit, ThumbnailModeCrop:
+	default:
+		return ErrBadThumbnailMode
+	}
+
+	file, err := fs.metaStorage.getFile(id)
+	if err != nil {
+		return err
+	}
+	if file.Type.FileType != extensions.FileTypeImage {
+		return ErrFileIsNotImage
+	}
+
+	name := getThumbnailName(file, size, mode)
+
+	err = fs.binStorage.GetThumbnail(w, id, name)
+	if !bs.IsNotExist(err) {
+		return err
+	}
+
+	thumbnail, err := fs.createThumbnail(file, name, size, mode)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, thumbnail)
+	return errors.Wrap(err, "can't write a thumbnail")
+}
+
+// thumbnailLocks serializes generation of the same thumbnail and limits a number of thumbnails
+// generated at the same time, because decoding of big images takes a lot of memory
+type thumbnailLocks struct {
+	keys *keyedMutex
+	// workers is a semaphore of generating goroutines
+	workers chan struct{}
+}
+
+func newThumbnailLocks(workers int) *thumbnailLocks {
+	if workers <= 0 {
+		workers = DefaultProcessingWorkers
+	}
+	return &thumbnailLocks{
+		keys:    newKeyedMutex(),
+		workers: make(chan struct{}, workers),
+	}
+}
+
+// createThumbnail generates a thumbnail and saves it into Binary Storage. The same thumbnail is generated
+// only once at a time. The number of thumbnails generated at the same time is limited by Config.ProcessingWorkers
+func (fs FileStorage) createThumbnail(file File, name string, size int, mode ThumbnailMode) (*bytes.Buffer, error) {
+	key := strconv.Itoa(file.ID) + "/" + name
+	fs.thumbnailLocks.keys.lock(key)
+	defer fs.thumbnailLocks.keys.unlock(key)
+
+	// The thumbnail could be generated while we were waiting for the lock
+	thumbnail := &bytes.Buffer{}
+	err := fs.binStorage.GetThumbnail(thumbnail, file.ID, name)
+	if err == nil {
+		return thumbnail, nil
+	}
+	if !bs.IsNotExist(err) {
+		return nil, err
+	}
+
+	fs.thumbnailLocks.workers <- struct{}{}
+	defer func() { <-fs.thumbnailLocks.workers }()
+
+	content := &bytes.Buffer{}
+	if err := fs.copyRevision(content, file, file.CurrentRevision()); err != nil {
+		return nil, errors.Wrapf(err, "can't load the image %s", file.Filename)
+	}
+
+	img, err := decodeImage(content.Bytes())
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't decode the image %s", file.Filename)
+	}
+	img = resizing.Thumbnail(img, size, mode == ThumbnailModeCrop)
+
+	r, err := resizing.Encode(img, filepath.Ext(file.Filename))
+	if err != nil {
+		// Use JPEG for formats which can be decoded but not encoded
+		r, err = resizing.Encode(img, ".jpg")
+		if err != nil {
+			return nil, errors.Wrapf(err, "can't encode a thumbnail of the image %s", file.Filename)
+		}
+	}
+
+	thumbnail.Reset()
+	if _, err := thumbnail.ReadFrom(r); err != nil {
+		return nil, errors.Wrapf(err, "can't encode a thumbnail of the image %s", file.Filename)
+	}
+
+	err = fs.binStorage.SaveThumbnail(bytes.NewReader(thumbnail.Bytes()), int64(thumbnail.Len()), file.ID, name)
+	if err != nil {
+		// The thumbnail can be generated again next time
+		fs.logger.Errorf("can't save a thumbnail of file with id %d: %s\n", file.ID, err)
+	}
+
+	return thumbnail, nil
+}
+
+// deleteThumbnails deletes cached thumbnails of a file. Errors are only logged
+func (fs FileStorage) deleteThumbnails(id int) {
+	if err := fs.binStorage.DeleteThumbnails(id); err != nil {
+		fs.logger.Errorf("can't delete thumbnails of file with id %d: %s\n", id, err)
+	}
+}
+
+// RegenerateResizedImages recreates resized images of images found by cnf and deletes their cached thumbnails.
+// It is used after changes of the resizing. Images are processed by passed number of workers. It returns
+// a number of regenerated images. Errors of single images are only logged
+func (fs FileStorage) RegenerateResizedImages(cnf GetFilesConfig, workers int) (int, error) {
+	files, err := fs.Get(cnf)
+	if err != nil {
+		return 0, err
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	var (
+		images = make(chan File)
+		wg     sync.WaitGroup
+
+		mu          sync.Mutex
+		regenerated int
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for file := range images {
+				if err := fs.regenerateResizedImage(file); err != nil {
+					fs.logger.Errorf("%s\n", err)
+					continue
+				}
+
+				mu.Lock()
+				regenerated++
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, file := range files {
+		if file.Type.FileType == extensions.FileTypeImage {
+			images <- file
+		}
+	}
+	close(images)
+	wg.Wait()
+
+	return regenerated, nil
+}
+
+func (fs FileStorage) regenerateResizedImage(file File) error {
+	content := new(bytes.Buffer)
+	if err := fs.copyRevision(content, file, file.CurrentRevision()); err != nil {
+		return errors.Wrapf(err, "can't load an image %s", file.Filename)
+	}
+
+	if err := fs.createResizedImage(content.Bytes(), file.ID, file.Filename); err != nil {
+		return err
+	}
+
+	return errors.Wrapf(fs.binStorage.DeleteThumbnails(file.ID), "can't delete thumbnails of an image %s", file.Filename)
+}
@@ -7,6 +7,8 @@ import (
 
 	"errors"
 	"github.com/tags-drive/core/internal/storage/files/aggregation"
+	bs "github.com/tags-drive/core/internal/storage/files/binary_storage"
+	"github.com/tags-drive/core/internal/storage/files/exif"
 	"github.com/tags-drive/core/internal/storage/files/extensions"
 )
 
@@ -20,11 +22,40 @@ type Config struct {
 	PassPhrase [32]byte
 	// A file is deleted from the storage and from a disk after this time since user add the file into the Trash
 	TimeBeforeDeleting time.Duration
+	// ScrubInterval is an interval between integrity checks of stored files. Files aren't checked if it is 0
+	ScrubInterval time.Duration
+	// ThumbnailSizes are sizes of thumbnails which can be requested. DefaultThumbnailSizes are used if it is empty
+	ThumbnailSizes []int
+	// ProcessingWorkers is a number of images processed in background at the same time.
+	// DefaultProcessingWorkers is used if it is 0
+	ProcessingWorkers int
+	// ImportMaxSize is a max size of a file imported from a url. DefaultImportMaxSize is used if it is 0
+	ImportMaxSize int64
+	// ImportTimeout is a max time of downloading of a file. DefaultImportTimeout is used if it is 0
+	ImportTimeout time.Duration
+	// ImportContentTypes are allowed media types of imported files ("image/*", "application/pdf").
+	// All types are allowed if it is empty
+	ImportContentTypes []string
+	// ImportAllowedHosts are internal hosts which files can be imported from. Items can be host names,
+	// IP addresses or networks ("10.0.0.0/8"). Loopback, private and link-local addresses are forbidden
+	// if it is empty
+	ImportAllowedHosts []string
+	// Quota is a max size of content of all files including old revisions and the Trash (in bytes).
+	// There's no limit if it is 0
+	Quota int64
+	// TypeQuotas are max sizes of content of files of every type (in bytes). Types without a quota aren't limited
+	TypeQuotas map[extensions.FileType]int64
+	// DuplicatePolicy defines what is done with uploaded duplicates of existing files. DuplicateKeep is used if it is empty
+	DuplicatePolicy DuplicatePolicy
+	// DuplicatesByFilename enables detection of duplicates by filename. Duplicates are always detected by content
+	DuplicatesByFilename bool
 
 	// Metadata storage
 
 	MetadataStorageType string
 	FilesJSONFile       string
+	// SQLiteFile is a path to the database used when MetadataStorageType is "sqlite"
+	SQLiteFile string
 
 	// Binary Storage
 
@@ -52,13 +83,25 @@ type Config_S3Storage struct {
 type FilterFilesFunction func([]File) ([]File, error)
 
 type GetFilesConfig struct {
-	Expr     string
+	Expr string
+	// Tags are used to resolve tags referred by name in Expr and to check ids. It can be nil
+	Tags     aggregation.Tags
 	SortMode FilesSortMode
+	// Sort is used instead of SortMode if Sort.Fields isn't empty. Sort.Locale is used in both cases
+	Sort     SortSpec
 	Search   string
 	IsRegexp bool
-	Offset   int
-	Count    int                 // count must be greater than 0, else all files will be returned ([offset:])
-	Filter   FilterFilesFunction // can be nil
+	// ContentSearch is a text query for search in content of text files. Snippets of found files are filled
+	ContentSearch string
+	// Cursor is used by FileStorage.GetPage instead of Offset. It must be created for the same sort specification
+	Cursor string
+	// Area restricts found files to files with GPS coordinates in an area. It can be nil
+	Area *GeoArea
+	// Facets enables counting of facets of all found files in FileStorage.GetPage
+	Facets bool
+	Offset int
+	Count  int                 // count must be greater than 0, else all files will be returned ([offset:])
+	Filter FilterFilesFunction // can be nil
 }
 
 // File contains the information about a file
@@ -71,9 +114,169 @@ type File struct {
 	Description string    `json:"description,omitempty"`
 	Size        int64     `json:"size"`
 	AddTime     time.Time `json:"addTime"`
+	// Hash is a hex-encoded SHA-256 hash of the current content. Content of files uploaded before
+	// the introduction of hashes is stored by file id, Hash is empty for such files
+	Hash string `json:"hash,omitempty"`
 
 	Deleted      bool  `json:"deleted"`
 	TimeToDelete int64 `json:"timeToDelete,omitempty"`
+
+	// Revisions is a history of file content. The last revision is the current one.
+	// Files uploaded before the first content update have no revisions (see GetRevisions)
+	Revisions []Revision `json:"revisions,omitempty"`
+
+	// Image contains metadata of an image (dimensions, camera, capture time and etc.). It is nil for other
+	// files and images uploaded before the introduction of metadata (see FileStorage.ExtractImageMetadata)
+	Image *exif.Metadata `json:"image,omitempty"`
+	// Processing is a status of background processing of an image (see ProcessingStatus)
+	Processing ProcessingStatus `json:"processing,omitempty"`
+
+	// Snippets are filled only in results of search in content (see GetFilesConfig.ContentSearch)
+	Snippets []Snippet `json:"snippets,omitempty"`
+}
+
+// Revision contains the information about a version of file content
+type Revision struct {
+	Number  int       `json:"number"`
+	Size    int64     `json:"size"`
+	AddTime time.Time `json:"addTime"`
+	Hash    string    `json:"hash,omitempty"`
+}
+
+// GetRevisions returns all revisions of a file. The first revision is created from Size, AddTime and Hash
+// if the content of a file was never updated
+func (f File) GetRevisions() []Revision {
+	if len(f.Revisions) == 0 {
+		return []Revision{{Number: 1, Size: f.Size, AddTime: f.AddTime, Hash: f.Hash}}
+	}
+
+	return f.Revisions
+}
+
+// CurrentRevision returns the last revision of a file
+func (f File) CurrentRevision() Revision {
+	revisions := f.GetRevisions()
+	return revisions[len(revisions)-1]
+}
+
+// HasRevision checks if a file has a revision with passed number
+func (f File) HasRevision(number int) bool {
+	_, ok := f.getRevision(number)
+	return ok
+}
+
+func (f File) getRevision(number int) (Revision, bool) {
+	for _, r := range f.GetRevisions() {
+		if r.Number == number {
+			return r, true
+		}
+	}
+
+	return Revision{}, false
+}
+
+// addRevision appends a new revision and updates Size and Hash
+func (f *File) addRevision(size int64, hash string, addTime time.Time) {
+	revisions := append([]Revision{}, f.GetRevisions()...)
+	revisions = append(revisions, Revision{
+		Number:  revisions[len(revisions)-1].Number + 1,
+		Size:    size,
+		AddTime: addTime,
+		Hash:    hash,
+	})
+
+	f.Revisions = revisions
+	f.Size = size
+	f.Hash = hash
+}
+
+// setRevisionHash sets a hash of a revision without a hash. Hash of the file is updated too if it is
+// the current revision. It returns false if there's no such revision
+func (f *File) setRevisionHash(number int, hash string) bool {
+	revisions := append([]Revision{}, f.GetRevisions()...)
+	for i := range revisions {
+		if revisions[i].Number != number {
+			continue
+		}
+
+		revisions[i].Hash = hash
+		if len(f.Revisions) > 0 {
+			f.Revisions = revisions
+		}
+		if i == len(revisions)-1 {
+			f.Hash = hash
+		}
+		return true
+	}
+
+	return false
+}
+
+// TakenTime returns the time of capture of an image. The time of upload is returned if it is unknown
+func (f File) TakenTime() time.Time {
+	if f.Image != nil && f.Image.TakenAt != nil {
+		return *f.Image.TakenAt
+	}
+	return f.AddTime
+}
+
+// countRefs returns number of revisions with passed hash
+func (f File) countRefs(hash string) (n int) {
+	for _, r := range f.GetRevisions() {
+		if r.Hash == hash {
+			n++
+		}
+	}
+
+	return n
+}
+
+// isDuplicate checks if a file isn't in Trash and its current content has passed hash or it has
+// passed filename. filename is ignored if it is empty
+func (f File) isDuplicate(hash, filename string) bool {
+	if f.Deleted {
+		return false
+	}
+	return f.Hash == hash || (filename != "" && f.Filename == filename)
+}
+
+// fields returns fields of a file which can be used in logical expressions
+func (f File) fields() aggregation.Fields {
+	fields := aggregation.Fields{
+		Tags:        f.Tags,
+		Filename:    f.Filename,
+		Type:        string(f.Type.FileType),
+		Ext:         f.Type.Ext,
+		Size:        f.Size,
+		AddTime:     f.AddTime,
+		Description: f.Description,
+		Deleted:     f.Deleted,
+	}
+
+	if f.Image != nil {
+		if f.Image.TakenAt != nil {
+			fields.TakenAt = *f.Image.TakenAt
+		}
+		fields.Camera = f.Image.Camera()
+		fields.Lens = f.Image.Lens()
+		fields.Width = f.Image.Width
+		fields.Height = f.Image.Height
+		fields.ISO = f.Image.ISO
+		fields.HasGPS = f.Image.GPS != nil
+	}
+
+	return fields
+}
+
+// sortSpec returns the specification of the requested order
+func (cnf GetFilesConfig) sortSpec() SortSpec {
+	if len(cnf.Sort.Fields) > 0 {
+		return cnf.Sort
+	}
+
+	spec := cnf.SortMode.spec()
+	spec.Locale = cnf.Sort.Locale
+	return spec
 }
 
 type FilesSortMode int
@@ -104,8 +307,14 @@ type metadataStorage interface {
 
 	getFilesWithIDs(ids ...int) []File
 
+	// getLocations returns locations of files (including files in Trash) in a box
+	getLocations(box BoundingBox) ([]Location, error)
+
+	// countFacets returns facets of files with passed ids. Non-existent files are skipped
+	countFacets(ids []int) (Facets, error)
+
 	// add adds a file
-	addFile(filename string, fileType extensions.Ext, tags []int, size int64, addTime time.Time) (id int)
+	addFile(filename string, fileType extensions.Ext, tags []int, size int64, hash string, addTime time.Time) (id int, err error)
 
 	// renameFile renames a file
 	renameFile(id int, newName string) (File, error)
@@ -116,6 +325,18 @@ type metadataStorage interface {
 	// updateFileDescription update description of a file
 	updateFileDescription(id int, newDesc string) (File, error)
 
+	// updateFileImage updates metadata of an image
+	updateFileImage(id int, image *exif.Metadata) (File, error)
+
+	// updateFileProcessing updates a status of background processing of a file
+	updateFileProcessing(id int, status ProcessingStatus) (File, error)
+
+	// addFileRevision adds a new revision of a file content and updates the size and the hash of the file
+	addFileRevision(id int, size int64, hash string, addTime time.Time) (File, error)
+
+	// setRevisionHash sets a hash of a revision stored by file id (see FileStorage.MigrateToBlobs)
+	setRevisionHash(id, revision int, hash string) (File, error)
+
 	// deleteFile marks file deleted and sets TimeToDelete
 	// File can't be deleted several times (function should return ErrFileDeletedAgain)
 	deleteFile(id int) error
@@ -138,11 +359,33 @@ type metadataStorage interface {
 	// getExpiredDeletedFiles returns names of files with expired TimeToDelete
 	getExpiredDeletedFiles() []int
 
+	// countBlobRefs returns number of revisions of all files (including files in Trash) which content
+	// has passed hash. A blob can be deleted only when there are no refs
+	countBlobRefs(hash string) (int, error)
+
+	// findDuplicates returns files (except files in Trash) which current content has passed hash
+	// or which have passed filename. filename is ignored if it is empty
+	findDuplicates(hash, filename string) ([]File, error)
+
 	shutdown() error
 }
 
-// binaryStorage is a storage for the files themselves
+// binaryStorage is a storage for the files themselves.
+//
+// Content of files is stored in blobs addressed by a hash. Resized images and content of files without
+// a hash are stored by file id
 type binaryStorage interface {
+	// SaveBlob saves content and returns its SHA-256 hash. Identical content is stored only once.
+	// size is -1 if it is unknown
+	SaveBlob(r io.Reader, size int64) (hash string, err error)
+
+	// GetBlob writes a blob into passed io.Writer
+	GetBlob(w io.Writer, hash string) error
+
+	GetBlobStats(hash string) (os.FileInfo, error)
+
+	DeleteBlob(hash string) error
+
 	// GetFile writes a file into passed io.Writer
 	GetFile(w io.Writer, fileID int, resized bool) error
 
@@ -151,6 +394,42 @@ type binaryStorage interface {
 	SaveFile(r io.Reader, fileID int, fileSize int64, resized bool) error
 
 	DeleteFile(fileID int, resized bool) error
+
+	// SaveThumbnail saves a thumbnail of a file. Name must be unique among thumbnails of the file
+	SaveThumbnail(r io.Reader, size int64, fileID int, name string) error
+
+	// GetThumbnail writes a thumbnail of a file into passed io.Writer
+	GetThumbnail(w io.Writer, fileID int, name string) error
+
+	// DeleteThumbnails deletes all thumbnails of a file
+	DeleteThumbnails(fileID int) error
+
+	// SaveUploadChunk saves a chunk of a resumable upload. Chunks are identified by their offsets.
+	// size is -1 if it is unknown
+	SaveUploadChunk(r io.Reader, size int64, uploadID string, offset int64) error
+
+	// GetUploadChunk writes a chunk of a resumable upload into passed io.Writer
+	GetUploadChunk(w io.Writer, uploadID string, offset int64) error
+
+	// DeleteUpload deletes all chunks of a resumable upload
+	DeleteUpload(uploadID string) error
+
+	// ArchiveFile copies the current version of a file without a hash into the archive of revisions
+	ArchiveFile(fileID, revision int) error
+
+	// GetFileRevision writes an archived revision of a file into passed io.Writer
+	GetFileRevision(w io.Writer, fileID, revision int) error
+
+	DeleteFileRevision(fileID, revision int) error
+
+	// Inventory returns all stored files
+	Inventory() (bs.Inventory, error)
+
+	// DeleteTemporaryFile deletes a temporary file returned by Inventory
+	DeleteTemporaryFile(name string) error
+
+	// ResizedImagesSize returns the total size of resized images and thumbnails
+	ResizedImagesSize() (int64, error)
 }
 
 type binaryStorageMock struct{}
@@ -0,0 +1,481 @@
+package files
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/tags-drive/core/internal/storage/files/extensions"
+	"github.com/tags-drive/core/internal/utils"
+)
+
+const (
+	// uploadsFile is a name of a file in config.VarFolder. States of unfinished resumable uploads are kept there
+	uploadsFile = "uploads.json"
+
+	// UploadExpiration is a time after the last chunk after which an unfinished upload is deleted
+	UploadExpiration = 24 * time.Hour
+)
+
+// Errors
+var (
+	ErrUploadIsNotExist = errors.New("the upload doesn't exist")
+	ErrUploadIsLocked   = errors.New("the upload is being written by another request")
+	ErrBadUploadOffset  = errors.New("offset doesn't match the offset of the upload")
+	ErrBadUploadLength  = errors.New("invalid length of the upload")
+	ErrEmptyFilename    = errors.New("filename can't be empty")
+)
+
+// UploadStatus is a status of a resumable upload
+type UploadStatus string
+
+const (
+	// UploadReceiving means that content is still being received
+	UploadReceiving UploadStatus = "receiving"
+	// UploadFinishing means that all content is received and the file is being created in background
+	UploadFinishing UploadStatus = "finishing"
+	// UploadFinished means that the file is created (or the upload is merged into an existing file)
+	UploadFinished UploadStatus = "finished"
+	// UploadRejected means that the file is rejected as a duplicate
+	UploadRejected UploadStatus = "rejected"
+	// UploadFailed means that the file can't be created. Creation is retried till the upload expires
+	UploadFailed UploadStatus = "failed"
+)
+
+// ResumableUpload is an upload which content is sent by chunks. Chunks are staged in Binary Storage.
+// When all content is received, a new file is created in background and the chunks are deleted.
+// The result is kept till the upload expires
+type ResumableUpload struct {
+	ID       string `json:"id"`
+	Filename string `json:"filename"`
+	Tags     []int  `json:"tags"`
+	// Length is a size of the whole content
+	Length int64 `json:"length"`
+	// Offset is a number of received bytes
+	Offset int64 `json:"offset"`
+	// Chunks contains offsets of saved chunks
+	Chunks  []int64      `json:"chunks"`
+	Status  UploadStatus `json:"status"`
+	Created time.Time    `json:"created"`
+	Expires time.Time    `json:"expires"`
+
+	// Error is a reason why the file can't be created. It is set only for rejected and failed uploads
+	Error string `json:"error,omitempty"`
+	// FileID is an id of the created file (or of the file the upload was merged into). It is set
+	// only when the upload is finished
+	FileID int `json:"fileID,omitempty"`
+	// Duplicates and Duplicate describe found duplicates (see UploadResult). They are set only when
+	// the upload is finished or rejected
+	Duplicates []int           `json:"duplicates,omitempty"`
+	Duplicate  DuplicatePolicy `json:"duplicate,omitempty"`
+}
+
+// Finished returns true if all content of the upload was received
+func (u ResumableUpload) Finished() bool {
+	return u.Offset == u.Length
+}
+
+// resumableUploads keeps states of unfinished uploads. They are saved after every change, so uploads
+// survive restarts
+type resumableUploads struct {
+	mutex   *sync.Mutex
+	uploads map[string]ResumableUpload
+	// locked contains ids of uploads which chunks are being written or which are being finished
+	locked map[string]bool
+	// finishing tracks goroutines which create files of finished uploads
+	finishing *sync.WaitGroup
+
+	path       string
+	encrypt    bool
+	passPhrase [32]byte
+}
+
+func newResumableUploads(cnf Config) *resumableUploads {
+	return &resumableUploads{
+		mutex:      new(sync.Mutex),
+		uploads:    make(map[string]ResumableUpload),
+		locked:     make(map[string]bool),
+		finishing:  new(sync.WaitGroup),
+		path:       filepath.Join(cnf.VarFolder, uploadsFile),
+		encrypt:    cnf.Encrypt,
+		passPhrase: cnf.PassPhrase,
+	}
+}
+
+// load loads states of uploads. It doesn't return an error if the file doesn't exist
+func (ru *resumableUploads) load() error {
+	f, err := os.Open(ru.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "can't open file %s", ru.path)
+	}
+	defer f.Close()
+
+	var uploads []ResumableUpload
+	if err := utils.Decode(f, &uploads, ru.encrypt, ru.passPhrase); err != nil {
+		return errors.Wrap(err, "can't decode uploads")
+	}
+
+	ru.mutex.Lock()
+	defer ru.mutex.Unlock()
+
+	for _, u := range uploads {
+		if u.Status == "" {
+			// Saved by a previous version
+			u.Status = UploadReceiving
+		}
+		ru.uploads[u.ID] = u
+	}
+	return nil
+}
+
+// save saves states of uploads. It must be called under the lock
+func (ru *resumableUploads) save() error {
+	uploads := make([]ResumableUpload, 0, len(ru.uploads))
+	for _, u := range ru.uploads {
+		uploads = append(uploads, u)
+	}
+	sort.Slice(uploads, func(i, j int) bool { return uploads[i].Created.Before(uploads[j].Created) })
+
+	return errors.Wrap(utils.WriteFileAtomic(ru.path, uploads, ru.encrypt, ru.passPhrase), "can't save uploads")
+}
+
+func (ru *resumableUploads) get(id string) (ResumableUpload, bool) {
+	ru.mutex.Lock()
+	defer ru.mutex.Unlock()
+
+	u, ok := ru.uploads[id]
+	return u, ok
+}
+
+func (ru *resumableUploads) getAll() []ResumableUpload {
+	ru.mutex.Lock()
+	defer ru.mutex.Unlock()
+
+	uploads := make([]ResumableUpload, 0, len(ru.uploads))
+	for _, u := range ru.uploads {
+		uploads = append(uploads, u)
+	}
+	return uploads
+}
+
+// put adds or updates an upload
+func (ru *resumableUploads) put(u ResumableUpload) error {
+	ru.mutex.Lock()
+	defer ru.mutex.Unlock()
+
+	ru.uploads[u.ID] = u
+	return ru.save()
+}
+
+// remove removes an upload
+func (ru *resumableUploads) remove(id string) error {
+	ru.mutex.Lock()
+	defer ru.mutex.Unlock()
+
+	delete(ru.uploads, id)
+	return ru.save()
+}
+
+// lock locks an upload for writing. It returns ErrUploadIsLocked if the upload is already locked
+func (ru *resumableUploads) lock(id string) (ResumableUpload, error) {
+	ru.mutex.Lock()
+	defer ru.mutex.Unlock()
+
+	u, ok := ru.uploads[id]
+	if !ok {
+		return ResumableUpload{}, ErrUploadIsNotExist
+	}
+	if ru.locked[id] {
+		return ResumableUpload{}, ErrUploadIsLocked
+	}
+
+	ru.locked[id] = true
+	return u, nil
+}
+
+func (ru *resumableUploads) unlock(id string) {
+	ru.mutex.Lock()
+	defer ru.mutex.Unlock()
+
+	delete(ru.locked, id)
+}
+
+// chunkReader reads a chunk sent by a client. A read error is kept and reported as io.EOF,
+// so data received before a connection is broken can be saved
+type chunkReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	if err != nil && err != io.EOF {
+		c.err = err
+		err = io.EOF
+	}
+	return n, err
+}
+
+// generateRandomID generates a random hex-encoded id of 32 characters
+func generateRandomID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// CreateUpload creates a new resumable upload. Upload with zero length is finished at once.
+// It returns ErrQuotaExceeded (wrapped) if the file doesn't fit into quotas
+func (fs FileStorage) CreateUpload(filename string, tags []int, length int64) (ResumableUpload, error) {
+	if filename == "" {
+		return ResumableUpload{}, ErrEmptyFilename
+	}
+	if length < 0 {
+		return ResumableUpload{}, ErrBadUploadLength
+	}
+	if tags == nil {
+		tags = []int{}
+	}
+
+	// Reject the upload at once if the file doesn't fit into quotas. They are checked again when the upload is finished
+	fileType := extensions.GetExt(filepath.Ext(filename)).FileType
+	if err := fs.checkQuota(fileType, length); err != nil {
+		return ResumableUpload{}, err
+	}
+
+	id, err := generateRandomID()
+	if err != nil {
+		return ResumableUpload{}, errors.Wrap(err, "can't generate an id of the upload")
+	}
+
+	now := time.Now()
+	upload := ResumableUpload{
+		ID:       id,
+		Filename: filename,
+		Tags:     tags,
+		Length:   length,
+		Chunks:   []int64{},
+		Status:   UploadReceiving,
+		Created:  now,
+		Expires:  now.Add(UploadExpiration),
+	}
+	if length == 0 {
+		// There's nothing to wait for
+		if err := fs.createUploadFile(&upload); err != nil {
+			return ResumableUpload{}, err
+		}
+		upload.Status = UploadFinished
+		return upload, nil
+	}
+
+	if err := fs.uploads.put(upload); err != nil {
+		return ResumableUpload{}, err
+	}
+	return upload, nil
+}
+
+// GetUpload returns an upload. Finished uploads are kept till they expire
+func (fs FileStorage) GetUpload(id string) (ResumableUpload, error) {
+	upload, ok := fs.uploads.get(id)
+	if !ok {
+		return ResumableUpload{}, ErrUploadIsNotExist
+	}
+	return upload, nil
+}
+
+// WriteUploadChunk saves a chunk of content which starts at offset. offset must be equal to the offset
+// of the upload. Content beyond the length of the upload is ignored. If a client is disconnected, received
+// data is kept, so the upload can be resumed.
+//
+// When all content is received, a new file is created (as by Upload) in background. The result can be
+// checked with GetUpload. A failed upload is finished again by an empty chunk or by scheduleUploadsExpiration
+func (fs FileStorage) WriteUploadChunk(id string, offset int64, r io.Reader) (ResumableUpload, error) {
+	upload, err := fs.uploads.lock(id)
+	if err != nil {
+		return ResumableUpload{}, err
+	}
+	// The lock is passed to the goroutine which finishes the upload
+	locked := true
+	defer func() {
+		if locked {
+			fs.uploads.unlock(id)
+		}
+	}()
+
+	if offset != upload.Offset {
+		return upload, ErrBadUploadOffset
+	}
+
+	if upload.Status == UploadReceiving && !upload.Finished() {
+		chunk := &chunkReader{r: io.LimitReader(r, upload.Length-upload.Offset)}
+		err := fs.binStorage.SaveUploadChunk(chunk, -1, upload.ID, upload.Offset)
+		if err != nil {
+			return upload, errors.Wrap(err, "can't save a chunk into Binary Storage")
+		}
+
+		if chunk.n > 0 {
+			upload.Chunks = append(upload.Chunks, upload.Offset)
+			upload.Offset += chunk.n
+			upload.Expires = time.Now().Add(UploadExpiration)
+			if err := fs.uploads.put(upload); err != nil {
+				return upload, err
+			}
+		}
+
+		if chunk.err != nil {
+			return upload, errors.Wrap(chunk.err, "can't read a chunk")
+		}
+	}
+
+	if !upload.Finished() || (upload.Status != UploadReceiving && upload.Status != UploadFailed) {
+		// Wait for the next chunk, or the file is already being created
+		return upload, nil
+	}
+
+	upload.Status = UploadFinishing
+	if err := fs.uploads.put(upload); err != nil {
+		return upload, err
+	}
+
+	locked = false
+	fs.uploads.finishing.Add(1)
+	go func() {
+		defer fs.uploads.finishing.Done()
+		defer fs.uploads.unlock(id)
+
+		fs.finishUpload(upload)
+	}()
+
+	return upload, nil
+}
+
+// retryUpload finishes an upload which content is received, but the file wasn't created because
+// of an error or a restart
+func (fs FileStorage) retryUpload(id string) error {
+	upload, err := fs.uploads.lock(id)
+	if err != nil {
+		return err
+	}
+	defer fs.uploads.unlock(id)
+
+	if upload.Finished() && (upload.Status == UploadFinishing || upload.Status == UploadFailed) {
+		fs.finishUpload(upload)
+	}
+	return nil
+}
+
+// finishUpload creates a new file with content of an upload and saves the result into the upload.
+// Chunks are deleted when the file is created or rejected as a duplicate. The upload must be locked
+func (fs FileStorage) finishUpload(upload ResumableUpload) {
+	err := fs.createUploadFile(&upload)
+	switch {
+	case err == nil:
+		upload.Status = UploadFinished
+		upload.Error = ""
+	case errors.Cause(err) == ErrAlreadyExist:
+		upload.Status = UploadRejected
+		upload.Error = err.Error()
+	default:
+		// Chunks are kept, so the upload can be finished later
+		fs.logger.Errorf("can't create a file of the upload %s: %s\n", upload.ID, err)
+		upload.Status = UploadFailed
+		upload.Error = err.Error()
+		if err := fs.uploads.put(upload); err != nil {
+			fs.logger.Errorf("can't save the failed upload %s: %s\n", upload.ID, err)
+		}
+		return
+	}
+
+	// The result is kept till the upload expires
+	upload.Chunks = []int64{}
+	upload.Expires = time.Now().Add(UploadExpiration)
+	if err := fs.uploads.put(upload); err != nil {
+		fs.logger.Errorf("can't save the finished upload %s: %s\n", upload.ID, err)
+	}
+	if err := fs.binStorage.DeleteUpload(upload.ID); err != nil {
+		fs.logger.Errorf("can't delete chunks of the finished upload %s: %s\n", upload.ID, err)
+	}
+}
+
+// createUploadFile creates a new file with content of an upload. FileID and duplicates of the upload are filled
+func (fs FileStorage) createUploadFile(upload *ResumableUpload) error {
+	pr, pw := io.Pipe()
+	go func() {
+		var err error
+		for _, offset := range upload.Chunks {
+			if err = fs.binStorage.GetUploadChunk(pw, upload.ID, offset); err != nil {
+				err = errors.Wrapf(err, "can't load a chunk at offset %d", offset)
+				break
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+
+	res, err := fs.upload(pr, upload.Length, upload.Filename, upload.Tags)
+	// Stop the writer if the content wasn't read till the end
+	pr.Close()
+	upload.Duplicates = res.Duplicates
+	upload.Duplicate = res.Action
+	if err != nil {
+		return err
+	}
+	upload.FileID = res.File.ID
+
+	return nil
+}
+
+// DeleteUpload deletes an upload and its chunks
+func (fs FileStorage) DeleteUpload(id string) error {
+	if _, err := fs.uploads.lock(id); err != nil {
+		return err
+	}
+	defer fs.uploads.unlock(id)
+
+	if err := fs.binStorage.DeleteUpload(id); err != nil {
+		return errors.Wrap(err, "can't delete chunks of the upload")
+	}
+
+	return fs.uploads.remove(id)
+}
+
+// scheduleUploadsExpiration deletes expired uploads every hour. Uploads which files weren't created
+// (because of an error or a restart) are finished again
+// It has to be run in goroutine
+func (fs FileStorage) scheduleUploadsExpiration() {
+	ticker := time.NewTicker(time.Hour)
+
+	for ; true; <-ticker.C {
+		fs.logger.Debugln("delete expired uploads")
+
+		now := time.Now()
+		for _, upload := range fs.uploads.getAll() {
+			if upload.Expires.After(now) {
+				if upload.Status == UploadFinishing || upload.Status == UploadFailed {
+					err := fs.retryUpload(upload.ID)
+					if err != nil && err != ErrUploadIsNotExist && err != ErrUploadIsLocked {
+						fs.logger.Errorf("can't finish the upload of \"%s\": %s\n", upload.Filename, err)
+					}
+				}
+				continue
+			}
+
+			err := fs.DeleteUpload(upload.ID)
+			if err != nil && err != ErrUploadIsNotExist && err != ErrUploadIsLocked {
+				fs.logger.Errorf("can't delete the expired upload of \"%s\": %s\n", upload.Filename, err)
+			}
+		}
+	}
+}
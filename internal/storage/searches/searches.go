@@ -0,0 +1,187 @@
+// Package searches keeps saved searches (smart folders). A saved search is executed every time
+// its files are requested, so the result is always up to date
+package searches
+
+import (
+	"regexp"
+
+	clog "github.com/ShoshinNikita/log/v2"
+	"github.com/pkg/errors"
+
+	"github.com/tags-drive/core/internal/storage/files"
+	"github.com/tags-drive/core/internal/storage/files/aggregation"
+	"github.com/tags-drive/core/internal/storage/tags"
+)
+
+var (
+	ErrSearchNotExist = errors.New("search doesn't exist")
+	ErrEmptyName      = errors.New("name of a search can't be empty")
+	ErrBadRegexp      = errors.New("invalid regular expression")
+)
+
+// internalStorage is an internal storage for saved searches
+type internalStorage interface {
+	init() error
+
+	// getAll returns all searches
+	getAll() Searches
+
+	// getSearch returns a search with passed id
+	getSearch(id int) (Search, bool)
+
+	// addSearch adds a new search and returns it with a new id
+	addSearch(s Search) (Search, error)
+
+	// updateSearch replaces a search with the same id
+	updateSearch(s Search) (Search, error)
+
+	// deleteSearch deletes a search
+	deleteSearch(id int)
+
+	shutdown() error
+}
+
+// SearchStorage keeps saved searches and executes them
+type SearchStorage struct {
+	config Config
+
+	storage     internalStorage
+	fileStorage FileStorage
+	tagStorage  TagStorage
+
+	logger *clog.Logger
+}
+
+// NewSearchStorage creates new SearchStorage
+func NewSearchStorage(cnf Config, fs FileStorage, ts TagStorage, lg *clog.Logger) (*SearchStorage, error) {
+	var st internalStorage
+
+	switch cnf.MetadataStorageType {
+	case "sqlite":
+		st = newSqliteSearchStorage(cnf, lg)
+	case "json":
+		fallthrough
+	default:
+		st = newJsonSearchStorage(cnf, lg)
+	}
+
+	ss := &SearchStorage{
+		config:      cnf,
+		storage:     st,
+		fileStorage: fs,
+		tagStorage:  ts,
+		logger:      lg,
+	}
+
+	err := ss.storage.init()
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't init searches storage")
+	}
+
+	return ss, nil
+}
+
+// Get returns a search with passed id
+func (ss SearchStorage) Get(id int) (Search, error) {
+	s, ok := ss.storage.getSearch(id)
+	if !ok {
+		return Search{}, ErrSearchNotExist
+	}
+	return s, nil
+}
+
+// GetAll returns all searches
+func (ss SearchStorage) GetAll() Searches {
+	return ss.storage.getAll()
+}
+
+// Add checks and adds a new search. Search.ID is ignored
+func (ss SearchStorage) Add(s Search) (Search, error) {
+	if err := ss.check(s); err != nil {
+		return Search{}, err
+	}
+	return ss.storage.addSearch(s)
+}
+
+// Update checks and replaces a search with the same id
+func (ss SearchStorage) Update(s Search) (Search, error) {
+	if err := ss.check(s); err != nil {
+		return Search{}, err
+	}
+	return ss.storage.updateSearch(s)
+}
+
+// Delete deletes a search with passed id
+func (ss SearchStorage) Delete(id int) {
+	ss.storage.deleteSearch(id)
+}
+
+// FindFiles executes a search with passed id and returns found files
+func (ss SearchStorage) FindFiles(id int) ([]files.File, error) {
+	s, err := ss.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	cnf, err := s.FilesConfig(ss.tagStorage.GetAll())
+	if err != nil {
+		return nil, err
+	}
+
+	return ss.fileStorage.Get(cnf)
+}
+
+// check checks if a search can be executed
+func (ss SearchStorage) check(s Search) error {
+	if s.Name == "" {
+		return ErrEmptyName
+	}
+
+	if _, err := s.FilesConfig(ss.tagStorage.GetAll()); err != nil {
+		return err
+	}
+	if _, err := aggregation.ParseExpr(s.Expr, ss.tagStorage.GetAll()); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Shutdown gracefully shutdown SearchStorage
+func (ss SearchStorage) Shutdown() error {
+	return ss.storage.shutdown()
+}
+
+// FilesConfig returns a config for files.FileStorage.Get and files.FileStorage.GetPage.
+// Offset, Count and Filter can be set by a caller
+func (s Search) FilesConfig(allTags tags.Tags) (files.GetFilesConfig, error) {
+	cnf := files.GetFilesConfig{
+		Expr:          s.Expr,
+		Tags:          allTags,
+		Search:        s.Search,
+		IsRegexp:      s.IsRegexp,
+		ContentSearch: s.ContentSearch,
+		SortMode:      files.SortByNameAsc,
+	}
+
+	if s.IsRegexp {
+		if _, err := regexp.Compile(s.Search); err != nil {
+			return files.GetFilesConfig{}, ErrBadRegexp
+		}
+	}
+
+	if s.Sort != "" {
+		spec, err := files.ParseSortSpec(s.Sort)
+		if err != nil {
+			return files.GetFilesConfig{}, err
+		}
+		cnf.Sort = spec
+	}
+	cnf.Sort.Seed = s.Seed
+	cnf.Sort.Locale = s.Locale
+	if err := cnf.Sort.Check(); err != nil {
+		return files.GetFilesConfig{}, err
+	}
+
+	return cnf, nil
+}
@@ -0,0 +1,208 @@
+package searches
+
+import (
+	"os"
+	"sync"
+
+	clog "github.com/ShoshinNikita/log/v2"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+
+	"github.com/tags-drive/core/internal/utils"
+)
+
+var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+// maxJournalRecords is a number of journal records after which the journal is compacted
+const maxJournalRecords = 100
+
+// journalRecord describes a change of jsonSearchStorage.searches. It contains the final state of changed
+// searches, so a record can be applied several times
+type journalRecord struct {
+	Put    []Search `json:"put,omitempty"`
+	Delete []int    `json:"delete,omitempty"`
+}
+
+// jsonSearchStorage implements searches.internalStorage interface.
+//
+// Every change is written into the journal before it is applied. The journal is replayed
+// on start and compacted into config.SearchesJSONFile
+type jsonSearchStorage struct {
+	config Config
+
+	searches Searches
+	mutex    *sync.RWMutex
+
+	journal *utils.Journal
+
+	logger *clog.Logger
+}
+
+func newJsonSearchStorage(cnf Config, lg *clog.Logger) *jsonSearchStorage {
+	return &jsonSearchStorage{
+		config:   cnf,
+		searches: make(Searches),
+		mutex:    new(sync.RWMutex),
+		logger:   lg,
+	}
+}
+
+func (jss *jsonSearchStorage) init() error {
+	f, err := os.Open(jss.config.SearchesJSONFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return errors.Wrapf(err, "can't open file %s", jss.config.SearchesJSONFile)
+		}
+
+		// Have to create a new file
+		jss.logger.Debugf("file %s doesn't exist. Need to create a new file\n", jss.config.SearchesJSONFile)
+
+		err := utils.WriteFileAtomic(jss.config.SearchesJSONFile, jss.searches, jss.config.Encrypt, jss.config.PassPhrase)
+		if err != nil {
+			return errors.Wrap(err, "can't create a new file")
+		}
+	} else {
+		err = utils.Decode(f, &jss.searches, jss.config.Encrypt, jss.config.PassPhrase)
+		f.Close()
+		if err != nil {
+			return errors.Wrapf(err, "can't decode file %s", jss.config.SearchesJSONFile)
+		}
+	}
+
+	// Apply changes made after the last snapshot
+	jss.journal, err = utils.OpenJournal(jss.config.SearchesJSONFile+".journal", jss.config.Encrypt, jss.config.PassPhrase)
+	if err != nil {
+		return err
+	}
+
+	err = jss.journal.Replay(func(data []byte) error {
+		var rec journalRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return err
+		}
+		jss.apply(rec)
+
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "can't replay journal")
+	}
+
+	return nil
+}
+
+// compact writes jss.searches into jss.config.SearchesJSONFile and clears the journal. jss.mutex must be locked
+func (jss *jsonSearchStorage) compact() {
+	err := utils.WriteFileAtomic(jss.config.SearchesJSONFile, jss.searches, jss.config.Encrypt, jss.config.PassPhrase)
+	if err != nil {
+		jss.logger.Warnf("can't write '%s': %s\n", jss.config.SearchesJSONFile, err)
+		return
+	}
+
+	if err := jss.journal.Reset(); err != nil {
+		jss.logger.Errorf("can't reset journal: %s\n", err)
+	}
+}
+
+// commit writes a record into the journal and applies it. jss.mutex must be locked
+func (jss *jsonSearchStorage) commit(rec journalRecord) error {
+	if err := jss.journal.Append(rec); err != nil {
+		return errors.Wrap(err, "can't write a change into the journal")
+	}
+
+	jss.apply(rec)
+
+	if jss.journal.Len() >= maxJournalRecords {
+		jss.compact()
+	}
+
+	return nil
+}
+
+// apply applies a record to jss.searches
+func (jss *jsonSearchStorage) apply(rec journalRecord) {
+	for _, s := range rec.Put {
+		jss.searches[s.ID] = s
+	}
+	for _, id := range rec.Delete {
+		delete(jss.searches, id)
+	}
+}
+
+func (jss *jsonSearchStorage) getAll() Searches {
+	jss.mutex.RLock()
+	defer jss.mutex.RUnlock()
+
+	res := make(Searches, len(jss.searches))
+	for id, s := range jss.searches {
+		res[id] = s
+	}
+	return res
+}
+
+func (jss *jsonSearchStorage) getSearch(id int) (Search, bool) {
+	jss.mutex.RLock()
+	defer jss.mutex.RUnlock()
+
+	s, ok := jss.searches[id]
+	return s, ok
+}
+
+func (jss *jsonSearchStorage) addSearch(s Search) (Search, error) {
+	jss.mutex.Lock()
+	defer jss.mutex.Unlock()
+
+	// Get max ID (max)
+	nextID := 0
+	for id := range jss.searches {
+		if nextID < id {
+			nextID = id
+		}
+	}
+	nextID++
+	s.ID = nextID
+
+	if err := jss.commit(journalRecord{Put: []Search{s}}); err != nil {
+		return Search{}, err
+	}
+
+	return s, nil
+}
+
+func (jss *jsonSearchStorage) updateSearch(s Search) (Search, error) {
+	jss.mutex.Lock()
+	defer jss.mutex.Unlock()
+
+	if _, ok := jss.searches[s.ID]; !ok {
+		return Search{}, ErrSearchNotExist
+	}
+
+	if err := jss.commit(journalRecord{Put: []Search{s}}); err != nil {
+		return Search{}, err
+	}
+
+	return s, nil
+}
+
+func (jss *jsonSearchStorage) deleteSearch(id int) {
+	jss.mutex.Lock()
+	defer jss.mutex.Unlock()
+
+	if _, ok := jss.searches[id]; !ok {
+		return
+	}
+
+	if err := jss.commit(journalRecord{Delete: []int{id}}); err != nil {
+		jss.logger.Errorf("can't delete search with id %d: %s\n", id, err)
+	}
+}
+
+func (jss *jsonSearchStorage) shutdown() error {
+	jss.mutex.Lock()
+	defer jss.mutex.Unlock()
+
+	// Write changes
+	jss.compact()
+
+	return jss.journal.Close()
+}
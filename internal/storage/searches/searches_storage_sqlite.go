@@ -0,0 +1,205 @@
+package searches
+
+import (
+	"database/sql"
+	"os"
+
+	clog "github.com/ShoshinNikita/log/v2"
+	"github.com/pkg/errors"
+
+	"github.com/tags-drive/core/internal/utils"
+)
+
+const sqliteSearchesSchema = `
+	CREATE TABLE IF NOT EXISTS searches (
+		id       INTEGER PRIMARY KEY,
+		name     TEXT NOT NULL,
+		expr     TEXT NOT NULL DEFAULT '',
+		search   TEXT NOT NULL DEFAULT '',
+		regexp   BOOLEAN NOT NULL DEFAULT 0,
+		content  TEXT NOT NULL DEFAULT '',
+		sort     TEXT NOT NULL DEFAULT '',
+		seed     INTEGER NOT NULL DEFAULT 0,
+		locale   TEXT NOT NULL DEFAULT ''
+	);`
+
+const selectSearchesQuery = `SELECT id, name, expr, search, regexp, content, sort, seed, locale FROM searches`
+
+// sqliteSearchStorage implements searches.internalStorage interface
+type sqliteSearchStorage struct {
+	config Config
+
+	db *sql.DB
+
+	logger *clog.Logger
+}
+
+func newSqliteSearchStorage(cnf Config, lg *clog.Logger) *sqliteSearchStorage {
+	return &sqliteSearchStorage{
+		config: cnf,
+		logger: lg,
+	}
+}
+
+func (sss *sqliteSearchStorage) init() (err error) {
+	sss.db, err = utils.OpenSQLite(sss.config.SQLiteFile)
+	if err != nil {
+		return err
+	}
+
+	// The table is created in the same transaction in which searches are imported. So, if the import fails,
+	// nothing is committed and the import is repeated on the next start
+	tx, err := sss.db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "can't begin a transaction")
+	}
+	defer tx.Rollback()
+
+	var tableExists bool
+	err = tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'searches')`).Scan(&tableExists)
+	if err != nil {
+		return errors.Wrap(err, "can't check the table 'searches'")
+	}
+
+	if _, err := tx.Exec(sqliteSearchesSchema); err != nil {
+		return errors.Wrap(err, "can't create the table 'searches'")
+	}
+
+	imported := 0
+	if !tableExists {
+		// The table was just created. Import searches from the json storage to not lose them
+		// after switching from "json" to "sqlite"
+		if imported, err = sss.importFromJSON(tx); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "can't commit the schema")
+	}
+
+	if imported > 0 {
+		sss.logger.Infof("%d search(es) were imported from %s\n", imported, sss.config.SearchesJSONFile)
+	}
+
+	return nil
+}
+
+// importFromJSON copies searches from config.SearchesJSONFile into the database. IDs are preserved.
+// It returns a number of imported searches
+func (sss *sqliteSearchStorage) importFromJSON(tx *sql.Tx) (int, error) {
+	if _, err := os.Stat(sss.config.SearchesJSONFile); os.IsNotExist(err) {
+		return 0, nil
+	}
+
+	// Load searches with jsonSearchStorage to apply changes from its journal
+	jsonStorage := newJsonSearchStorage(sss.config, sss.logger)
+	if err := jsonStorage.init(); err != nil {
+		return 0, errors.Wrapf(err, "can't load searches from %s", sss.config.SearchesJSONFile)
+	}
+	defer jsonStorage.shutdown()
+
+	searches := jsonStorage.getAll()
+	for _, s := range searches {
+		_, err := tx.Exec(`
+			INSERT INTO searches (id, name, expr, search, regexp, content, sort, seed, locale)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			s.ID, s.Name, s.Expr, s.Search, s.IsRegexp, s.ContentSearch, s.Sort, s.Seed, s.Locale)
+		if err != nil {
+			return 0, errors.Wrap(err, "can't insert a search")
+		}
+	}
+
+	return len(searches), nil
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanSearch(row rowScanner) (Search, error) {
+	var s Search
+	err := row.Scan(&s.ID, &s.Name, &s.Expr, &s.Search, &s.IsRegexp, &s.ContentSearch, &s.Sort, &s.Seed, &s.Locale)
+	return s, err
+}
+
+func (sss *sqliteSearchStorage) getAll() Searches {
+	searches := make(Searches)
+
+	rows, err := sss.db.Query(selectSearchesQuery)
+	if err != nil {
+		sss.logger.Errorf("can't select searches: %s\n", err)
+		return searches
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		s, err := scanSearch(rows)
+		if err != nil {
+			sss.logger.Errorf("can't scan a search: %s\n", err)
+			return searches
+		}
+		searches[s.ID] = s
+	}
+
+	return searches
+}
+
+func (sss *sqliteSearchStorage) getSearch(id int) (Search, bool) {
+	s, err := scanSearch(sss.db.QueryRow(selectSearchesQuery+` WHERE id = ?`, id))
+	if err != nil {
+		if err != sql.ErrNoRows {
+			sss.logger.Errorf("can't select search with id %d: %s\n", id, err)
+		}
+		return Search{}, false
+	}
+
+	return s, true
+}
+
+func (sss *sqliteSearchStorage) addSearch(s Search) (Search, error) {
+	// The id is max(id) + 1 like in the json storage
+	res, err := sss.db.Exec(`
+		INSERT INTO searches (name, expr, search, regexp, content, sort, seed, locale)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		s.Name, s.Expr, s.Search, s.IsRegexp, s.ContentSearch, s.Sort, s.Seed, s.Locale)
+	if err != nil {
+		return Search{}, errors.Wrap(err, "can't add a search")
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return Search{}, errors.Wrap(err, "can't get id of a new search")
+	}
+	s.ID = int(id)
+
+	return s, nil
+}
+
+func (sss *sqliteSearchStorage) updateSearch(s Search) (Search, error) {
+	res, err := sss.db.Exec(`
+		UPDATE searches SET
+			name = ?, expr = ?, search = ?, regexp = ?, content = ?, sort = ?, seed = ?, locale = ?
+		WHERE id = ?`,
+		s.Name, s.Expr, s.Search, s.IsRegexp, s.ContentSearch, s.Sort, s.Seed, s.Locale, s.ID)
+	if err != nil {
+		return Search{}, errors.Wrapf(err, "can't update search with id %d", s.ID)
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return Search{}, ErrSearchNotExist
+	}
+
+	return s, nil
+}
+
+func (sss *sqliteSearchStorage) deleteSearch(id int) {
+	_, err := sss.db.Exec(`DELETE FROM searches WHERE id = ?`, id)
+	if err != nil {
+		sss.logger.Errorf("can't delete search with id %d: %s\n", id, err)
+	}
+}
+
+func (sss *sqliteSearchStorage) shutdown() error {
+	return sss.db.Close()
+}
@@ -0,0 +1,172 @@
+package searches
+
+import (
+	"os"
+	"testing"
+
+	clog "github.com/ShoshinNikita/log/v2"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tags-drive/core/internal/storage/files"
+	"github.com/tags-drive/core/internal/storage/files/aggregation"
+	"github.com/tags-drive/core/internal/storage/tags"
+)
+
+const (
+	testFile       = "./searches.json"
+	testSQLiteFile = "./searches.db"
+)
+
+// testStorages contains constructors of all internal storages. Every test is run for every storage
+var testStorages = []struct {
+	name       string
+	newStorage func(cnf Config) internalStorage
+}{
+	{"json", func(cnf Config) internalStorage { return newJsonSearchStorage(cnf, clog.NewProdLogger()) }},
+	{"sqlite", func(cnf Config) internalStorage { return newSqliteSearchStorage(cnf, clog.NewProdLogger()) }},
+}
+
+// runForAllStorages creates every internal storage, calls init() function and runs f. f can reopen
+// the storage to check if changes were saved. Storages are removed after the test
+func runForAllStorages(t *testing.T, f func(t *testing.T, storage internalStorage, reopen func() internalStorage)) {
+	cnf := Config{
+		Debug:            false,
+		SearchesJSONFile: testFile,
+		SQLiteFile:       testSQLiteFile,
+		Encrypt:          false,
+	}
+
+	for _, st := range testStorages {
+		t.Run(st.name, func(t *testing.T) {
+			cnf.MetadataStorageType = st.name
+
+			storage := st.newStorage(cnf)
+			if err := storage.init(); err != nil {
+				t.Fatalf("can't init storage: %s", err)
+			}
+			defer func() {
+				storage.shutdown()
+				for _, path := range []string{testFile, testFile + ".journal", testSQLiteFile, testSQLiteFile + "-wal", testSQLiteFile + "-shm"} {
+					os.Remove(path)
+				}
+			}()
+
+			reopen := func() internalStorage {
+				if err := storage.shutdown(); err != nil {
+					t.Fatalf("can't shutdown storage: %s", err)
+				}
+				storage = st.newStorage(cnf)
+				if err := storage.init(); err != nil {
+					t.Fatalf("can't init storage: %s", err)
+				}
+				return storage
+			}
+
+			f(t, storage, reopen)
+		})
+	}
+}
+
+func TestStorage(t *testing.T) {
+	runForAllStorages(t, func(t *testing.T, storage internalStorage, reopen func() internalStorage) {
+		assert := assert.New(t)
+
+		assert.Empty(storage.getAll())
+
+		first, err := storage.addSearch(Search{Name: "photos", Expr: "photo", Sort: "-time"})
+		assert.NoError(err)
+		assert.Equal(1, first.ID)
+
+		second, err := storage.addSearch(Search{Name: "notes", Search: "^note", IsRegexp: true, Seed: 5, Locale: "ru"})
+		assert.NoError(err)
+		assert.Equal(2, second.ID)
+
+		second.ContentSearch = "todo"
+		_, err = storage.updateSearch(second)
+		assert.NoError(err)
+
+		_, err = storage.updateSearch(Search{ID: 10, Name: "unknown"})
+		assert.Equal(ErrSearchNotExist, err)
+
+		storage = reopen()
+		assert.Equal(Searches{1: first, 2: second}, storage.getAll())
+
+		s, ok := storage.getSearch(2)
+		assert.True(ok)
+		assert.Equal(second, s)
+
+		storage.deleteSearch(1)
+		storage.deleteSearch(10)
+
+		storage = reopen()
+		assert.Equal(Searches{2: second}, storage.getAll())
+		_, ok = storage.getSearch(1)
+		assert.False(ok)
+	})
+}
+
+type fileStorageMock struct {
+	cnf files.GetFilesConfig
+}
+
+func (fs *fileStorageMock) Get(cnf files.GetFilesConfig) ([]files.File, error) {
+	fs.cnf = cnf
+	return []files.File{{ID: 1}}, nil
+}
+
+type tagStorageMock tags.Tags
+
+func (ts tagStorageMock) GetAll() tags.Tags {
+	return tags.Tags(ts)
+}
+
+func TestSearchStorage(t *testing.T) {
+	assert := assert.New(t)
+
+	defer func() {
+		os.Remove(testFile)
+		os.Remove(testFile + ".journal")
+	}()
+
+	fs := &fileStorageMock{}
+	ts := tagStorageMock{1: {ID: 1, Name: "photo"}}
+	ss, err := NewSearchStorage(Config{SearchesJSONFile: testFile}, fs, ts, clog.NewProdLogger())
+	if !assert.NoError(err) {
+		return
+	}
+	defer ss.Shutdown()
+
+	// Check invalid searches
+	for _, tt := range []struct {
+		search Search
+		err    error
+	}{
+		{Search{Expr: "photo"}, ErrEmptyName},
+		{Search{Name: "a", Expr: "photo &"}, aggregation.ErrBadSyntax},
+		{Search{Name: "a", Expr: "video"}, aggregation.ErrUnknownTag},
+		{Search{Name: "a", Search: "(", IsRegexp: true}, ErrBadRegexp},
+		{Search{Name: "a", Sort: "name,owner"}, files.ErrBadSortSpec},
+		{Search{Name: "a", Locale: "?"}, files.ErrBadSortSpec},
+	} {
+		_, err := ss.Add(tt.search)
+		assert.Equal(tt.err, errors.Cause(err), "%+v", tt.search)
+	}
+	assert.Empty(ss.GetAll())
+
+	search, err := ss.Add(Search{Name: "photos", Expr: "photo", Sort: "type,-time", Locale: "ru"})
+	assert.NoError(err)
+
+	_, err = ss.Update(Search{ID: 2, Name: "videos"})
+	assert.Equal(ErrSearchNotExist, err)
+
+	found, err := ss.FindFiles(search.ID)
+	assert.NoError(err)
+	assert.Equal([]files.File{{ID: 1}}, found)
+	assert.Equal("photo", fs.cnf.Expr)
+	assert.Equal("type,-time;locale=ru", fs.cnf.Sort.String())
+
+	ss.Delete(search.ID)
+	_, err = ss.FindFiles(search.ID)
+	assert.Equal(ErrSearchNotExist, err)
+}
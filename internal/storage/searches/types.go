@@ -0,0 +1,46 @@
+package searches
+
+import (
+	"github.com/tags-drive/core/internal/storage/files"
+	"github.com/tags-drive/core/internal/storage/tags"
+)
+
+type Config struct {
+	Debug bool
+
+	MetadataStorageType string
+	SearchesJSONFile    string
+	// SQLiteFile is a path to the database used when MetadataStorageType is "sqlite"
+	SQLiteFile string
+
+	Encrypt    bool
+	PassPhrase [32]byte
+}
+
+type FileStorage interface {
+	Get(cnf files.GetFilesConfig) ([]files.File, error)
+}
+
+type TagStorage interface {
+	GetAll() tags.Tags
+}
+
+// Searches is a map of Search
+type Searches map[int]Search
+
+// Search is a saved search. It contains params of GET /api/files
+type Search struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+
+	// Expr is a logical expression (see aggregation.ParseExpr)
+	Expr          string `json:"expr"`
+	Search        string `json:"search"`
+	IsRegexp      bool   `json:"regexp"`
+	ContentSearch string `json:"content"`
+
+	// Sort is a sort specification (see files.ParseSortSpec). Files are sorted by name if it is empty
+	Sort   string `json:"sort"`
+	Seed   int64  `json:"seed"`
+	Locale string `json:"locale"`
+}
@@ -1,6 +1,9 @@
 package share
 
 import (
+	"sync"
+	"time"
+
 	clog "github.com/ShoshinNikita/log/v2"
 	"github.com/pkg/errors"
 
@@ -12,15 +15,99 @@ var (
 	ErrInvalidToken = errors.New("invalid share token")
 )
 
+// searchCacheTTL is a time during which files found by a saved search are reused. A page opened
+// with a token requests many files, so the search isn't executed for every one of them
+const searchCacheTTL = 5 * time.Second
+
+// ShareService manages share tokens. A token shares either a fixed list of files or a saved search.
+// Files of a saved search are found again after searchCacheTTL, so a token of a search shares the current
+// result. Files in the Trash are never shared by a search
 type ShareService struct {
-	storage internalStorage
+	storage     internalStorage
+	searches    SearchStorage
+	searchCache *searchCache
+
+	logger *clog.Logger
+}
+
+// searchCache keeps files found by saved searches
+type searchCache struct {
+	ttl     time.Duration
+	mutex   *sync.Mutex
+	results map[int]searchResult
+}
+
+type searchResult struct {
+	files []filesPck.File
+	ids   filesIDs
+	found time.Time
+}
+
+func newSearchCache(ttl time.Duration) *searchCache {
+	return &searchCache{
+		ttl:     ttl,
+		mutex:   new(sync.Mutex),
+		results: make(map[int]searchResult),
+	}
+}
+
+func (c *searchCache) get(searchID int) (searchResult, bool) {
+	if c == nil {
+		return searchResult{}, false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	res, ok := c.results[searchID]
+	if !ok || time.Since(res.found) >= c.ttl {
+		delete(c.results, searchID)
+		return searchResult{}, false
+	}
+	return res, true
+}
+
+func (c *searchCache) put(searchID int, res searchResult) {
+	if c == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	res.found = time.Now()
+	c.results[searchID] = res
 }
 
-func NewShareStorage(cnf Config, fs FileStorage, lg *clog.Logger) (*ShareService, error) {
-	storage := &ShareService{}
+func (c *searchCache) delete(searchID int) {
+	if c == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.results, searchID)
+}
+
+func NewShareStorage(cnf Config, fs FileStorage, ss SearchStorage, lg *clog.Logger) (*ShareService, error) {
+	storage := &ShareService{
+		searches:    ss,
+		searchCache: newSearchCache(searchCacheTTL),
+		logger:      lg,
+	}
 
 	// Init an internal storage
-	st := newJsonShareStorage(cnf, fs, lg)
+	var st internalStorage
+
+	switch cnf.MetadataStorageType {
+	case "sqlite":
+		st = newSqliteShareStorage(cnf, fs, lg)
+	case "json":
+		fallthrough
+	default:
+		st = newJsonShareStorage(cnf, fs, lg)
+	}
 
 	err := st.init()
 	if err != nil {
@@ -32,27 +119,70 @@ func NewShareStorage(cnf Config, fs FileStorage, lg *clog.Logger) (*ShareService
 	return storage, nil
 }
 
+// GetAllTokens returns all tokens with ids of shared files. Files of saved searches are found right now
 func (st ShareService) GetAllTokens() map[string][]int {
-	return st.storage.getAllTokens()
+	tokens := st.storage.getAllTokens()
+	for token, searchID := range st.storage.getSearchTokens() {
+		res, err := st.findSearchFiles(searchID)
+		if err != nil {
+			st.logger.Errorf("can't find files of search with id %d: %s\n", searchID, err)
+			tokens[token] = []int{}
+			continue
+		}
+		tokens[token] = res.ids
+	}
+
+	return tokens
 }
 
 func (st ShareService) CreateToken(ids []int) (token string) {
 	return st.storage.createToken(ids)
 }
 
+// CreateSearchToken creates a token which shares files found by a saved search
+func (st ShareService) CreateSearchToken(searchID int) (token string) {
+	return st.storage.createSearchToken(searchID)
+}
+
 func (st ShareService) DeleteToken(token string) {
 	st.storage.deleteToken(token)
 }
 
+// DeleteSearch deletes all tokens of a saved search
+func (st ShareService) DeleteSearch(searchID int) {
+	st.storage.deleteSearch(searchID)
+	st.searchCache.delete(searchID)
+}
+
 func (st ShareService) GetFilesIDs(token string) ([]int, error) {
+	res, ok, err := st.searchFiles(token)
+	if ok {
+		if err != nil {
+			return nil, err
+		}
+		return res.ids, nil
+	}
+
 	return st.storage.getFilesIDs(token)
 }
 
 func (st ShareService) CheckToken(token string) bool {
+	if _, ok := st.storage.getSearchID(token); ok {
+		return true
+	}
 	return st.storage.checkToken(token)
 }
 
 func (st ShareService) CheckFile(token string, id int) bool {
+	res, ok, err := st.searchFiles(token)
+	if ok {
+		if err != nil {
+			st.logger.Errorf("can't find files shared by a search token: %s\n", err)
+			return false
+		}
+		return res.ids.hasID(id)
+	}
+
 	return st.storage.checkFile(token, id)
 }
 
@@ -61,13 +191,64 @@ func (st ShareService) DeleteFile(id int) {
 }
 
 func (st ShareService) FilterFiles(token string, files []filesPck.File) ([]filesPck.File, error) {
+	res, ok, err := st.searchFiles(token)
+	if ok {
+		if err != nil {
+			return nil, err
+		}
+		return filterFilesByIDs(files, res.ids), nil
+	}
+
 	return st.storage.filterFiles(token, files)
 }
 
 func (st ShareService) FilterTags(token string, tags tagsPck.Tags) (tagsPck.Tags, error) {
+	res, ok, err := st.searchFiles(token)
+	if ok {
+		if err != nil {
+			return tags, err
+		}
+		return filterTagsByFiles(tags, res.files), nil
+	}
+
 	return st.storage.filterTags(token, tags)
 }
 
+// searchFiles finds files of a saved search if the token shares a search. ok is false for
+// other tokens
+func (st ShareService) searchFiles(token string) (res searchResult, ok bool, err error) {
+	searchID, ok := st.storage.getSearchID(token)
+	if !ok {
+		return searchResult{}, false, nil
+	}
+
+	res, err = st.findSearchFiles(searchID)
+	return res, true, err
+}
+
+// findSearchFiles executes a saved search or returns a cached result. Files in the Trash are skipped
+func (st ShareService) findSearchFiles(searchID int) (searchResult, error) {
+	if res, ok := st.searchCache.get(searchID); ok {
+		return res, nil
+	}
+
+	found, err := st.searches.FindFiles(searchID)
+	if err != nil {
+		return searchResult{}, errors.Wrapf(err, "can't find files of search with id %d", searchID)
+	}
+
+	files := make([]filesPck.File, 0, len(found))
+	for _, f := range found {
+		if !f.Deleted {
+			files = append(files, f)
+		}
+	}
+
+	res := searchResult{files: files, ids: idsOfFiles(files)}
+	st.searchCache.put(searchID, res)
+	return res, nil
+}
+
 func (st ShareService) Shutdown() error {
 	return st.storage.shutdown()
 }
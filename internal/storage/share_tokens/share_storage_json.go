@@ -6,6 +6,7 @@ import (
 	"sync"
 
 	"github.com/ShoshinNikita/log/v2"
+	jsoniter "github.com/json-iterator/go"
 	"github.com/pkg/errors"
 
 	filesPck "github.com/tags-drive/core/internal/storage/files"
@@ -40,11 +41,77 @@ func (ids *filesIDs) deleteID(id int) {
 	}
 }
 
+// idsOfFiles returns sorted ids of passed files
+func idsOfFiles(files []filesPck.File) filesIDs {
+	ids := make([]int, len(files))
+	for i := range files {
+		ids[i] = files[i].ID
+	}
+	sort.Ints(ids)
+
+	return filesIDs(ids)
+}
+
+// filterFilesByIDs returns files with ids from the passed list
+func filterFilesByIDs(files []filesPck.File, ids filesIDs) []filesPck.File {
+	res := make([]filesPck.File, 0, len(files))
+	for _, f := range files {
+		if ids.hasID(f.ID) {
+			res = append(res, f)
+		}
+	}
+
+	return res
+}
+
+// filterTagsByFiles returns tags that are used by at least one of the passed files
+func filterTagsByFiles(tags tagsPck.Tags, files []filesPck.File) tagsPck.Tags {
+	result := make(tagsPck.Tags)
+
+	for id := range tags {
+	searchLoop:
+		for i := range files {
+			for j := range files[i].Tags {
+				if files[i].Tags[j] == id {
+					result[id] = tags[id]
+					break searchLoop
+				}
+			}
+		}
+	}
+
+	return result
+}
+
+var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+// maxJournalRecords is a number of journal records after which the journal is compacted
+const maxJournalRecords = 100
+
+// journalRecord describes a change of jsonShareStorage.tokens. It contains the final state of changed tokens,
+// so a record can be applied several times
+type journalRecord struct {
+	Put    map[string]filesIDs `json:"put,omitempty"`
+	Delete []string            `json:"delete,omitempty"`
+
+	// PutSearches and DeleteSearches change jsonShareStorage.searchTokens
+	PutSearches    map[string]int `json:"putSearches,omitempty"`
+	DeleteSearches []string       `json:"deleteSearches,omitempty"`
+}
+
+// jsonShareStorage implements share.internalStorage interface.
+//
+// Every change is written into the journal before it is applied. The journal is replayed
+// on start and compacted into config.ShareTokenJSONFile and config.SearchTokensJSONFile
 type jsonShareStorage struct {
 	config Config
 
 	tokens map[string]filesIDs
-	mu     sync.RWMutex
+	// searchTokens contains ids of shared saved searches
+	searchTokens map[string]int
+	mu           sync.RWMutex
+
+	journal *utils.Journal
 
 	fileStorage FileStorage
 	logger      *clog.Logger
@@ -52,51 +119,137 @@ type jsonShareStorage struct {
 
 func newJsonShareStorage(cnf Config, fileStorage FileStorage, lg *clog.Logger) *jsonShareStorage {
 	return &jsonShareStorage{
-		config:      cnf,
-		tokens:      make(map[string]filesIDs),
-		fileStorage: fileStorage,
-		logger:      lg,
+		config:       cnf,
+		tokens:       make(map[string]filesIDs),
+		searchTokens: make(map[string]int),
+		fileStorage:  fileStorage,
+		logger:       lg,
 	}
 }
 
 func (jss *jsonShareStorage) init() error {
-	if f, err := os.Open(jss.config.ShareTokenJSONFile); err == nil {
+	f, err := os.Open(jss.config.ShareTokenJSONFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return errors.Wrapf(err, "can't open file %s", jss.config.ShareTokenJSONFile)
+		}
+
+		// Have to create a new file
+		jss.logger.Debugf("file %s doesn't exist. Need to create a new file\n", jss.config.ShareTokenJSONFile)
+
+		// Write empty tokens map
+		err := utils.WriteFileAtomic(jss.config.ShareTokenJSONFile, jss.tokens, jss.config.Encrypt, jss.config.PassPhrase)
+		if err != nil {
+			return errors.Wrap(err, "can't create a new file")
+		}
+	} else {
 		err = utils.Decode(f, &jss.tokens, jss.config.Encrypt, jss.config.PassPhrase)
 		f.Close()
-		return err
+		if err != nil {
+			return errors.Wrapf(err, "can't decode file %s", jss.config.ShareTokenJSONFile)
+		}
 	}
 
-	// Have to create a new file
-	jss.logger.Debugf("file %s doesn't exist. Need to create a new file\n", jss.config.ShareTokenJSONFile)
+	if err := jss.readSearchTokens(); err != nil {
+		return err
+	}
 
-	// Just create a new file
-	f, err := os.OpenFile(jss.config.ShareTokenJSONFile, os.O_CREATE|os.O_RDWR, 0666)
+	// Apply changes made after the last snapshot
+	jss.journal, err = utils.OpenJournal(jss.config.ShareTokenJSONFile+".journal", jss.config.Encrypt, jss.config.PassPhrase)
 	if err != nil {
-		return errors.Wrap(err, "can't create a new file")
+		return err
 	}
-	f.Close()
 
-	// Write empty tag map
-	jss.write()
+	err = jss.journal.Replay(func(data []byte) error {
+		var rec journalRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return err
+		}
+		jss.apply(rec)
 
-	return nil
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "can't replay journal")
+	}
 
+	return nil
 }
 
-func (jss *jsonShareStorage) write() {
-	jss.mu.RLock()
-	defer jss.mu.RUnlock()
+// readSearchTokens reads config.SearchTokensJSONFile. The file is optional: it doesn't exist
+// if no search was shared
+func (jss *jsonShareStorage) readSearchTokens() error {
+	if jss.config.SearchTokensJSONFile == "" {
+		return nil
+	}
 
-	f, err := os.OpenFile(jss.config.ShareTokenJSONFile, os.O_TRUNC|os.O_RDWR, 0666)
+	f, err := os.Open(jss.config.SearchTokensJSONFile)
 	if err != nil {
-		jss.logger.Errorf("can't open file %s: %s\n", jss.config.ShareTokenJSONFile, err)
-		return
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "can't open file %s", jss.config.SearchTokensJSONFile)
 	}
 	defer f.Close()
 
-	err = utils.Encode(f, jss.tokens, jss.config.Encrypt, jss.config.PassPhrase)
+	err = utils.Decode(f, &jss.searchTokens, jss.config.Encrypt, jss.config.PassPhrase)
 	if err != nil {
-		jss.logger.Warnf("can't write '%s': %s", jss.config.ShareTokenJSONFile, err)
+		return errors.Wrapf(err, "can't decode file %s", jss.config.SearchTokensJSONFile)
+	}
+
+	return nil
+}
+
+// compact writes jss.tokens into jss.config.ShareTokenJSONFile, jss.searchTokens into
+// jss.config.SearchTokensJSONFile and clears the journal. jss.mu must be locked
+func (jss *jsonShareStorage) compact() {
+	err := utils.WriteFileAtomic(jss.config.ShareTokenJSONFile, jss.tokens, jss.config.Encrypt, jss.config.PassPhrase)
+	if err != nil {
+		jss.logger.Warnf("can't write '%s': %s\n", jss.config.ShareTokenJSONFile, err)
+		return
+	}
+
+	if jss.config.SearchTokensJSONFile != "" {
+		err := utils.WriteFileAtomic(jss.config.SearchTokensJSONFile, jss.searchTokens, jss.config.Encrypt, jss.config.PassPhrase)
+		if err != nil {
+			jss.logger.Warnf("can't write '%s': %s\n", jss.config.SearchTokensJSONFile, err)
+			return
+		}
+	}
+
+	if err := jss.journal.Reset(); err != nil {
+		jss.logger.Errorf("can't reset journal: %s\n", err)
+	}
+}
+
+// commit writes a record into the journal and applies it. jss.mu must be locked
+func (jss *jsonShareStorage) commit(rec journalRecord) error {
+	if err := jss.journal.Append(rec); err != nil {
+		return errors.Wrap(err, "can't write a change into the journal")
+	}
+
+	jss.apply(rec)
+
+	if jss.journal.Len() >= maxJournalRecords {
+		jss.compact()
+	}
+
+	return nil
+}
+
+// apply applies a record to jss.tokens
+func (jss *jsonShareStorage) apply(rec journalRecord) {
+	for token, ids := range rec.Put {
+		jss.tokens[token] = ids
+	}
+	for _, token := range rec.Delete {
+		delete(jss.tokens, token)
+	}
+	for token, id := range rec.PutSearches {
+		jss.searchTokens[token] = id
+	}
+	for _, token := range rec.DeleteSearches {
+		delete(jss.searchTokens, token)
 	}
 }
 
@@ -115,25 +268,36 @@ func (jss *jsonShareStorage) getAllTokens() map[string][]int {
 
 func (jss *jsonShareStorage) createToken(ids []int) (token string) {
 	jss.mu.Lock()
-	defer func() {
-		jss.mu.Unlock()
-		jss.write()
-	}()
+	defer jss.mu.Unlock()
 
 	token = utils.GenerateRandomString(maxTokenSize)
-	jss.tokens[token] = newFileIDs(ids)
+
+	err := jss.commit(journalRecord{Put: map[string]filesIDs{token: newFileIDs(ids)}})
+	if err != nil {
+		jss.logger.Errorf("can't create a share token: %s\n", err)
+	}
 
 	return token
 }
 
 func (jss *jsonShareStorage) deleteToken(token string) {
 	jss.mu.Lock()
-	defer func() {
-		jss.mu.Unlock()
-		jss.write()
-	}()
+	defer jss.mu.Unlock()
+
+	var rec journalRecord
+	if _, ok := jss.tokens[token]; ok {
+		rec.Delete = []string{token}
+	}
+	if _, ok := jss.searchTokens[token]; ok {
+		rec.DeleteSearches = []string{token}
+	}
+	if rec.Delete == nil && rec.DeleteSearches == nil {
+		return
+	}
 
-	delete(jss.tokens, token)
+	if err := jss.commit(rec); err != nil {
+		jss.logger.Errorf("can't delete a share token: %s\n", err)
+	}
 }
 
 func (jss *jsonShareStorage) getFilesIDs(token string) ([]int, error) {
@@ -169,14 +333,80 @@ func (jss *jsonShareStorage) checkFile(token string, id int) bool {
 
 func (jss *jsonShareStorage) deleteFile(id int) {
 	jss.mu.Lock()
-	defer func() {
-		jss.mu.Unlock()
-		jss.write()
-	}()
+	defer jss.mu.Unlock()
 
+	rec := journalRecord{Put: make(map[string]filesIDs)}
 	for token, ids := range jss.tokens {
-		ids.deleteID(id)
-		jss.tokens[token] = ids
+		if !ids.hasID(id) {
+			continue
+		}
+
+		// Copy ids to not change jss.tokens before the commit
+		newIDs := append(ids[:0:0], ids...)
+		newIDs.deleteID(id)
+		rec.Put[token] = newIDs
+	}
+
+	if len(rec.Put) == 0 {
+		return
+	}
+
+	if err := jss.commit(rec); err != nil {
+		jss.logger.Errorf("can't delete refs to file with id %d: %s\n", id, err)
+	}
+}
+
+func (jss *jsonShareStorage) getSearchTokens() map[string]int {
+	jss.mu.RLock()
+	defer jss.mu.RUnlock()
+
+	res := make(map[string]int, len(jss.searchTokens))
+	for token, id := range jss.searchTokens {
+		res[token] = id
+	}
+
+	return res
+}
+
+func (jss *jsonShareStorage) getSearchID(token string) (int, bool) {
+	jss.mu.RLock()
+	defer jss.mu.RUnlock()
+
+	id, ok := jss.searchTokens[token]
+	return id, ok
+}
+
+func (jss *jsonShareStorage) createSearchToken(searchID int) (token string) {
+	jss.mu.Lock()
+	defer jss.mu.Unlock()
+
+	token = utils.GenerateRandomString(maxTokenSize)
+
+	err := jss.commit(journalRecord{PutSearches: map[string]int{token: searchID}})
+	if err != nil {
+		jss.logger.Errorf("can't create a share token: %s\n", err)
+	}
+
+	return token
+}
+
+func (jss *jsonShareStorage) deleteSearch(searchID int) {
+	jss.mu.Lock()
+	defer jss.mu.Unlock()
+
+	var rec journalRecord
+	for token, id := range jss.searchTokens {
+		if id == searchID {
+			rec.DeleteSearches = append(rec.DeleteSearches, token)
+		}
+	}
+
+	if len(rec.DeleteSearches) == 0 {
+		return
+	}
+
+	if err := jss.commit(rec); err != nil {
+		jss.logger.Errorf("can't delete tokens of search with id %d: %s\n", searchID, err)
 	}
 }
 
@@ -192,14 +422,7 @@ func (jss *jsonShareStorage) filterFiles(token string, files []filesPck.File) ([
 
 	jss.mu.RUnlock()
 
-	res := make([]filesPck.File, 0, len(files))
-	for _, f := range files {
-		if ids.hasID(f.ID) {
-			res = append(res, f)
-		}
-	}
-
-	return res, nil
+	return filterFilesByIDs(files, ids), nil
 }
 
 func (jss *jsonShareStorage) filterTags(token string, tags tagsPck.Tags) (tagsPck.Tags, error) {
@@ -210,30 +433,15 @@ func (jss *jsonShareStorage) filterTags(token string, tags tagsPck.Tags) (tagsPc
 
 	// We don't need to use mutex
 
-	result := make(tagsPck.Tags)
-
-	files := jss.fileStorage.GetFiles(ids...)
-
-	for id := range tags {
-	searchLoop:
-		for i := range files {
-			for j := range files[i].Tags {
-				if files[i].Tags[j] == id {
-					result[id] = tags[id]
-					break searchLoop
-				}
-			}
-		}
-	}
-
-	return result, nil
+	return filterTagsByFiles(tags, jss.fileStorage.GetFiles(ids...)), nil
 }
 
 func (jss *jsonShareStorage) shutdown() error {
 	jss.mu.Lock()
-	jss.mu.Unlock()
+	defer jss.mu.Unlock()
 
-	jss.write()
+	// Write changes
+	jss.compact()
 
-	return nil
+	return jss.journal.Close()
 }
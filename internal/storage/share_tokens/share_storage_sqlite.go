@@ -0,0 +1,343 @@
+package share
+
+import (
+	"database/sql"
+	"os"
+
+	clog "github.com/ShoshinNikita/log/v2"
+	"github.com/pkg/errors"
+
+	filesPck "github.com/tags-drive/core/internal/storage/files"
+	tagsPck "github.com/tags-drive/core/internal/storage/tags"
+	"github.com/tags-drive/core/internal/utils"
+)
+
+const sqliteShareSchema = `
+	CREATE TABLE IF NOT EXISTS share_tokens (
+		token  TEXT PRIMARY KEY
+	);
+
+	CREATE TABLE IF NOT EXISTS share_token_files (
+		token    TEXT NOT NULL REFERENCES share_tokens(token) ON DELETE CASCADE,
+		file_id  INTEGER NOT NULL,
+
+		PRIMARY KEY (token, file_id)
+	);
+
+	CREATE INDEX IF NOT EXISTS share_token_files_file_id ON share_token_files(file_id);
+
+	CREATE TABLE IF NOT EXISTS share_search_tokens (
+		token      TEXT PRIMARY KEY,
+		search_id  INTEGER NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS share_search_tokens_search_id ON share_search_tokens(search_id);`
+
+// sqliteShareStorage implements share.internalStorage interface
+type sqliteShareStorage struct {
+	config Config
+
+	db *sql.DB
+
+	fileStorage FileStorage
+	logger      *clog.Logger
+}
+
+func newSqliteShareStorage(cnf Config, fileStorage FileStorage, lg *clog.Logger) *sqliteShareStorage {
+	return &sqliteShareStorage{
+		config:      cnf,
+		fileStorage: fileStorage,
+		logger:      lg,
+	}
+}
+
+func (sss *sqliteShareStorage) init() (err error) {
+	sss.db, err = utils.OpenSQLite(sss.config.SQLiteFile)
+	if err != nil {
+		return err
+	}
+
+	// Tables are created in the same transaction in which tokens are imported. So, if the import fails,
+	// nothing is committed and the import is repeated on the next start
+	tx, err := sss.db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "can't begin a transaction")
+	}
+	defer tx.Rollback()
+
+	var tableExists bool
+	err = tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'share_tokens')`).Scan(&tableExists)
+	if err != nil {
+		return errors.Wrap(err, "can't check the table 'share_tokens'")
+	}
+
+	if _, err := tx.Exec(sqliteShareSchema); err != nil {
+		return errors.Wrap(err, "can't create share tables")
+	}
+
+	imported := 0
+	if !tableExists {
+		// The tables were just created. Import tokens from the json storage to not lose them
+		// after switching from "json" to "sqlite"
+		if imported, err = sss.importFromJSON(tx); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "can't commit the schema")
+	}
+
+	if imported > 0 {
+		sss.logger.Infof("%d share token(s) were imported from %s\n", imported, sss.config.ShareTokenJSONFile)
+	}
+
+	return nil
+}
+
+// importFromJSON copies tokens from config.ShareTokenJSONFile into the database. It returns a number of imported tokens
+func (sss *sqliteShareStorage) importFromJSON(tx *sql.Tx) (int, error) {
+	if _, err := os.Stat(sss.config.ShareTokenJSONFile); os.IsNotExist(err) {
+		return 0, nil
+	}
+
+	// Load tokens with jsonShareStorage to apply changes from its journal
+	jsonStorage := newJsonShareStorage(sss.config, sss.fileStorage, sss.logger)
+	if err := jsonStorage.init(); err != nil {
+		return 0, errors.Wrapf(err, "can't load tokens from %s", sss.config.ShareTokenJSONFile)
+	}
+	defer jsonStorage.shutdown()
+
+	tokens := jsonStorage.getAllTokens()
+	for token, ids := range tokens {
+		if err := insertToken(tx, token, ids); err != nil {
+			return 0, err
+		}
+	}
+
+	searchTokens := jsonStorage.getSearchTokens()
+	for token, id := range searchTokens {
+		_, err := tx.Exec(`INSERT INTO share_search_tokens (token, search_id) VALUES (?, ?)`, token, id)
+		if err != nil {
+			return 0, errors.Wrap(err, "can't insert a search token")
+		}
+	}
+
+	return len(tokens) + len(searchTokens), nil
+}
+
+// insertToken inserts a token and refs to shared files
+func insertToken(tx *sql.Tx, token string, ids []int) error {
+	if _, err := tx.Exec(`INSERT INTO share_tokens (token) VALUES (?)`, token); err != nil {
+		return errors.Wrap(err, "can't insert a token")
+	}
+
+	for _, id := range ids {
+		_, err := tx.Exec(`INSERT OR IGNORE INTO share_token_files (token, file_id) VALUES (?, ?)`, token, id)
+		if err != nil {
+			return errors.Wrap(err, "can't insert a shared file")
+		}
+	}
+
+	return nil
+}
+
+func (sss *sqliteShareStorage) getAllTokens() map[string][]int {
+	res := make(map[string][]int)
+
+	rows, err := sss.db.Query(`
+		SELECT share_tokens.token, share_token_files.file_id
+		FROM share_tokens LEFT JOIN share_token_files ON share_tokens.token = share_token_files.token
+		ORDER BY share_token_files.file_id`)
+	if err != nil {
+		sss.logger.Errorf("can't select share tokens: %s\n", err)
+		return res
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			token string
+			id    sql.NullInt64
+		)
+		if err := rows.Scan(&token, &id); err != nil {
+			sss.logger.Errorf("can't scan a share token: %s\n", err)
+			return res
+		}
+
+		if _, ok := res[token]; !ok {
+			res[token] = []int{}
+		}
+		if id.Valid {
+			res[token] = append(res[token], int(id.Int64))
+		}
+	}
+
+	return res
+}
+
+func (sss *sqliteShareStorage) createToken(ids []int) (token string) {
+	token = utils.GenerateRandomString(maxTokenSize)
+
+	tx, err := sss.db.Begin()
+	if err != nil {
+		sss.logger.Errorf("can't begin a transaction: %s\n", err)
+		return token
+	}
+	defer tx.Rollback()
+
+	if err := insertToken(tx, token, ids); err != nil {
+		sss.logger.Errorf("can't create a share token: %s\n", err)
+		return token
+	}
+
+	if err := tx.Commit(); err != nil {
+		sss.logger.Errorf("can't commit a new share token: %s\n", err)
+	}
+
+	return token
+}
+
+func (sss *sqliteShareStorage) deleteToken(token string) {
+	_, err := sss.db.Exec(`DELETE FROM share_tokens WHERE token = ?`, token)
+	if err != nil {
+		sss.logger.Errorf("can't delete a share token: %s\n", err)
+	}
+
+	_, err = sss.db.Exec(`DELETE FROM share_search_tokens WHERE token = ?`, token)
+	if err != nil {
+		sss.logger.Errorf("can't delete a search token: %s\n", err)
+	}
+}
+
+func (sss *sqliteShareStorage) getFilesIDs(token string) ([]int, error) {
+	if !sss.checkToken(token) {
+		return nil, ErrInvalidToken
+	}
+
+	rows, err := sss.db.Query(`SELECT file_id FROM share_token_files WHERE token = ? ORDER BY file_id`, token)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't select shared files")
+	}
+	defer rows.Close()
+
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, errors.Wrap(err, "can't scan a shared file id")
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+func (sss *sqliteShareStorage) checkToken(token string) bool {
+	var exists bool
+	err := sss.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM share_tokens WHERE token = ?)`, token).Scan(&exists)
+	if err != nil {
+		sss.logger.Errorf("can't check a share token: %s\n", err)
+		return false
+	}
+
+	return exists
+}
+
+func (sss *sqliteShareStorage) checkFile(token string, id int) bool {
+	var exists bool
+	err := sss.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM share_token_files WHERE token = ? AND file_id = ?)`, token, id).
+		Scan(&exists)
+	if err != nil {
+		sss.logger.Errorf("can't check a shared file: %s\n", err)
+		return false
+	}
+
+	return exists
+}
+
+func (sss *sqliteShareStorage) deleteFile(id int) {
+	_, err := sss.db.Exec(`DELETE FROM share_token_files WHERE file_id = ?`, id)
+	if err != nil {
+		sss.logger.Errorf("can't delete refs to file with id %d: %s\n", id, err)
+	}
+}
+
+func (sss *sqliteShareStorage) getSearchTokens() map[string]int {
+	res := make(map[string]int)
+
+	rows, err := sss.db.Query(`SELECT token, search_id FROM share_search_tokens`)
+	if err != nil {
+		sss.logger.Errorf("can't select search tokens: %s\n", err)
+		return res
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			token string
+			id    int
+		)
+		if err := rows.Scan(&token, &id); err != nil {
+			sss.logger.Errorf("can't scan a search token: %s\n", err)
+			return res
+		}
+		res[token] = id
+	}
+
+	return res
+}
+
+func (sss *sqliteShareStorage) getSearchID(token string) (int, bool) {
+	var id int
+	err := sss.db.QueryRow(`SELECT search_id FROM share_search_tokens WHERE token = ?`, token).Scan(&id)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			sss.logger.Errorf("can't check a search token: %s\n", err)
+		}
+		return 0, false
+	}
+
+	return id, true
+}
+
+func (sss *sqliteShareStorage) createSearchToken(searchID int) (token string) {
+	token = utils.GenerateRandomString(maxTokenSize)
+
+	_, err := sss.db.Exec(`INSERT INTO share_search_tokens (token, search_id) VALUES (?, ?)`, token, searchID)
+	if err != nil {
+		sss.logger.Errorf("can't create a search token: %s\n", err)
+	}
+
+	return token
+}
+
+func (sss *sqliteShareStorage) deleteSearch(searchID int) {
+	_, err := sss.db.Exec(`DELETE FROM share_search_tokens WHERE search_id = ?`, searchID)
+	if err != nil {
+		sss.logger.Errorf("can't delete tokens of search with id %d: %s\n", searchID, err)
+	}
+}
+
+func (sss *sqliteShareStorage) filterFiles(token string, files []filesPck.File) ([]filesPck.File, error) {
+	ids, err := sss.getFilesIDs(token)
+	if err != nil {
+		return nil, err
+	}
+
+	// ids are already sorted
+	return filterFilesByIDs(files, filesIDs(ids)), nil
+}
+
+func (sss *sqliteShareStorage) filterTags(token string, tags tagsPck.Tags) (tagsPck.Tags, error) {
+	ids, err := sss.getFilesIDs(token)
+	if err != nil {
+		return tags, err
+	}
+
+	return filterTagsByFiles(tags, sss.fileStorage.GetFiles(ids...)), nil
+}
+
+func (sss *sqliteShareStorage) shutdown() error {
+	return sss.db.Close()
+}
@@ -3,6 +3,7 @@ package share
 import (
 	"os"
 	"testing"
+	"time"
 
 	clog "github.com/ShoshinNikita/log/v2"
 	"github.com/stretchr/testify/assert"
@@ -11,12 +12,19 @@ import (
 	"github.com/tags-drive/core/internal/storage/tags"
 )
 
-const testJsonFile = "test.json"
+const (
+	testJsonFile         = "test.json"
+	testSearchesJsonFile = "test_searches.json"
+	testSQLiteFile       = "test.db"
+)
 
 func TestMain(m *testing.M) {
 	code := m.Run()
 
 	os.Remove(testJsonFile)
+	os.Remove(testJsonFile + ".journal")
+	os.Remove(testSearchesJsonFile)
+	os.Remove(testSQLiteFile)
 
 	os.Exit(code)
 }
@@ -104,11 +112,9 @@ func TestDeleteID(t *testing.T) {
 	}
 }
 
-// Test of jsonShareStorage type
+// Tests of internal storages
 
 func TestCheckFile(t *testing.T) {
-	assert := assert.New(t)
-
 	tests := []struct {
 		startTokens map[string]filesIDs
 		checkToken  string
@@ -162,20 +168,17 @@ func TestCheckFile(t *testing.T) {
 	}
 
 	for i, tt := range tests {
-		st := newStorage()
-		st.tokens = tt.startTokens
+		runForAllStorages(t, tt.startTokens, func(t *testing.T, st internalStorage, fs *FileStorageMock) {
+			assert := assert.New(t)
 
-		res := st.checkFile(tt.checkToken, tt.checkID)
+			res := st.checkFile(tt.checkToken, tt.checkID)
 
-		assert.Equalf(tt.result, res, "iteration #%d", i+1)
-
-		assert.NoError(st.shutdown())
+			assert.Equalf(tt.result, res, "iteration #%d", i+1)
+		})
 	}
 }
 
 func TestGetFilesIDs(t *testing.T) {
-	assert := assert.New(t)
-
 	tests := []struct {
 		startTokens map[string]filesIDs
 
@@ -220,24 +223,21 @@ func TestGetFilesIDs(t *testing.T) {
 	}
 
 	for i, tt := range tests {
-		st := newStorage()
-		st.tokens = tt.startTokens
-
-		res, err := st.getFilesIDs(tt.token)
+		runForAllStorages(t, tt.startTokens, func(t *testing.T, st internalStorage, fs *FileStorageMock) {
+			assert := assert.New(t)
 
-		assert.Equal(err != nil, tt.isError, "iteration #%d", i+1)
+			res, err := st.getFilesIDs(tt.token)
 
-		if !tt.isError {
-			assert.Equal(tt.res, res, "iteration #%d", i+1)
-		}
+			assert.Equal(err != nil, tt.isError, "iteration #%d", i+1)
 
-		assert.NoError(st.shutdown())
+			if !tt.isError {
+				assert.Equal(tt.res, res, "iteration #%d", i+1)
+			}
+		})
 	}
 }
 
 func TestDeleteFile(t *testing.T) {
-	assert := assert.New(t)
-
 	tests := []struct {
 		startIDs [][]int
 		deleteID int
@@ -291,29 +291,29 @@ func TestDeleteFile(t *testing.T) {
 	}
 
 	for i, tt := range tests {
-		st := newStorage()
-		var tokens []string
-		for j := range tt.startIDs {
-			t := st.createToken(tt.startIDs[j])
-			tokens = append(tokens, t)
-		}
+		runForAllStorages(t, nil, func(t *testing.T, st internalStorage, fs *FileStorageMock) {
+			assert := assert.New(t)
 
-		st.deleteFile(tt.deleteID)
+			var tokens []string
+			for j := range tt.startIDs {
+				t := st.createToken(tt.startIDs[j])
+				tokens = append(tokens, t)
+			}
 
-		var res [][]int
-		for _, token := range tokens {
-			res = append(res, st.tokens[token])
-		}
+			st.deleteFile(tt.deleteID)
 
-		assert.Equalf(tt.result, res, "iteration #%d", i+1)
+			var res [][]int
+			for _, token := range tokens {
+				ids, _ := st.getFilesIDs(token)
+				res = append(res, ids)
+			}
 
-		assert.NoError(st.shutdown())
+			assert.Equalf(tt.result, res, "iteration #%d", i+1)
+		})
 	}
 }
 
 func TestFilterFiles(t *testing.T) {
-	assert := assert.New(t)
-
 	tests := []struct {
 		tokens map[string]filesIDs
 
@@ -404,24 +404,21 @@ func TestFilterFiles(t *testing.T) {
 	}
 
 	for i, tt := range tests {
-		st := newStorage()
-		st.tokens = tt.tokens
+		runForAllStorages(t, tt.tokens, func(t *testing.T, st internalStorage, fs *FileStorageMock) {
+			assert := assert.New(t)
 
-		res, err := st.filterFiles(tt.filterToken, tt.files)
+			res, err := st.filterFiles(tt.filterToken, tt.files)
 
-		assert.Equal(err != nil, tt.isError, "iteration #%d", i+1)
+			assert.Equal(err != nil, tt.isError, "iteration #%d", i+1)
 
-		if !tt.isError {
-			assert.Equal(tt.res, res, "iteration #%d", i+1)
-		}
-
-		assert.NoError(st.shutdown())
+			if !tt.isError {
+				assert.Equal(tt.res, res, "iteration #%d", i+1)
+			}
+		})
 	}
 }
 
 func TestFilterTags(t *testing.T) {
-	assert := assert.New(t)
-
 	files := []files.File{
 		{ID: 1, Tags: []int{1, 2, 3}},
 		{ID: 2, Tags: []int{1, 2, 5}},
@@ -565,34 +562,30 @@ func TestFilterTags(t *testing.T) {
 	}
 
 	for i, tt := range tests {
-		// Init
-		st := newStorage()
-		st.tokens = tt.tokens
-		// Set files
-		fs := st.fileStorage.(*FileStorageMock)
-		fs.files = files
+		runForAllStorages(t, tt.tokens, func(t *testing.T, st internalStorage, fs *FileStorageMock) {
+			assert := assert.New(t)
 
-		res, err := st.filterTags(tt.token, tt.tags)
+			// Set files
+			fs.files = files
 
-		assert.Equal(err != nil, tt.isError, "iteration #%d", i+1)
+			res, err := st.filterTags(tt.token, tt.tags)
 
-		if !tt.isError {
-			assert.Equal(tt.res, res, "iteration #%d", i+1)
-		}
+			assert.Equal(err != nil, tt.isError, "iteration #%d", i+1)
 
-		assert.NoError(st.shutdown())
+			if !tt.isError {
+				assert.Equal(tt.res, res, "iteration #%d", i+1)
+			}
+		})
 	}
 }
 
 func TestDeleteToken(t *testing.T) {
-	assert := assert.New(t)
-
 	tests := []struct {
 		tokens map[string]filesIDs
 		// Input
 		token string
 		// Result
-		res map[string]filesIDs
+		res map[string][]int
 	}{
 		{
 			tokens: map[string]filesIDs{
@@ -600,7 +593,7 @@ func TestDeleteToken(t *testing.T) {
 			},
 			//
 			token: "1",
-			res:   map[string]filesIDs{},
+			res:   map[string][]int{},
 		},
 		{
 			tokens: map[string]filesIDs{
@@ -609,29 +602,25 @@ func TestDeleteToken(t *testing.T) {
 			},
 			//
 			token: "10",
-			res: map[string]filesIDs{
-				"1": []int{1, 2, 3},
-				"5": []int{1, 2, 3},
+			res: map[string][]int{
+				"1": {1, 2, 3},
+				"5": {1, 2, 3},
 			},
 		},
 	}
 
 	for i, tt := range tests {
-		// Init
-		st := newStorage()
-		st.tokens = tt.tokens
+		runForAllStorages(t, tt.tokens, func(t *testing.T, st internalStorage, fs *FileStorageMock) {
+			assert := assert.New(t)
 
-		st.deleteToken(tt.token)
+			st.deleteToken(tt.token)
 
-		assert.Equal(tt.res, st.tokens, "iteration #%d", i+1)
-
-		assert.NoError(st.shutdown())
+			assert.Equal(tt.res, st.getAllTokens(), "iteration #%d", i+1)
+		})
 	}
 }
 
 func TestAllTokens(t *testing.T) {
-	assert := assert.New(t)
-
 	tests := []struct {
 		tokens map[string]filesIDs
 		// Result
@@ -660,16 +649,117 @@ func TestAllTokens(t *testing.T) {
 	}
 
 	for i, tt := range tests {
-		// Init
-		st := newStorage()
-		st.tokens = tt.tokens
+		runForAllStorages(t, tt.tokens, func(t *testing.T, st internalStorage, fs *FileStorageMock) {
+			assert := assert.New(t)
 
-		res := st.getAllTokens()
+			res := st.getAllTokens()
 
-		assert.Equal(tt.res, res, "iteration #%d", i+1)
+			assert.Equal(tt.res, res, "iteration #%d", i+1)
+		})
+	}
+}
 
-		assert.NoError(st.shutdown())
+func TestSearchTokens(t *testing.T) {
+	tokens := map[string]filesIDs{
+		"1": []int{1, 2, 3},
 	}
+
+	runForAllStorages(t, tokens, func(t *testing.T, st internalStorage, fs *FileStorageMock) {
+		assert := assert.New(t)
+
+		first := st.createSearchToken(5)
+		second := st.createSearchToken(5)
+		third := st.createSearchToken(7)
+		assert.Equal(map[string]int{first: 5, second: 5, third: 7}, st.getSearchTokens())
+
+		id, ok := st.getSearchID(third)
+		assert.True(ok)
+		assert.Equal(7, id)
+		_, ok = st.getSearchID("1")
+		assert.False(ok)
+
+		// Tokens of searches don't share files
+		assert.Equal(map[string][]int{"1": {1, 2, 3}}, st.getAllTokens())
+		assert.False(st.checkToken(first))
+
+		st.deleteSearch(5)
+		assert.Equal(map[string]int{third: 7}, st.getSearchTokens())
+
+		st.deleteToken(third)
+		assert.Empty(st.getSearchTokens())
+		assert.Equal(map[string][]int{"1": {1, 2, 3}}, st.getAllTokens())
+	})
+}
+
+func TestShareSearch(t *testing.T) {
+	runForAllStorages(t, nil, func(t *testing.T, st internalStorage, fs *FileStorageMock) {
+		assert := assert.New(t)
+
+		fs.files = []files.File{
+			{ID: 1, Tags: []int{1}},
+			{ID: 2, Tags: []int{2}},
+			{ID: 3, Tags: []int{1, 3}},
+			{ID: 4, Tags: []int{2}, Deleted: true},
+		}
+		searches := &SearchStorageMock{
+			found: map[int][]int{1: {3, 1, 4}},
+			fs:    fs,
+		}
+		service := ShareService{
+			storage:     st,
+			searches:    searches,
+			searchCache: newSearchCache(time.Hour),
+			logger:      clog.NewProdLogger(),
+		}
+
+		token := service.CreateSearchToken(1)
+		filesToken := service.CreateToken([]int{2})
+		assert.True(service.CheckToken(token))
+
+		ids, err := service.GetFilesIDs(token)
+		assert.NoError(err)
+		assert.Equal([]int{1, 3}, ids)
+		assert.True(service.CheckFile(token, 3))
+		assert.False(service.CheckFile(token, 2))
+		// Files in the Trash aren't shared
+		assert.False(service.CheckFile(token, 4))
+
+		sharedTags, err := service.FilterTags(token, tags.Tags{1: {ID: 1}, 2: {ID: 2}, 3: {ID: 3}})
+		assert.NoError(err)
+		assert.Equal(tags.Tags{1: {ID: 1}, 3: {ID: 3}}, sharedTags)
+
+		// The result is cached for a while
+		searches.found[1] = []int{2}
+		assert.True(service.CheckFile(token, 3))
+		assert.Equal(1, searches.calls[1])
+
+		// A token shares the current result of a search
+		service.searchCache.ttl = 0
+		res, err := service.FilterFiles(token, fs.files)
+		assert.NoError(err)
+		assert.Equal([]files.File{{ID: 2, Tags: []int{2}}}, res)
+		assert.Equal(map[string][]int{token: {2}, filesToken: {2}}, service.GetAllTokens())
+
+		service.DeleteSearch(1)
+		assert.False(service.CheckToken(token))
+		assert.True(service.CheckToken(filesToken))
+	})
+}
+
+type SearchStorageMock struct {
+	// found contains ids of files found by every search
+	found map[int][]int
+	// calls contains numbers of executions of every search
+	calls map[int]int
+	fs    *FileStorageMock
+}
+
+func (ss *SearchStorageMock) FindFiles(searchID int) ([]files.File, error) {
+	if ss.calls == nil {
+		ss.calls = make(map[int]int)
+	}
+	ss.calls[searchID]++
+	return ss.fs.GetFiles(ss.found[searchID]...), nil
 }
 
 type FileStorageMock struct {
@@ -690,18 +780,79 @@ func (fs FileStorageMock) GetFiles(ids ...int) []files.File {
 	return files
 }
 
-func newStorage() *jsonShareStorage {
-	fs := &FileStorageMock{}
+// testStorages contains constructors of all internal storages. Every test is run for every storage
+var testStorages = []struct {
+	name       string
+	newStorage func(cnf Config, fs FileStorage) internalStorage
+	setTokens  func(st internalStorage, tokens map[string]filesIDs) error
+}{
+	{
+		name: "json",
+		newStorage: func(cnf Config, fs FileStorage) internalStorage {
+			return newJsonShareStorage(cnf, fs, clog.NewProdLogger())
+		},
+		setTokens: func(st internalStorage, tokens map[string]filesIDs) error {
+			st.(*jsonShareStorage).tokens = tokens
+			return nil
+		},
+	},
+	{
+		name: "sqlite",
+		newStorage: func(cnf Config, fs FileStorage) internalStorage {
+			return newSqliteShareStorage(cnf, fs, clog.NewProdLogger())
+		},
+		setTokens: func(st internalStorage, tokens map[string]filesIDs) error {
+			tx, err := st.(*sqliteShareStorage).db.Begin()
+			if err != nil {
+				return err
+			}
+			defer tx.Rollback()
 
-	st := newJsonShareStorage(Config{
-		ShareTokenJSONFile: testJsonFile,
-		Encrypt:            false,
-	}, fs, clog.NewProdLogger())
+			for token, ids := range tokens {
+				if err := insertToken(tx, token, ids); err != nil {
+					return err
+				}
+			}
 
-	err := st.init()
-	if err != nil {
-		panic(err)
-	}
+			return tx.Commit()
+		},
+	},
+}
+
+// runForAllStorages creates every internal storage with passed tokens and runs f.
+// Storages are removed after the test
+func runForAllStorages(t *testing.T, tokens map[string]filesIDs,
+	f func(t *testing.T, st internalStorage, fs *FileStorageMock)) {
+
+	for _, storage := range testStorages {
+		t.Run(storage.name, func(t *testing.T) {
+			fs := &FileStorageMock{}
+			cnf := Config{
+				MetadataStorageType:  storage.name,
+				ShareTokenJSONFile:   testJsonFile,
+				SearchTokensJSONFile: testSearchesJsonFile,
+				SQLiteFile:           testSQLiteFile,
+				Encrypt:              false,
+			}
 
-	return st
+			st := storage.newStorage(cnf, fs)
+			if err := st.init(); err != nil {
+				t.Fatalf("can't init storage: %s", err)
+			}
+			defer func() {
+				assert.NoError(t, st.shutdown())
+				for _, path := range []string{testJsonFile, testJsonFile + ".journal", testSearchesJsonFile, testSQLiteFile, testSQLiteFile + "-wal", testSQLiteFile + "-shm"} {
+					os.Remove(path)
+				}
+			}()
+
+			if tokens != nil {
+				if err := storage.setTokens(st, tokens); err != nil {
+					t.Fatalf("can't set tokens: %s", err)
+				}
+			}
+
+			f(t, st, fs)
+		})
+	}
 }
@@ -6,7 +6,12 @@ import (
 )
 
 type Config struct {
-	ShareTokenJSONFile string
+	MetadataStorageType string
+	ShareTokenJSONFile  string
+	// SearchTokensJSONFile keeps tokens of saved searches. It shares the journal with ShareTokenJSONFile
+	SearchTokensJSONFile string
+	// SQLiteFile is a path to the database used when MetadataStorageType is "sqlite"
+	SQLiteFile string
 
 	Encrypt    bool
 	PassPhrase [32]byte
@@ -16,6 +21,11 @@ type FileStorage interface {
 	GetFiles(ids ...int) []files.File
 }
 
+// SearchStorage executes saved searches
+type SearchStorage interface {
+	FindFiles(searchID int) ([]files.File, error)
+}
+
 type internalStorage interface {
 	// GetAllTokens returns all tokens with shared files ids
 	getAllTokens() map[string][]int
@@ -38,11 +48,25 @@ type internalStorage interface {
 	// DeleteFile deletes all refs to a file
 	deleteFile(id int)
 
+	// getSearchTokens returns all tokens of saved searches with ids of searches
+	getSearchTokens() map[string]int
+
+	// getSearchID returns id of a search shared by a token
+	getSearchID(token string) (searchID int, ok bool)
+
+	// createSearchToken creates new token with access to files found by a saved search
+	createSearchToken(searchID int) (token string)
+
+	// deleteSearch deletes all tokens of a search
+	deleteSearch(searchID int)
+
 	// FilterFiles filters files according to token share permissions
 	filterFiles(token string, files []files.File) ([]files.File, error)
 
 	// FilterTags filters tags according to token share permissions
 	filterTags(token string, tags tags.Tags) (tags.Tags, error)
 
+	init() error
+
 	shutdown() error
 }
@@ -43,6 +43,8 @@ func NewTagStorage(cnf Config, lg *clog.Logger) (*TagStorage, error) {
 	var st internalStorage
 
 	switch cnf.MetadataStorageType {
+	case "sqlite":
+		st = newSqliteTagStorage(cnf, lg)
 	case "json":
 		fallthrough
 	default:
@@ -5,17 +5,36 @@ import (
 	"sync"
 
 	clog "github.com/ShoshinNikita/log/v2"
+	jsoniter "github.com/json-iterator/go"
 	"github.com/pkg/errors"
 
 	"github.com/tags-drive/core/internal/utils"
 )
 
+var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+// maxJournalRecords is a number of journal records after which the journal is compacted
+const maxJournalRecords = 100
+
+// journalRecord describes a change of jsonTagStorage.tags. It contains the final state of changed tags,
+// so a record can be applied several times
+type journalRecord struct {
+	Put    []Tag `json:"put,omitempty"`
+	Delete []int `json:"delete,omitempty"`
+}
+
+// jsonTagStorage implements tags.internalStorage interface.
+//
+// Every change is written into the journal before it is applied. The journal is replayed
+// on start and compacted into config.TagsJSONFile
 type jsonTagStorage struct {
 	config Config
 
 	tags  Tags
 	mutex *sync.RWMutex
 
+	journal *utils.Journal
+
 	logger *clog.Logger
 }
 
@@ -29,50 +48,94 @@ func newJsonTagStorage(cnf Config, lg *clog.Logger) *jsonTagStorage {
 }
 
 func (jts *jsonTagStorage) init() error {
-	f, err := os.OpenFile(jts.config.TagsJSONFile, os.O_RDWR, 0666)
+	f, err := os.Open(jts.config.TagsJSONFile)
 	if err != nil {
+		if !os.IsNotExist(err) {
+			return errors.Wrapf(err, "can't open file %s", jts.config.TagsJSONFile)
+		}
+
 		// Have to create a new file
-		if os.IsNotExist(err) {
-			return jts.createNewFile()
+		err := jts.createNewFile()
+		if err != nil {
+			return err
 		}
+	} else {
+		err = utils.Decode(f, &jts.tags, jts.config.Encrypt, jts.config.PassPhrase)
+		f.Close()
+		if err != nil {
+			return errors.Wrapf(err, "can't decode file %s", jts.config.TagsJSONFile)
+		}
+	}
 
-		return errors.Wrapf(err, "can't open file %s", jts.config.TagsJSONFile)
+	// Apply changes made after the last snapshot
+	jts.journal, err = utils.OpenJournal(jts.config.TagsJSONFile+".journal", jts.config.Encrypt, jts.config.PassPhrase)
+	if err != nil {
+		return err
 	}
-	defer f.Close()
 
-	return utils.Decode(f, &jts.tags, jts.config.Encrypt, jts.config.PassPhrase)
+	err = jts.journal.Replay(func(data []byte) error {
+		var rec journalRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return err
+		}
+		jts.apply(rec)
+
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "can't replay journal")
+	}
+
+	return nil
 }
 
 func (jts *jsonTagStorage) createNewFile() error {
 	jts.logger.Debugf("file %s doesn't exist. Need to create a new file\n", jts.config.TagsJSONFile)
 
-	// Just create a new file
-	f, err := os.OpenFile(jts.config.TagsJSONFile, os.O_CREATE|os.O_RDWR, 0666)
+	// Write empty tag map
+	err := utils.WriteFileAtomic(jts.config.TagsJSONFile, jts.tags, jts.config.Encrypt, jts.config.PassPhrase)
 	if err != nil {
 		return errors.Wrap(err, "can't create a new file")
 	}
-	f.Close()
-
-	// Write empty tag map
-	jts.write()
 
 	return nil
 }
 
-func (jts jsonTagStorage) write() {
-	jts.mutex.RLock()
-	defer jts.mutex.RUnlock()
-
-	f, err := os.OpenFile(jts.config.TagsJSONFile, os.O_TRUNC|os.O_RDWR, 0666)
+// compact writes jts.tags into jts.config.TagsJSONFile and clears the journal. jts.mutex must be locked
+func (jts *jsonTagStorage) compact() {
+	err := utils.WriteFileAtomic(jts.config.TagsJSONFile, jts.tags, jts.config.Encrypt, jts.config.PassPhrase)
 	if err != nil {
-		jts.logger.Errorf("can't open file %s: %s\n", jts.config.TagsJSONFile, err)
+		jts.logger.Warnf("can't write '%s': %s\n", jts.config.TagsJSONFile, err)
 		return
 	}
-	defer f.Close()
 
-	err = utils.Encode(f, jts.tags, jts.config.Encrypt, jts.config.PassPhrase)
-	if err != nil {
-		jts.logger.Warnf("can't write '%s': %s", jts.config.TagsJSONFile, err)
+	if err := jts.journal.Reset(); err != nil {
+		jts.logger.Errorf("can't reset journal: %s\n", err)
+	}
+}
+
+// commit writes a record into the journal and applies it. jts.mutex must be locked
+func (jts *jsonTagStorage) commit(rec journalRecord) error {
+	if err := jts.journal.Append(rec); err != nil {
+		return errors.Wrap(err, "can't write a change into the journal")
+	}
+
+	jts.apply(rec)
+
+	if jts.journal.Len() >= maxJournalRecords {
+		jts.compact()
+	}
+
+	return nil
+}
+
+// apply applies a record to jts.tags
+func (jts *jsonTagStorage) apply(rec journalRecord) {
+	for _, tag := range rec.Put {
+		jts.tags[tag.ID] = tag
+	}
+	for _, id := range rec.Delete {
+		delete(jts.tags, id)
 	}
 }
 
@@ -95,11 +158,12 @@ func (jts *jsonTagStorage) addTag(tag Tag) {
 	}
 	nextID++
 	tag.ID = nextID
-	jts.tags[nextID] = tag
 
-	jts.mutex.Unlock()
+	if err := jts.commit(journalRecord{Put: []Tag{tag}}); err != nil {
+		jts.logger.Errorf("can't add a tag: %s\n", err)
+	}
 
-	jts.write()
+	jts.mutex.Unlock()
 }
 
 func (jts *jsonTagStorage) updateTag(id int, newName, newColor string) (Tag, error) {
@@ -123,11 +187,13 @@ func (jts *jsonTagStorage) updateTag(id int, newName, newColor string) (Tag, err
 		tag.Color = newColor
 	}
 
-	jts.tags[id] = tag
+	err := jts.commit(journalRecord{Put: []Tag{tag}})
 
 	jts.mutex.Unlock()
 
-	jts.write()
+	if err != nil {
+		return Tag{}, err
+	}
 
 	return tag, nil
 }
@@ -144,11 +210,13 @@ func (jts *jsonTagStorage) updateGroup(id int, newGroup string) (Tag, error) {
 
 	tag.Group = newGroup
 
-	jts.tags[id] = tag
+	err := jts.commit(journalRecord{Put: []Tag{tag}})
 
 	jts.mutex.Unlock()
 
-	jts.write()
+	if err != nil {
+		return Tag{}, err
+	}
 
 	return tag, nil
 }
@@ -161,10 +229,11 @@ func (jts *jsonTagStorage) deleteTag(id int) {
 		return
 	}
 
-	delete(jts.tags, id)
-	jts.mutex.Unlock()
+	if err := jts.commit(journalRecord{Delete: []int{id}}); err != nil {
+		jts.logger.Errorf("can't delete tag with id %d: %s\n", id, err)
+	}
 
-	jts.write()
+	jts.mutex.Unlock()
 }
 
 func (jts jsonTagStorage) check(id int) bool {
@@ -175,15 +244,16 @@ func (jts jsonTagStorage) check(id int) bool {
 	return ok
 }
 
-func (jts jsonTagStorage) shutdown() error {
-	// We have not to do any special operations because we update json file on every change.
-	// Also there are no any requests because server is already down. But it's better to check the mutex
+func (jts *jsonTagStorage) shutdown() error {
+	// There are no any requests because server is already down. But it's better to check the mutex
 	// just in case.
-
 	jts.mutex.Lock()
-	jts.mutex.Unlock()
+	defer jts.mutex.Unlock()
+
+	// Write changes
+	jts.compact()
 
 	// There will be no any new requests.
 
-	return nil
+	return jts.journal.Close()
 }
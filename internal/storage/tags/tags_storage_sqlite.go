@@ -0,0 +1,206 @@
+package tags
+
+import (
+	"database/sql"
+	"os"
+
+	clog "github.com/ShoshinNikita/log/v2"
+	"github.com/pkg/errors"
+
+	"github.com/tags-drive/core/internal/utils"
+)
+
+const sqliteTagsSchema = `
+	CREATE TABLE IF NOT EXISTS tags (
+		id          INTEGER PRIMARY KEY,
+		name        TEXT NOT NULL,
+		color       TEXT NOT NULL,
+		group_name  TEXT NOT NULL DEFAULT ''
+	);`
+
+// sqliteTagStorage implements tags.internalStorage interface
+type sqliteTagStorage struct {
+	config Config
+
+	db *sql.DB
+
+	logger *clog.Logger
+}
+
+func newSqliteTagStorage(cnf Config, lg *clog.Logger) *sqliteTagStorage {
+	return &sqliteTagStorage{
+		config: cnf,
+		logger: lg,
+	}
+}
+
+func (sts *sqliteTagStorage) init() (err error) {
+	sts.db, err = utils.OpenSQLite(sts.config.SQLiteFile)
+	if err != nil {
+		return err
+	}
+
+	// The table is created in the same transaction in which tags are imported. So, if the import fails,
+	// nothing is committed and the import is repeated on the next start
+	tx, err := sts.db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "can't begin a transaction")
+	}
+	defer tx.Rollback()
+
+	var tableExists bool
+	err = tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'tags')`).Scan(&tableExists)
+	if err != nil {
+		return errors.Wrap(err, "can't check the table 'tags'")
+	}
+
+	if _, err := tx.Exec(sqliteTagsSchema); err != nil {
+		return errors.Wrap(err, "can't create the table 'tags'")
+	}
+
+	imported := 0
+	if !tableExists {
+		// The table was just created. Import tags from the json storage to not lose them
+		// after switching from "json" to "sqlite"
+		if imported, err = sts.importFromJSON(tx); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "can't commit the schema")
+	}
+
+	if imported > 0 {
+		sts.logger.Infof("%d tag(s) were imported from %s\n", imported, sts.config.TagsJSONFile)
+	}
+
+	return nil
+}
+
+// importFromJSON copies tags from config.TagsJSONFile into the database. IDs are preserved.
+// It returns a number of imported tags
+func (sts *sqliteTagStorage) importFromJSON(tx *sql.Tx) (int, error) {
+	if _, err := os.Stat(sts.config.TagsJSONFile); os.IsNotExist(err) {
+		return 0, nil
+	}
+
+	// Load tags with jsonTagStorage to apply changes from its journal
+	jsonStorage := newJsonTagStorage(sts.config, sts.logger)
+	if err := jsonStorage.init(); err != nil {
+		return 0, errors.Wrapf(err, "can't load tags from %s", sts.config.TagsJSONFile)
+	}
+	defer jsonStorage.shutdown()
+
+	tags := jsonStorage.getAll()
+	for _, tag := range tags {
+		_, err := tx.Exec(`INSERT INTO tags (id, name, color, group_name) VALUES (?, ?, ?, ?)`,
+			tag.ID, tag.Name, tag.Color, tag.Group)
+		if err != nil {
+			return 0, errors.Wrap(err, "can't insert a tag")
+		}
+	}
+
+	return len(tags), nil
+}
+
+func (sts *sqliteTagStorage) getTag(id int) (Tag, error) {
+	var tag Tag
+	err := sts.db.QueryRow(`SELECT id, name, color, group_name FROM tags WHERE id = ?`, id).
+		Scan(&tag.ID, &tag.Name, &tag.Color, &tag.Group)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Tag{}, errors.New("tag doesn't exist")
+		}
+		return Tag{}, errors.Wrapf(err, "can't select tag with id %d", id)
+	}
+
+	return tag, nil
+}
+
+func (sts *sqliteTagStorage) getAll() Tags {
+	tags := make(Tags)
+
+	rows, err := sts.db.Query(`SELECT id, name, color, group_name FROM tags`)
+	if err != nil {
+		sts.logger.Errorf("can't select tags: %s\n", err)
+		return tags
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var tag Tag
+		if err := rows.Scan(&tag.ID, &tag.Name, &tag.Color, &tag.Group); err != nil {
+			sts.logger.Errorf("can't scan a tag: %s\n", err)
+			return tags
+		}
+		tags[tag.ID] = tag
+	}
+
+	return tags
+}
+
+func (sts *sqliteTagStorage) addTag(tag Tag) {
+	// The id is max(id) + 1 like in the json storage
+	_, err := sts.db.Exec(`INSERT INTO tags (name, color, group_name) VALUES (?, ?, ?)`, tag.Name, tag.Color, tag.Group)
+	if err != nil {
+		sts.logger.Errorf("can't add a tag: %s\n", err)
+	}
+}
+
+func (sts *sqliteTagStorage) updateTag(id int, newName, newColor string) (Tag, error) {
+	if newColor != "" && newColor[0] != '#' {
+		newColor = "#" + newColor
+	}
+
+	res, err := sts.db.Exec(`
+		UPDATE tags SET
+			name = CASE WHEN ? = '' THEN name ELSE ? END,
+			color = CASE WHEN ? = '' THEN color ELSE ? END
+		WHERE id = ?`,
+		newName, newName, newColor, newColor, id)
+	if err != nil {
+		return Tag{}, errors.Wrapf(err, "can't update tag with id %d", id)
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return Tag{}, errors.New("tag doesn't exist")
+	}
+
+	return sts.getTag(id)
+}
+
+func (sts *sqliteTagStorage) updateGroup(id int, newGroup string) (Tag, error) {
+	res, err := sts.db.Exec(`UPDATE tags SET group_name = ? WHERE id = ?`, newGroup, id)
+	if err != nil {
+		return Tag{}, errors.Wrapf(err, "can't update group of tag with id %d", id)
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return Tag{}, errors.New("tag doesn't exist")
+	}
+
+	return sts.getTag(id)
+}
+
+func (sts *sqliteTagStorage) deleteTag(id int) {
+	_, err := sts.db.Exec(`DELETE FROM tags WHERE id = ?`, id)
+	if err != nil {
+		sts.logger.Errorf("can't delete tag with id %d: %s\n", id, err)
+	}
+}
+
+func (sts *sqliteTagStorage) check(id int) bool {
+	var exists bool
+	err := sts.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM tags WHERE id = ?)`, id).Scan(&exists)
+	if err != nil {
+		sts.logger.Errorf("can't check tag with id %d: %s\n", id, err)
+		return false
+	}
+
+	return exists
+}
+
+func (sts *sqliteTagStorage) shutdown() error {
+	return sts.db.Close()
+}
@@ -1,18 +1,44 @@
 package tags
 
+import (
+	"sort"
+	"strings"
+)
+
 type Config struct {
 	Debug bool
 
 	MetadataStorageType string
 	TagsJSONFile        string
+	// SQLiteFile is a path to the database used when MetadataStorageType is "sqlite"
+	SQLiteFile string
 
 	Encrypt    bool
 	PassPhrase [32]byte
 }
 
-// Tags is a map of Tag
+// Tags is a map of Tag. It implements aggregation.Tags
 type Tags map[int]Tag
 
+// Resolve returns ids of tags with passed name (case-insensitive)
+func (t Tags) Resolve(name string) []int {
+	var ids []int
+	for id, tag := range t {
+		if strings.EqualFold(tag.Name, name) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+
+	return ids
+}
+
+// Exists checks if there's a tag with passed id
+func (t Tags) Exists(id int) bool {
+	_, ok := t[id]
+	return ok
+}
+
 // Tag contains the information about a tag
 type Tag struct {
 	ID    int    `json:"id"`
@@ -0,0 +1,267 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+)
+
+// Every journal record is stored as a frame:
+//
+//	| length (4 bytes, big-endian) | crc32 of payload (4 bytes, big-endian) | payload |
+//
+// payload is a record encoded with Encode(), so it is encrypted if needed.
+const journalHeaderSize = 8
+
+// MaxJournalRecordSize is a max size of an encoded record. A bigger length in a header means
+// that the header is damaged
+const MaxJournalRecordSize = 64 << 20 // 64MB
+
+// ErrJournalDamaged is returned by Replay when a record in the middle of a journal is broken.
+// Records after it can't be trusted and can't be discarded, so the journal must be repaired manually
+var ErrJournalDamaged = errors.New("journal is damaged")
+
+// Journal is an append-only log of storage mutations. Every record is flushed on disk
+// before Append returns. Journal is safe for concurrent use.
+type Journal struct {
+	path       string
+	encrypted  bool
+	encryptKey [32]byte
+
+	mu      sync.Mutex
+	f       *os.File
+	records int
+}
+
+// OpenJournal opens (and creates if needed) a journal
+func OpenJournal(path string, encrypted bool, encryptKey [32]byte) (*Journal, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't open journal %s", path)
+	}
+
+	return &Journal{
+		path:       path,
+		encrypted:  encrypted,
+		encryptKey: encryptKey,
+		f:          f,
+	}, nil
+}
+
+// Replay calls apply for every record of the journal in order. data is a decoded (and decrypted) record.
+//
+// A broken last record is a trace of an interrupted Append call. It is discarded, a copy of the discarded
+// bytes is kept in "{path}.tail-{unix time}". A broken record followed by other data means that the journal
+// is damaged: ErrJournalDamaged (wrapped) is returned and nothing is discarded.
+func (j *Journal) Replay(apply func(data []byte) error) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	info, err := j.f.Stat()
+	if err != nil {
+		return errors.Wrap(err, "can't get journal stats")
+	}
+	size := info.Size()
+
+	if _, err := j.f.Seek(0, io.SeekStart); err != nil {
+		return errors.Wrap(err, "can't seek journal")
+	}
+
+	var (
+		offset  int64
+		records int
+		header  [journalHeaderSize]byte
+	)
+	for offset < size {
+		if size-offset < journalHeaderSize {
+			// Torn header
+			break
+		}
+		if _, err := io.ReadFull(j.f, header[:]); err != nil {
+			return errors.Wrap(err, "can't read journal")
+		}
+
+		length := int64(binary.BigEndian.Uint32(header[:4]))
+		checksum := binary.BigEndian.Uint32(header[4:])
+
+		frameEnd := offset + journalHeaderSize + length
+		if frameEnd > size {
+			// Torn payload
+			break
+		}
+		if length > MaxJournalRecordSize {
+			return errors.Wrapf(ErrJournalDamaged, "record #%d at offset %d has invalid length %d",
+				records+1, offset, length)
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(j.f, payload); err != nil {
+			return errors.Wrap(err, "can't read journal")
+		}
+		if crc32.ChecksumIEEE(payload) != checksum {
+			if frameEnd == size {
+				// The last record wasn't written completely
+				break
+			}
+			return errors.Wrapf(ErrJournalDamaged, "record #%d at offset %d has invalid checksum, %d byte(s) follow it",
+				records+1, offset, size-frameEnd)
+		}
+
+		var data jsoniter.RawMessage
+		if err := Decode(bytes.NewReader(payload), &data, j.encrypted, j.encryptKey); err != nil {
+			return errors.Wrapf(err, "can't decode record #%d", records+1)
+		}
+
+		if err := apply(data); err != nil {
+			return errors.Wrapf(err, "can't apply record #%d", records+1)
+		}
+
+		offset = frameEnd
+		records++
+	}
+
+	if offset < size {
+		// Keep a copy of the broken tail before it is discarded
+		if err := j.saveTail(offset); err != nil {
+			return err
+		}
+		if err := j.f.Truncate(offset); err != nil {
+			return errors.Wrap(err, "can't truncate journal")
+		}
+	}
+
+	// Continue appending after the last valid record
+	if _, err := j.f.Seek(offset, io.SeekStart); err != nil {
+		return errors.Wrap(err, "can't seek journal")
+	}
+	j.records = records
+
+	return nil
+}
+
+// saveTail copies the journal data after offset into a separate file
+func (j *Journal) saveTail(offset int64) error {
+	if _, err := j.f.Seek(offset, io.SeekStart); err != nil {
+		return errors.Wrap(err, "can't seek journal")
+	}
+	tail, err := ioutil.ReadAll(j.f)
+	if err != nil {
+		return errors.Wrap(err, "can't read the broken tail of journal")
+	}
+
+	path := j.path + ".tail-" + strconv.FormatInt(time.Now().Unix(), 10)
+	if err := ioutil.WriteFile(path, tail, 0600); err != nil {
+		return errors.Wrapf(err, "can't save the broken tail of journal into %s", path)
+	}
+	return nil
+}
+
+// Append encodes a record and writes it into the journal
+func (j *Journal) Append(record interface{}) error {
+	payload := new(bytes.Buffer)
+	if err := Encode(payload, record, j.encrypted, j.encryptKey); err != nil {
+		return errors.Wrap(err, "can't encode record")
+	}
+	if payload.Len() > MaxJournalRecordSize {
+		return errors.Errorf("record is too large (%d bytes)", payload.Len())
+	}
+
+	frame := make([]byte, journalHeaderSize, journalHeaderSize+payload.Len())
+	binary.BigEndian.PutUint32(frame[:4], uint32(payload.Len()))
+	binary.BigEndian.PutUint32(frame[4:], crc32.ChecksumIEEE(payload.Bytes()))
+	frame = append(frame, payload.Bytes()...)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, err := j.f.Write(frame); err != nil {
+		return errors.Wrap(err, "can't write record")
+	}
+	if err := j.f.Sync(); err != nil {
+		return errors.Wrap(err, "can't sync journal")
+	}
+	j.records++
+
+	return nil
+}
+
+// Len returns number of records in the journal
+func (j *Journal) Len() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.records
+}
+
+// Reset removes all records. It must be called only after all changes were saved into a snapshot
+func (j *Journal) Reset() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := j.f.Truncate(0); err != nil {
+		return errors.Wrap(err, "can't truncate journal")
+	}
+	if _, err := j.f.Seek(0, io.SeekStart); err != nil {
+		return errors.Wrap(err, "can't seek journal")
+	}
+	if err := j.f.Sync(); err != nil {
+		return errors.Wrap(err, "can't sync journal")
+	}
+	j.records = 0
+
+	return nil
+}
+
+// Close closes the journal file
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.f.Close()
+}
+
+// WriteFileAtomic encodes source into a temporary file and renames it to path. So, path always contains
+// either the previous or the new version, even if the process was killed during the write.
+func WriteFileAtomic(path string, source interface{}, encrypted bool, encryptKey [32]byte) error {
+	tmpPath := path + ".tmp"
+
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return errors.Wrapf(err, "can't open file %s", tmpPath)
+	}
+
+	err = Encode(f, source, encrypted, encryptKey)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return errors.Wrapf(err, "can't write file %s", tmpPath)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return errors.Wrapf(err, "can't rename %s to %s", tmpPath, path)
+	}
+
+	// Sync the directory to persist the rename
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	return nil
+}
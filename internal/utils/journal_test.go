@@ -0,0 +1,215 @@
+package utils_test
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tags-drive/core/internal/utils"
+)
+
+const testJournal = "test.journal"
+
+type testRecord struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+func readJournal(t *testing.T, encrypted bool, key [32]byte) (*utils.Journal, []testRecord) {
+	j, err := utils.OpenJournal(testJournal, encrypted, key)
+	if err != nil {
+		t.Fatalf("can't open journal: %s", err)
+	}
+
+	var records []testRecord
+	err = j.Replay(func(data []byte) error {
+		var rec testRecord
+		if err := jsoniter.Unmarshal(data, &rec); err != nil {
+			return err
+		}
+		records = append(records, rec)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("can't replay journal: %s", err)
+	}
+
+	return j, records
+}
+
+func TestJournal(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		assert := assert.New(t)
+		key := sha256.Sum256([]byte("sha256"))
+
+		records := []testRecord{{1, "first"}, {2, "second"}, {3, "third"}}
+
+		j, err := utils.OpenJournal(testJournal, encrypted, key)
+		if !assert.NoError(err) {
+			t.FailNow()
+		}
+		for _, rec := range records {
+			assert.NoError(j.Append(rec))
+		}
+		assert.Equal(len(records), j.Len())
+		assert.NoError(j.Close())
+
+		// Replay
+		j, got := readJournal(t, encrypted, key)
+		assert.Equal(records, got, "encrypted: %t", encrypted)
+		assert.Equal(len(records), j.Len())
+
+		// Append after replay
+		assert.NoError(j.Append(testRecord{4, "fourth"}))
+		assert.NoError(j.Close())
+
+		j, got = readJournal(t, encrypted, key)
+		assert.Equal(append(records, testRecord{4, "fourth"}), got, "encrypted: %t", encrypted)
+
+		// Reset
+		assert.NoError(j.Reset())
+		assert.Equal(0, j.Len())
+		assert.NoError(j.Close())
+
+		j, got = readJournal(t, encrypted, key)
+		assert.Empty(got)
+		assert.NoError(j.Close())
+
+		os.Remove(testJournal)
+	}
+}
+
+// removeJournal removes the test journal and copies of its discarded tails
+func removeJournal() {
+	os.Remove(testJournal)
+	tails, _ := filepath.Glob(testJournal + ".tail-*")
+	for _, path := range tails {
+		os.Remove(path)
+	}
+}
+
+func TestJournalTornTail(t *testing.T) {
+	assert := assert.New(t)
+	defer removeJournal()
+
+	j, err := utils.OpenJournal(testJournal, false, [32]byte{})
+	if !assert.NoError(err) {
+		t.FailNow()
+	}
+	assert.NoError(j.Append(testRecord{1, "first"}))
+	assert.NoError(j.Append(testRecord{2, "second"}))
+	assert.NoError(j.Close())
+
+	// Cut the last record as if the app was killed during Append
+	info, err := os.Stat(testJournal)
+	if !assert.NoError(err) {
+		t.FailNow()
+	}
+	assert.NoError(os.Truncate(testJournal, info.Size()-3))
+
+	j, got := readJournal(t, false, [32]byte{})
+	assert.Equal([]testRecord{{1, "first"}}, got)
+
+	// The broken record must be discarded
+	assert.NoError(j.Append(testRecord{3, "third"}))
+	assert.NoError(j.Close())
+
+	j, got = readJournal(t, false, [32]byte{})
+	assert.Equal([]testRecord{{1, "first"}, {3, "third"}}, got)
+	assert.NoError(j.Close())
+
+	// A copy of the discarded bytes is kept
+	tails, err := filepath.Glob(testJournal + ".tail-*")
+	assert.NoError(err)
+	assert.Len(tails, 1)
+}
+
+func TestJournalDamagedRecord(t *testing.T) {
+	assert := assert.New(t)
+	defer removeJournal()
+
+	records := []testRecord{{1, "first"}, {2, "second"}, {3, "third"}}
+
+	j, err := utils.OpenJournal(testJournal, false, [32]byte{})
+	if !assert.NoError(err) {
+		t.FailNow()
+	}
+	for _, rec := range records {
+		assert.NoError(j.Append(rec))
+	}
+	assert.NoError(j.Close())
+
+	original, err := ioutil.ReadFile(testJournal)
+	if !assert.NoError(err) {
+		t.FailNow()
+	}
+	// Offsets of the records
+	var offsets []int
+	for offset := 0; offset < len(original); offset += 8 + int(binary.BigEndian.Uint32(original[offset:])) {
+		offsets = append(offsets, offset)
+	}
+	if !assert.Len(offsets, len(records)) {
+		t.FailNow()
+	}
+
+	replay := func() error {
+		j, err := utils.OpenJournal(testJournal, false, [32]byte{})
+		if err != nil {
+			return err
+		}
+		defer j.Close()
+		return j.Replay(func([]byte) error { return nil })
+	}
+
+	// Records after a broken one in the middle can't be discarded
+	damaged := append([]byte(nil), original...)
+	damaged[offsets[1]-1] ^= 0xFF
+	assert.NoError(ioutil.WriteFile(testJournal, damaged, 0666))
+
+	err = replay()
+	assert.Equal(utils.ErrJournalDamaged, errors.Cause(err))
+	current, err := ioutil.ReadFile(testJournal)
+	assert.NoError(err)
+	assert.Equal(damaged, current)
+
+	// A huge length of the last record is a torn tail
+	damaged = append([]byte(nil), original...)
+	binary.BigEndian.PutUint32(damaged[offsets[2]:], 0xFFFFFFF0)
+	assert.NoError(ioutil.WriteFile(testJournal, damaged, 0666))
+
+	j, got := readJournal(t, false, [32]byte{})
+	assert.NoError(j.Close())
+	assert.Equal(records[:2], got)
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	assert := assert.New(t)
+
+	const path = "test.json"
+	defer os.Remove(path)
+
+	for _, source := range []testRecord{{1, "first"}, {2, "second"}} {
+		assert.NoError(utils.WriteFileAtomic(path, source, false, [32]byte{}))
+
+		f, err := os.Open(path)
+		if !assert.NoError(err) {
+			continue
+		}
+
+		var res testRecord
+		assert.NoError(utils.Decode(f, &res, false, [32]byte{}))
+		assert.Equal(source, res)
+		f.Close()
+
+		// Temporary file must be removed
+		_, err = os.Stat(path + ".tmp")
+		assert.True(os.IsNotExist(err))
+	}
+}
@@ -0,0 +1,29 @@
+package utils
+
+import (
+	"database/sql"
+
+	_ "github.com/mattn/go-sqlite3" // register "sqlite3" driver
+	"github.com/pkg/errors"
+)
+
+// OpenSQLite opens (and creates if needed) a SQLite database.
+//
+// Several storages can share one database file: WAL mode allows concurrent readers,
+// writers wait for each other (up to 5 seconds) and every transaction takes the write lock
+// at the beginning, so read-modify-write transactions can't deadlock.
+func OpenSQLite(path string) (*sql.DB, error) {
+	dsn := "file:" + path + "?_journal_mode=WAL&_busy_timeout=5000&_foreign_keys=1&_txlock=immediate"
+
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't open database '%s'", path)
+	}
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, errors.Wrapf(err, "can't connect to database '%s'", path)
+	}
+
+	return db, nil
+}
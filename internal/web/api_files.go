@@ -3,13 +3,14 @@ package web
 import (
 	"fmt"
 	"io"
-	"mime/multipart"
+	"io/ioutil"
 	"net/http"
 	"regexp"
 	"strconv"
 	"strings"
 
 	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
 
 	filesPck "github.com/tags-drive/core/internal/storage/files"
 	"github.com/tags-drive/core/internal/storage/files/aggregation"
@@ -21,15 +22,40 @@ const (
 	// If maxSize == 2MB, there're too many I/O-operations
 	maxSize = 10 << 20 // 10MB
 
+	// maxTagsFieldSize is a max size of the "tags" field of POST /api/files
+	maxTagsFieldSize = 64 << 10 // 64KB
+
 	maxThreadsInPool = 3
 )
 
+// errTagsAfterFiles is returned by POST /api/files when the "tags" field follows files
+var errTagsAfterFiles = errors.New("the tags field follows files")
+
 // multiplyResponse is used as a response by POST /api/files and DELETE /api/files
 type multiplyResponse struct {
 	Filename string `json:"filename"`
 	IsError  bool   `json:"isError"`
 	Error    string `json:"error"`
 	Status   string `json:"status"` // Status isn't empty when IsError == false
+	// Duplicates contains ids of existing files with the same content (or filename). It is set only by uploads
+	Duplicates []int `json:"duplicates,omitempty"`
+}
+
+// uploadResponse returns a response for an uploaded file. status is used when the file is saved as a new one
+func uploadResponse(filename string, res filesPck.UploadResult, err error, status string) multiplyResponse {
+	resp := multiplyResponse{Filename: filename, Duplicates: res.Duplicates}
+	switch {
+	case err != nil:
+		resp.IsError = true
+		resp.Error = err.Error()
+	case res.Action == filesPck.DuplicateMerge:
+		resp.Status = "merged"
+	case res.Action == filesPck.DuplicateReplace:
+		resp.Status = "replaced"
+	default:
+		resp.Status = status
+	}
+	return resp
 }
 
 // GET /api/file/{id}
@@ -83,16 +109,25 @@ func (s Server) returnSingleFile(w http.ResponseWriter, r *http.Request) {
 // GET /api/files
 //
 // Params:
-//   - expr: logical expression
+//   - expr: logical expression (see aggregation.ParseExpr)
 //   - search: text for search
 //   - regexp: is search a regular expression (it is true when regexp != "")
-//   - sort: name | size | time
-//   - order: asc | desc
+//   - content: text for search in content of text files
+//   - sort: name | size | time or a comma-separated list of keys (name, time, size, ext, type, tags, random).
+//     A key with the '-' prefix is sorted in descending order, for example: type,-time,name
+//   - order: asc | desc (only for a single key without the prefix)
+//   - seed: seed for the random key. Default is 0
+//   - locale: BCP 47 language tag for comparing names (for example, ru). Names are compared in natural order by default
 //   - offset: lower bound [offset:]
 //   - count: number of returned files ([offset:offset+count]). If count == 0, all files will be returned. Default is 0
+//   - cursor: cursor from a previous response. If the param is passed (an empty value for the first page),
+//     the response is wrapped into an envelope and offset is ignored
+//   - facets: count facets of all found files (it is true when facets != ""). The response is wrapped into an envelope
+//   - bbox (optional): only files with GPS coordinates in a box "south,west,north,east"
+//   - near, radius (optional): only files with GPS coordinates within radius (in meters) of a point "latitude,longitude"
 //   - shareToken (optional): share token
 //
-// Response: json array
+// Response: json array or json object (files.FilesPage) if cursor or facets is passed
 //
 func (s Server) returnFiles(w http.ResponseWriter, r *http.Request) {
 	state, ok := getRequestState(r.Context())
@@ -140,14 +175,53 @@ func (s Server) returnFiles(w http.ResponseWriter, r *http.Request) {
 		return n
 	}
 
+	sortMode := getSortMode(r.FormValue("sort"), r.FormValue("order"))
+
+	// Use a sort specification if sort isn't a single key
+	var sortSpec filesPck.SortSpec
+	if sortParam := r.FormValue("sort"); sortParam != "" && getParam(sortParam, "", []string{"name", "size", "time"}) == "" {
+		var err error
+		sortSpec, err = filesPck.ParseSortSpec(sortParam)
+		if err != nil {
+			s.processError(w, err.Error(), http.StatusBadRequest, err)
+			return
+		}
+	}
+	if seed := r.FormValue("seed"); seed != "" {
+		var err error
+		sortSpec.Seed, err = strconv.ParseInt(seed, 10, 64)
+		if err != nil {
+			s.processError(w, "invalid seed", http.StatusBadRequest, err)
+			return
+		}
+	}
+	sortSpec.Locale = r.FormValue("locale")
+
 	cnf := filesPck.GetFilesConfig{
-		Expr:     r.FormValue("expr"),
-		Search:   r.FormValue("search"),
-		IsRegexp: r.FormValue("regexp") != "",
-		SortMode: getSortMode(r.FormValue("sort"), r.FormValue("order")),
-		Offset:   customAtoi(r.FormValue("offset"), 0),
-		Count:    customAtoi(r.FormValue("count"), 0),
-		Filter:   nil,
+		Expr:          r.FormValue("expr"),
+		Tags:          s.tagStorage.GetAll(),
+		Search:        r.FormValue("search"),
+		IsRegexp:      r.FormValue("regexp") != "",
+		ContentSearch: r.FormValue("content"),
+		SortMode:      sortMode,
+		Sort:          sortSpec,
+		Cursor:        r.FormValue("cursor"),
+		Facets:        r.FormValue("facets") != "",
+		Offset:        customAtoi(r.FormValue("offset"), 0),
+		Count:         customAtoi(r.FormValue("count"), 0),
+		Filter:        nil,
+	}
+	area, err := parseGeoArea(r)
+	if err != nil {
+		s.processError(w, err.Error(), http.StatusBadRequest, err)
+		return
+	}
+	cnf.Area = area
+
+	_, useCursor := r.Form["cursor"]
+	if useCursor && cnf.Cursor == "" {
+		// The first page
+		cnf.Offset = 0
 	}
 
 	// Check if a regexp is valid
@@ -165,13 +239,33 @@ func (s Server) returnFiles(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 
-	files, err := s.fileStorage.Get(cnf)
+	s.writeFiles(w, cnf, useCursor || cnf.Facets)
+}
+
+// writeFiles gets files with passed config and writes them. If usePage is true, files are wrapped
+// into files.FilesPage
+func (s Server) writeFiles(w http.ResponseWriter, cnf filesPck.GetFilesConfig, usePage bool) {
+	var (
+		res interface{}
+		err error
+	)
+	if usePage {
+		res, err = s.fileStorage.GetPage(cnf)
+	} else {
+		res, err = s.fileStorage.Get(cnf)
+	}
 	if err != nil {
-		switch err {
+		switch errors.Cause(err) {
 		case filesPck.ErrOffsetOutOfBounds:
 			s.processError(w, "offset is out of bounds", http.StatusNoContent, err)
+		case filesPck.ErrInvalidCursor:
+			s.processError(w, "invalid cursor", http.StatusBadRequest, err)
+		case filesPck.ErrBadSortSpec, filesPck.ErrBadGeoArea:
+			s.processError(w, err.Error(), http.StatusBadRequest, err)
 		case aggregation.ErrBadSyntax:
-			s.processError(w, "bad syntax of logical expression", http.StatusBadRequest, err)
+			s.processError(w, "bad syntax of logical expression: "+err.Error(), http.StatusBadRequest, err)
+		case aggregation.ErrUnknownTag:
+			s.processError(w, "logical expression contains an unknown tag: "+err.Error(), http.StatusBadRequest, err)
 		default:
 			s.processError(w, "can't get files", http.StatusInternalServerError, err)
 		}
@@ -184,7 +278,163 @@ func (s Server) returnFiles(w http.ResponseWriter, r *http.Request) {
 		enc.SetIndent("", "  ")
 	}
 
-	enc.Encode(files)
+	enc.Encode(res)
+}
+
+// GET /api/files/geo
+//
+// Params:
+//   - expr, search, regexp, content, bbox, near, radius: same as GET /api/files
+//   - zoom: zoom level of a map (0-22)
+//   - shareToken (optional): share token
+//
+// Response: json array of clusters (files.Cluster) sorted by a number of files
+//
+func (s Server) returnGeoClusters(w http.ResponseWriter, r *http.Request) {
+	state, ok := getRequestState(r.Context())
+	if !ok {
+		s.processError(w, "can't obtain request state", http.StatusInternalServerError)
+		return
+	}
+
+	zoom, err := strconv.Atoi(r.FormValue("zoom"))
+	if err != nil {
+		s.processError(w, "invalid zoom", http.StatusBadRequest, err)
+		return
+	}
+
+	area, err := parseGeoArea(r)
+	if err != nil {
+		s.processError(w, err.Error(), http.StatusBadRequest, err)
+		return
+	}
+
+	cnf := filesPck.GetFilesConfig{
+		Expr:          r.FormValue("expr"),
+		Tags:          s.tagStorage.GetAll(),
+		Search:        r.FormValue("search"),
+		IsRegexp:      r.FormValue("regexp") != "",
+		ContentSearch: r.FormValue("content"),
+		// The newest file is a preview of a cluster
+		SortMode: filesPck.SortByTimeDesc,
+		Area:     area,
+	}
+
+	if cnf.IsRegexp {
+		if _, err := regexp.Compile(cnf.Search); err != nil {
+			s.processError(w, "invalid regular expression", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if state.shareAccess {
+		cnf.Filter = filesPck.FilterFilesFunction(func(files []filesPck.File) ([]filesPck.File, error) {
+			return s.shareService.FilterFiles(state.shareToken, files)
+		})
+	}
+
+	clusters, err := s.fileStorage.GetClusters(cnf, zoom)
+	if err != nil {
+		switch errors.Cause(err) {
+		case filesPck.ErrBadZoom, filesPck.ErrBadGeoArea:
+			s.processError(w, err.Error(), http.StatusBadRequest, err)
+		case aggregation.ErrBadSyntax:
+			s.processError(w, "bad syntax of logical expression: "+err.Error(), http.StatusBadRequest, err)
+		case aggregation.ErrUnknownTag:
+			s.processError(w, "logical expression contains an unknown tag: "+err.Error(), http.StatusBadRequest, err)
+		default:
+			s.processError(w, "can't get clusters", http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if s.config.Debug {
+		enc.SetIndent("", "  ")
+	}
+
+	enc.Encode(clusters)
+}
+
+// parseGeoArea parses params "bbox", "near" and "radius". It returns nil if the params aren't passed
+func parseGeoArea(r *http.Request) (*filesPck.GeoArea, error) {
+	parseFloats := func(s string, n int) ([]float64, bool) {
+		parts := strings.Split(s, ",")
+		if len(parts) != n {
+			return nil, false
+		}
+
+		res := make([]float64, n)
+		for i, p := range parts {
+			var err error
+			res[i], err = strconv.ParseFloat(strings.TrimSpace(p), 64)
+			if err != nil {
+				return nil, false
+			}
+		}
+		return res, true
+	}
+
+	var area filesPck.GeoArea
+	if bbox := r.FormValue("bbox"); bbox != "" {
+		v, ok := parseFloats(bbox, 4)
+		if !ok {
+			return nil, errors.New("invalid bbox")
+		}
+		area.Box = &filesPck.BoundingBox{South: v[0], West: v[1], North: v[2], East: v[3]}
+	}
+	if near := r.FormValue("near"); near != "" {
+		v, ok := parseFloats(near, 2)
+		if !ok {
+			return nil, errors.New("invalid near")
+		}
+		radius, err := strconv.ParseFloat(r.FormValue("radius"), 64)
+		if err != nil {
+			return nil, errors.New("invalid radius")
+		}
+		area.Circle = &filesPck.Circle{Latitude: v[0], Longitude: v[1], Radius: radius}
+	}
+
+	if area.Box == nil && area.Circle == nil {
+		return nil, nil
+	}
+	if err := area.Check(); err != nil {
+		return nil, err
+	}
+	return &area, nil
+}
+
+// GET /api/files/expr/validate
+//
+// Params:
+//   - expr: logical expression
+//
+// Response: json object:
+//   - valid: true if the expression is correct
+//   - normalized: the expression in the canonical form (only if the expression is valid)
+//   - errors: array of errors: pos and end (offsets in runes, end is exclusive), kind and message
+//
+func (s Server) validateExpr(w http.ResponseWriter, r *http.Request) {
+	res := aggregation.ParseExprWithDiagnostics(r.FormValue("expr"), s.tagStorage.GetAll())
+
+	response := struct {
+		Valid      bool                      `json:"valid"`
+		Normalized string                    `json:"normalized"`
+		Errors     []aggregation.SyntaxError `json:"errors"`
+	}{
+		Valid:      len(res.Errors) == 0,
+		Normalized: res.Normalized,
+		Errors:     res.Errors,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if s.config.Debug {
+		enc.SetIndent("", "  ")
+	}
+
+	enc.Encode(response)
 }
 
 func getParam(passedVal, defaultVal string, validOptions []string) string {
@@ -224,6 +474,52 @@ func (s Server) returnRecentFiles(w http.ResponseWriter, r *http.Request) {
 	enc.Encode(files)
 }
 
+// GET /api/files/scrub-report
+//
+// Params: -
+//
+// Response: report of the last integrity check of stored files
+//
+func (s Server) returnScrubReport(w http.ResponseWriter, r *http.Request) {
+	report, err := s.fileStorage.LastScrubReport()
+	if err != nil {
+		if err == filesPck.ErrNoScrubReport {
+			s.processError(w, "files were never scrubbed", http.StatusNotFound)
+			return
+		}
+
+		s.processError(w, "can't get the scrub report", http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if s.config.Debug {
+		enc.SetIndent("", "  ")
+	}
+	enc.Encode(report)
+}
+
+// GET /api/files/duplicates
+//
+// Params:
+//   - filename (optional): group files by filename too
+//
+// Response: json array of groups of duplicates
+//
+func (s Server) returnDuplicates(w http.ResponseWriter, r *http.Request) {
+	byFilename := r.FormValue("filename") != ""
+
+	groups := s.fileStorage.GetDuplicates(byFilename)
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if s.config.Debug {
+		enc.SetIndent("", "  ")
+	}
+	enc.Encode(groups)
+}
+
 // GET /api/files/download
 //
 // Params:
@@ -275,51 +571,193 @@ func (s Server) downloadFiles(w http.ResponseWriter, r *http.Request) {
 
 // POST /api/files
 //
-// Body must be "multipart/form-data"
+// Body must be "multipart/form-data". Files are streamed into the storage one by one, so they
+// aren't held in memory or in temporary files
 //
 // Params:
-//   - tags: list of tags, separated by comma (`tags=1,2,3`)
+//   - tags: list of tags, separated by comma (`tags=1,2,3`). Tags can be passed in the query or
+//     as a form field. The form field must precede files, otherwise the request is rejected with 400.
+//     If files were received before the field, they are kept and the response contains them and
+//     an entry with the error (with an empty filename). If the job is passed, the job is returned
+//     anyway, the error is saved into it
+//   - job (optional): id of a job created by POST /api/jobs. Files are stored into the job, its progress
+//     can be checked with GET /api/jobs/{id} while the request is being sent. Only a single request
+//     can send files into a job
 //
-// Response: json array
+// Response: json array or json object (files.UploadJob) if the job is passed
 //
 func (s Server) upload(w http.ResponseWriter, r *http.Request) {
-	tags := func() []int {
-		t := r.FormValue("tags")
+	parseTags := func(t string) []int {
+		res := []int{}
 		if t == "" {
-			return []int{}
+			return res
 		}
 
-		res := []int{}
 		for _, s := range strings.Split(t, ",") {
 			if id, err := strconv.Atoi(s); err == nil {
 				res = append(res, id)
 			}
 		}
 		return res
-	}()
+	}
+
+	// Don't use r.FormValue(), because it parses the body
+	tags := parseTags(r.URL.Query().Get("tags"))
+	jobID := r.URL.Query().Get("job")
+	async := jobID != ""
 
-	err := r.ParseMultipartForm(maxSize)
+	reader, err := r.MultipartReader()
 	if err != nil {
-		switch err {
-		case http.ErrNotMultipart:
-			s.processError(w, "invalid form type", http.StatusBadRequest, err)
+		s.processError(w, "invalid form type", http.StatusBadRequest, err)
+		return
+	}
+
+	if async {
+		switch err := s.fileStorage.StartUploadJob(jobID); err {
+		case nil:
+			// Ok
+		case filesPck.ErrUploadJobIsNotExist:
+			s.processError(w, "job doesn't exist", http.StatusNotFound)
+			return
+		case filesPck.ErrUploadJobIsStarted:
+			s.processError(w, "job is already started", http.StatusConflict)
+			return
 		default:
-			s.processError(w, "can't parse request form", http.StatusInternalServerError, err)
+			s.processError(w, "can't start the job", http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if s.config.Debug {
+		enc.SetIndent("", "  ")
+	}
+
+	var (
+		responses = []multiplyResponse{}
+		// filesReceived is true after the first file part
+		filesReceived bool
+	)
+	// receive reads the form. It returns a message for the client and an error if the form is invalid
+	receive := func() (string, error) {
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				return "", nil
+			}
+			if err != nil {
+				return "can't parse request form", err
+			}
+
+			switch {
+			case part.FormName() == "tags" && part.FileName() == "":
+				if filesReceived {
+					// Tags can't be applied to the files which were already stored
+					return "tags must precede files", errTagsAfterFiles
+				}
+
+				t, err := ioutil.ReadAll(io.LimitReader(part, maxTagsFieldSize))
+				if err != nil {
+					return "can't parse request form", err
+				}
+				tags = parseTags(string(t))
+
+			case part.FormName() == "files" && part.FileName() != "":
+				filesReceived = true
+				filename := part.FileName()
+
+				var (
+					res filesPck.UploadResult
+					err error
+				)
+				if async {
+					// The file is stored in background
+					err = s.fileStorage.UploadToJob(jobID, part, filename, tags)
+				} else {
+					res, err = s.fileStorage.UploadReader(part, filename, tags)
+				}
+				if err != nil {
+					s.logger.Errorf("can't load a file %s: %s\n", filename, err)
+				}
+				responses = append(responses, uploadResponse(filename, res, err, "uploaded"))
+			}
+
+			part.Close()
+		}
+	}
+
+	msg, err := receive()
+	if async {
+		// The job keeps the error
+		s.fileStorage.FinishUploadJob(jobID, errors.Wrap(err, msg))
+		if err != nil {
+			s.logger.Errorf("upload job %s: %s: %s\n", jobID, msg, err)
 		}
+
+		job, err := s.fileStorage.GetUploadJob(jobID)
+		if err != nil {
+			s.processError(w, "can't get the upload job", http.StatusInternalServerError, err)
+			return
+		}
+		enc.Encode(job)
 		return
 	}
 
-	responses := make([]multiplyResponse, 0, len(r.MultipartForm.File["files"]))
-	responsesReady := make(chan struct{})
+	if err != nil {
+		if len(responses) == 0 {
+			s.processError(w, msg, http.StatusBadRequest, err)
+			return
+		}
+
+		// Some files were already stored. The client must know about them
+		s.logger.Errorf("can't upload files: %s: %s\n", msg, err)
+		responses = append(responses, multiplyResponse{
+			IsError: true,
+			Error:   fmt.Sprintf("%s: %s", msg, err),
+		})
+	}
+
+	enc.Encode(responses)
+}
+
+// POST /api/files/import
+//
+// Params:
+//   - url: url of a file. It can be passed several times
+//   - tags: list of tags, separated by comma (`tags=1,2,3`)
+//
+// Response: json array. Filename of a failed import is its url
+//
+func (s Server) importFiles(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	urls := r.Form["url"]
+	if len(urls) == 0 {
+		s.processError(w, "no urls", http.StatusBadRequest)
+		return
+	}
+
+	tags := func() []int {
+		res := []int{}
+		for _, s := range strings.Split(r.FormValue("tags"), ",") {
+			if id, err := strconv.Atoi(s); err == nil {
+				res = append(res, id)
+			}
+		}
+		return res
+	}()
+
+	responses := make([]multiplyResponse, 0, len(urls))
 	responsesChan := make(chan multiplyResponse, 50)
+	responsesReady := make(chan struct{})
 
-	headersChan := make(chan interface{}, 5)
-	// Fill headersChan
+	urlsChan := make(chan interface{}, 5)
+	// Fill urlsChan
 	go func() {
-		for i := range r.MultipartForm.File["files"] {
-			headersChan <- r.MultipartForm.File["files"][i]
+		for _, u := range urls {
+			urlsChan <- u
 		}
-		close(headersChan)
+		close(urlsChan)
 	}()
 
 	// Fill responsesChan
@@ -330,27 +768,21 @@ func (s Server) upload(w http.ResponseWriter, r *http.Request) {
 		close(responsesReady)
 	}()
 
-	runPool(maxThreadsInPool, headersChan, func(data <-chan interface{}) {
+	runPool(maxThreadsInPool, urlsChan, func(data <-chan interface{}) {
 		for d := range data {
-			header, ok := d.(*multipart.FileHeader)
+			u, ok := d.(string)
 			if !ok {
 				continue
 			}
 
-			err := s.fileStorage.Upload(header, tags)
-			var resp multiplyResponse
+			res, err := s.fileStorage.ImportURL(u, tags)
 			if err != nil {
-				resp = multiplyResponse{
-					Filename: header.Filename,
-					IsError:  true,
-					Error:    err.Error(),
-				}
-				s.logger.Errorf("can't load a file %s: %s\n", header.Filename, err)
-			} else {
-				resp = multiplyResponse{Filename: header.Filename, Status: "uploaded"}
+				s.logger.Errorf("can't import a file from %s: %s\n", u, err)
+				responsesChan <- uploadResponse(u, res, err, "")
+				continue
 			}
 
-			responsesChan <- resp
+			responsesChan <- uploadResponse(res.File.Filename, res, nil, "imported")
 		}
 	})
 	close(responsesChan)
@@ -528,6 +960,182 @@ func (s Server) changeFileDescription(w http.ResponseWriter, r *http.Request) {
 	enc.Encode(updatedFile)
 }
 
+// PUT /api/file/{id}/content
+//
+// Body must be "multipart/form-data"
+//
+// Params:
+//   - id: file id
+//   - file: new content of the file
+//
+// Response: updated file
+//
+func (s Server) uploadFileRevision(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		s.processError(w, "bad id syntax", http.StatusBadRequest)
+		return
+	}
+
+	err = r.ParseMultipartForm(maxSize)
+	if err != nil {
+		switch err {
+		case http.ErrNotMultipart:
+			s.processError(w, "invalid form type", http.StatusBadRequest, err)
+		default:
+			s.processError(w, "can't parse request form", http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	headers := r.MultipartForm.File["file"]
+	if len(headers) != 1 {
+		s.processError(w, "request must contain a single file", http.StatusBadRequest)
+		return
+	}
+
+	updatedFile, err := s.fileStorage.UploadRevision(id, headers[0])
+	if err != nil {
+		if err == filesPck.ErrFileIsNotExist {
+			s.processError(w, "file doesn't exist", http.StatusNotFound)
+			return
+		}
+		if errors.Cause(err) == filesPck.ErrQuotaExceeded {
+			s.processError(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		s.processError(w, "can't upload a new revision", http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if s.config.Debug {
+		enc.SetIndent("", "  ")
+	}
+	enc.Encode(updatedFile)
+}
+
+// GET /api/file/{id}/revisions
+//
+// Params:
+//   - id: file id
+//
+// Response: json array (the last revision is the current one)
+//
+func (s Server) returnFileRevisions(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		s.processError(w, "bad id syntax", http.StatusBadRequest)
+		return
+	}
+
+	revisions, err := s.fileStorage.GetRevisions(id)
+	if err != nil {
+		if err == filesPck.ErrFileIsNotExist {
+			s.processError(w, "file doesn't exist", http.StatusNotFound)
+			return
+		}
+
+		s.processError(w, "can't get revisions", http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if s.config.Debug {
+		enc.SetIndent("", "  ")
+	}
+	enc.Encode(revisions)
+}
+
+// GET /api/file/{id}/revision/{rev}
+//
+// Params:
+//   - id: file id
+//   - rev: revision number
+//
+// Response: content of the revision
+//
+func (s Server) downloadFileRevision(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		s.processError(w, "bad id syntax", http.StatusBadRequest)
+		return
+	}
+	rev, err := strconv.Atoi(mux.Vars(r)["rev"])
+	if err != nil {
+		s.processError(w, "bad revision syntax", http.StatusBadRequest)
+		return
+	}
+
+	file, err := s.fileStorage.GetFile(id)
+	if err != nil {
+		if err == filesPck.ErrFileIsNotExist {
+			s.processError(w, "file doesn't exist", http.StatusNotFound)
+			return
+		}
+
+		s.processError(w, "can't get file", http.StatusInternalServerError, err)
+		return
+	}
+
+	if !file.HasRevision(rev) {
+		s.processError(w, "revision doesn't exist", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", file.Filename))
+	err = s.fileStorage.CopyFileRevision(w, id, rev)
+	if err != nil {
+		s.processError(w, "can't load revision", http.StatusInternalServerError, err)
+	}
+}
+
+// POST /api/file/{id}/revision/{rev}/restore
+//
+// Params:
+//   - id: file id
+//   - rev: number of a revision to restore. The content is saved as a new revision
+//
+// Response: updated file
+//
+func (s Server) restoreFileRevision(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		s.processError(w, "bad id syntax", http.StatusBadRequest)
+		return
+	}
+	rev, err := strconv.Atoi(mux.Vars(r)["rev"])
+	if err != nil {
+		s.processError(w, "bad revision syntax", http.StatusBadRequest)
+		return
+	}
+
+	updatedFile, err := s.fileStorage.RestoreRevision(id, rev)
+	if err != nil {
+		switch errors.Cause(err) {
+		case filesPck.ErrFileIsNotExist:
+			s.processError(w, "file doesn't exist", http.StatusNotFound)
+		case filesPck.ErrRevisionIsNotExist:
+			s.processError(w, "revision doesn't exist", http.StatusNotFound)
+		case filesPck.ErrQuotaExceeded:
+			s.processError(w, err.Error(), http.StatusRequestEntityTooLarge)
+		default:
+			s.processError(w, "can't restore revision", http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if s.config.Debug {
+		enc.SetIndent("", "  ")
+	}
+	enc.Encode(updatedFile)
+}
+
 // POST /api/files/tags
 //
 // Params:
@@ -0,0 +1,74 @@
+package web
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	filesPck "github.com/tags-drive/core/internal/storage/files"
+)
+
+// POST /api/jobs
+//
+// Creates an upload job. Files are sent into it with POST /api/files?job={id}. A job which doesn't
+// receive files is deleted in files.UploadJobRetention
+//
+// Response: json object, status code is 201
+//
+func (s Server) createUploadJob(w http.ResponseWriter, r *http.Request) {
+	job, err := s.fileStorage.CreateUploadJob()
+	if err != nil {
+		s.processError(w, "can't create an upload job", http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	enc := json.NewEncoder(w)
+	if s.config.Debug {
+		enc.SetIndent("", "  ")
+	}
+	enc.Encode(job)
+}
+
+// GET /api/jobs
+//
+// Response: json array of upload jobs
+//
+func (s Server) returnUploadJobs(w http.ResponseWriter, r *http.Request) {
+	jobs := s.fileStorage.GetUploadJobs()
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if s.config.Debug {
+		enc.SetIndent("", "  ")
+	}
+	enc.Encode(jobs)
+}
+
+// GET /api/jobs/{id}
+//
+// Params:
+//   - id: job id
+//
+// Response: json object
+//
+func (s Server) returnUploadJob(w http.ResponseWriter, r *http.Request) {
+	job, err := s.fileStorage.GetUploadJob(mux.Vars(r)["id"])
+	if err != nil {
+		if err == filesPck.ErrUploadJobIsNotExist {
+			s.processError(w, "job doesn't exist", http.StatusNotFound)
+			return
+		}
+
+		s.processError(w, "can't get a job", http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if s.config.Debug {
+		enc.SetIndent("", "  ")
+	}
+	enc.Encode(job)
+}
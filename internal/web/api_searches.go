@@ -0,0 +1,201 @@
+package web
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+
+	filesPck "github.com/tags-drive/core/internal/storage/files"
+	"github.com/tags-drive/core/internal/storage/files/aggregation"
+	"github.com/tags-drive/core/internal/storage/searches"
+)
+
+// GET /api/searches
+//
+// Params: -
+//
+// Response: json map
+//
+func (s Server) returnSearches(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if s.config.Debug {
+		enc.SetIndent("", "  ")
+	}
+	enc.Encode(s.searchStorage.GetAll())
+}
+
+// POST /api/searches
+//
+// Params:
+//   - name: name of a new search
+//   - expr, search, regexp, content: same as in GET /api/files
+//   - sort: comma-separated list of sort keys (see GET /api/files). Files are sorted by name by default
+//   - seed, locale: same as in GET /api/files
+//
+// Response: created search
+//
+func (s Server) addSearch(w http.ResponseWriter, r *http.Request) {
+	search, ok := s.parseSearch(w, r)
+	if !ok {
+		return
+	}
+
+	search, err := s.searchStorage.Add(search)
+	if err != nil {
+		s.processSearchError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	enc := json.NewEncoder(w)
+	if s.config.Debug {
+		enc.SetIndent("", "  ")
+	}
+	enc.Encode(search)
+}
+
+// PUT /api/searches/{id}
+//
+// Params:
+//   - id: id of a search
+//   - other params are the same as in POST /api/searches. All fields of the search are replaced
+//
+// Response: updated search
+//
+func (s Server) changeSearch(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		s.processError(w, "search id isn't valid", http.StatusBadRequest)
+		return
+	}
+
+	search, ok := s.parseSearch(w, r)
+	if !ok {
+		return
+	}
+	search.ID = id
+
+	search, err = s.searchStorage.Update(search)
+	if err != nil {
+		s.processSearchError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if s.config.Debug {
+		enc.SetIndent("", "  ")
+	}
+	enc.Encode(search)
+}
+
+// DELETE /api/searches/{id}
+//
+// Params:
+//   - id: id of a search
+//
+// Response: -
+//
+func (s Server) deleteSearch(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		s.processError(w, "search id isn't valid", http.StatusBadRequest)
+		return
+	}
+
+	s.searchStorage.Delete(id)
+	// Delete share tokens of the search
+	s.shareService.DeleteSearch(id)
+}
+
+// GET /api/searches/{id}/files
+//
+// Params:
+//   - id: id of a search
+//   - offset, count, cursor, facets: same as in GET /api/files
+//
+// Response: same as `GET /api/files`
+//
+func (s Server) returnSearchFiles(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		s.processError(w, "search id isn't valid", http.StatusBadRequest)
+		return
+	}
+
+	search, err := s.searchStorage.Get(id)
+	if err != nil {
+		s.processSearchError(w, err)
+		return
+	}
+
+	cnf, err := search.FilesConfig(s.tagStorage.GetAll())
+	if err != nil {
+		s.processSearchError(w, err)
+		return
+	}
+
+	cnf.Cursor = r.FormValue("cursor")
+	cnf.Facets = r.FormValue("facets") != ""
+	for _, p := range []struct {
+		name string
+		v    *int
+	}{
+		{"offset", &cnf.Offset},
+		{"count", &cnf.Count},
+	} {
+		if n, err := strconv.Atoi(r.FormValue(p.name)); err == nil && n >= 0 {
+			*p.v = n
+		}
+	}
+	_, useCursor := r.Form["cursor"]
+	if useCursor && cnf.Cursor == "" {
+		// The first page
+		cnf.Offset = 0
+	}
+
+	s.writeFiles(w, cnf, useCursor || cnf.Facets)
+}
+
+// parseSearch parses params of POST /api/searches. It writes an error if params are invalid
+func (s Server) parseSearch(w http.ResponseWriter, r *http.Request) (searches.Search, bool) {
+	search := searches.Search{
+		Name:          r.FormValue("name"),
+		Expr:          r.FormValue("expr"),
+		Search:        r.FormValue("search"),
+		IsRegexp:      r.FormValue("regexp") != "",
+		ContentSearch: r.FormValue("content"),
+		Sort:          r.FormValue("sort"),
+		Locale:        r.FormValue("locale"),
+	}
+
+	if seed := r.FormValue("seed"); seed != "" {
+		var err error
+		search.Seed, err = strconv.ParseInt(seed, 10, 64)
+		if err != nil {
+			s.processError(w, "invalid seed", http.StatusBadRequest, err)
+			return searches.Search{}, false
+		}
+	}
+
+	return search, true
+}
+
+func (s Server) processSearchError(w http.ResponseWriter, err error) {
+	switch errors.Cause(err) {
+	case searches.ErrSearchNotExist:
+		s.processError(w, "search doesn't exist", http.StatusNotFound, err)
+	case searches.ErrEmptyName, searches.ErrBadRegexp, filesPck.ErrBadSortSpec:
+		s.processError(w, err.Error(), http.StatusBadRequest, err)
+	case aggregation.ErrBadSyntax:
+		s.processError(w, "bad syntax of logical expression: "+err.Error(), http.StatusBadRequest, err)
+	case aggregation.ErrUnknownTag:
+		s.processError(w, "logical expression contains an unknown tag: "+err.Error(), http.StatusBadRequest, err)
+	default:
+		s.processError(w, "can't process search", http.StatusInternalServerError, err)
+	}
+}
@@ -67,10 +67,30 @@ func (s Server) getFilesSharedByToken(w http.ResponseWriter, r *http.Request) {
 //
 // Params:
 //   - ids: list of ids of files to share separated by commas (example: "1,2,3")
+//   - search (optional): id of a saved search to share instead of files. The token shares
+//     files found by the search at the moment of a request
 //
 // Response: { "token": "created token" }
 //
 func (s Server) createShareToken(w http.ResponseWriter, r *http.Request) {
+	if searchID := r.FormValue("search"); searchID != "" {
+		id, err := strconv.Atoi(searchID)
+		if err != nil {
+			s.processError(w, "search id isn't valid", http.StatusBadRequest)
+			return
+		}
+		if _, err := s.searchStorage.Get(id); err != nil {
+			s.processSearchError(w, err)
+			return
+		}
+
+		token := s.shareService.CreateSearchToken(id)
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"token":"%s"}`, token)
+		return
+	}
+
 	ids := func() []int {
 		t := r.FormValue("ids")
 		if t == "" {
@@ -0,0 +1,26 @@
+package web
+
+import (
+	"net/http"
+)
+
+// GET /api/storage/usage
+//
+// Params: -
+//
+// Response: json object with space used by files broken down by type, tag, Trash and thumbnails
+//
+func (s Server) returnStorageUsage(w http.ResponseWriter, r *http.Request) {
+	usage, err := s.fileStorage.GetStorageUsage()
+	if err != nil {
+		s.processError(w, "can't get storage usage", http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if s.config.Debug {
+		enc.SetIndent("", "  ")
+	}
+	enc.Encode(usage)
+}
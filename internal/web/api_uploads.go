@@ -0,0 +1,283 @@
+package web
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+
+	filesPck "github.com/tags-drive/core/internal/storage/files"
+)
+
+// Resumable uploads implement the core protocol of tus 1.0.0 (https://tus.io/protocols/resumable-upload.html)
+// with "creation", "expiration" and "termination" extensions
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,expiration,termination"
+
+	tusContentType = "application/offset+octet-stream"
+
+	// uploadStatusHeader contains a status of an upload (see files.UploadStatus), uploadErrorHeader - a reason
+	// why the file of a rejected or failed upload isn't created
+	uploadStatusHeader = "X-Upload-Status"
+	uploadErrorHeader  = "X-Upload-Error"
+	// fileIDHeader contains an id of the created file. It is sent when an upload is finished
+	fileIDHeader = "X-File-Id"
+	// duplicatesHeader contains ids of duplicates of the uploaded file separated by comma,
+	// duplicateHeader - a policy applied to them
+	duplicatesHeader = "X-Duplicates"
+	duplicateHeader  = "X-Duplicate"
+)
+
+// checkTusVersion sets Tus-Resumable header and checks the version of the protocol used by a client
+func (s Server) checkTusVersion(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		s.processError(w, "unsupported version of tus protocol", http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// setUploadHeaders sets headers which describe the state of an upload
+func setUploadHeaders(w http.ResponseWriter, upload filesPck.ResumableUpload) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Expires", upload.Expires.UTC().Format(http.TimeFormat))
+	w.Header().Set(uploadStatusHeader, string(upload.Status))
+	setDuplicateHeaders(w, upload)
+
+	switch upload.Status {
+	case filesPck.UploadFinished:
+		w.Header().Set(fileIDHeader, strconv.Itoa(upload.FileID))
+	case filesPck.UploadRejected, filesPck.UploadFailed:
+		w.Header().Set(uploadErrorHeader, upload.Error)
+	}
+}
+
+// setDuplicateHeaders sets headers which describe found duplicates of a finished or rejected upload
+func setDuplicateHeaders(w http.ResponseWriter, upload filesPck.ResumableUpload) {
+	if len(upload.Duplicates) == 0 {
+		return
+	}
+
+	ids := make([]string, len(upload.Duplicates))
+	for i, id := range upload.Duplicates {
+		ids[i] = strconv.Itoa(id)
+	}
+	w.Header().Set(duplicatesHeader, strings.Join(ids, ","))
+	w.Header().Set(duplicateHeader, string(upload.Duplicate))
+}
+
+// parseTusMetadata parses Upload-Metadata header: comma separated pairs of a key and a base64-encoded value
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if header == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, " ", 2)
+		value := ""
+		if len(parts) == 2 {
+			v, err := base64.StdEncoding.DecodeString(strings.TrimSpace(parts[1]))
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid value of the key '%s'", parts[0])
+			}
+			value = string(v)
+		}
+		metadata[parts[0]] = value
+	}
+
+	return metadata, nil
+}
+
+// OPTIONS /api/uploads
+//
+// Response: tus headers (Tus-Version, Tus-Extension)
+//
+func (s Server) tusOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /api/uploads
+//
+// Headers:
+//   - Upload-Length: size of a file
+//   - Upload-Metadata: must contain "filename" (or "name"). It can contain "tags" - list of tags
+//     separated by comma (`1,2,3`)
+//
+// Response: Location header with the url of the upload. A file with zero length is created at once,
+// its id is sent in X-File-Id header
+//
+func (s Server) createUpload(w http.ResponseWriter, r *http.Request) {
+	if !s.checkTusVersion(w, r) {
+		return
+	}
+
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		s.processError(w, "deferred length isn't supported", http.StatusBadRequest)
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		s.processError(w, "invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		s.processError(w, "invalid Upload-Metadata", http.StatusBadRequest, err)
+		return
+	}
+
+	filename := metadata["filename"]
+	if filename == "" {
+		filename = metadata["name"]
+	}
+
+	tags := []int{}
+	if t := metadata["tags"]; t != "" {
+		for _, s := range strings.Split(t, ",") {
+			if id, err := strconv.Atoi(s); err == nil {
+				tags = append(tags, id)
+			}
+		}
+	}
+
+	upload, err := s.fileStorage.CreateUpload(filename, tags, length)
+	if err != nil {
+		switch errors.Cause(err) {
+		case filesPck.ErrEmptyFilename:
+			s.processError(w, "filename must be passed in Upload-Metadata", http.StatusBadRequest)
+		case filesPck.ErrQuotaExceeded:
+			s.processError(w, err.Error(), http.StatusRequestEntityTooLarge)
+		case filesPck.ErrAlreadyExist:
+			s.processError(w, err.Error(), http.StatusUnprocessableEntity)
+		default:
+			s.processError(w, "can't create an upload", http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	w.Header().Set("Location", "/api/uploads/"+upload.ID)
+	setUploadHeaders(w, upload)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// HEAD /api/uploads/{id}
+//
+// Params:
+//   - id: upload id
+//
+// Response: Upload-Offset and Upload-Length headers. X-Upload-Status header contains a status of the upload:
+// receiving, finishing (the file is being created), finished (the id of the file is sent in X-File-Id header),
+// rejected (the file is a duplicate) or failed (creation is retried till the upload expires). A reason of
+// a rejected or failed upload is sent in X-Upload-Error header. Finished uploads are kept till they expire
+//
+func (s Server) returnUploadOffset(w http.ResponseWriter, r *http.Request) {
+	if !s.checkTusVersion(w, r) {
+		return
+	}
+
+	upload, err := s.fileStorage.GetUpload(mux.Vars(r)["id"])
+	if err != nil {
+		s.processError(w, "upload doesn't exist", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	setUploadHeaders(w, upload)
+	w.WriteHeader(http.StatusOK)
+}
+
+// PATCH /api/uploads/{id}
+//
+// Body: a chunk of content. Content-Type must be "application/offset+octet-stream"
+//
+// Params:
+//   - id: upload id
+//
+// Headers:
+//   - Upload-Offset: offset of the chunk. It must be equal to the current offset of the upload
+//
+// Response: new Upload-Offset header. When the last chunk is received, the file is created in background
+// (X-Upload-Status is "finishing"), the result can be checked with HEAD /api/uploads/{id}
+//
+func (s Server) uploadChunk(w http.ResponseWriter, r *http.Request) {
+	if !s.checkTusVersion(w, r) {
+		return
+	}
+
+	if r.Header.Get("Content-Type") != tusContentType {
+		s.processError(w, "Content-Type must be "+tusContentType, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		s.processError(w, "invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+
+	upload, err := s.fileStorage.WriteUploadChunk(mux.Vars(r)["id"], offset, r.Body)
+	if err != nil {
+		switch errors.Cause(err) {
+		case filesPck.ErrUploadIsNotExist:
+			s.processError(w, "upload doesn't exist", http.StatusNotFound)
+		case filesPck.ErrBadUploadOffset:
+			s.processError(w, "offset doesn't match the offset of the upload", http.StatusConflict)
+		case filesPck.ErrUploadIsLocked:
+			s.processError(w, "upload is being written by another request", http.StatusLocked)
+		default:
+			s.processError(w, "can't save a chunk", http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	setUploadHeaders(w, upload)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DELETE /api/uploads/{id}
+//
+// Params:
+//   - id: upload id
+//
+// Response: -
+//
+func (s Server) deleteUpload(w http.ResponseWriter, r *http.Request) {
+	if !s.checkTusVersion(w, r) {
+		return
+	}
+
+	err := s.fileStorage.DeleteUpload(mux.Vars(r)["id"])
+	if err != nil {
+		switch err {
+		case filesPck.ErrUploadIsNotExist:
+			s.processError(w, "upload doesn't exist", http.StatusNotFound)
+		case filesPck.ErrUploadIsLocked:
+			s.processError(w, "upload is being written by another request", http.StatusLocked)
+		default:
+			s.processError(w, "can't delete an upload", http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -8,6 +8,8 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	filesPck "github.com/tags-drive/core/internal/storage/files"
 )
 
 const (
@@ -121,9 +123,11 @@ func (s Server) ping(w http.ResponseWriter, r *http.Request) {
 }
 
 // GET /data/.../{id}
+// GET /data/thumb/{size}/{id}
 //
 // Params:
 //   - shareToken (optional): share token
+//   - mode (optional): thumbnail mode: fit (default) or crop
 //
 func (s Server) serveData() (handler http.Handler) {
 	getFileID := func(url string) (id int, ok bool) {
@@ -175,6 +179,21 @@ func (s Server) serveData() (handler http.Handler) {
 			return
 		}
 
+		// Thumbnails are requested as /data/thumb/{size}/{id}
+		var (
+			isThumbnail   = strings.HasPrefix(url, "/data/thumb/")
+			thumbnailSize int
+		)
+		if isThumbnail {
+			parts := strings.Split(strings.TrimPrefix(url, "/data/thumb/"), "/")
+			size, err := strconv.Atoi(parts[0])
+			if len(parts) != 2 || err != nil {
+				s.processError(w, "invalid thumbnail size", http.StatusBadRequest)
+				return
+			}
+			thumbnailSize = size
+		}
+
 		state, ok := getRequestState(r.Context())
 		if !ok {
 			s.processError(w, "share token doesn't grant access to this file", http.StatusForbidden)
@@ -201,10 +220,22 @@ func (s Server) serveData() (handler http.Handler) {
 			return
 		}
 
+		if (isThumbnail || strings.Contains(url, "resized")) &&
+			(file.Processing == filesPck.ProcessingPending || file.Processing == filesPck.ProcessingFailed) {
+			// The resized image isn't ready. Show the file icon as a placeholder. It mustn't be cached
+			w.Header().Set("Cache-Control", "no-store")
+			w.Header().Del("Expires")
+			s.writeFileIcon(w, r, file.Type.Ext, file.Filename)
+			return
+		}
+
+		// Content is changed with every new revision
+		modTime := file.CurrentRevision().AddTime
+
 		// Always add "Last-Modified" header
-		w.Header().Set("Last-Modified", file.AddTime.Format(http.TimeFormat))
+		w.Header().Set("Last-Modified", modTime.Format(http.TimeFormat))
 
-		if shouldUseCache(file.AddTime, r) {
+		if shouldUseCache(modTime, r) {
 			// Response with http.StatusNotModified (304)
 
 			// From "net/http/fs.go", "writeNotModified" function
@@ -215,6 +246,19 @@ func (s Server) serveData() (handler http.Handler) {
 			return
 		}
 
+		if isThumbnail {
+			mode := filesPck.ThumbnailMode(r.FormValue("mode"))
+			err = s.fileStorage.CopyThumbnail(w, id, thumbnailSize, mode)
+			switch err {
+			case nil:
+			case filesPck.ErrBadThumbnailSize, filesPck.ErrBadThumbnailMode, filesPck.ErrFileIsNotImage:
+				s.processError(w, err.Error(), http.StatusBadRequest)
+			default:
+				s.processError(w, "can't load thumbnail", http.StatusInternalServerError, err)
+			}
+			return
+		}
+
 		// Write a file
 		resized := strings.Contains(url, "resized")
 		err = s.fileStorage.CopyFile(w, id, resized)
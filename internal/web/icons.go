@@ -16,20 +16,18 @@ const (
 //   - filename: name of a file
 //
 func (s Server) serveFileIcons(w http.ResponseWriter, r *http.Request) {
-	var (
-		// The default file icon is "file"
-		iconName = "file"
+	s.writeFileIcon(w, r, r.FormValue("ext"), r.FormValue("filename"))
+}
 
-		extension = func() string {
-			// Return "ext" without dot
-			ext := r.FormValue("ext")
-			if len(ext) > 0 && ext[0] == '.' {
-				return ext[1:]
-			}
-			return ext
-		}()
-		filename = r.FormValue("filename")
-	)
+// writeFileIcon writes an icon of a file with passed extension and name
+func (s Server) writeFileIcon(w http.ResponseWriter, r *http.Request, extension, filename string) {
+	// The default file icon is "file"
+	iconName := "file"
+
+	// Use "ext" without dot
+	if len(extension) > 0 && extension[0] == '.' {
+		extension = extension[1:]
+	}
 
 	if icon := defineIcon(extension, filename); icon != "" {
 		iconName = icon
@@ -51,6 +51,10 @@ func (s *Server) addDefaultRoutes(router *mux.Router) {
 		POST   = http.MethodPost
 		PUT    = http.MethodPut
 		DELETE = http.MethodDelete
+		//
+		OPTIONS = http.MethodOptions
+		HEAD    = http.MethodHead
+		PATCH   = http.MethodPatch
 	)
 
 	routes := []*route{
@@ -71,20 +75,42 @@ func (s *Server) addDefaultRoutes(router *mux.Router) {
 		// Files
 		newRoute("/api/file/{id:\\d+}", GET, s.returnSingleFile).enableShare(),
 		newRoute("/api/files", GET, s.returnFiles).enableShare(),
+		newRoute("/api/files/geo", GET, s.returnGeoClusters).enableShare(),
 		newRoute("/api/files/recent", GET, s.returnRecentFiles),
+		newRoute("/api/files/scrub-report", GET, s.returnScrubReport),
+		newRoute("/api/files/duplicates", GET, s.returnDuplicates),
+		newRoute("/api/files/expr/validate", GET, s.validateExpr),
 		newRoute("/api/files/download", GET, s.downloadFiles).enableShare(),
 		// upload new files
 		newRoute("/api/files", POST, s.upload),
+		newRoute("/api/files/import", POST, s.importFiles),
 		// change file info
 		newRoute("/api/file/{id:\\d+}/name", PUT, s.changeFilename),
 		newRoute("/api/file/{id:\\d+}/tags", PUT, s.changeFileTags),
 		newRoute("/api/file/{id:\\d+}/description", PUT, s.changeFileDescription),
+		// file revisions
+		newRoute("/api/file/{id:\\d+}/content", PUT, s.uploadFileRevision),
+		newRoute("/api/file/{id:\\d+}/revisions", GET, s.returnFileRevisions),
+		newRoute("/api/file/{id:\\d+}/revision/{rev:\\d+}", GET, s.downloadFileRevision),
+		newRoute("/api/file/{id:\\d+}/revision/{rev:\\d+}/restore", POST, s.restoreFileRevision),
 		// bulk tags changing
 		newRoute("/api/files/tags", POST, s.addTagsToFiles),
 		newRoute("/api/files/tags", DELETE, s.removeTagsFromFiles),
 		// remove or recover files
 		newRoute("/api/files", DELETE, s.deleteFile),
 		newRoute("/api/files/recover", POST, s.recoverFile),
+		// resumable uploads (tus protocol)
+		newRoute("/api/uploads", OPTIONS, s.tusOptions).disableAuth(),
+		newRoute("/api/uploads", POST, s.createUpload),
+		newRoute("/api/uploads/{id:[0-9a-f]{32}}", HEAD, s.returnUploadOffset),
+		newRoute("/api/uploads/{id:[0-9a-f]{32}}", PATCH, s.uploadChunk),
+		newRoute("/api/uploads/{id:[0-9a-f]{32}}", DELETE, s.deleteUpload),
+		// upload jobs
+		newRoute("/api/jobs", GET, s.returnUploadJobs),
+		newRoute("/api/jobs", POST, s.createUploadJob),
+		newRoute("/api/jobs/{id:[0-9a-f]{32}}", GET, s.returnUploadJob),
+		// storage usage
+		newRoute("/api/storage/usage", GET, s.returnStorageUsage),
 
 		// Tags
 		newRoute("/api/tags", GET, s.returnTags).enableShare(),
@@ -92,6 +118,13 @@ func (s *Server) addDefaultRoutes(router *mux.Router) {
 		newRoute("/api/tag/{id:\\d+}", PUT, s.changeTag),
 		newRoute("/api/tags", DELETE, s.deleteTag),
 
+		// Saved searches
+		newRoute("/api/searches", GET, s.returnSearches),
+		newRoute("/api/searches", POST, s.addSearch),
+		newRoute("/api/searches/{id:\\d+}", PUT, s.changeSearch),
+		newRoute("/api/searches/{id:\\d+}", DELETE, s.deleteSearch),
+		newRoute("/api/searches/{id:\\d+}/files", GET, s.returnSearchFiles),
+
 		// Share
 		newRoute("/api/share/tokens", GET, s.getAllShareTokens),
 		newRoute("/api/share/token/{token}", GET, s.getFilesSharedByToken),
@@ -134,6 +167,8 @@ func (s *Server) addDebugRoutes(router *mux.Router) {
 		{path: "/api/file/{id:\\d+}/tags", methods: OPTIONS, handler: setDebugHeaders},
 		{path: "/api/file/{id:\\d+}/name", methods: OPTIONS, handler: setDebugHeaders},
 		{path: "/api/file/{id:\\d+}/description", methods: OPTIONS, handler: setDebugHeaders},
+		{path: "/api/file/{id:\\d+}/content", methods: OPTIONS, handler: setDebugHeaders},
+		{path: "/api/file/{id:\\d+}/revision/{rev:\\d+}/restore", methods: OPTIONS, handler: setDebugHeaders},
 		//
 		{path: "/api/tags", methods: OPTIONS, handler: setDebugHeaders},
 		{path: "/api/tag/{id:\\d+}", methods: OPTIONS, handler: setDebugHeaders},
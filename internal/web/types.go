@@ -44,10 +44,14 @@ type ShareServiceInterface interface {
 
 	CreateToken(filesIDs []int) (token string)
 
+	CreateSearchToken(searchID int) (token string)
+
 	GetFilesIDs(token string) ([]int, error)
 
 	DeleteToken(token string)
 
+	DeleteSearch(searchID int)
+
 	// Files and tags
 
 	CheckFile(token string, id int) bool
@@ -11,6 +11,7 @@ import (
 	jsoniter "github.com/json-iterator/go"
 
 	"github.com/tags-drive/core/internal/storage/files"
+	"github.com/tags-drive/core/internal/storage/searches"
 	"github.com/tags-drive/core/internal/storage/tags"
 	"github.com/tags-drive/core/internal/web/limiter"
 )
@@ -25,8 +26,9 @@ var json = jsoniter.ConfigCompatibleWithStandardLibrary
 type Server struct {
 	config Config
 
-	fileStorage *files.FileStorage
-	tagStorage  *tags.TagStorage
+	fileStorage   *files.FileStorage
+	tagStorage    *tags.TagStorage
+	searchStorage *searches.SearchStorage
 
 	shareService ShareServiceInterface
 
@@ -42,15 +44,17 @@ type Server struct {
 func NewWebServer(cnf Config,
 	fs *files.FileStorage,
 	ts *tags.TagStorage,
+	ss *searches.SearchStorage,
 	auth AuthServiceInterface,
 	share ShareServiceInterface,
 	lg *clog.Logger,
 ) (*Server, error) {
 	s := &Server{
-		config:      cnf,
-		fileStorage: fs,
-		tagStorage:  ts,
-		logger:      lg,
+		config:        cnf,
+		fileStorage:   fs,
+		tagStorage:    ts,
+		searchStorage: ss,
+		logger:        lg,
 	}
 
 	s.authService = auth
@@ -16,10 +16,16 @@ type Command func(version string) <-chan struct{}
 
 func main() {
 	commandList := map[string]Command{
-		"":        app.StartApp, // the default command is app.StartApp
-		"start":   app.StartApp,
-		"decrypt": decryptor.StartDecryptor,
-		"migrate": migrator.StartMigrator,
+		"":           app.StartApp, // the default command is app.StartApp
+		"start":      app.StartApp,
+		"decrypt":    decryptor.StartDecryptor,
+		"migrate":    migrator.StartMigrator,
+		"scrub":      app.StartScrub,
+		"fsck":       app.StartFsck,
+		"reindex":    app.StartReindex,
+		"exif":       app.StartExif,
+		"thumbnails": app.StartThumbnails,
+		"blobs":      app.StartBlobs,
 	}
 
 	var (